@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/r11/esxi-commander/internal/storage"
+	"github.com/r11/esxi-commander/pkg/backup"
+	backupcli "github.com/r11/esxi-commander/pkg/cli/backup"
+	"github.com/r11/esxi-commander/pkg/config"
+	"github.com/r11/esxi-commander/pkg/esxi/client"
+	"github.com/r11/esxi-commander/pkg/rpc"
+	"github.com/r11/esxi-commander/pkg/scheduler"
+	"github.com/r11/esxi-commander/pkg/tasks"
+	"github.com/rs/zerolog/log"
+	"github.com/vmware/govmomi/vim25/mo"
+)
+
+// backend serves scheduled jobs and API calls with an ESXi session and a
+// backup manager that are opened on demand and shared by everything
+// running at the same time. The catalog is a bbolt file only one process
+// can hold open, so it is released whenever no backup work runs and ceso
+// commands can use it in between.
+type backend struct {
+	cfg   *config.Config
+	tasks *tasks.Manager
+
+	mu           sync.Mutex
+	clientUsers  int
+	client       *client.ESXiClient
+	managerUsers int
+	manager      *backup.BackupManager
+}
+
+func newBackend(cfg *config.Config) *backend {
+	return &backend{cfg: cfg, tasks: tasks.NewManager(cfg.Tasks.DBPath)}
+}
+
+// track runs fn as a task that ceso task can follow and cancel. Progress
+// fn reports reaches both the task and the caller.
+func (b *backend) track(ctx context.Context, call *rpc.Call, kind, target string, fn func(ctx context.Context, progress backup.ProgressFunc) (interface{}, error)) (interface{}, error) {
+	ctx, t, err := b.tasks.Start(ctx, kind, target)
+	if err != nil {
+		log.Warn().Err(err).Str("kind", kind).Str("target", target).Msg("operation not tracked as a task")
+	}
+
+	result, err := fn(ctx, func(stage string, percent float32) {
+		call.Progress(stage, percent)
+		t.Progress(stage, percent)
+	})
+	t.Finish(taskResult(result, target), err)
+	return result, err
+}
+
+// taskResult names what a tracked operation produced
+func taskResult(result interface{}, target string) string {
+	switch r := result.(type) {
+	case *backup.BackupInfo:
+		return r.ID
+	case *client.VM:
+		return r.Name
+	}
+	return target
+}
+
+// acquireClient returns the shared ESXi session, opening it if needed;
+// every successful call must be paired with releaseClient
+func (b *backend) acquireClient() (*client.ESXiClient, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.acquireClientLocked()
+}
+
+func (b *backend) acquireClientLocked() (*client.ESXiClient, error) {
+	if b.clientUsers == 0 {
+		esxiClient, err := client.NewClient(&client.Config{
+			Host:     b.cfg.ESXi.Host,
+			User:     b.cfg.ESXi.User,
+			Password: b.cfg.ESXi.Password,
+			Insecure: b.cfg.ESXi.Insecure,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create ESXi client: %w", err)
+		}
+		b.client = esxiClient
+	}
+
+	b.clientUsers++
+	return b.client, nil
+}
+
+// releaseClient closes the shared session once its last user is done
+func (b *backend) releaseClient() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.releaseClientLocked()
+}
+
+func (b *backend) releaseClientLocked() {
+	b.clientUsers--
+	if b.clientUsers == 0 {
+		b.client.Close()
+		b.client = nil
+	}
+}
+
+// acquire returns the shared session and backup manager, opening them if
+// needed; every successful call must be paired with release
+func (b *backend) acquire() (*client.ESXiClient, *backup.BackupManager, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	esxiClient, err := b.acquireClientLocked()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if b.managerUsers == 0 {
+		catalogPath := b.cfg.Backup.CatalogPath
+		if catalogPath == "" {
+			catalogPath = "/var/lib/ceso/backup.db"
+		}
+		if err := os.MkdirAll(filepath.Dir(catalogPath), 0755); err != nil {
+			b.releaseClientLocked()
+			return nil, nil, fmt.Errorf("failed to create catalog directory: %w", err)
+		}
+
+		manager, err := backup.NewBackupManagerWithConfig(esxiClient, &backup.Config{
+			CatalogPath:        catalogPath,
+			DefaultTarget:      b.cfg.Backup.DefaultTarget,
+			Compression:        b.cfg.Backup.Compression,
+			CompressionLevel:   b.cfg.Backup.CompressionLevel,
+			CompressionThreads: b.cfg.Backup.CompressionThreads,
+			TempDir:            b.cfg.Backup.TempDir,
+			Recipients:         b.cfg.Backup.Encryption.Recipients,
+			MaxConcurrent:      b.cfg.Backup.MaxConcurrent,
+			ResolveTarget:      backupcli.LocationResolver(b.cfg, esxiClient),
+		})
+		if err != nil {
+			b.releaseClientLocked()
+			return nil, nil, fmt.Errorf("failed to create backup manager: %w", err)
+		}
+		b.manager = manager
+	}
+
+	b.managerUsers++
+	return esxiClient, b.manager, nil
+}
+
+// release closes the backup manager and session once their last user is
+// done
+func (b *backend) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.managerUsers--
+	if b.managerUsers == 0 {
+		b.manager.Close()
+		b.manager = nil
+	}
+	b.releaseClientLocked()
+}
+
+func (b *backend) ListVMs(ctx context.Context) ([]scheduler.VM, error) {
+	esxiClient, err := b.acquireClient()
+	if err != nil {
+		return nil, err
+	}
+	defer b.releaseClient()
+
+	vmObjs, err := esxiClient.Finder().VirtualMachineList(ctx, "*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list VMs: %w", err)
+	}
+
+	var vms []scheduler.VM
+	for _, vmObj := range vmObjs {
+		var vmMo mo.VirtualMachine
+		if err := vmObj.Properties(ctx, vmObj.Reference(), []string{"name", "config.annotation"}, &vmMo); err != nil {
+			continue
+		}
+		vm := scheduler.VM{Name: vmMo.Name}
+		if vmMo.Config != nil {
+			vm.Tags = scheduler.ParseTags(vmMo.Config.Annotation)
+		}
+		vms = append(vms, vm)
+	}
+	return vms, nil
+}
+
+func (b *backend) Backup(ctx context.Context, job *scheduler.Job, vmName string) (*backup.BackupInfo, error) {
+	esxiClient, manager, err := b.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer b.release()
+
+	target, err := backupcli.NewTarget(job.Target, b.cfg, esxiClient)
+	if err != nil {
+		return nil, err
+	}
+	hooks, err := backupcli.BackupHooks(vmName, b.cfg, esxiClient)
+	if err != nil {
+		return nil, err
+	}
+
+	description := job.Description
+	if description == "" {
+		description = fmt.Sprintf("Scheduled by job %s", job.Name)
+	}
+
+	ctx, t, err := b.tasks.Start(ctx, "backup.create", vmName)
+	if err != nil {
+		log.Warn().Err(err).Str("vm", vmName).Msg("scheduled backup not tracked as a task")
+	}
+
+	info, err := manager.CreateBackup(ctx, backup.BackupOptions{
+		VMName:      vmName,
+		Hot:         job.Hot,
+		PowerOff:    !job.Hot,
+		Compress:    true,
+		Incremental: job.Incremental,
+		Target:      target,
+		Description: description,
+		Hooks:       hooks,
+		Progress:    t.Progress,
+		RetainUntil: backupcli.RetainUntil(b.cfg.Backup.ImmutableDays),
+	})
+	if err != nil {
+		t.Finish("", err)
+		return nil, err
+	}
+	t.Finish(info.ID, nil)
+	return info, nil
+}
+
+func (b *backend) Replicate(ctx context.Context, backupID, targetName string) (*storage.Replica, error) {
+	esxiClient, manager, err := b.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer b.release()
+
+	target, err := backupcli.NewTarget(targetName, b.cfg, esxiClient)
+	if err != nil {
+		return nil, err
+	}
+
+	return manager.ReplicateBackup(ctx, backup.ReplicateOptions{
+		BackupID: backupID,
+		Target:   target,
+	})
+}
+
+func (b *backend) Prune(ctx context.Context, job *scheduler.Job, vmName string) (*backup.PruneResult, error) {
+	_, manager, err := b.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer b.release()
+
+	opts := *job.Retention
+	opts.VMName = vmName
+	return manager.PruneBackups(ctx, opts)
+}
+
+// recoverBackups cleans up after backups that were killed half-way, e.g. by
+// a crash of cesod, and logs what it fixed. It runs before any backup can
+// start, so everything it finds was abandoned.
+func (b *backend) recoverBackups(ctx context.Context) {
+	_, manager, err := b.acquire()
+	if err != nil {
+		log.Warn().Err(err).Msg("skipping backup recovery")
+		return
+	}
+	defer b.release()
+
+	result, err := manager.RecoverBackups(ctx, backup.RecoverOptions{})
+	if err != nil {
+		log.Warn().Err(err).Msg("backup recovery failed")
+		return
+	}
+
+	for _, snapshot := range result.RemovedSnapshots {
+		log.Info().Str("vm", snapshot.VMName).Str("snapshot", snapshot.Snapshot).Msg("removed orphaned backup snapshot")
+	}
+	for _, vmName := range result.ConsolidatedVMs {
+		log.Info().Str("vm", vmName).Msg("consolidated disks")
+	}
+	for _, id := range result.InterruptedBackups {
+		log.Info().Str("backup", id).Msg("marked killed backup as interrupted; resume it with ceso backup create --resume")
+	}
+	for _, problem := range result.Errors {
+		log.Warn().Str("problem", problem).Msg("backup recovery could not fix a problem")
+	}
+}
+
+func (b *backend) Drill(ctx context.Context, job *scheduler.Job, vmName string) (*backup.DrillResult, error) {
+	_, manager, err := b.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer b.release()
+
+	ctx, t, err := b.tasks.Start(ctx, "backup.drill", vmName)
+	if err != nil {
+		log.Warn().Err(err).Str("vm", vmName).Msg("scheduled drill not tracked as a task")
+	}
+
+	opts := *job.Drill
+	opts.VMName = vmName
+	opts.IdentityFile = b.cfg.Backup.Encryption.IdentityFile
+	opts.Progress = t.Progress
+	result, err := manager.DrillBackup(ctx, opts)
+	if err != nil {
+		t.Finish("", err)
+		return result, err
+	}
+	t.Finish(result.BackupID, nil)
+	return result, nil
+}
+
+// publishDrills sets the drill metrics from the catalog, so they do not
+// go missing after a restart until each VM's next drill
+func (b *backend) publishDrills() {
+	_, manager, err := b.acquire()
+	if err != nil {
+		log.Warn().Err(err).Msg("skipping drill metrics")
+		return
+	}
+	defer b.release()
+
+	backups, err := manager.ListBackups("")
+	if err != nil {
+		log.Warn().Err(err).Msg("skipping drill metrics")
+		return
+	}
+
+	latest := make(map[string]*storage.DrillRecord)
+	for _, info := range backups {
+		drill := info.LastDrill
+		if drill != nil && (latest[info.VMName] == nil || drill.Started.After(latest[info.VMName].Started)) {
+			latest[info.VMName] = drill
+		}
+	}
+	for vmName, drill := range latest {
+		backup.PublishDrill(vmName, drill)
+	}
+}
+
+func (b *backend) RecordRun(run *storage.JobRun) error {
+	_, manager, err := b.acquire()
+	if err != nil {
+		return err
+	}
+	defer b.release()
+
+	return manager.RecordJobRun(run)
+}
+
+// loadJobs converts the backup.jobs configuration into scheduler jobs
+func loadJobs(cfg *config.Config) ([]*scheduler.Job, error) {
+	var jobs []*scheduler.Job
+	seen := make(map[string]bool)
+
+	for i, jobCfg := range cfg.Backup.Jobs {
+		if jobCfg.Name == "" {
+			return nil, fmt.Errorf("backup.jobs[%d]: name is required", i)
+		}
+		if seen[jobCfg.Name] {
+			return nil, fmt.Errorf("backup.jobs: duplicate job name %q", jobCfg.Name)
+		}
+		seen[jobCfg.Name] = true
+
+		if len(jobCfg.VMs) == 0 && len(jobCfg.Tags) == 0 {
+			return nil, fmt.Errorf("backup.jobs.%s: select VMs with vms or tags", jobCfg.Name)
+		}
+
+		schedule, err := scheduler.ParseSchedule(jobCfg.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("backup.jobs.%s: %w", jobCfg.Name, err)
+		}
+
+		job := &scheduler.Job{
+			Name:        jobCfg.Name,
+			Schedule:    schedule,
+			VMs:         jobCfg.VMs,
+			Tags:        jobCfg.Tags,
+			Incremental: jobCfg.Incremental,
+			Target:      jobCfg.Target,
+			CopyTo:      jobCfg.CopyTo,
+			Description: jobCfg.Description,
+		}
+
+		if jobCfg.Timezone != "" {
+			job.Location, err = time.LoadLocation(jobCfg.Timezone)
+			if err != nil {
+				return nil, fmt.Errorf("backup.jobs.%s: invalid timezone: %w", jobCfg.Name, err)
+			}
+		}
+
+		switch jobCfg.Mode {
+		case "", "hot":
+			job.Hot = true
+		case "cold":
+		default:
+			return nil, fmt.Errorf("backup.jobs.%s: mode must be hot or cold, not %q", jobCfg.Name, jobCfg.Mode)
+		}
+
+		primary := jobCfg.Target
+		if primary == "" {
+			primary = cfg.Backup.DefaultTarget
+		}
+		for _, name := range jobCfg.CopyTo {
+			if name == "" || name == primary {
+				return nil, fmt.Errorf("backup.jobs.%s: copy_to must name targets other than the job's target", jobCfg.Name)
+			}
+		}
+
+		if jobCfg.Drill != nil {
+			// A drill job takes no backups, so there is nothing to copy or prune
+			if len(jobCfg.CopyTo) > 0 || jobCfg.Retention != nil {
+				return nil, fmt.Errorf("backup.jobs.%s: a drill job cannot have copy_to or retention", jobCfg.Name)
+			}
+			opts := backupcli.DrillOptions(jobCfg.Drill, cfg)
+			if opts.Network == "" {
+				return nil, fmt.Errorf("backup.jobs.%s: drill needs a network, or set backup.drill.network", jobCfg.Name)
+			}
+			job.Drill = &opts
+		}
+
+		if r := jobCfg.Retention; r != nil {
+			// An empty policy would keep nothing
+			if r.KeepLast+r.KeepDaily+r.KeepWeekly+r.KeepMonthly == 0 {
+				return nil, fmt.Errorf("backup.jobs.%s: retention needs at least one keep_* rule", jobCfg.Name)
+			}
+			job.Retention = &backup.PruneOptions{
+				KeepLast:    r.KeepLast,
+				KeepDaily:   r.KeepDaily,
+				KeepWeekly:  r.KeepWeekly,
+				KeepMonthly: r.KeepMonthly,
+				Timezone:    r.Timezone,
+			}
+		}
+
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
@@ -1,13 +1,229 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
 	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/r11/esxi-commander/pkg/api"
+	"github.com/r11/esxi-commander/pkg/audit"
+	"github.com/r11/esxi-commander/pkg/config"
 	"github.com/r11/esxi-commander/pkg/logger"
+	"github.com/r11/esxi-commander/pkg/rpc"
+	"github.com/r11/esxi-commander/pkg/scheduler"
+	"github.com/r11/esxi-commander/pkg/security"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	configPath = flag.String("config", "", "Configuration file (default: config.yaml, /etc/ceso/config.yaml, ~/.ceso/config.yaml)")
 )
 
 func main() {
+	flag.Parse()
 	logger.Init()
-	fmt.Println("cesod daemon - stub implementation for Phase 1")
-	fmt.Println("JSON-RPC daemon will be implemented in future phases")
+
+	if err := run(); err != nil {
+		log.Error().Err(err).Msg("cesod failed")
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	if cfg.Security.AuditLog != "" {
+		if err := audit.Initialize(expandHome(cfg.Security.AuditLog)); err != nil {
+			return fmt.Errorf("failed to open audit log: %w", err)
+		}
+	}
+
+	jobs, err := loadJobs(cfg)
+	if err != nil {
+		return err
+	}
+
+	security.Initialize(securityMode(cfg.Security.Mode))
+	allowlist, err := rpc.ParseAllowlist(cfg.Security.IPAllowlist)
+	if err != nil {
+		return err
+	}
+
+	if cfg.API.HTTPListen != "" && cfg.API.Token == "" {
+		return fmt.Errorf("api.http_listen requires api.token")
+	}
+
+	listeners, err := apiListeners(cfg.API)
+	if err != nil {
+		return err
+	}
+
+	if cfg.Metrics.Enabled {
+		go func() {
+			addr := fmt.Sprintf(":%d", cfg.Metrics.Port)
+			log.Info().Str("addr", addr+cfg.Metrics.Path).Msg("serving metrics")
+			mux := http.NewServeMux()
+			mux.Handle(cfg.Metrics.Path, promhttp.Handler())
+			if err := http.ListenAndServe(addr, mux); err != nil {
+				log.Error().Err(err).Msg("metrics server failed")
+			}
+		}()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	b := newBackend(cfg)
+	b.recoverBackups(ctx)
+	if cfg.Metrics.Enabled {
+		b.publishDrills()
+	}
+
+	server := rpc.NewServer(security.GetSandbox(), allowlist)
+	registerMethods(server, b)
+
+	var wg sync.WaitGroup
+	for _, l := range listeners {
+		wg.Add(1)
+		go func(l net.Listener) {
+			defer wg.Done()
+			log.Info().Str("addr", l.Addr().String()).Msg("serving JSON-RPC API")
+			if err := server.Serve(ctx, l); err != nil {
+				log.Error().Err(err).Msg("JSON-RPC server failed")
+			}
+		}(l)
+	}
+
+	if cfg.API.HTTPListen != "" {
+		restServer, err := api.NewServer(server, cfg.API.Token, allowlist, apiInfo, restRoutes)
+		if err != nil {
+			return err
+		}
+		httpServer := &http.Server{Addr: cfg.API.HTTPListen, Handler: restServer}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			log.Info().Str("addr", cfg.API.HTTPListen).Msg("serving REST API")
+			if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Error().Err(err).Msg("REST server failed")
+			}
+		}()
+		go func() {
+			<-ctx.Done()
+			httpServer.Shutdown(context.Background())
+		}()
+	}
+
+	log.Info().Int("jobs", len(jobs)).Msg("cesod started")
+	scheduler.New(b, jobs).Run(ctx)
+	wg.Wait()
+	log.Info().Msg("cesod stopped")
+	return nil
+}
+
+// securityMode maps security.mode to a sandbox mode, defaulting to standard
+// like ceso does
+func securityMode(mode string) security.OperationMode {
+	switch mode {
+	case "restricted":
+		return security.ModeRestricted
+	case "unrestricted":
+		return security.ModeUnrestricted
+	default:
+		return security.ModeStandard
+	}
+}
+
+// apiListeners opens the Unix socket and, if api.listen is set, the TLS
+// listener of the JSON-RPC API
+func apiListeners(cfg config.APIConfig) ([]net.Listener, error) {
+	socket := expandHome(cfg.Socket)
+	if err := os.MkdirAll(filepath.Dir(socket), 0750); err != nil {
+		return nil, fmt.Errorf("failed to create socket directory: %w", err)
+	}
+	// A socket left behind by an unclean shutdown would fail the bind
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+	}
+
+	unixListener, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", socket, err)
+	}
+	// Access to the socket is access to the API
+	if err := os.Chmod(socket, 0660); err != nil {
+		unixListener.Close()
+		return nil, fmt.Errorf("failed to set socket permissions: %w", err)
+	}
+	listeners := []net.Listener{unixListener}
+
+	if cfg.Listen == "" {
+		return listeners, nil
+	}
+
+	tlsConfig, err := apiTLSConfig(cfg)
+	if err != nil {
+		unixListener.Close()
+		return nil, err
+	}
+	tlsListener, err := tls.Listen("tcp", cfg.Listen, tlsConfig)
+	if err != nil {
+		unixListener.Close()
+		return nil, fmt.Errorf("failed to listen on %s: %w", cfg.Listen, err)
+	}
+	return append(listeners, tlsListener), nil
+}
+
+// apiTLSConfig builds the TLS configuration of the TCP listener. Clients
+// must present a certificate signed by api.client_ca.
+func apiTLSConfig(cfg config.APIConfig) (*tls.Config, error) {
+	if cfg.TLSCert == "" || cfg.TLSKey == "" || cfg.ClientCA == "" {
+		return nil, fmt.Errorf("api.listen requires api.tls_cert, api.tls_key and api.client_ca")
+	}
+
+	cert, err := tls.LoadX509KeyPair(expandHome(cfg.TLSCert), expandHome(cfg.TLSKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	caPEM, err := os.ReadFile(expandHome(cfg.ClientCA))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA: %w", err)
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in %s", cfg.ClientCA)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// expandHome expands a leading ~ in path to the user's home directory
+func expandHome(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, strings.TrimPrefix(path, "~"))
+		}
+	}
+	return path
 }
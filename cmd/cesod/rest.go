@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/r11/esxi-commander/internal/storage"
+	"github.com/r11/esxi-commander/pkg/api"
+	"github.com/r11/esxi-commander/pkg/backup"
+	"github.com/r11/esxi-commander/pkg/cli/host"
+	"github.com/r11/esxi-commander/pkg/esxi/client"
+	"github.com/r11/esxi-commander/pkg/esxi/pci"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// apiInfo describes the REST API in its OpenAPI document
+var apiInfo = api.Info{Title: "ESXi Commander API", Version: "1.0.0"}
+
+// restRoutes maps the REST resources onto the JSON-RPC methods of
+// registerMethods
+var restRoutes = []api.Route{
+	{Method: http.MethodGet, Path: "/api/v1/vms", Call: "vm.list", Tag: "vms", Summary: "List VMs", Result: []*client.VM{}},
+	{Method: http.MethodPost, Path: "/api/v1/vms", Call: "vm.create", Tag: "vms", Summary: "Create a VM from a template", Params: vmCreateParams{}, Result: &client.VM{}},
+	{Method: http.MethodGet, Path: "/api/v1/vms/{name}", Call: "vm.info", Tag: "vms", Summary: "Show a VM", Params: vmParams{}, Result: &client.VM{}},
+	{Method: http.MethodDelete, Path: "/api/v1/vms/{name}", Call: "vm.delete", Tag: "vms", Summary: "Delete a VM", Params: vmParams{}},
+	{Method: http.MethodPost, Path: "/api/v1/vms/{source}/clone", Call: "vm.clone", Tag: "vms", Summary: "Clone a VM", Params: vmCloneParams{}, Result: &client.VM{}},
+	{Method: http.MethodPost, Path: "/api/v1/vms/{name}/start", Call: "vm.start", Tag: "vms", Summary: "Power on a VM", Params: vmPowerParams{}, Result: &client.VM{}},
+	{Method: http.MethodPost, Path: "/api/v1/vms/{name}/stop", Call: "vm.stop", Tag: "vms", Summary: "Shut down or power off a VM", Params: vmPowerParams{}, Result: &client.VM{}},
+	{Method: http.MethodPost, Path: "/api/v1/vms/{name}/restart", Call: "vm.restart", Tag: "vms", Summary: "Restart a VM", Params: vmPowerParams{}, Result: &client.VM{}},
+	{Method: http.MethodPost, Path: "/api/v1/vms/{name}/suspend", Call: "vm.suspend", Tag: "vms", Summary: "Suspend a VM", Params: vmPowerParams{}, Result: &client.VM{}},
+	{Method: http.MethodPost, Path: "/api/v1/vms/{name}/resume", Call: "vm.resume", Tag: "vms", Summary: "Resume a suspended VM", Params: vmPowerParams{}, Result: &client.VM{}},
+
+	{Method: http.MethodGet, Path: "/api/v1/vms/{vm}/snapshots", Call: "vm.snapshot.list", Tag: "snapshots", Summary: "List the snapshot tree of a VM", Params: snapshotListParams{}, Result: []types.VirtualMachineSnapshotTree{}},
+	{Method: http.MethodPost, Path: "/api/v1/vms/{vm}/snapshots", Call: "vm.snapshot.create", Tag: "snapshots", Summary: "Create a snapshot", Params: snapshotCreateParams{}},
+	{Method: http.MethodPost, Path: "/api/v1/vms/{vm}/snapshots/{name}/revert", Call: "vm.snapshot.revert", Tag: "snapshots", Summary: "Revert to a snapshot", Params: snapshotParams{}},
+	{Method: http.MethodDelete, Path: "/api/v1/vms/{vm}/snapshots/{name}", Call: "vm.snapshot.delete", Tag: "snapshots", Summary: "Delete a snapshot", Params: snapshotDeleteParams{}},
+
+	{Method: http.MethodGet, Path: "/api/v1/backups", Call: "backup.list", Tag: "backups", Summary: "List backups", Params: backupListParams{}, Result: []*backup.BackupInfo{}},
+	{Method: http.MethodPost, Path: "/api/v1/backups", Call: "backup.create", Tag: "backups", Summary: "Back up a VM", Params: backupCreateParams{}, Result: &backup.BackupInfo{}},
+	{Method: http.MethodGet, Path: "/api/v1/backups/history", Call: "backup.history", Tag: "backups", Summary: "List scheduled job runs", Params: backupHistoryParams{}, Result: []*storage.JobRun{}},
+	{Method: http.MethodPost, Path: "/api/v1/backups/prune", Call: "backup.prune", Tag: "backups", Summary: "Apply a retention policy", Params: backupPruneParams{}, Result: &backup.PruneResult{}},
+	{Method: http.MethodGet, Path: "/api/v1/backups/{id}", Call: "backup.info", Tag: "backups", Summary: "Show a backup", Params: backupIDParams{}, Result: &backup.BackupInfo{}},
+	{Method: http.MethodDelete, Path: "/api/v1/backups/{id}", Call: "backup.delete", Tag: "backups", Summary: "Delete a backup", Params: backupIDParams{}},
+	{Method: http.MethodPost, Path: "/api/v1/backups/{id}/restore", Call: "backup.restore", Tag: "backups", Summary: "Restore a backup", Params: backupRestoreParams{}, Result: &client.VM{}},
+	{Method: http.MethodPost, Path: "/api/v1/backups/{id}/verify", Call: "backup.verify", Tag: "backups", Summary: "Verify a backup's checksums", Params: backupIDParams{}, Result: &backup.VerifyResult{}},
+	{Method: http.MethodPost, Path: "/api/v1/backups/{id}/hold", Call: "backup.hold", Tag: "backups", Summary: "Place a legal hold on a backup", Params: backupHoldParams{}, Result: &backup.BackupInfo{}},
+	{Method: http.MethodDelete, Path: "/api/v1/backups/{id}/hold", Call: "backup.release", Tag: "backups", Summary: "Release the legal hold on a backup", Params: backupIDParams{}, Result: &backup.BackupInfo{}},
+	{Method: http.MethodPost, Path: "/api/v1/backups/{id}/drill", Call: "backup.drill", Tag: "backups", Summary: "Restore a backup into an isolated network and check that it boots", Params: backupDrillParams{}, Result: &backup.DrillResult{}},
+	{Method: http.MethodPost, Path: "/api/v1/backups/{id}/replicate", Call: "backup.replicate", Tag: "backups", Summary: "Copy a backup to another target", Params: backupReplicateParams{}, Result: &storage.Replica{}},
+
+	{Method: http.MethodGet, Path: "/api/v1/pci", Call: "pci.list", Tag: "pci", Summary: "List PCI devices", Params: pciListParams{}, Result: []*pci.Device{}},
+	{Method: http.MethodGet, Path: "/api/v1/pci/{id}", Call: "pci.info", Tag: "pci", Summary: "Show a PCI device", Params: pciDeviceParams{}, Result: &pci.Device{}},
+	{Method: http.MethodPost, Path: "/api/v1/pci/{id}/passthrough", Call: "pci.enable", Tag: "pci", Summary: "Enable passthrough for a device", Params: pciDeviceParams{}},
+	{Method: http.MethodDelete, Path: "/api/v1/pci/{id}/passthrough", Call: "pci.disable", Tag: "pci", Summary: "Disable passthrough for a device", Params: pciDeviceParams{}},
+
+	{Method: http.MethodGet, Path: "/api/v1/host", Call: "host.info", Tag: "host", Summary: "Show host information", Result: &host.HostInfo{}},
+	{Method: http.MethodGet, Path: "/api/v1/host/stats", Call: "host.stats", Tag: "host", Summary: "Show host resource usage", Result: &host.HostStats{}},
+	{Method: http.MethodGet, Path: "/api/v1/host/health", Call: "host.health", Tag: "host", Summary: "Check host health", Result: &host.HealthStatus{}},
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/r11/esxi-commander/pkg/api"
+	"github.com/r11/esxi-commander/pkg/audit"
+	"github.com/r11/esxi-commander/pkg/config"
+	"github.com/r11/esxi-commander/pkg/rpc"
+	"github.com/r11/esxi-commander/pkg/security"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/govmomi/simulator"
+)
+
+const testToken = "s3cret"
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "cesod-audit")
+	if err != nil {
+		panic(err)
+	}
+	if err := audit.Initialize(filepath.Join(dir, "audit.json")); err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// newTestAPI serves the REST API of a backend connected to an ESX model
+// vcsim instance
+func newTestAPI(t *testing.T, allowlist *rpc.Allowlist) *httptest.Server {
+	t.Helper()
+
+	model := simulator.ESX()
+	require.NoError(t, model.Create())
+	model.Service.TLS = new(tls.Config)
+	t.Cleanup(model.Remove)
+	vcsim := model.Service.NewServer()
+	t.Cleanup(vcsim.Close)
+
+	password, _ := vcsim.URL.User.Password()
+	cfg := &config.Config{}
+	cfg.ESXi.Host = vcsim.URL.Host
+	cfg.ESXi.User = vcsim.URL.User.Username()
+	cfg.ESXi.Password = password
+	cfg.ESXi.Insecure = true
+	cfg.Backup.CatalogPath = filepath.Join(t.TempDir(), "backup.db")
+	cfg.Tasks.DBPath = filepath.Join(t.TempDir(), "tasks.db")
+
+	security.Initialize(security.ModeStandard)
+	rpcServer := rpc.NewServer(security.GetSandbox(), allowlist)
+	registerMethods(rpcServer, newBackend(cfg))
+
+	restServer, err := api.NewServer(rpcServer, testToken, allowlist, apiInfo, restRoutes)
+	require.NoError(t, err)
+
+	server := httptest.NewServer(restServer)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// do sends an authenticated request and returns the status and body
+func do(t *testing.T, server *httptest.Server, method, path, body string) (int, []byte) {
+	t.Helper()
+
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, server.URL+path, reader)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+
+	resp, err := server.Client().Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, data
+}
+
+// firstVM returns the name of the first VM the API lists
+func firstVM(t *testing.T, server *httptest.Server) string {
+	t.Helper()
+
+	status, body := do(t, server, http.MethodGet, "/api/v1/vms", "")
+	require.Equal(t, http.StatusOK, status, string(body))
+	var vms []struct {
+		Name string `json:"name"`
+	}
+	require.NoError(t, json.Unmarshal(body, &vms))
+	require.NotEmpty(t, vms)
+	return vms[0].Name
+}
+
+func TestRESTRequiresToken(t *testing.T) {
+	server := newTestAPI(t, nil)
+
+	resp, err := server.Client().Get(server.URL + "/api/v1/vms")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("WWW-Authenticate"), "Bearer")
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/api/v1/vms", nil)
+	req.Header.Set("Authorization", "Bearer wrong")
+	resp, err = server.Client().Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestRESTOpenAPIDocument(t *testing.T) {
+	server := newTestAPI(t, nil)
+
+	// The document is public
+	resp, err := server.Client().Get(server.URL + "/openapi.json")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var document struct {
+		OpenAPI    string                                `json:"openapi"`
+		Paths      map[string]map[string]json.RawMessage `json:"paths"`
+		Components struct {
+			Schemas map[string]json.RawMessage `json:"schemas"`
+		} `json:"components"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&document))
+
+	assert.Equal(t, "3.0.3", document.OpenAPI)
+	for _, route := range restRoutes {
+		assert.Contains(t, document.Paths[route.Path], strings.ToLower(route.Method), route.Path)
+	}
+	assert.Contains(t, document.Components.Schemas, "BackupInfo")
+	assert.Contains(t, document.Components.Schemas, "VirtualMachineSnapshotTree")
+
+	var createVM struct {
+		RequestBody struct {
+			Content map[string]struct {
+				Schema struct {
+					Properties map[string]json.RawMessage `json:"properties"`
+				} `json:"schema"`
+			} `json:"content"`
+		} `json:"requestBody"`
+	}
+	require.NoError(t, json.Unmarshal(document.Paths["/api/v1/vms"]["post"], &createVM))
+	properties := createVM.RequestBody.Content["application/json"].Schema.Properties
+	assert.Contains(t, properties, "template")
+	assert.Contains(t, properties, "ssh_key") // Promoted from networkParams
+}
+
+func TestRESTVMs(t *testing.T) {
+	server := newTestAPI(t, nil)
+
+	name := firstVM(t, server)
+
+	status, body := do(t, server, http.MethodGet, "/api/v1/vms/"+name, "")
+	require.Equal(t, http.StatusOK, status, string(body))
+	var info struct {
+		Name   string `json:"name"`
+		Status string `json:"status"`
+	}
+	require.NoError(t, json.Unmarshal(body, &info))
+	assert.Equal(t, name, info.Name)
+
+	status, body = do(t, server, http.MethodPost, "/api/v1/vms/"+name+"/stop", `{"force":true}`)
+	require.Equal(t, http.StatusOK, status, string(body))
+	require.NoError(t, json.Unmarshal(body, &info))
+	assert.Equal(t, "poweredOff", info.Status)
+
+	status, body = do(t, server, http.MethodGet, "/api/v1/vms/does-not-exist", "")
+	assert.Equal(t, http.StatusInternalServerError, status, string(body))
+}
+
+func TestRESTSnapshots(t *testing.T) {
+	server := newTestAPI(t, nil)
+	snapshots := "/api/v1/vms/" + firstVM(t, server) + "/snapshots"
+
+	status, body := do(t, server, http.MethodPost, snapshots, `{"name":"before-upgrade"}`)
+	require.Equal(t, http.StatusNoContent, status, string(body))
+
+	status, body = do(t, server, http.MethodGet, snapshots, "")
+	require.Equal(t, http.StatusOK, status, string(body))
+	var tree []struct {
+		Name string `json:"name"`
+	}
+	require.NoError(t, json.Unmarshal(body, &tree))
+	require.Len(t, tree, 1)
+	assert.Equal(t, "before-upgrade", tree[0].Name)
+
+	status, body = do(t, server, http.MethodPost, snapshots+"/before-upgrade/revert", "")
+	assert.Equal(t, http.StatusNoContent, status, string(body))
+
+	status, body = do(t, server, http.MethodDelete, snapshots+"/before-upgrade", "")
+	assert.Equal(t, http.StatusNoContent, status, string(body))
+}
+
+func TestRESTHostAndBackups(t *testing.T) {
+	server := newTestAPI(t, nil)
+
+	status, body := do(t, server, http.MethodGet, "/api/v1/host", "")
+	require.Equal(t, http.StatusOK, status, string(body))
+	var hostInfo struct {
+		Name string `json:"name"`
+	}
+	require.NoError(t, json.Unmarshal(body, &hostInfo))
+	assert.NotEmpty(t, hostInfo.Name)
+
+	status, body = do(t, server, http.MethodGet, "/api/v1/backups?vm="+firstVM(t, server), "")
+	assert.Equal(t, http.StatusOK, status, string(body))
+
+	status, body = do(t, server, http.MethodGet, "/api/v1/backups/history?limit=5", "")
+	assert.Equal(t, http.StatusOK, status, string(body))
+}
+
+func TestRESTErrors(t *testing.T) {
+	server := newTestAPI(t, nil)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+		code   int
+	}{
+		{"unknown query param", http.MethodGet, "/api/v1/backups?color=red", "", http.StatusBadRequest, rpc.CodeInvalidParams},
+		{"bad query value", http.MethodGet, "/api/v1/backups/history?limit=ten", "", http.StatusBadRequest, rpc.CodeInvalidParams},
+		{"body not an object", http.MethodPost, "/api/v1/backups", `[1]`, http.StatusBadRequest, rpc.CodeInvalidParams},
+		{"missing vm", http.MethodPost, "/api/v1/backups", `{}`, http.StatusBadRequest, rpc.CodeInvalidParams},
+		// Prune is reserved for unrestricted mode
+		{"sandbox denial", http.MethodPost, "/api/v1/backups/prune", `{"keep_last":1}`, http.StatusForbidden, rpc.CodeNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := do(t, server, tt.method, tt.path, tt.body)
+			assert.Equal(t, tt.status, status, string(body))
+
+			var errBody struct {
+				Error rpc.Error `json:"error"`
+			}
+			require.NoError(t, json.Unmarshal(body, &errBody))
+			assert.Equal(t, tt.code, errBody.Error.Code)
+		})
+	}
+}
+
+func TestRESTAllowlist(t *testing.T) {
+	allowlist, err := rpc.ParseAllowlist([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+	server := newTestAPI(t, allowlist)
+
+	status, _ := do(t, server, http.MethodGet, "/api/v1/vms", "")
+	assert.Equal(t, http.StatusForbidden, status)
+}
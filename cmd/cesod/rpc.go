@@ -0,0 +1,1021 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/r11/esxi-commander/pkg/backup"
+	backupcli "github.com/r11/esxi-commander/pkg/cli/backup"
+	"github.com/r11/esxi-commander/pkg/cli/host"
+	vmcli "github.com/r11/esxi-commander/pkg/cli/vm"
+	"github.com/r11/esxi-commander/pkg/cloudinit"
+	"github.com/r11/esxi-commander/pkg/config"
+	"github.com/r11/esxi-commander/pkg/esxi/client"
+	"github.com/r11/esxi-commander/pkg/esxi/pci"
+	"github.com/r11/esxi-commander/pkg/esxi/vm"
+	"github.com/r11/esxi-commander/pkg/rpc"
+	"github.com/r11/esxi-commander/pkg/validation"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// registerMethods exposes the operations of the ceso commands as JSON-RPC
+// methods. The second argument is the sandbox operation each one performs,
+// the same the matching ceso command maps to.
+func registerMethods(s *rpc.Server, b *backend) {
+	s.Register("vm.list", "vm.list", b.vmList)
+	s.Register("vm.info", "vm.info", b.vmInfo)
+	s.Register("vm.create", "vm.create", b.vmCreate)
+	s.Register("vm.clone", "vm.clone", b.vmClone)
+	s.Register("vm.delete", "vm.delete", b.vmDelete)
+	s.Register("vm.start", "vm.power", b.vmStart)
+	s.Register("vm.stop", "vm.power", b.vmStop)
+	s.Register("vm.restart", "vm.power", b.vmRestart)
+	s.Register("vm.suspend", "vm.power", b.vmSuspend)
+	s.Register("vm.resume", "vm.power", b.vmResume)
+	s.Register("vm.snapshot.list", "vm.info", b.snapshotList)
+	s.Register("vm.snapshot.create", "vm.snapshot", b.snapshotCreate)
+	s.Register("vm.snapshot.revert", "vm.snapshot", b.snapshotRevert)
+	s.Register("vm.snapshot.delete", "vm.snapshot", b.snapshotDelete)
+
+	s.Register("backup.list", "backup.list", b.backupList)
+	s.Register("backup.info", "backup.list", b.backupInfo)
+	s.Register("backup.history", "backup.list", b.backupHistory)
+	s.Register("backup.create", "backup.create", b.backupCreate)
+	s.Register("backup.restore", "backup.restore", b.backupRestore)
+	s.Register("backup.verify", "backup.verify", b.backupVerify)
+	s.Register("backup.replicate", "backup.replicate", b.backupReplicate)
+	s.Register("backup.hold", "backup.hold", b.backupHold)
+	s.Register("backup.release", "backup.release", b.backupRelease)
+	s.Register("backup.drill", "backup.drill", b.backupDrill)
+	s.Register("backup.delete", "backup.delete", b.backupDelete)
+	s.Register("backup.prune", "backup.prune", b.backupPrune)
+
+	s.Register("pci.list", "pci.list", b.pciList)
+	s.Register("pci.info", "pci.list", b.pciInfo)
+	s.Register("pci.enable", "pci.passthrough", b.pciEnable)
+	s.Register("pci.disable", "pci.passthrough", b.pciDisable)
+
+	s.Register("host.info", "host.info", b.hostInfo)
+	s.Register("host.stats", "host.info", b.hostStats)
+	s.Register("host.health", "host.info", b.hostHealth)
+}
+
+// withClient runs fn with the shared ESXi session
+func (b *backend) withClient(fn func(*client.ESXiClient) (interface{}, error)) (interface{}, error) {
+	esxiClient, err := b.acquireClient()
+	if err != nil {
+		return nil, err
+	}
+	defer b.releaseClient()
+	return fn(esxiClient)
+}
+
+// withManager runs fn with the shared ESXi session and backup manager
+func (b *backend) withManager(fn func(*client.ESXiClient, *backup.BackupManager) (interface{}, error)) (interface{}, error) {
+	esxiClient, manager, err := b.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer b.release()
+	return fn(esxiClient, manager)
+}
+
+type vmParams struct {
+	Name string `json:"name"`
+}
+
+func (p *vmParams) bind(call *rpc.Call) error {
+	if err := call.Bind(p); err != nil {
+		return err
+	}
+	if p.Name == "" {
+		return rpc.InvalidParams(fmt.Errorf("name is required"))
+	}
+	return nil
+}
+
+type networkParams struct {
+	IP      string   `json:"ip"` // CIDR notation
+	Gateway string   `json:"gateway"`
+	DNS     []string `json:"dns"`
+	SSHKey  string   `json:"ssh_key"`
+}
+
+// guestinfo builds the cloud-init guestinfo for a VM named name
+func (p networkParams) guestinfo(name string) (map[string]string, error) {
+	dns := p.DNS
+	if len(dns) == 0 {
+		dns = []string{"8.8.8.8", "8.8.4.4"}
+	}
+
+	data := &cloudinit.CloudInitData{
+		Hostname: name,
+		FQDN:     fmt.Sprintf("%s.local", name),
+		IP:       p.IP,
+		Gateway:  p.Gateway,
+		DNS:      dns,
+	}
+	if p.SSHKey != "" {
+		data.SSHKeys = []string{p.SSHKey}
+	}
+
+	guestinfo, err := cloudinit.BuildGuestinfo(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build cloud-init: %w", err)
+	}
+	return guestinfo, nil
+}
+
+func (b *backend) vmList(ctx context.Context, call *rpc.Call) (interface{}, error) {
+	return b.withClient(func(esxiClient *client.ESXiClient) (interface{}, error) {
+		vms, err := esxiClient.ListVMs(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list VMs: %w", err)
+		}
+		return vms, nil
+	})
+}
+
+func (b *backend) vmInfo(ctx context.Context, call *rpc.Call) (interface{}, error) {
+	var params vmParams
+	if err := params.bind(call); err != nil {
+		return nil, err
+	}
+
+	return b.withClient(func(esxiClient *client.ESXiClient) (interface{}, error) {
+		info, err := vm.NewOperations(esxiClient).GetVMInfo(ctx, params.Name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get VM info: %w", err)
+		}
+		return info, nil
+	})
+}
+
+type vmCreateParams struct {
+	Name     string `json:"name"`
+	Template string `json:"template"`
+	CPU      int    `json:"cpu"`
+	Memory   int    `json:"memory"` // GB
+	Disk     int    `json:"disk"`   // GB
+	GPU      string `json:"gpu"`    // PCI device ID to pass through
+	networkParams
+}
+
+func (b *backend) vmCreate(ctx context.Context, call *rpc.Call) (interface{}, error) {
+	params := vmCreateParams{CPU: 2, Memory: 4, Disk: 40}
+	if err := call.Bind(&params); err != nil {
+		return nil, err
+	}
+
+	if err := validation.ValidateVMName(params.Name); err != nil {
+		return nil, rpc.InvalidParams(fmt.Errorf("invalid VM name: %w", err))
+	}
+	if params.Template == "" {
+		return nil, rpc.InvalidParams(fmt.Errorf("template is required"))
+	}
+	if params.IP != "" {
+		if err := validation.ValidateCIDR(params.IP); err != nil {
+			return nil, rpc.InvalidParams(fmt.Errorf("invalid IP address: %w", err))
+		}
+	}
+	if err := validation.ValidateGateway(params.Gateway); err != nil {
+		return nil, rpc.InvalidParams(fmt.Errorf("invalid gateway: %w", err))
+	}
+	if err := validation.ValidateDNS(params.DNS); err != nil {
+		return nil, rpc.InvalidParams(fmt.Errorf("invalid DNS: %w", err))
+	}
+	if err := validation.ValidateSSHKey(params.SSHKey); err != nil {
+		return nil, rpc.InvalidParams(fmt.Errorf("invalid SSH key: %w", err))
+	}
+	if err := validation.ValidateResourceLimits(params.CPU, params.Memory); err != nil {
+		return nil, rpc.InvalidParams(fmt.Errorf("invalid resource limits: %w", err))
+	}
+
+	guestinfo, err := params.guestinfo(params.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.track(ctx, call, "vm.create", params.Name, func(ctx context.Context, progress backup.ProgressFunc) (interface{}, error) {
+		return b.withClient(func(esxiClient *client.ESXiClient) (interface{}, error) {
+			vmOps := vm.NewOperations(esxiClient)
+
+			progress("clone", -1)
+			newVM, err := vmOps.CreateFromTemplate(ctx, &vm.CreateOptions{
+				Name:      params.Name,
+				Template:  params.Template,
+				CPU:       params.CPU,
+				Memory:    params.Memory * 1024,
+				Disk:      params.Disk,
+				Guestinfo: guestinfo,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to create VM: %w", err)
+			}
+
+			// PCI devices can only be attached while the VM is powered off
+			if params.GPU != "" {
+				progress("attach gpu", -1)
+				attachment := pci.NewAttachment(esxiClient)
+				if err := attachment.ValidateAttachment(ctx, params.Name, params.GPU); err != nil {
+					return nil, fmt.Errorf("GPU validation failed: %w", err)
+				}
+				if err := attachment.AttachDevice(ctx, params.Name, params.GPU); err != nil {
+					return nil, fmt.Errorf("failed to attach GPU: %w", err)
+				}
+			}
+
+			progress("power on", -1)
+			if err := vmOps.PowerOn(ctx, newVM); err != nil {
+				return nil, fmt.Errorf("failed to power on VM: %w", err)
+			}
+			return vmOps.GetVMInfo(ctx, params.Name)
+		})
+	})
+}
+
+type vmCloneParams struct {
+	Source string `json:"source"`
+	Name   string `json:"name"`
+	networkParams
+}
+
+func (b *backend) vmClone(ctx context.Context, call *rpc.Call) (interface{}, error) {
+	var params vmCloneParams
+	if err := call.Bind(&params); err != nil {
+		return nil, err
+	}
+	if params.Source == "" {
+		return nil, rpc.InvalidParams(fmt.Errorf("source is required"))
+	}
+	if err := validation.ValidateVMName(params.Name); err != nil {
+		return nil, rpc.InvalidParams(fmt.Errorf("invalid VM name: %w", err))
+	}
+
+	// Without a new IP the clone keeps the source's guest configuration
+	var guestinfo map[string]string
+	if params.IP != "" {
+		var err error
+		if guestinfo, err = params.guestinfo(params.Name); err != nil {
+			return nil, err
+		}
+	}
+
+	return b.track(ctx, call, "vm.clone", params.Name, func(ctx context.Context, progress backup.ProgressFunc) (interface{}, error) {
+		return b.withClient(func(esxiClient *client.ESXiClient) (interface{}, error) {
+			vmOps := vm.NewOperations(esxiClient)
+
+			progress("clone", -1)
+			newVM, err := vmOps.CloneVM(ctx, params.Source, params.Name, guestinfo)
+			if err != nil {
+				return nil, fmt.Errorf("failed to clone VM: %w", err)
+			}
+
+			progress("power on", -1)
+			if err := vmOps.PowerOn(ctx, newVM); err != nil {
+				return nil, fmt.Errorf("failed to power on VM: %w", err)
+			}
+			return vmOps.GetVMInfo(ctx, params.Name)
+		})
+	})
+}
+
+func (b *backend) vmDelete(ctx context.Context, call *rpc.Call) (interface{}, error) {
+	var params vmParams
+	if err := params.bind(call); err != nil {
+		return nil, err
+	}
+	if err := validation.ValidateVMName(params.Name); err != nil {
+		return nil, rpc.InvalidParams(fmt.Errorf("invalid VM name: %w", err))
+	}
+
+	return b.withClient(func(esxiClient *client.ESXiClient) (interface{}, error) {
+		if err := vm.NewOperations(esxiClient).Delete(ctx, params.Name); err != nil {
+			return nil, fmt.Errorf("failed to delete VM: %w", err)
+		}
+		return nil, nil
+	})
+}
+
+// powerAction finds the VM named in call's params and runs fn on it with
+// its current power state, returning the VM's information afterwards
+func (b *backend) powerAction(ctx context.Context, call *rpc.Call, fn func(vmOps *vm.Operations, vmObj *object.VirtualMachine, params vmPowerParams, state string) error) (interface{}, error) {
+	var params vmPowerParams
+	if err := call.Bind(&params); err != nil {
+		return nil, err
+	}
+	if params.Name == "" {
+		return nil, rpc.InvalidParams(fmt.Errorf("name is required"))
+	}
+
+	return b.withClient(func(esxiClient *client.ESXiClient) (interface{}, error) {
+		vmOps := vm.NewOperations(esxiClient)
+		vmObj, err := esxiClient.FindVM(ctx, params.Name)
+		if err != nil {
+			return nil, fmt.Errorf("VM '%s' not found: %w", params.Name, err)
+		}
+		state, err := vmOps.GetPowerState(ctx, vmObj)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get power state: %w", err)
+		}
+
+		if err := fn(vmOps, vmObj, params, string(state)); err != nil {
+			return nil, err
+		}
+		return vmOps.GetVMInfo(ctx, params.Name)
+	})
+}
+
+type vmPowerParams struct {
+	Name  string `json:"name"`
+	Force bool   `json:"force"` // vm.stop: power off instead of a guest shutdown
+}
+
+func (b *backend) vmStart(ctx context.Context, call *rpc.Call) (interface{}, error) {
+	return b.powerAction(ctx, call, func(vmOps *vm.Operations, vmObj *object.VirtualMachine, params vmPowerParams, state string) error {
+		if state == "poweredOn" {
+			return nil
+		}
+		if err := vmOps.PowerOn(ctx, vmObj); err != nil {
+			return fmt.Errorf("failed to start VM: %w", err)
+		}
+		return nil
+	})
+}
+
+func (b *backend) vmStop(ctx context.Context, call *rpc.Call) (interface{}, error) {
+	return b.powerAction(ctx, call, func(vmOps *vm.Operations, vmObj *object.VirtualMachine, params vmPowerParams, state string) error {
+		if state != "poweredOn" {
+			return nil
+		}
+
+		var stopErr error
+		if params.Force {
+			stopErr = vmOps.PowerOff(ctx, vmObj)
+		} else if stopErr = vmOps.Shutdown(ctx, vmObj); stopErr != nil {
+			// Same fallback as ceso vm stop
+			call.Progress("power off", -1)
+			stopErr = vmOps.PowerOff(ctx, vmObj)
+		}
+		if stopErr != nil {
+			return fmt.Errorf("failed to stop VM: %w", stopErr)
+		}
+		return nil
+	})
+}
+
+func (b *backend) vmRestart(ctx context.Context, call *rpc.Call) (interface{}, error) {
+	return b.powerAction(ctx, call, func(vmOps *vm.Operations, vmObj *object.VirtualMachine, params vmPowerParams, state string) error {
+		if state != "poweredOn" {
+			return fmt.Errorf("VM '%s' must be powered on to restart (current state: %s)", params.Name, state)
+		}
+		if err := vmOps.Restart(ctx, vmObj); err != nil {
+			return fmt.Errorf("failed to restart VM: %w", err)
+		}
+		return nil
+	})
+}
+
+func (b *backend) vmSuspend(ctx context.Context, call *rpc.Call) (interface{}, error) {
+	return b.powerAction(ctx, call, func(vmOps *vm.Operations, vmObj *object.VirtualMachine, params vmPowerParams, state string) error {
+		if state != "poweredOn" {
+			return fmt.Errorf("VM '%s' must be powered on to suspend (current state: %s)", params.Name, state)
+		}
+		if err := vmOps.Suspend(ctx, vmObj); err != nil {
+			return fmt.Errorf("failed to suspend VM: %w", err)
+		}
+		return nil
+	})
+}
+
+func (b *backend) vmResume(ctx context.Context, call *rpc.Call) (interface{}, error) {
+	return b.powerAction(ctx, call, func(vmOps *vm.Operations, vmObj *object.VirtualMachine, params vmPowerParams, state string) error {
+		if state != "suspended" {
+			return fmt.Errorf("VM '%s' is not suspended (current state: %s)", params.Name, state)
+		}
+		if err := vmOps.Resume(ctx, vmObj); err != nil {
+			return fmt.Errorf("failed to resume VM: %w", err)
+		}
+		return nil
+	})
+}
+
+type snapshotListParams struct {
+	VM string `json:"vm"`
+}
+
+type snapshotParams struct {
+	VM   string `json:"vm"`
+	Name string `json:"name"`
+}
+
+type snapshotCreateParams struct {
+	snapshotParams
+	Description string `json:"description"`
+	Memory      bool   `json:"memory"`  // Include memory state
+	Quiesce     bool   `json:"quiesce"` // Quiesce the guest file system
+}
+
+type snapshotDeleteParams struct {
+	snapshotParams
+	Children bool `json:"children"` // Also delete child snapshots
+}
+
+func (p *snapshotParams) validate() error {
+	if p.VM == "" {
+		return rpc.InvalidParams(fmt.Errorf("vm is required"))
+	}
+	if p.Name == "" {
+		return rpc.InvalidParams(fmt.Errorf("name is required"))
+	}
+	return nil
+}
+
+// findSnapshot returns the named VM and the reference of its snapshot
+func findSnapshot(ctx context.Context, esxiClient *client.ESXiClient, params snapshotParams) (*object.VirtualMachine, types.ManagedObjectReference, error) {
+	vmObj, err := esxiClient.FindVM(ctx, params.VM)
+	if err != nil {
+		return nil, types.ManagedObjectReference{}, fmt.Errorf("VM not found: %w", err)
+	}
+	snapshots, err := vm.NewOperations(esxiClient).ListSnapshots(ctx, vmObj)
+	if err != nil {
+		return nil, types.ManagedObjectReference{}, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	ref, found := vmcli.FindSnapshotByName(snapshots, params.Name)
+	if !found {
+		return nil, types.ManagedObjectReference{}, fmt.Errorf("snapshot '%s' not found", params.Name)
+	}
+	return vmObj, ref, nil
+}
+
+func (b *backend) snapshotList(ctx context.Context, call *rpc.Call) (interface{}, error) {
+	var params snapshotListParams
+	if err := call.Bind(&params); err != nil {
+		return nil, err
+	}
+	if params.VM == "" {
+		return nil, rpc.InvalidParams(fmt.Errorf("vm is required"))
+	}
+
+	return b.withClient(func(esxiClient *client.ESXiClient) (interface{}, error) {
+		vmObj, err := esxiClient.FindVM(ctx, params.VM)
+		if err != nil {
+			return nil, fmt.Errorf("VM not found: %w", err)
+		}
+		snapshots, err := vm.NewOperations(esxiClient).ListSnapshots(ctx, vmObj)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list snapshots: %w", err)
+		}
+		return snapshots, nil
+	})
+}
+
+func (b *backend) snapshotCreate(ctx context.Context, call *rpc.Call) (interface{}, error) {
+	var params snapshotCreateParams
+	if err := call.Bind(&params); err != nil {
+		return nil, err
+	}
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+
+	return b.withClient(func(esxiClient *client.ESXiClient) (interface{}, error) {
+		vmObj, err := esxiClient.FindVM(ctx, params.VM)
+		if err != nil {
+			return nil, fmt.Errorf("VM not found: %w", err)
+		}
+
+		description := params.Description
+		if description == "" {
+			description = fmt.Sprintf("Snapshot created on %s", time.Now().Format("2006-01-02 15:04:05"))
+		}
+		if err := vm.NewOperations(esxiClient).CreateSnapshot(ctx, vmObj, params.Name, description, params.Memory, params.Quiesce); err != nil {
+			return nil, fmt.Errorf("failed to create snapshot: %w", err)
+		}
+		return nil, nil
+	})
+}
+
+func (b *backend) snapshotRevert(ctx context.Context, call *rpc.Call) (interface{}, error) {
+	var params snapshotParams
+	if err := call.Bind(&params); err != nil {
+		return nil, err
+	}
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+
+	return b.withClient(func(esxiClient *client.ESXiClient) (interface{}, error) {
+		vmObj, ref, err := findSnapshot(ctx, esxiClient, params)
+		if err != nil {
+			return nil, err
+		}
+		if err := vm.NewOperations(esxiClient).RevertToSnapshot(ctx, vmObj, ref); err != nil {
+			return nil, fmt.Errorf("failed to revert to snapshot: %w", err)
+		}
+		return nil, nil
+	})
+}
+
+func (b *backend) snapshotDelete(ctx context.Context, call *rpc.Call) (interface{}, error) {
+	var params snapshotDeleteParams
+	if err := call.Bind(&params); err != nil {
+		return nil, err
+	}
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+
+	return b.withClient(func(esxiClient *client.ESXiClient) (interface{}, error) {
+		vmObj, ref, err := findSnapshot(ctx, esxiClient, params.snapshotParams)
+		if err != nil {
+			return nil, err
+		}
+		if err := vm.NewOperations(esxiClient).RemoveSnapshot(ctx, vmObj, ref, params.Children); err != nil {
+			return nil, fmt.Errorf("failed to delete snapshot: %w", err)
+		}
+		return nil, nil
+	})
+}
+
+type backupIDParams struct {
+	ID string `json:"id"`
+}
+
+func (p *backupIDParams) bind(call *rpc.Call) error {
+	if err := call.Bind(p); err != nil {
+		return err
+	}
+	if p.ID == "" {
+		return rpc.InvalidParams(fmt.Errorf("id is required"))
+	}
+	return nil
+}
+
+type backupListParams struct {
+	VM string `json:"vm"` // Empty lists the backups of every VM
+}
+
+func (b *backend) backupList(ctx context.Context, call *rpc.Call) (interface{}, error) {
+	var params backupListParams
+	if err := call.Bind(&params); err != nil {
+		return nil, err
+	}
+
+	return b.withManager(func(esxiClient *client.ESXiClient, manager *backup.BackupManager) (interface{}, error) {
+		backups, err := manager.ListBackups(params.VM)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list backups: %w", err)
+		}
+		return backups, nil
+	})
+}
+
+func (b *backend) backupInfo(ctx context.Context, call *rpc.Call) (interface{}, error) {
+	var params backupIDParams
+	if err := params.bind(call); err != nil {
+		return nil, err
+	}
+
+	return b.withManager(func(esxiClient *client.ESXiClient, manager *backup.BackupManager) (interface{}, error) {
+		return manager.GetBackup(params.ID)
+	})
+}
+
+type backupHistoryParams struct {
+	Job   string `json:"job"` // Empty returns the runs of every job
+	Limit int    `json:"limit"`
+}
+
+func (b *backend) backupHistory(ctx context.Context, call *rpc.Call) (interface{}, error) {
+	params := backupHistoryParams{Limit: 20}
+	if err := call.Bind(&params); err != nil {
+		return nil, err
+	}
+
+	return b.withManager(func(esxiClient *client.ESXiClient, manager *backup.BackupManager) (interface{}, error) {
+		runs, err := manager.ListJobRuns(params.Job, params.Limit)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list job runs: %w", err)
+		}
+		return runs, nil
+	})
+}
+
+type backupCreateParams struct {
+	VM          string `json:"vm"`
+	PowerOff    bool   `json:"power_off"`
+	Hot         bool   `json:"hot"`
+	Compress    *bool  `json:"compress"` // Default true
+	Compression string `json:"compression"`
+	Incremental bool   `json:"incremental"`
+	Target      string `json:"target"`
+	Description string `json:"description"`
+	SkipHooks   bool   `json:"skip_hooks"`
+
+	// Days the backup is locked against deletion; default backup.immutable_days
+	ImmutableDays *int `json:"immutable_days"`
+}
+
+func (b *backend) backupCreate(ctx context.Context, call *rpc.Call) (interface{}, error) {
+	var params backupCreateParams
+	if err := call.Bind(&params); err != nil {
+		return nil, err
+	}
+	if params.VM == "" {
+		return nil, rpc.InvalidParams(fmt.Errorf("vm is required"))
+	}
+	if params.Hot && params.PowerOff {
+		return nil, rpc.InvalidParams(fmt.Errorf("cannot use both hot and power_off"))
+	}
+
+	return b.track(ctx, call, "backup.create", params.VM, func(ctx context.Context, progress backup.ProgressFunc) (interface{}, error) {
+		return b.withManager(func(esxiClient *client.ESXiClient, manager *backup.BackupManager) (interface{}, error) {
+			opts := backup.BackupOptions{
+				VMName:      params.VM,
+				PowerOff:    params.PowerOff,
+				Hot:         params.Hot,
+				Compress:    params.Compress == nil || *params.Compress,
+				Compression: params.Compression,
+				Incremental: params.Incremental,
+				Description: params.Description,
+				Progress:    progress,
+				RetainUntil: backupcli.RetainUntil(b.cfg.Backup.ImmutableDays),
+			}
+			if params.ImmutableDays != nil {
+				opts.RetainUntil = backupcli.RetainUntil(*params.ImmutableDays)
+			}
+
+			var err error
+			opts.Target, err = backupcli.NewTarget(params.Target, b.cfg, esxiClient)
+			if err != nil {
+				return nil, err
+			}
+			if !params.SkipHooks {
+				opts.Hooks, err = backupcli.BackupHooks(params.VM, b.cfg, esxiClient)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			info, err := manager.CreateBackup(ctx, opts)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create backup: %w", err)
+			}
+			return info, nil
+		})
+	})
+}
+
+type backupRestoreParams struct {
+	ID           string `json:"id"`
+	AsNew        string `json:"as_new"`
+	InPlace      bool   `json:"in_place"`
+	KeepOriginal bool   `json:"keep_original"`
+	PowerOn      bool   `json:"power_on"`
+	networkParams
+}
+
+func (b *backend) backupRestore(ctx context.Context, call *rpc.Call) (interface{}, error) {
+	var params backupRestoreParams
+	if err := call.Bind(&params); err != nil {
+		return nil, err
+	}
+	if params.ID == "" {
+		return nil, rpc.InvalidParams(fmt.Errorf("id is required"))
+	}
+	if (params.AsNew == "") == !params.InPlace {
+		return nil, rpc.InvalidParams(fmt.Errorf("exactly one of as_new and in_place is required"))
+	}
+	if params.KeepOriginal && !params.InPlace {
+		return nil, rpc.InvalidParams(fmt.Errorf("keep_original requires in_place"))
+	}
+
+	return b.track(ctx, call, "backup.restore", params.ID, func(ctx context.Context, progress backup.ProgressFunc) (interface{}, error) {
+		return b.withManager(func(esxiClient *client.ESXiClient, manager *backup.BackupManager) (interface{}, error) {
+			info, err := manager.GetBackup(params.ID)
+			if err != nil {
+				return nil, err
+			}
+
+			opts := backup.RestoreOptions{
+				BackupID:     params.ID,
+				NewName:      params.AsNew,
+				PowerOn:      params.PowerOn,
+				InPlace:      params.InPlace,
+				KeepOriginal: params.KeepOriginal,
+				IdentityFile: b.cfg.Backup.Encryption.IdentityFile,
+				Progress:     progress,
+			}
+			opts.Target, err = backupcli.LocationResolver(b.cfg, esxiClient)(info.Location)
+			if err != nil {
+				return nil, err
+			}
+
+			vmName := params.AsNew
+			if params.InPlace {
+				vmName = info.VMName
+			}
+			if params.IP != "" {
+				if opts.Guestinfo, err = params.guestinfo(vmName); err != nil {
+					return nil, err
+				}
+			}
+
+			if err := manager.RestoreBackup(ctx, opts); err != nil {
+				return nil, fmt.Errorf("failed to restore backup: %w", err)
+			}
+			return vm.NewOperations(esxiClient).GetVMInfo(ctx, vmName)
+		})
+	})
+}
+
+func (b *backend) backupVerify(ctx context.Context, call *rpc.Call) (interface{}, error) {
+	var params backupIDParams
+	if err := params.bind(call); err != nil {
+		return nil, err
+	}
+
+	return b.withManager(func(esxiClient *client.ESXiClient, manager *backup.BackupManager) (interface{}, error) {
+		info, err := manager.GetBackup(params.ID)
+		if err != nil {
+			return nil, err
+		}
+		target, err := backupcli.LocationResolver(b.cfg, esxiClient)(info.Location)
+		if err != nil {
+			return nil, err
+		}
+
+		// A failed verification is a result, not an RPC error
+		result, err := manager.VerifyBackup(ctx, backup.VerifyOptions{
+			BackupID:     params.ID,
+			Target:       target,
+			IdentityFile: b.cfg.Backup.Encryption.IdentityFile,
+		})
+		if result != nil {
+			return result, nil
+		}
+		return nil, err
+	})
+}
+
+type backupDrillParams struct {
+	ID        string `json:"id"`
+	VM        string `json:"vm"`      // Drill the newest backup of this VM instead of id
+	Network   string `json:"network"` // Default backup.drill.network
+	Timeout   int    `json:"timeout"` // Seconds; default backup.drill.timeout
+	WaitIP    bool   `json:"wait_ip"`
+	ProbePort int    `json:"probe_port"`
+}
+
+func (b *backend) backupDrill(ctx context.Context, call *rpc.Call) (interface{}, error) {
+	var params backupDrillParams
+	if err := call.Bind(&params); err != nil {
+		return nil, err
+	}
+	if (params.ID == "") == (params.VM == "") {
+		return nil, rpc.InvalidParams(fmt.Errorf("either id or vm is required"))
+	}
+
+	opts := backupcli.DrillOptions(&config.DrillConfig{
+		Network:   params.Network,
+		Timeout:   params.Timeout,
+		WaitIP:    params.WaitIP,
+		ProbePort: params.ProbePort,
+	}, b.cfg)
+	if opts.Network == "" {
+		return nil, rpc.InvalidParams(fmt.Errorf("network is required unless backup.drill.network is set"))
+	}
+	opts.BackupID = params.ID
+	opts.VMName = params.VM
+	opts.IdentityFile = b.cfg.Backup.Encryption.IdentityFile
+
+	return b.track(ctx, call, "backup.drill", params.ID+params.VM, func(ctx context.Context, progress backup.ProgressFunc) (interface{}, error) {
+		return b.withManager(func(esxiClient *client.ESXiClient, manager *backup.BackupManager) (interface{}, error) {
+			opts.Progress = progress
+
+			// A failed drill is a result, not an RPC error
+			result, err := manager.DrillBackup(ctx, opts)
+			if result != nil {
+				return result, nil
+			}
+			return nil, err
+		})
+	})
+}
+
+type backupReplicateParams struct {
+	ID string `json:"id"`
+	To string `json:"to"` // Target name, as for backup.create
+}
+
+func (b *backend) backupReplicate(ctx context.Context, call *rpc.Call) (interface{}, error) {
+	var params backupReplicateParams
+	if err := call.Bind(&params); err != nil {
+		return nil, err
+	}
+	if params.ID == "" || params.To == "" {
+		return nil, rpc.InvalidParams(fmt.Errorf("id and to are required"))
+	}
+
+	return b.track(ctx, call, "backup.replicate", params.ID, func(ctx context.Context, progress backup.ProgressFunc) (interface{}, error) {
+		return b.withManager(func(esxiClient *client.ESXiClient, manager *backup.BackupManager) (interface{}, error) {
+			target, err := backupcli.NewTarget(params.To, b.cfg, esxiClient)
+			if err != nil {
+				return nil, err
+			}
+
+			replica, err := manager.ReplicateBackup(ctx, backup.ReplicateOptions{
+				BackupID: params.ID,
+				Target:   target,
+				Progress: progress,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to replicate backup: %w", err)
+			}
+			return replica, nil
+		})
+	})
+}
+
+type backupHoldParams struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason"`
+}
+
+func (b *backend) backupHold(ctx context.Context, call *rpc.Call) (interface{}, error) {
+	var params backupHoldParams
+	if err := call.Bind(&params); err != nil {
+		return nil, err
+	}
+	if params.ID == "" {
+		return nil, rpc.InvalidParams(fmt.Errorf("id is required"))
+	}
+
+	return b.withManager(func(esxiClient *client.ESXiClient, manager *backup.BackupManager) (interface{}, error) {
+		if err := manager.HoldBackup(ctx, params.ID, params.Reason); err != nil {
+			return nil, fmt.Errorf("failed to hold backup: %w", err)
+		}
+		return manager.GetBackup(params.ID)
+	})
+}
+
+func (b *backend) backupRelease(ctx context.Context, call *rpc.Call) (interface{}, error) {
+	var params backupIDParams
+	if err := params.bind(call); err != nil {
+		return nil, err
+	}
+
+	return b.withManager(func(esxiClient *client.ESXiClient, manager *backup.BackupManager) (interface{}, error) {
+		if err := manager.ReleaseBackup(ctx, params.ID); err != nil {
+			return nil, fmt.Errorf("failed to release hold: %w", err)
+		}
+		return manager.GetBackup(params.ID)
+	})
+}
+
+func (b *backend) backupDelete(ctx context.Context, call *rpc.Call) (interface{}, error) {
+	var params backupIDParams
+	if err := params.bind(call); err != nil {
+		return nil, err
+	}
+
+	return b.withManager(func(esxiClient *client.ESXiClient, manager *backup.BackupManager) (interface{}, error) {
+		if err := manager.DeleteBackup(ctx, params.ID); err != nil {
+			return nil, fmt.Errorf("failed to delete backup: %w", err)
+		}
+		return nil, nil
+	})
+}
+
+type backupPruneParams struct {
+	VM          string `json:"vm"`
+	KeepLast    int    `json:"keep_last"`
+	KeepDays    int    `json:"keep_days"`
+	KeepDaily   int    `json:"keep_daily"`
+	KeepWeekly  int    `json:"keep_weekly"`
+	KeepMonthly int    `json:"keep_monthly"`
+	Timezone    string `json:"timezone"`
+	DryRun      bool   `json:"dry_run"`
+}
+
+func (b *backend) backupPrune(ctx context.Context, call *rpc.Call) (interface{}, error) {
+	var params backupPruneParams
+	if err := call.Bind(&params); err != nil {
+		return nil, err
+	}
+	// An empty policy would keep nothing
+	if params.KeepLast+params.KeepDays+params.KeepDaily+params.KeepWeekly+params.KeepMonthly == 0 {
+		return nil, rpc.InvalidParams(fmt.Errorf("at least one keep_* rule is required"))
+	}
+
+	return b.withManager(func(esxiClient *client.ESXiClient, manager *backup.BackupManager) (interface{}, error) {
+		return manager.PruneBackups(ctx, backup.PruneOptions{
+			VMName:      params.VM,
+			KeepLast:    params.KeepLast,
+			KeepDays:    params.KeepDays,
+			KeepDaily:   params.KeepDaily,
+			KeepWeekly:  params.KeepWeekly,
+			KeepMonthly: params.KeepMonthly,
+			Timezone:    params.Timezone,
+			DryRun:      params.DryRun,
+		})
+	})
+}
+
+type pciDeviceParams struct {
+	ID string `json:"id"` // e.g. 0000:81:00.0
+}
+
+func (p *pciDeviceParams) bind(call *rpc.Call) error {
+	if err := call.Bind(p); err != nil {
+		return err
+	}
+	if p.ID == "" {
+		return rpc.InvalidParams(fmt.Errorf("id is required"))
+	}
+	return nil
+}
+
+type pciListParams struct {
+	GPUs       bool `json:"gpus"`
+	Assignable bool `json:"assignable"`
+}
+
+func (b *backend) pciList(ctx context.Context, call *rpc.Call) (interface{}, error) {
+	var params pciListParams
+	if err := call.Bind(&params); err != nil {
+		return nil, err
+	}
+
+	return b.withClient(func(esxiClient *client.ESXiClient) (interface{}, error) {
+		discovery := pci.NewDiscovery(esxiClient)
+		switch {
+		case params.GPUs:
+			return discovery.ListGPUs(ctx)
+		case params.Assignable:
+			return discovery.ListAssignableDevices(ctx)
+		default:
+			return discovery.ListDevices(ctx)
+		}
+	})
+}
+
+func (b *backend) pciInfo(ctx context.Context, call *rpc.Call) (interface{}, error) {
+	var params pciDeviceParams
+	if err := params.bind(call); err != nil {
+		return nil, err
+	}
+
+	return b.withClient(func(esxiClient *client.ESXiClient) (interface{}, error) {
+		return pci.NewDiscovery(esxiClient).GetDevice(ctx, params.ID)
+	})
+}
+
+func (b *backend) pciEnable(ctx context.Context, call *rpc.Call) (interface{}, error) {
+	var params pciDeviceParams
+	if err := params.bind(call); err != nil {
+		return nil, err
+	}
+
+	return b.withClient(func(esxiClient *client.ESXiClient) (interface{}, error) {
+		if err := pci.NewDiscovery(esxiClient).EnablePassthrough(ctx, params.ID); err != nil {
+			return nil, fmt.Errorf("failed to enable passthrough: %w", err)
+		}
+		return nil, nil
+	})
+}
+
+func (b *backend) pciDisable(ctx context.Context, call *rpc.Call) (interface{}, error) {
+	var params pciDeviceParams
+	if err := params.bind(call); err != nil {
+		return nil, err
+	}
+
+	return b.withClient(func(esxiClient *client.ESXiClient) (interface{}, error) {
+		if err := pci.NewDiscovery(esxiClient).DisablePassthrough(ctx, params.ID); err != nil {
+			return nil, fmt.Errorf("failed to disable passthrough: %w", err)
+		}
+		return nil, nil
+	})
+}
+
+func (b *backend) hostInfo(ctx context.Context, call *rpc.Call) (interface{}, error) {
+	return b.withClient(func(esxiClient *client.ESXiClient) (interface{}, error) {
+		return host.GetInfo(ctx, esxiClient)
+	})
+}
+
+func (b *backend) hostStats(ctx context.Context, call *rpc.Call) (interface{}, error) {
+	return b.withClient(func(esxiClient *client.ESXiClient) (interface{}, error) {
+		return host.GetStats(ctx, esxiClient)
+	})
+}
+
+func (b *backend) hostHealth(ctx context.Context, call *rpc.Call) (interface{}, error) {
+	return b.withClient(func(esxiClient *client.ESXiClient) (interface{}, error) {
+		return host.GetHealth(ctx, esxiClient)
+	})
+}
@@ -28,13 +28,101 @@ type BackupEntry struct {
 	Type        string            `json:"type"` // cold, hot, snapshot
 	Status      string            `json:"status"` // pending, completed, failed
 	Metadata    map[string]string `json:"metadata"`
+
+	// Backup this incremental backup was taken against; empty for full backups
+	ParentID string `json:"parent_id,omitempty"`
+
+	// Result of the most recent end-to-end verification
+	LastVerified *time.Time `json:"last_verified,omitempty"`
+	VerifyStatus string     `json:"verify_status,omitempty"` // passed, failed
+	VerifyError  string     `json:"verify_error,omitempty"`
+
+	// Guest hook commands run around the backup snapshot, in order
+	Hooks []HookRun `json:"hooks,omitempty"`
+
+	// Verified copies of the artifact on other targets, in the order made
+	Replicas []Replica `json:"replicas,omitempty"`
+
+	// Write-once lock applied by the target; the artifact cannot be deleted
+	// before this time
+	RetainUntil *time.Time `json:"retain_until,omitempty"`
+
+	// Legal hold; a held backup is never deleted until the hold is released
+	Hold *LegalHold `json:"hold,omitempty"`
+
+	// Result of the most recent restore drill
+	LastDrill *DrillRecord `json:"last_drill,omitempty"`
+}
+
+// DrillRecord records a restore drill: the backup was restored into an
+// isolated network, booted and checked, and the drill VM destroyed
+type DrillRecord struct {
+	Started time.Time `json:"started"`
+	Passed  bool      `json:"passed"`
+	Error   string    `json:"error,omitempty"`
+	DrillVM string    `json:"drill_vm"`
+	GuestIP string    `json:"guest_ip,omitempty"`
+
+	// Time taken by each step; zero for steps not reached or not run
+	Restore   time.Duration `json:"restore"`
+	Heartbeat time.Duration `json:"heartbeat"`       // Power on to a green VMware Tools heartbeat
+	Probe     time.Duration `json:"probe,omitempty"` // Heartbeat to guest IP and TCP probe
+	Duration  time.Duration `json:"duration"`
+}
+
+// LegalHold records why and since when a backup is held
+type LegalHold struct {
+	Reason string    `json:"reason,omitempty"`
+	Since  time.Time `json:"since"`
+}
+
+// Protected returns why the backup must not be deleted at now, or an empty
+// string if it may be
+func (e *BackupEntry) Protected(now time.Time) string {
+	if e.Hold != nil {
+		return "legal hold"
+	}
+	if e.RetainUntil != nil && now.Before(*e.RetainUntil) {
+		return "immutable until " + e.RetainUntil.Format(time.RFC3339)
+	}
+	return ""
+}
+
+// Supersedes reports whether the backup is a synthetic full consolidated
+// from other, which it shares its timestamp with
+func (e *BackupEntry) Supersedes(other *BackupEntry) bool {
+	return e.Metadata["consolidated_from"] == other.ID
+}
+
+// Replica records a copy of a backup artifact stored on another target
+type Replica struct {
+	Location string    `json:"location"`
+	Created  time.Time `json:"created"`
+}
+
+// HookRun records one backup hook command and its output
+type HookRun struct {
+	Phase    string        `json:"phase"` // pre_freeze, post_thaw
+	Command  string        `json:"command"`
+	Output   string        `json:"output,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration"`
 }
 
 type RetentionPolicy struct {
-	KeepLast    int `json:"keep_last"`
-	KeepDaily   int `json:"keep_daily"`
-	KeepWeekly  int `json:"keep_weekly"`
-	KeepMonthly int `json:"keep_monthly"`
+	KeepLast       int    `json:"keep_last"`
+	KeepWithinDays int    `json:"keep_within_days"`
+	KeepDaily      int    `json:"keep_daily"`
+	KeepWeekly     int    `json:"keep_weekly"`
+	KeepMonthly    int    `json:"keep_monthly"`
+	Timezone       string `json:"timezone"` // IANA name used for day/week/month boundaries; empty means local time
+}
+
+// Empty reports whether the policy has no keep rule, so it would keep no
+// backup at all
+func (p RetentionPolicy) Empty() bool {
+	return p.KeepLast+p.KeepWithinDays+p.KeepDaily+p.KeepWeekly+p.KeepMonthly == 0
 }
 
 // InitCatalog creates or opens a backup catalog database
@@ -60,6 +148,9 @@ func InitCatalog(path string) (*BackupCatalog, error) {
 		if _, err := tx.CreateBucketIfNotExists([]byte(vmIndexBucket)); err != nil {
 			return fmt.Errorf("failed to create VM index bucket: %w", err)
 		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(jobRunBucket)); err != nil {
+			return fmt.Errorf("failed to create job run bucket: %w", err)
+		}
 		return nil
 	})
 	if err != nil {
@@ -107,8 +198,14 @@ func (c *BackupCatalog) AddBackup(entry *BackupEntry) error {
 			}
 		}
 		
+		// Entries are re-added on status changes; index each ID only once
+		for _, id := range backupIDs {
+			if id == entry.ID {
+				return nil
+			}
+		}
 		backupIDs = append(backupIDs, entry.ID)
-		
+
 		indexData, err := json.Marshal(backupIDs)
 		if err != nil {
 			return fmt.Errorf("failed to marshal VM index: %w", err)
@@ -205,6 +302,9 @@ func (c *BackupCatalog) DeleteBackup(id string) error {
 		if err := json.Unmarshal(data, &entry); err != nil {
 			return fmt.Errorf("failed to unmarshal backup entry: %w", err)
 		}
+		if reason := entry.Protected(time.Now()); reason != "" {
+			return fmt.Errorf("backup %s cannot be deleted: %s", id, reason)
+		}
 
 		// Remove from VM index
 		vmBucket := tx.Bucket([]byte(vmIndexBucket))
@@ -249,70 +349,99 @@ func (c *BackupCatalog) DeleteBackup(id string) error {
 	})
 }
 
-// ApplyRetention applies retention policy to backups
+// ApplyRetention removes the catalog entries a retention policy does not
+// keep. It does not touch stored artifacts; BackupManager.ApplyRetentionPolicy
+// uses the same plan and deletes the artifacts as well.
 func (c *BackupCatalog) ApplyRetention(policy RetentionPolicy) error {
-	// Group backups by VM
 	allBackups, err := c.ListBackups("")
 	if err != nil {
 		return fmt.Errorf("failed to list backups: %w", err)
 	}
 
-	vmBackups := make(map[string][]*BackupEntry)
-	for _, backup := range allBackups {
-		vmBackups[backup.VMName] = append(vmBackups[backup.VMName], backup)
+	plan, err := PlanRetention(allBackups, policy, time.Now())
+	if err != nil {
+		return err
 	}
 
-	// Apply retention per VM
-	for _, backups := range vmBackups {
-		toDelete := c.identifyBackupsToDelete(backups, policy)
-		for _, backup := range toDelete {
-			if err := c.DeleteBackup(backup.ID); err != nil {
-				return fmt.Errorf("failed to delete backup %s: %w", backup.ID, err)
-			}
+	for _, decision := range plan {
+		if decision.Keep {
+			continue
+		}
+		if err := c.DeleteBackup(decision.Entry.ID); err != nil {
+			return fmt.Errorf("failed to delete backup %s: %w", decision.Entry.ID, err)
 		}
 	}
 
 	return nil
 }
 
-// identifyBackupsToDelete determines which backups should be deleted based on retention policy
-func (c *BackupCatalog) identifyBackupsToDelete(backups []*BackupEntry, policy RetentionPolicy) []*BackupEntry {
-	if len(backups) == 0 {
+// UpdateBackupStatus updates the status of a backup entry
+func (c *BackupCatalog) UpdateBackupStatus(id string, status string) error {
+	return c.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(backupBucket))
+		data := bucket.Get([]byte(id))
+		if data == nil {
+			return fmt.Errorf("backup not found: %s", id)
+		}
+
+		var entry BackupEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return fmt.Errorf("failed to unmarshal backup entry: %w", err)
+		}
+
+		entry.Status = status
+
+		updatedData, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("failed to marshal updated entry: %w", err)
+		}
+
+		if err := bucket.Put([]byte(id), updatedData); err != nil {
+			return fmt.Errorf("failed to update backup entry: %w", err)
+		}
+
 		return nil
-	}
+	})
+}
 
-	// Sort backups by timestamp (newest first)
-	// Implementation would include sorting logic
+// RecordVerification stores the outcome of verifying a backup
+func (c *BackupCatalog) RecordVerification(id string, verifiedAt time.Time, verifyErr error) error {
+	return c.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(backupBucket))
+		data := bucket.Get([]byte(id))
+		if data == nil {
+			return fmt.Errorf("backup not found: %s", id)
+		}
 
-	var toKeep = make(map[string]bool)
-	var toDelete []*BackupEntry
+		var entry BackupEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return fmt.Errorf("failed to unmarshal backup entry: %w", err)
+		}
 
-	// Keep last N backups
-	count := 0
-	for _, backup := range backups {
-		if count < policy.KeepLast {
-			toKeep[backup.ID] = true
-			count++
+		entry.LastVerified = &verifiedAt
+		entry.VerifyStatus = "passed"
+		entry.VerifyError = ""
+		if verifyErr != nil {
+			entry.VerifyStatus = "failed"
+			entry.VerifyError = verifyErr.Error()
 		}
-	}
 
-	// Keep daily backups (one per day for N days)
-	// Keep weekly backups (one per week for N weeks)
-	// Keep monthly backups (one per month for N months)
-	// Implementation would include date-based grouping logic
+		updatedData, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("failed to marshal updated entry: %w", err)
+		}
 
-	// Mark non-kept backups for deletion
-	for _, backup := range backups {
-		if !toKeep[backup.ID] {
-			toDelete = append(toDelete, backup)
+		if err := bucket.Put([]byte(id), updatedData); err != nil {
+			return fmt.Errorf("failed to update backup entry: %w", err)
 		}
-	}
 
-	return toDelete
+		return nil
+	})
 }
 
-// UpdateBackupStatus updates the status of a backup entry
-func (c *BackupCatalog) UpdateBackupStatus(id string, status string) error {
+// AddReplica records a copy of a backup, replacing any earlier copy at the
+// same location
+func (c *BackupCatalog) AddReplica(id string, replica Replica) error {
 	return c.db.Update(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket([]byte(backupBucket))
 		data := bucket.Get([]byte(id))
@@ -325,7 +454,71 @@ func (c *BackupCatalog) UpdateBackupStatus(id string, status string) error {
 			return fmt.Errorf("failed to unmarshal backup entry: %w", err)
 		}
 
-		entry.Status = status
+		replicas := []Replica{}
+		for _, existing := range entry.Replicas {
+			if existing.Location != replica.Location {
+				replicas = append(replicas, existing)
+			}
+		}
+		entry.Replicas = append(replicas, replica)
+
+		updatedData, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("failed to marshal updated entry: %w", err)
+		}
+
+		if err := bucket.Put([]byte(id), updatedData); err != nil {
+			return fmt.Errorf("failed to update backup entry: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// SetHold places a legal hold on a backup, or releases it if hold is nil
+func (c *BackupCatalog) SetHold(id string, hold *LegalHold) error {
+	return c.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(backupBucket))
+		data := bucket.Get([]byte(id))
+		if data == nil {
+			return fmt.Errorf("backup not found: %s", id)
+		}
+
+		var entry BackupEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return fmt.Errorf("failed to unmarshal backup entry: %w", err)
+		}
+
+		entry.Hold = hold
+
+		updatedData, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("failed to marshal updated entry: %w", err)
+		}
+
+		if err := bucket.Put([]byte(id), updatedData); err != nil {
+			return fmt.Errorf("failed to update backup entry: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// RecordDrill stores the outcome of a restore drill of a backup
+func (c *BackupCatalog) RecordDrill(id string, record *DrillRecord) error {
+	return c.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(backupBucket))
+		data := bucket.Get([]byte(id))
+		if data == nil {
+			return fmt.Errorf("backup not found: %s", id)
+		}
+
+		var entry BackupEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return fmt.Errorf("failed to unmarshal backup entry: %w", err)
+		}
+
+		entry.LastDrill = record
 
 		updatedData, err := json.Marshal(entry)
 		if err != nil {
@@ -354,10 +547,54 @@ func (c *BackupCatalog) GetLatestBackup(vmName string) (*BackupEntry, error) {
 	// Find the most recent backup
 	var latest *BackupEntry
 	for _, backup := range backups {
-		if latest == nil || backup.Timestamp.After(latest.Timestamp) {
+		if latest == nil || backup.Timestamp.After(latest.Timestamp) || backup.Supersedes(latest) {
 			latest = backup
 		}
 	}
 
 	return latest, nil
-}
\ No newline at end of file
+}
+
+// ListChildren returns the backups taken directly against a backup
+func (c *BackupCatalog) ListChildren(id string) ([]*BackupEntry, error) {
+	parent, err := c.GetBackup(id)
+	if err != nil {
+		return nil, err
+	}
+
+	backups, err := c.ListBackups(parent.VMName)
+	if err != nil {
+		return nil, err
+	}
+
+	var children []*BackupEntry
+	for _, backup := range backups {
+		if backup.ParentID == id {
+			children = append(children, backup)
+		}
+	}
+	return children, nil
+}
+
+// GetChain returns the backups needed to restore a backup, starting with
+// the full backup its incremental chain is based on
+func (c *BackupCatalog) GetChain(id string) ([]*BackupEntry, error) {
+	var chain []*BackupEntry
+	seen := make(map[string]bool)
+
+	for id != "" {
+		if seen[id] {
+			return nil, fmt.Errorf("backup chain contains a cycle at %s", id)
+		}
+		seen[id] = true
+
+		entry, err := c.GetBackup(id)
+		if err != nil {
+			return nil, fmt.Errorf("backup chain is broken: %w", err)
+		}
+		chain = append([]*BackupEntry{entry}, chain...)
+		id = entry.ParentID
+	}
+
+	return chain, nil
+}
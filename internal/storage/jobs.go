@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+const jobRunBucket = "job_runs"
+
+// JobRun records one run of a scheduled backup job
+type JobRun struct {
+	ID        string        `json:"id"`
+	Job       string        `json:"job"`
+	Scheduled time.Time     `json:"scheduled"` // When the schedule fired
+	Started   time.Time     `json:"started"`
+	Finished  time.Time     `json:"finished"`
+	Status    string        `json:"status"` // completed, failed, skipped
+	Error     string        `json:"error,omitempty"`
+	VMs       []JobVMResult `json:"vms,omitempty"`
+}
+
+// JobVMResult is the outcome of backing up one VM in a job run
+type JobVMResult struct {
+	VMName   string `json:"vm_name"`
+	BackupID string `json:"backup_id,omitempty"`
+	Status   string `json:"status"` // completed, failed
+	Error    string `json:"error,omitempty"`
+	Pruned   int    `json:"pruned,omitempty"` // Backups removed by the job's retention
+
+	// Locations of the copies made for the job's copy_to targets
+	Replicas []string `json:"replicas,omitempty"`
+}
+
+// AddJobRun stores a job run, replacing any earlier record with its ID
+func (c *BackupCatalog) AddJobRun(run *JobRun) error {
+	if run.ID == "" {
+		return fmt.Errorf("job run ID cannot be empty")
+	}
+
+	return c.db.Update(func(tx *bbolt.Tx) error {
+		data, err := json.Marshal(run)
+		if err != nil {
+			return fmt.Errorf("failed to marshal job run: %w", err)
+		}
+		if err := tx.Bucket([]byte(jobRunBucket)).Put([]byte(run.ID), data); err != nil {
+			return fmt.Errorf("failed to store job run: %w", err)
+		}
+		return nil
+	})
+}
+
+// ListJobRuns returns the runs of a job, or of all jobs when job is empty,
+// newest first; limit caps the number returned unless it is zero
+func (c *BackupCatalog) ListJobRuns(job string, limit int) ([]*JobRun, error) {
+	var runs []*JobRun
+
+	err := c.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(jobRunBucket)).ForEach(func(k, v []byte) error {
+			run := &JobRun{}
+			if err := json.Unmarshal(v, run); err != nil {
+				return fmt.Errorf("failed to unmarshal job run: %w", err)
+			}
+			if job == "" || run.Job == job {
+				runs = append(runs, run)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].Started.After(runs[j].Started)
+	})
+	if limit > 0 && len(runs) > limit {
+		runs = runs[:limit]
+	}
+	return runs, nil
+}
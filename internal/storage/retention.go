@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+var errEmptyRetention = errors.New("retention policy has no keep rule and would delete every backup")
+
+// RetentionDecision records whether a backup is kept and which rules keep it
+type RetentionDecision struct {
+	Entry   *BackupEntry `json:"backup"`
+	Keep    bool         `json:"keep"`
+	Reasons []string     `json:"reasons"`
+}
+
+// PlanRetention decides which backups a policy keeps. Each VM is planned
+// separately. KeepDaily, KeepWeekly and KeepMonthly keep the newest backup
+// of each of the N most recent calendar days, ISO weeks and months that have
+// a backup, in the policy's timezone; a backup is kept if any rule keeps it.
+// Only completed backups count towards the rules. Pending backups, backups
+// under legal hold or still immutable, and the parents of kept incremental
+// backups are always kept, and backups already being deleted are left out
+// of the plan. An empty policy is refused rather than deleting everything.
+func PlanRetention(backups []*BackupEntry, policy RetentionPolicy, now time.Time) ([]RetentionDecision, error) {
+	if policy.Empty() {
+		return nil, errEmptyRetention
+	}
+
+	loc := time.Local
+	if policy.Timezone != "" {
+		var err error
+		loc, err = time.LoadLocation(policy.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid retention timezone %q: %w", policy.Timezone, err)
+		}
+	}
+
+	byVM := make(map[string][]*BackupEntry)
+	var vms []string
+	for _, backup := range backups {
+		if backup.Status == "deleting" {
+			continue
+		}
+		if _, ok := byVM[backup.VMName]; !ok {
+			vms = append(vms, backup.VMName)
+		}
+		byVM[backup.VMName] = append(byVM[backup.VMName], backup)
+	}
+	sort.Strings(vms)
+
+	var plan []RetentionDecision
+	for _, vm := range vms {
+		plan = append(plan, planVM(byVM[vm], policy, now, loc)...)
+	}
+	return plan, nil
+}
+
+// planVM applies the policy to the backups of one VM, newest first
+func planVM(backups []*BackupEntry, policy RetentionPolicy, now time.Time, loc *time.Location) []RetentionDecision {
+	sort.SliceStable(backups, func(i, j int) bool {
+		if backups[i].Timestamp.Equal(backups[j].Timestamp) {
+			return backups[i].Supersedes(backups[j])
+		}
+		return backups[i].Timestamp.After(backups[j].Timestamp)
+	})
+
+	decisions := make([]RetentionDecision, len(backups))
+	for i, backup := range backups {
+		decisions[i].Entry = backup
+	}
+
+	keep := func(i int, reason string) {
+		decisions[i].Keep = true
+		decisions[i].Reasons = append(decisions[i].Reasons, reason)
+	}
+
+	// bucket keeps the newest backup in each of the first n periods
+	bucket := func(n int, rule string, period func(time.Time) string) {
+		seen := make(map[string]bool)
+		for i, backup := range backups {
+			if len(seen) >= n {
+				return
+			}
+			if backup.Status != "completed" {
+				continue
+			}
+			key := period(backup.Timestamp.In(loc))
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			keep(i, fmt.Sprintf("%s %s", rule, key))
+		}
+	}
+
+	last := 0
+	for i, backup := range backups {
+		switch backup.Status {
+		case "completed":
+			if last < policy.KeepLast {
+				last++
+				keep(i, fmt.Sprintf("last %d of %d", last, policy.KeepLast))
+			}
+		case "pending":
+			keep(i, "in progress")
+		}
+		if reason := backup.Protected(now); reason != "" {
+			keep(i, reason)
+		}
+	}
+
+	if policy.KeepWithinDays > 0 {
+		cutoff := now.AddDate(0, 0, -policy.KeepWithinDays)
+		for i, backup := range backups {
+			if backup.Status == "completed" && backup.Timestamp.After(cutoff) {
+				keep(i, fmt.Sprintf("within %d days", policy.KeepWithinDays))
+			}
+		}
+	}
+
+	bucket(policy.KeepDaily, "daily", func(t time.Time) string {
+		return t.Format("2006-01-02")
+	})
+	bucket(policy.KeepWeekly, "weekly", func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	})
+	bucket(policy.KeepMonthly, "monthly", func(t time.Time) string {
+		return t.Format("2006-01")
+	})
+
+	// Incremental backups cannot be restored without their parents
+	index := make(map[string]int, len(backups))
+	for i, backup := range backups {
+		index[backup.ID] = i
+	}
+	walked := make(map[string]bool)
+	for i := range decisions {
+		if !decisions[i].Keep {
+			continue
+		}
+		child := backups[i]
+		for !walked[child.ID] {
+			walked[child.ID] = true
+			parent, ok := index[child.ParentID]
+			if !ok {
+				break
+			}
+			keep(parent, "parent of "+child.ID)
+			child = backups[parent]
+		}
+	}
+
+	return decisions
+}
@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dailyBackups returns one completed backup per day at 23:30 UTC, newest
+// first, ending on end
+func dailyBackups(end time.Time, days int) []*BackupEntry {
+	var backups []*BackupEntry
+	for i := 0; i < days; i++ {
+		ts := end.AddDate(0, 0, -i)
+		backups = append(backups, &BackupEntry{
+			ID:        fmt.Sprintf("b-%s", ts.Format("2006-01-02")),
+			VMName:    "vm",
+			Timestamp: ts,
+			Status:    "completed",
+		})
+	}
+	return backups
+}
+
+func kept(plan []RetentionDecision) map[string][]string {
+	result := make(map[string][]string)
+	for _, decision := range plan {
+		if decision.Keep {
+			result[decision.Entry.ID] = decision.Reasons
+		}
+	}
+	return result
+}
+
+func TestPlanRetentionGFS(t *testing.T) {
+	// Sunday 2025-03-30 23:30 UTC; 90 days of daily backups
+	end := time.Date(2025, 3, 30, 23, 30, 0, 0, time.UTC)
+	backups := dailyBackups(end, 90)
+
+	plan, err := PlanRetention(backups, RetentionPolicy{
+		KeepLast:    2,
+		KeepDaily:   3,
+		KeepWeekly:  2,
+		KeepMonthly: 3,
+		Timezone:    "UTC",
+	}, end)
+	require.NoError(t, err)
+	require.Len(t, plan, 90)
+
+	keep := kept(plan)
+	assert.Equal(t, []string{"last 1 of 2", "daily 2025-03-30", "weekly 2025-W13", "monthly 2025-03"}, keep["b-2025-03-30"])
+	assert.Equal(t, []string{"last 2 of 2", "daily 2025-03-29"}, keep["b-2025-03-29"])
+	assert.Equal(t, []string{"daily 2025-03-28"}, keep["b-2025-03-28"])
+	// Newest backup of the previous ISO week (Mon 17 - Sun 23 March)
+	assert.Equal(t, []string{"weekly 2025-W12"}, keep["b-2025-03-23"])
+	// Newest backups of February and January
+	assert.Equal(t, []string{"monthly 2025-02"}, keep["b-2025-02-28"])
+	assert.Equal(t, []string{"monthly 2025-01"}, keep["b-2025-01-31"])
+	assert.Len(t, keep, 6)
+}
+
+func TestPlanRetentionUsesTimezone(t *testing.T) {
+	// 23:30 UTC is already the next day in Berlin, so the last backup of
+	// March in UTC belongs to April there
+	end := time.Date(2025, 3, 31, 23, 30, 0, 0, time.UTC)
+	backups := dailyBackups(end, 3)
+
+	plan, err := PlanRetention(backups, RetentionPolicy{KeepMonthly: 2, Timezone: "Europe/Berlin"}, end)
+	require.NoError(t, err)
+
+	keep := kept(plan)
+	assert.Equal(t, []string{"monthly 2025-04"}, keep["b-2025-03-31"])
+	assert.Equal(t, []string{"monthly 2025-03"}, keep["b-2025-03-30"])
+	assert.NotContains(t, keep, "b-2025-03-29")
+
+	_, err = PlanRetention(backups, RetentionPolicy{KeepMonthly: 2, Timezone: "Mars/Olympus"}, end)
+	assert.ErrorContains(t, err, "invalid retention timezone")
+}
+
+func TestPlanRetentionSkipsIncompleteBackups(t *testing.T) {
+	now := time.Now()
+	backups := []*BackupEntry{
+		{ID: "pending", VMName: "vm", Timestamp: now, Status: "pending"},
+		{ID: "failed", VMName: "vm", Timestamp: now.Add(-time.Hour), Status: "failed"},
+		{ID: "deleting", VMName: "vm", Timestamp: now.Add(-2 * time.Hour), Status: "deleting"},
+		{ID: "completed", VMName: "vm", Timestamp: now.Add(-3 * time.Hour), Status: "completed"},
+	}
+
+	plan, err := PlanRetention(backups, RetentionPolicy{KeepLast: 1}, now)
+	require.NoError(t, err)
+	require.Len(t, plan, 3, "backups being deleted are left out")
+
+	keep := kept(plan)
+	assert.Equal(t, []string{"in progress"}, keep["pending"])
+	assert.Equal(t, []string{"last 1 of 1"}, keep["completed"])
+	assert.NotContains(t, keep, "failed")
+}
+
+func TestPlanRetentionRefusesEmptyPolicy(t *testing.T) {
+	now := time.Now()
+	backups := []*BackupEntry{
+		{ID: "completed", VMName: "vm", Timestamp: now, Status: "completed"},
+	}
+
+	_, err := PlanRetention(backups, RetentionPolicy{Timezone: "UTC"}, now)
+	assert.ErrorContains(t, err, "no keep rule")
+
+	catalog, err := InitCatalog(filepath.Join(t.TempDir(), "catalog.db"))
+	require.NoError(t, err)
+	defer catalog.Close()
+	require.NoError(t, catalog.AddBackup(backups[0]))
+
+	assert.Error(t, catalog.ApplyRetention(RetentionPolicy{}))
+	_, err = catalog.GetBackup("completed")
+	assert.NoError(t, err, "an empty policy deletes nothing")
+}
+
+func TestPlanRetentionKeepsChainParents(t *testing.T) {
+	now := time.Now()
+	backups := []*BackupEntry{
+		{ID: "incr-2", VMName: "vm", Timestamp: now, Status: "completed", ParentID: "incr-1"},
+		{ID: "incr-1", VMName: "vm", Timestamp: now.Add(-time.Hour), Status: "completed", ParentID: "full"},
+		{ID: "full", VMName: "vm", Timestamp: now.Add(-2 * time.Hour), Status: "completed"},
+		{ID: "older", VMName: "vm", Timestamp: now.Add(-3 * time.Hour), Status: "completed"},
+	}
+
+	plan, err := PlanRetention(backups, RetentionPolicy{KeepLast: 1}, now)
+	require.NoError(t, err)
+
+	keep := kept(plan)
+	assert.Equal(t, []string{"last 1 of 1"}, keep["incr-2"])
+	assert.Equal(t, []string{"parent of incr-2"}, keep["incr-1"])
+	assert.Equal(t, []string{"parent of incr-1"}, keep["full"])
+	assert.NotContains(t, keep, "older")
+}
+
+func TestPlanRetentionPrefersSyntheticFull(t *testing.T) {
+	now := time.Now()
+	backups := []*BackupEntry{
+		{ID: "incr-1", VMName: "vm", Timestamp: now, Status: "completed", ParentID: "full"},
+		{ID: "synthetic", VMName: "vm", Timestamp: now, Status: "completed", Metadata: map[string]string{"consolidated_from": "incr-1"}},
+		{ID: "full", VMName: "vm", Timestamp: now.Add(-time.Hour), Status: "completed"},
+	}
+
+	// The synthetic full shares the timestamp of the backup it consolidates
+	plan, err := PlanRetention(backups, RetentionPolicy{KeepLast: 1}, now)
+	require.NoError(t, err)
+
+	keep := kept(plan)
+	assert.Equal(t, []string{"last 1 of 1"}, keep["synthetic"])
+	assert.NotContains(t, keep, "incr-1")
+	assert.NotContains(t, keep, "full")
+}
+
+func TestPlanRetentionKeepsProtectedBackups(t *testing.T) {
+	now := time.Now()
+	locked := now.Add(24 * time.Hour)
+	expired := now.Add(-time.Hour)
+	backups := []*BackupEntry{
+		{ID: "newest", VMName: "vm", Timestamp: now, Status: "completed"},
+		{ID: "held", VMName: "vm", Timestamp: now.Add(-time.Hour), Status: "completed", Hold: &LegalHold{Reason: "case 42", Since: now}},
+		{ID: "locked", VMName: "vm", Timestamp: now.Add(-2 * time.Hour), Status: "completed", RetainUntil: &locked},
+		{ID: "expired", VMName: "vm", Timestamp: now.Add(-3 * time.Hour), Status: "completed", RetainUntil: &expired},
+	}
+
+	plan, err := PlanRetention(backups, RetentionPolicy{KeepLast: 1}, now)
+	require.NoError(t, err)
+
+	keep := kept(plan)
+	assert.Equal(t, []string{"last 1 of 1"}, keep["newest"])
+	assert.Equal(t, []string{"legal hold"}, keep["held"])
+	assert.Equal(t, []string{"immutable until " + locked.Format(time.RFC3339)}, keep["locked"])
+	assert.NotContains(t, keep, "expired")
+}
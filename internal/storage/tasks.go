@@ -0,0 +1,239 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+const taskBucket = "tasks"
+
+// Task states. Running tasks whose process died are marked interrupted;
+// the others are final.
+const (
+	TaskRunning     = "running"
+	TaskSucceeded   = "succeeded"
+	TaskFailed      = "failed"
+	TaskCancelled   = "cancelled"
+	TaskInterrupted = "interrupted"
+)
+
+// TaskEntry is a long-running operation tracked across processes
+type TaskEntry struct {
+	ID      string  `json:"id"`
+	Kind    string  `json:"kind"`   // vm.create, vm.clone, backup.create, backup.restore
+	Target  string  `json:"target"` // VM name, or backup ID for restores
+	State   string  `json:"state"`
+	Stage   string  `json:"stage,omitempty"`
+	Percent float32 `json:"percent"` // Of the current stage; -1 when unknown
+	Result  string  `json:"result,omitempty"`
+	Error   string  `json:"error,omitempty"`
+
+	// ESXi task the operation is waiting on, e.g. haTask-2-vim.VirtualMachine.clone-123
+	ESXiTask string `json:"esxi_task,omitempty"`
+
+	// Process running the task
+	Host string `json:"host"`
+	PID  int    `json:"pid"`
+
+	CancelRequested bool `json:"cancel_requested,omitempty"`
+
+	Created  time.Time        `json:"created"`
+	Updated  time.Time        `json:"updated"`
+	Finished *time.Time       `json:"finished,omitempty"`
+	History  []TaskTransition `json:"history"`
+}
+
+// TaskTransition records a change of a task's state or stage
+type TaskTransition struct {
+	Time  time.Time `json:"time"`
+	State string    `json:"state"`
+	Stage string    `json:"stage,omitempty"`
+	Note  string    `json:"note,omitempty"`
+}
+
+// Done reports whether the task reached a final state
+func (t *TaskEntry) Done() bool {
+	switch t.State {
+	case TaskSucceeded, TaskFailed, TaskCancelled:
+		return true
+	}
+	return false
+}
+
+// Transition moves the task to state and stage and records the change
+func (t *TaskEntry) Transition(state, stage, note string) {
+	now := time.Now()
+	t.State = state
+	t.Stage = stage
+	t.Updated = now
+	if t.Done() {
+		t.Finished = &now
+	}
+	t.History = append(t.History, TaskTransition{Time: now, State: state, Stage: stage, Note: note})
+}
+
+// TaskStore persists tasks in their own bbolt file. Unlike the catalog,
+// which a backup holds open for its whole run, the file is only opened for
+// each read or write so that every ceso process and cesod can share it.
+type TaskStore struct {
+	path string
+}
+
+// NewTaskStore returns a store for the database at path; the file and its
+// directory are created on first use
+func NewTaskStore(path string) *TaskStore {
+	return &TaskStore{path: path}
+}
+
+// open opens the database and runs fn in a transaction
+func (s *TaskStore) open(writable bool, fn func(b *bbolt.Bucket) error) error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("failed to create task database directory: %w", err)
+	}
+
+	db, err := bbolt.Open(s.path, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return fmt.Errorf("failed to open task database: %w", err)
+	}
+	defer db.Close()
+
+	if !writable {
+		return db.View(func(tx *bbolt.Tx) error {
+			b := tx.Bucket([]byte(taskBucket))
+			if b == nil {
+				return nil
+			}
+			return fn(b)
+		})
+	}
+	return db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(taskBucket))
+		if err != nil {
+			return fmt.Errorf("failed to create task bucket: %w", err)
+		}
+		return fn(b)
+	})
+}
+
+func putTask(b *bbolt.Bucket, task *TaskEntry) error {
+	data, err := json.Marshal(task)
+	if err != nil {
+		return fmt.Errorf("failed to marshal task: %w", err)
+	}
+	if err := b.Put([]byte(task.ID), data); err != nil {
+		return fmt.Errorf("failed to store task: %w", err)
+	}
+	return nil
+}
+
+func getTask(b *bbolt.Bucket, id string) (*TaskEntry, error) {
+	data := b.Get([]byte(id))
+	if data == nil {
+		return nil, fmt.Errorf("task not found: %s", id)
+	}
+	task := &TaskEntry{}
+	if err := json.Unmarshal(data, task); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal task: %w", err)
+	}
+	return task, nil
+}
+
+// AddTask stores a new task
+func (s *TaskStore) AddTask(task *TaskEntry) error {
+	if task.ID == "" {
+		return fmt.Errorf("task ID cannot be empty")
+	}
+	return s.open(true, func(b *bbolt.Bucket) error {
+		return putTask(b, task)
+	})
+}
+
+// GetTask retrieves a task by ID
+func (s *TaskStore) GetTask(id string) (*TaskEntry, error) {
+	var task *TaskEntry
+	err := s.open(false, func(b *bbolt.Bucket) error {
+		var err error
+		task, err = getTask(b, id)
+		return err
+	})
+	if err == nil && task == nil {
+		err = fmt.Errorf("task not found: %s", id)
+	}
+	return task, err
+}
+
+// UpdateTask applies fn to a task and stores the result atomically; an
+// error from fn leaves the task unchanged
+func (s *TaskStore) UpdateTask(id string, fn func(task *TaskEntry) error) (*TaskEntry, error) {
+	var task *TaskEntry
+	err := s.open(true, func(b *bbolt.Bucket) error {
+		var err error
+		if task, err = getTask(b, id); err != nil {
+			return err
+		}
+		if err := fn(task); err != nil {
+			return err
+		}
+		return putTask(b, task)
+	})
+	return task, err
+}
+
+// ListTasks returns all tasks, newest first
+func (s *TaskStore) ListTasks() ([]*TaskEntry, error) {
+	var tasks []*TaskEntry
+	err := s.open(false, func(b *bbolt.Bucket) error {
+		return b.ForEach(func(k, v []byte) error {
+			task := &TaskEntry{}
+			if err := json.Unmarshal(v, task); err != nil {
+				return fmt.Errorf("failed to unmarshal task: %w", err)
+			}
+			tasks = append(tasks, task)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(tasks, func(i, j int) bool {
+		return tasks[i].Created.After(tasks[j].Created)
+	})
+	return tasks, nil
+}
+
+// PruneTasks deletes finished tasks that ended before cutoff and returns
+// how many were removed
+func (s *TaskStore) PruneTasks(cutoff time.Time) (int, error) {
+	removed := 0
+	err := s.open(true, func(b *bbolt.Bucket) error {
+		var stale [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			task := &TaskEntry{}
+			if err := json.Unmarshal(v, task); err != nil {
+				return fmt.Errorf("failed to unmarshal task: %w", err)
+			}
+			if task.Done() && task.Finished != nil && task.Finished.Before(cutoff) {
+				stale = append(stale, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range stale {
+			if err := b.Delete(k); err != nil {
+				return fmt.Errorf("failed to delete task: %w", err)
+			}
+			removed++
+		}
+		return nil
+	})
+	return removed, err
+}
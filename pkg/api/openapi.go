@@ -0,0 +1,297 @@
+package api
+
+import (
+	"encoding/json"
+	"path"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// jsonField is a field of a struct as encoding/json sees it
+type jsonField struct {
+	Name string
+	Type reflect.Type
+}
+
+// jsonFields returns the fields t encodes to, in order, with the fields of
+// embedded structs promoted
+func jsonFields(t reflect.Type) []jsonField {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var fields []jsonField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+
+		if f.Anonymous && name == "" {
+			fields = append(fields, jsonFields(f.Type)...)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, jsonField{Name: name, Type: f.Type})
+	}
+	return fields
+}
+
+// paramFields maps the JSON names of t's fields to their types
+func paramFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for _, f := range jsonFields(t) {
+		fields[f.Name] = f.Type
+	}
+	return fields
+}
+
+type schema map[string]interface{}
+
+var (
+	timeType      = reflect.TypeOf(time.Time{})
+	durationType  = reflect.TypeOf(time.Duration(0))
+	marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+// schemaBuilder derives JSON schemas from Go types. Named structs become
+// components so that recursive types terminate.
+type schemaBuilder struct {
+	components map[string]schema
+	names      map[reflect.Type]string
+}
+
+func newSchemaBuilder() *schemaBuilder {
+	return &schemaBuilder{
+		components: make(map[string]schema),
+		names:      make(map[reflect.Type]string),
+	}
+}
+
+func (b *schemaBuilder) schema(t reflect.Type) schema {
+	if t == nil {
+		return schema{}
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t {
+	case timeType:
+		return schema{"type": "string", "format": "date-time"}
+	case durationType:
+		return schema{"type": "integer", "format": "int64", "description": "nanoseconds"}
+	}
+	// Types with their own encoding can't be described from their fields
+	if t.Implements(marshalerType) || reflect.PointerTo(t).Implements(marshalerType) {
+		return schema{}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return schema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return schema{"type": "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return schema{"type": "integer", "format": "int64"}
+	case reflect.Float32:
+		return schema{"type": "number", "format": "float"}
+	case reflect.Float64:
+		return schema{"type": "number", "format": "double"}
+	case reflect.String:
+		return schema{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return schema{"type": "string", "format": "byte"}
+		}
+		return schema{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return schema{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.object(jsonFields(t))
+		}
+		return schema{"$ref": "#/components/schemas/" + b.component(t)}
+	default:
+		return schema{}
+	}
+}
+
+// object returns an object schema with fields as its properties
+func (b *schemaBuilder) object(fields []jsonField) schema {
+	properties := make(map[string]schema)
+	for _, f := range fields {
+		properties[f.Name] = b.schema(f.Type)
+	}
+	return schema{"type": "object", "properties": properties}
+}
+
+// component registers the named struct t and returns its component name
+func (b *schemaBuilder) component(t reflect.Type) string {
+	if name, ok := b.names[t]; ok {
+		return name
+	}
+
+	name := t.Name()
+	if _, taken := b.components[name]; taken {
+		name = exportedName(path.Base(t.PkgPath())) + name
+	}
+	b.names[t] = name
+
+	// Reserve the name before descending so recursive types refer back to it
+	b.components[name] = schema{}
+	b.components[name] = b.object(jsonFields(t))
+	return name
+}
+
+func exportedName(s string) string {
+	if s == "" {
+		return s
+	}
+	r := []rune(s)
+	r[0] = unicode.ToUpper(r[0])
+	return string(r)
+}
+
+// newDocument builds the OpenAPI 3 document describing routes
+func newDocument(info Info, routes []Route) schema {
+	b := newSchemaBuilder()
+	b.components["Error"] = schema{
+		"type": "object",
+		"properties": map[string]schema{
+			"error": {
+				"type": "object",
+				"properties": map[string]schema{
+					"code":    {"type": "integer", "description": "JSON-RPC error code"},
+					"message": {"type": "string"},
+					"data":    {},
+				},
+			},
+		},
+	}
+	errorResponse := func(description string) schema {
+		return schema{
+			"description": description,
+			"content": schema{
+				"application/json": schema{"schema": schema{"$ref": "#/components/schemas/Error"}},
+			},
+		}
+	}
+
+	paths := make(map[string]schema)
+	for _, route := range routes {
+		operation := schema{
+			"operationId": route.Call,
+			"summary":     route.Summary,
+			"tags":        []string{route.Tag},
+		}
+
+		pathParams := make(map[string]bool)
+		fields := jsonFields(reflect.TypeOf(route.Params))
+		fieldTypes := paramFields(reflect.TypeOf(route.Params))
+
+		var parameters []schema
+		for _, name := range pathParamNames(route.Path) {
+			pathParams[name] = true
+			parameters = append(parameters, schema{
+				"name":     name,
+				"in":       "path",
+				"required": true,
+				"schema":   b.schema(fieldTypes[name]),
+			})
+		}
+
+		var rest []jsonField
+		for _, f := range fields {
+			if !pathParams[f.Name] {
+				rest = append(rest, f)
+			}
+		}
+
+		if hasBody(route.Method) {
+			if len(rest) > 0 {
+				operation["requestBody"] = schema{
+					"content": schema{
+						"application/json": schema{"schema": b.object(rest)},
+					},
+				}
+			}
+		} else {
+			for _, f := range rest {
+				parameters = append(parameters, schema{
+					"name":   f.Name,
+					"in":     "query",
+					"schema": b.schema(f.Type),
+				})
+			}
+		}
+		if len(parameters) > 0 {
+			operation["parameters"] = parameters
+		}
+
+		responses := schema{
+			"400": errorResponse("Invalid parameters"),
+			"401": errorResponse("Missing or invalid bearer token"),
+			"403": errorResponse("Operation not allowed in the current security mode, or client not allowed"),
+			"500": errorResponse("The operation failed"),
+		}
+		if route.Result != nil {
+			responses["200"] = schema{
+				"description": "OK",
+				"content": schema{
+					"application/json": schema{"schema": b.schema(reflect.TypeOf(route.Result))},
+				},
+			}
+		} else {
+			responses["204"] = schema{"description": "Done"}
+		}
+		operation["responses"] = responses
+
+		item, ok := paths[route.Path]
+		if !ok {
+			item = schema{}
+			paths[route.Path] = item
+		}
+		item[strings.ToLower(route.Method)] = operation
+	}
+
+	paths["/openapi.json"] = schema{
+		"get": schema{
+			"operationId": "openapi",
+			"summary":     "This document",
+			"security":    []schema{},
+			"responses": schema{
+				"200": schema{"description": "OpenAPI document", "content": schema{"application/json": schema{}}},
+			},
+		},
+	}
+
+	return schema{
+		"openapi": "3.0.3",
+		"info": schema{
+			"title":   info.Title,
+			"version": info.Version,
+		},
+		"paths": paths,
+		"components": schema{
+			"schemas": b.components,
+			"securitySchemes": schema{
+				"bearerAuth": schema{"type": "http", "scheme": "bearer"},
+			},
+		},
+		"security": []schema{{"bearerAuth": []string{}}},
+	}
+}
@@ -0,0 +1,258 @@
+// Package api implements the local HTTP/REST API of cesod. Every route is a
+// thin mapping onto a JSON-RPC method, so REST clients get the same sandbox
+// checks, audit records and handlers as JSON-RPC clients.
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/r11/esxi-commander/pkg/metrics"
+	"github.com/r11/esxi-commander/pkg/rpc"
+)
+
+// Route maps an HTTP method and path onto a JSON-RPC method
+type Route struct {
+	Method  string // HTTP method
+	Path    string // e.g. /api/v1/vms/{name}; path parameters become params of the same name
+	Call    string // JSON-RPC method the route calls
+	Summary string
+	Tag     string
+	// Params is a value of the call's params type. GET and DELETE routes
+	// read the fields that are not path parameters from the query string,
+	// all others from a JSON body.
+	Params interface{}
+	Result interface{} // Value of the result type, for the OpenAPI document
+}
+
+// Info describes the API in the OpenAPI document
+type Info struct {
+	Title   string
+	Version string
+}
+
+// Server serves REST routes backed by a JSON-RPC server. Every request
+// except GET /openapi.json must carry the bearer token.
+type Server struct {
+	rpc       *rpc.Server
+	token     string
+	allowlist *rpc.Allowlist
+	mux       *http.ServeMux
+	openapi   []byte
+}
+
+var pathParamPattern = regexp.MustCompile(`\{(\w+)\}`)
+
+// NewServer creates a REST server for routes. token must not be empty;
+// a nil allowlist admits every client.
+func NewServer(rpcServer *rpc.Server, token string, allowlist *rpc.Allowlist, info Info, routes []Route) (*Server, error) {
+	if token == "" {
+		return nil, fmt.Errorf("a bearer token is required")
+	}
+
+	document, err := json.Marshal(newDocument(info, routes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build OpenAPI document: %w", err)
+	}
+
+	s := &Server{
+		rpc:       rpcServer,
+		token:     token,
+		allowlist: allowlist,
+		mux:       http.NewServeMux(),
+		openapi:   document,
+	}
+
+	s.mux.HandleFunc("GET /openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(s.openapi)
+	})
+	for _, route := range routes {
+		s.mux.Handle(route.Method+" "+route.Path, s.authorize(s.routeHandler(route)))
+	}
+	return s, nil
+}
+
+// ServeHTTP checks the client against the allowlist and dispatches r
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.allowlist.AllowsAddr(remoteAddr(r)) {
+		writeError(w, http.StatusForbidden, &rpc.Error{Code: rpc.CodeNotAllowed, Message: "client not in security.ip_allowlist"})
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// authorize rejects requests without the bearer token
+func (s *Server) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="cesod"`)
+			writeError(w, http.StatusUnauthorized, &rpc.Error{Code: rpc.CodeNotAllowed, Message: "missing or invalid bearer token"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// routeHandler collects the params of a request and makes route's call
+func (s *Server) routeHandler(route Route) http.Handler {
+	pathParams := pathParamNames(route.Path)
+	fields := paramFields(reflect.TypeOf(route.Params))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := make(map[string]interface{})
+
+		if hasBody(route.Method) {
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, &rpc.Error{Code: rpc.CodeInvalidRequest, Message: "failed to read body"})
+				return
+			}
+			if len(strings.TrimSpace(string(body))) > 0 {
+				if err := json.Unmarshal(body, &params); err != nil {
+					writeError(w, http.StatusBadRequest, rpc.InvalidParams(fmt.Errorf("body must be a JSON object: %w", err)))
+					return
+				}
+			}
+		} else {
+			for name, values := range r.URL.Query() {
+				value, err := queryValue(fields[name], values)
+				if err != nil {
+					writeError(w, http.StatusBadRequest, rpc.InvalidParams(fmt.Errorf("%s: %w", name, err)))
+					return
+				}
+				params[name] = value
+			}
+		}
+
+		// Path parameters take precedence over the body and query
+		for _, name := range pathParams {
+			params[name] = r.PathValue(name)
+		}
+
+		raw, err := json.Marshal(params)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, &rpc.Error{Code: rpc.CodeInternalError, Message: err.Error()})
+			return
+		}
+
+		result, err := s.rpc.Call(r.Context(), remoteAddr(r), &rpc.Call{Method: route.Call, Params: raw})
+		if err != nil {
+			var rpcErr *rpc.Error
+			if !errors.As(err, &rpcErr) {
+				rpcErr = &rpc.Error{Code: rpc.CodeInternalError, Message: err.Error()}
+			}
+			status := httpStatus(rpcErr.Code)
+			metrics.RecordAPIRequest(route.Call, strconv.Itoa(status))
+			writeError(w, status, rpcErr)
+			return
+		}
+
+		if result == nil {
+			metrics.RecordAPIRequest(route.Call, strconv.Itoa(http.StatusNoContent))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		metrics.RecordAPIRequest(route.Call, strconv.Itoa(http.StatusOK))
+		writeJSON(w, http.StatusOK, result)
+	})
+}
+
+// hasBody reports whether requests with method carry params in a body
+func hasBody(method string) bool {
+	return method != http.MethodGet && method != http.MethodDelete
+}
+
+// pathParamNames returns the names of the parameters in path
+func pathParamNames(path string) []string {
+	var names []string
+	for _, match := range pathParamPattern.FindAllStringSubmatch(path, -1) {
+		names = append(names, match[1])
+	}
+	return names
+}
+
+// queryValue converts query string values to the type of the params field
+// they set. Unknown fields are passed through as strings for the call to
+// reject.
+func queryValue(t reflect.Type, values []string) (interface{}, error) {
+	if t == nil {
+		return values[len(values)-1], nil
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	value := values[len(values)-1]
+	switch t.Kind() {
+	case reflect.Bool:
+		// A bare ?flag means true
+		if value == "" {
+			return true, nil
+		}
+		return strconv.ParseBool(value)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.ParseInt(value, 10, 64)
+	case reflect.Float32, reflect.Float64:
+		return strconv.ParseFloat(value, 64)
+	case reflect.Slice:
+		// Repeated keys and comma-separated values both make a list
+		var list []string
+		for _, v := range values {
+			list = append(list, strings.Split(v, ",")...)
+		}
+		return list, nil
+	default:
+		return value, nil
+	}
+}
+
+// httpStatus maps a JSON-RPC error code to an HTTP status
+func httpStatus(code int) int {
+	switch code {
+	case rpc.CodeInvalidParams, rpc.CodeInvalidRequest, rpc.CodeParseError:
+		return http.StatusBadRequest
+	case rpc.CodeNotAllowed:
+		return http.StatusForbidden
+	case rpc.CodeMethodNotFound:
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// remoteAddr returns the client's address as a TCP address
+func remoteAddr(r *http.Request) net.Addr {
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return net.TCPAddrFromAddrPort(addrPort)
+}
+
+// errorBody is the body of every error response
+type errorBody struct {
+	Error *rpc.Error `json:"error"`
+}
+
+func writeError(w http.ResponseWriter, status int, err *rpc.Error) {
+	writeJSON(w, status, errorBody{Error: err})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -110,6 +110,17 @@ type AuditContext struct {
 	startTime     time.Time
 }
 
+// SetParameter adds a parameter only known once the operation has run,
+// such as command output
+func (ac *AuditContext) SetParameter(key string, value interface{}) {
+	if ac.parameters == nil {
+		ac.parameters = make(map[string]interface{})
+	}
+	for k, v := range redactSensitive(map[string]interface{}{key: value}) {
+		ac.parameters[k] = v
+	}
+}
+
 // Success logs a successful operation
 func (ac *AuditContext) Success() {
 	ac.complete("success", "")
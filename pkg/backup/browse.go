@@ -0,0 +1,596 @@
+package backup
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"github.com/r11/esxi-commander/internal/storage"
+	"github.com/r11/esxi-commander/pkg/audit"
+	"github.com/r11/esxi-commander/pkg/diskfs"
+	"github.com/r11/esxi-commander/pkg/metrics"
+)
+
+// BrowseOptions selects the backup whose files are opened
+type BrowseOptions struct {
+	BackupID     string
+	Target       BackupTarget // Target holding the backup; defaults to its stored location
+	IdentityFile string       // age identity file, required for encrypted backups
+	Progress     ProgressFunc // Receives staging progress; may be nil
+}
+
+// ExtractOptions selects files to copy out of a backup
+type ExtractOptions struct {
+	BrowseOptions
+	Filesystem string // Filesystem name, e.g. disk0p1; defaults to the largest ext2/3/4 one
+	Path       string // File or directory in the filesystem, e.g. /etc/nginx
+	Dir        string // Local directory to extract into
+}
+
+// ExtractResult summarises the files copied out of a backup
+type ExtractResult struct {
+	BackupID    string   `json:"backup_id"`
+	Filesystem  string   `json:"filesystem"`
+	Path        string   `json:"path"`
+	Destination string   `json:"destination"`
+	Files       int      `json:"files"`
+	Dirs        int      `json:"dirs"`
+	Symlinks    int      `json:"symlinks"`
+	Bytes       int64    `json:"bytes"`
+	Skipped     []string `json:"skipped,omitempty"` // Device nodes, FIFOs and sockets
+}
+
+// BackupFilesystem is a partition of a disk in a backup
+type BackupFilesystem struct {
+	Name      string           `json:"name"` // disk0p1, or disk0 for a disk without partition table
+	Disk      string           `json:"disk"` // Disk file in the backup
+	Partition diskfs.Partition `json:"partition"`
+	Type      string           `json:"type,omitempty"` // ext4, vfat, swap, LVM2_member...
+	Label     string           `json:"label,omitempty"`
+
+	fsys    *diskfs.Ext4
+	openErr error
+}
+
+// FileEntry describes a file in a backed-up filesystem
+type FileEntry struct {
+	Name    string    `json:"name"`
+	Path    string    `json:"path"`
+	Mode    string    `json:"mode"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	UID     uint32    `json:"uid"`
+	GID     uint32    `json:"gid"`
+	Target  string    `json:"target,omitempty"` // Symlink target
+	IsDir   bool      `json:"is_dir"`
+}
+
+// BackupFiles gives read-only access to the filesystems in a backup's
+// disks. The disks are staged in the temp directory until Close.
+type BackupFiles struct {
+	BackupID    string
+	VMName      string
+	Filesystems []*BackupFilesystem
+
+	stageDir string
+	files    []*os.File
+}
+
+// OpenBackupFiles stages the disks of a backup from its artifact and opens
+// their partitions, without touching ESXi. The artifact checksum is
+// verified on the way and a replica is used if the primary copy is damaged.
+// ext2, ext3 and ext4 filesystems can be browsed; other partitions are
+// listed with their type.
+func (m *BackupManager) OpenBackupFiles(ctx context.Context, opts BrowseOptions) (*BackupFiles, error) {
+	entry, err := m.catalog.GetBackup(opts.BackupID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get backup from catalog: %w", err)
+	}
+	if entry.Status != "completed" {
+		return nil, fmt.Errorf("backup %s is %s", entry.ID, entry.Status)
+	}
+
+	stageDir, err := os.MkdirTemp(m.config.TempDir, entry.ID+"-files-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	files := &BackupFiles{BackupID: entry.ID, VMName: entry.VMName, stageDir: stageDir}
+
+	if err := m.stageBackupDisks(ctx, entry, opts, files); err != nil {
+		files.Close()
+		return nil, err
+	}
+	return files, nil
+}
+
+// stageBackupDisks stages every disk of entry and opens its partitions
+func (m *BackupManager) stageBackupDisks(ctx context.Context, entry *storage.BackupEntry, opts BrowseOptions, files *BackupFiles) error {
+	type disk struct {
+		name string
+		r    io.ReaderAt
+		size int64
+	}
+	var disks []disk
+
+	if isChainBackup(entry) {
+		// Rebuild raw images from the chain, as a restore would
+		opts.Progress.report("stage chain", -1)
+		staged := make(map[int32]*stagedDisk)
+		last, err := m.applyChain(ctx, entry, RestoreOptions{
+			Target:       opts.Target,
+			IdentityFile: opts.IdentityFile,
+			Progress:     opts.Progress,
+		}, files.stageDir, staged)
+		for _, s := range staged {
+			files.files = append(files.files, s.file)
+		}
+		if err != nil {
+			return err
+		}
+		for _, d := range last.index.Disks {
+			disks = append(disks, disk{name: d.File, r: staged[d.Key].file, size: staged[d.Key].capacity})
+		}
+	} else {
+		identities, err := loadIdentities(entry, opts.IdentityFile)
+		if err != nil {
+			return err
+		}
+
+		var names []string
+		_, err = m.firstIntact(entry, opts.Target, func(target BackupTarget) (err error) {
+			names, err = m.stageArchiveDisks(ctx, target, entry, identities, files.stageDir, opts.Progress)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			file, err := os.Open(filepath.Join(files.stageDir, name))
+			if err != nil {
+				return err
+			}
+			files.files = append(files.files, file)
+			stat, err := file.Stat()
+			if err != nil {
+				return err
+			}
+			r, err := openStreamOptimized(file, stat.Size())
+			if err != nil {
+				return fmt.Errorf("failed to open %s: %w", name, err)
+			}
+			disks = append(disks, disk{name: name, r: r, size: r.Size()})
+		}
+	}
+
+	if len(disks) == 0 {
+		return fmt.Errorf("backup %s has no disks", entry.ID)
+	}
+
+	for i, d := range disks {
+		partitions, err := diskfs.ReadPartitions(d.r, d.size)
+		if err != nil {
+			return fmt.Errorf("failed to read partitions of %s: %w", d.name, err)
+		}
+
+		for _, p := range partitions {
+			bf := &BackupFilesystem{Name: fmt.Sprintf("disk%d", i), Disk: d.name, Partition: p}
+			if p.Number > 0 {
+				bf.Name = fmt.Sprintf("disk%dp%d", i, p.Number)
+			}
+			bf.Type = diskfs.Detect(p.Section(d.r))
+			if strings.HasPrefix(bf.Type, "ext") {
+				bf.fsys, bf.openErr = diskfs.OpenExt4(p.Section(d.r))
+				if bf.fsys != nil {
+					bf.Label = bf.fsys.Label()
+				}
+			}
+			files.Filesystems = append(files.Filesystems, bf)
+		}
+	}
+	return nil
+}
+
+// stageArchiveDisks copies the disks of an OVA backup to stageDir, checking
+// the stored checksum and the manifest, and returns their names in order
+func (m *BackupManager) stageArchiveDisks(ctx context.Context, target BackupTarget, entry *storage.BackupEntry, identities []age.Identity, stageDir string, progress ProgressFunc) ([]string, error) {
+	if entry.Checksum == "" {
+		return nil, fmt.Errorf("backup %s has no checksum", entry.ID)
+	}
+
+	rc, err := target.Retrieve(ctx, entry.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve backup: %w", err)
+	}
+	defer rc.Close()
+
+	hasher := sha256.New()
+	reader := io.TeeReader(rc, hasher)
+
+	var names []string
+	var manifest map[string]string
+	digests := make(map[string]string)
+
+	err = walkArchive(reader, identities, func(header *tar.Header, r io.Reader) error {
+		name := path.Base(header.Name)
+		fileHasher := sha256.New()
+		r = io.TeeReader(r, fileHasher)
+
+		// The chunks of an OVF chunked file are appended in order
+		disk, chunk, _ := chunkOf(name)
+		switch path.Ext(disk) {
+		case ".mf":
+			data, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			manifest = parseManifest(data)
+			return nil
+		case ".vmdk":
+			flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+			if chunk == 0 {
+				progress.report("stage "+disk, -1)
+				names = append(names, disk)
+			} else if len(names) == 0 || names[len(names)-1] != disk {
+				return fmt.Errorf("backup archive has %s out of order", name)
+			} else {
+				flag = os.O_WRONLY | os.O_APPEND
+			}
+
+			file, err := os.OpenFile(filepath.Join(stageDir, disk), flag, 0600)
+			if err != nil {
+				return fmt.Errorf("failed to stage %s: %w", disk, err)
+			}
+			_, err = io.Copy(file, r)
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return fmt.Errorf("failed to stage %s: %w", disk, err)
+			}
+		}
+
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			return err
+		}
+		digests[name] = hex.EncodeToString(fileHasher.Sum(nil))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup archive: %w", err)
+	}
+
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		return nil, fmt.Errorf("failed to read backup: %w", err)
+	}
+	if checksum := hex.EncodeToString(hasher.Sum(nil)); checksum != entry.Checksum {
+		return nil, fmt.Errorf("backup checksum mismatch: catalog has %s, artifact is %s", entry.Checksum, checksum)
+	}
+
+	for name, actual := range digests {
+		if expected, ok := manifest[name]; ok && actual != expected {
+			return nil, fmt.Errorf("checksum mismatch for %s: manifest has %s, got %s", name, expected, actual)
+		}
+	}
+	return names, nil
+}
+
+// Close releases and removes the staged disks
+func (f *BackupFiles) Close() error {
+	for _, file := range f.files {
+		file.Close()
+	}
+	return os.RemoveAll(f.stageDir)
+}
+
+// Filesystem returns the named filesystem, or the largest ext2/3/4
+// filesystem in the backup when name is empty
+func (f *BackupFiles) Filesystem(name string) (*BackupFilesystem, error) {
+	if name == "" {
+		var largest *BackupFilesystem
+		for _, bf := range f.Filesystems {
+			if bf.fsys != nil && (largest == nil || bf.Partition.Size > largest.Partition.Size) {
+				largest = bf
+			}
+		}
+		if largest == nil {
+			return nil, fmt.Errorf("backup %s has no ext2, ext3 or ext4 filesystem", f.BackupID)
+		}
+		return largest, nil
+	}
+
+	for _, bf := range f.Filesystems {
+		if bf.Name != name {
+			continue
+		}
+		switch {
+		case bf.openErr != nil:
+			return nil, fmt.Errorf("failed to open filesystem %s: %w", name, bf.openErr)
+		case bf.fsys == nil && bf.Type == "":
+			return nil, fmt.Errorf("%s holds no recognised filesystem", name)
+		case bf.fsys == nil:
+			return nil, fmt.Errorf("%s is %s; only ext2, ext3 and ext4 filesystems can be browsed", name, bf.Type)
+		}
+		return bf, nil
+	}
+	return nil, fmt.Errorf("backup %s has no filesystem %s", f.BackupID, name)
+}
+
+// fsPath turns an absolute path in the guest filesystem into an fs.FS path
+func fsPath(name string) string {
+	if p := strings.TrimPrefix(path.Clean("/"+name), "/"); p != "" {
+		return p
+	}
+	return "."
+}
+
+// FS returns the filesystem for reading
+func (b *BackupFilesystem) FS() *diskfs.Ext4 {
+	return b.fsys
+}
+
+// List describes the entries of the named directory, or the named file
+// itself. Paths are absolute in the filesystem, e.g. /etc; symlinks to
+// directories are listed as the directory.
+func (b *BackupFilesystem) List(name string) ([]FileEntry, error) {
+	p := fsPath(name)
+	info, err := b.fsys.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		info, err := b.fsys.Lstat(p)
+		if err != nil {
+			return nil, err
+		}
+		entry, err := b.fileEntry(p, info)
+		if err != nil {
+			return nil, err
+		}
+		return []FileEntry{entry}, nil
+	}
+
+	dirEntries, err := b.fsys.ReadDir(p)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]FileEntry, 0, len(dirEntries))
+	for _, d := range dirEntries {
+		info, err := d.Info()
+		if err != nil {
+			return nil, err
+		}
+		entry, err := b.fileEntry(path.Join(p, d.Name()), info)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (b *BackupFilesystem) fileEntry(p string, info fs.FileInfo) (FileEntry, error) {
+	entry := FileEntry{
+		Name:    info.Name(),
+		Path:    "/" + strings.TrimPrefix(p, "."),
+		Mode:    info.Mode().String(),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		IsDir:   info.IsDir(),
+	}
+	if stat, ok := info.Sys().(*diskfs.InodeStat); ok {
+		entry.UID, entry.GID = stat.UID, stat.GID
+	}
+	if info.Mode()&fs.ModeSymlink != 0 {
+		target, err := b.fsys.ReadLink(p)
+		if err != nil {
+			return entry, err
+		}
+		entry.Target = target
+	}
+	return entry, nil
+}
+
+// ExtractFiles copies a file or directory tree out of a backup into a local
+// directory, without touching ESXi
+func (m *BackupManager) ExtractFiles(ctx context.Context, opts ExtractOptions) (*ExtractResult, error) {
+	start := time.Now()
+
+	auditCtx := audit.GetLogger().LogOperation(ctx, "backup.extract", map[string]interface{}{
+		"backup_id":  opts.BackupID,
+		"filesystem": opts.Filesystem,
+		"path":       opts.Path,
+		"dir":        opts.Dir,
+	})
+
+	result, err := m.extractFiles(ctx, opts)
+	if err != nil {
+		metrics.RecordBackupOperation("extract", "failure", time.Since(start).Seconds())
+		auditCtx.Failure(err)
+		return nil, err
+	}
+
+	auditCtx.SetParameter("files", result.Files)
+	auditCtx.SetParameter("bytes", result.Bytes)
+	metrics.RecordBackupOperation("extract", "success", time.Since(start).Seconds())
+	auditCtx.Success()
+	return result, nil
+}
+
+func (m *BackupManager) extractFiles(ctx context.Context, opts ExtractOptions) (*ExtractResult, error) {
+	if opts.Dir == "" {
+		return nil, fmt.Errorf("a destination directory is required")
+	}
+
+	files, err := m.OpenBackupFiles(ctx, opts.BrowseOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer files.Close()
+
+	fsys, err := files.Filesystem(opts.Filesystem)
+	if err != nil {
+		return nil, err
+	}
+
+	opts.Progress.report("extract "+opts.Path, -1)
+	result, err := fsys.Extract(opts.Path, opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+	result.BackupID = files.BackupID
+	return result, nil
+}
+
+// Extract copies the named file or directory tree into dir, keeping modes
+// and modification times, and ownership when run as root. A symlink named
+// directly is followed; symlinks inside a tree are recreated as symlinks.
+// Device nodes, FIFOs and sockets are skipped. Nothing is overwritten.
+func (b *BackupFilesystem) Extract(name, dir string) (*ExtractResult, error) {
+	src := fsPath(name)
+	if _, err := b.fsys.Stat(src); err != nil {
+		return nil, err
+	}
+
+	base := path.Base(src)
+	if src == "." {
+		base = b.Name
+	}
+	dest := filepath.Join(dir, base)
+	if _, err := os.Lstat(dest); err == nil {
+		return nil, fmt.Errorf("%s already exists", dest)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+
+	result := &ExtractResult{
+		Filesystem:  b.Name,
+		Path:        "/" + strings.TrimPrefix(src, "."),
+		Destination: dest,
+	}
+
+	// Directories get their modes and times last, deepest first, so
+	// read-only ones can still be filled and mtimes are not bumped
+	type extractedDir struct {
+		path string
+		info fs.FileInfo
+	}
+	var dirs []extractedDir
+
+	err := fs.WalkDir(b.fsys, src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		target := dest
+		if p != src {
+			target = filepath.Join(dest, filepath.FromSlash(strings.TrimPrefix(p, src+"/")))
+			if src == "." {
+				target = filepath.Join(dest, filepath.FromSlash(p))
+			}
+		}
+		if !withinDir(dest, target) {
+			return fmt.Errorf("refusing to extract /%s outside %s", p, dest)
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case d.IsDir():
+			if err := os.Mkdir(target, 0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, extractedDir{path: target, info: info})
+			result.Dirs++
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := b.fsys.ReadLink(p)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+			setOwner(target, info)
+			result.Symlinks++
+		case d.Type().IsRegular():
+			n, err := extractFile(b.fsys, p, target)
+			if err != nil {
+				return err
+			}
+			if err := setMetadata(target, info); err != nil {
+				return err
+			}
+			result.Files++
+			result.Bytes += n
+		default:
+			result.Skipped = append(result.Skipped, "/"+p)
+		}
+		return nil
+	})
+	if err != nil {
+		return result, fmt.Errorf("failed to extract %s: %w", result.Path, err)
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := setMetadata(dirs[i].path, dirs[i].info); err != nil {
+			return result, fmt.Errorf("failed to extract %s: %w", result.Path, err)
+		}
+	}
+	return result, nil
+}
+
+// withinDir reports whether target is dir or a path below it
+func withinDir(dir, target string) bool {
+	rel, err := filepath.Rel(dir, target)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+// extractFile copies a regular file to a new local file
+func extractFile(fsys fs.FS, name, target string) (int64, error) {
+	in, err := fsys.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return n, err
+}
+
+// setMetadata applies the ownership, mode and modification time of info
+func setMetadata(target string, info fs.FileInfo) error {
+	// Ownership first: changing it clears setuid and setgid bits
+	setOwner(target, info)
+	if err := os.Chmod(target, info.Mode()&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)); err != nil {
+		return err
+	}
+	return os.Chtimes(target, info.ModTime(), info.ModTime())
+}
+
+// setOwner gives target the owner of info when running as root. Owners are
+// guest IDs, which need not exist locally.
+func setOwner(target string, info fs.FileInfo) {
+	if stat, ok := info.Sys().(*diskfs.InodeStat); ok && os.Geteuid() == 0 {
+		os.Lchown(target, int(stat.UID), int(stat.GID))
+	}
+}
@@ -0,0 +1,275 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ubuntuDisk returns a raw disk with an MBR holding the ext4 test image
+// from the diskfs package in partition 1 and a swap partition 2
+func ubuntuDisk(t *testing.T) []byte {
+	t.Helper()
+
+	f, err := os.Open(filepath.Join("..", "diskfs", "testdata", "ext4.img.gz"))
+	require.NoError(t, err)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	image, err := io.ReadAll(gz)
+	require.NoError(t, err)
+
+	rootSectors := uint32(len(image) / sectorSize)
+	swapStart := 2048 + rootSectors
+	disk := make([]byte, int(swapStart+2048)*sectorSize)
+	copy(disk[2048*sectorSize:], image)
+	copy(disk[int(swapStart)*sectorSize+4086:], "SWAPSPACE2")
+
+	for i, p := range []struct {
+		kind           byte
+		first, sectors uint32
+	}{{0x83, 2048, rootSectors}, {0x82, swapStart, 2048}} {
+		entry := disk[446+i*16:]
+		entry[4] = p.kind
+		binary.LittleEndian.PutUint32(entry[8:], p.first)
+		binary.LittleEndian.PutUint32(entry[12:], p.sectors)
+	}
+	disk[510], disk[511] = 0x55, 0xaa
+	return disk
+}
+
+// backupWithDisk creates a backup of a simulator VM and replaces its disks
+// in the stored OVA with a streamOptimized encoding of disk, updating the
+// manifest and catalog checksum to match
+func backupWithDisk(t *testing.T, manager *BackupManager, target *memoryTarget, disk []byte) string {
+	t.Helper()
+	ctx := context.Background()
+
+	info, err := manager.CreateBackup(ctx, BackupOptions{VMName: firstVMName(t, manager), Hot: true, Compress: true, Target: target})
+	require.NoError(t, err)
+
+	var vmdk bytes.Buffer
+	require.NoError(t, writeStreamOptimized(&vmdk, "disk.vmdk", int64(len(disk)), bytes.NewReader(disk), []extent{{Offset: 0, Length: int64(len(disk))}}))
+
+	entries := readOVA(t, target.data[info.ID])
+	var names []string
+	disks := make(map[string][]byte)
+	for name, content := range entries {
+		// Chunks of an exported disk are replaced by the whole disk
+		if file, _, ok := chunkOf(name); ok {
+			name = file
+		}
+		if strings.HasSuffix(name, ".vmdk") {
+			content = vmdk.Bytes()
+		}
+		if _, ok := disks[name]; !ok {
+			names = append(names, name)
+		}
+		disks[name] = content
+	}
+	entries = disks
+	sort.Strings(names)
+
+	var manifest strings.Builder
+	for _, name := range names {
+		if strings.HasSuffix(name, ".mf") {
+			continue
+		}
+		sum := sha256.Sum256(entries[name])
+		fmt.Fprintf(&manifest, "SHA256(%s)= %s\n", name, hex.EncodeToString(sum[:]))
+	}
+
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+	for _, name := range names {
+		content := entries[name]
+		if strings.HasSuffix(name, ".mf") {
+			content = []byte(manifest.String())
+		}
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}))
+		_, err := tw.Write(content)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gzw.Close())
+	target.data[info.ID] = buf.Bytes()
+
+	entry, err := manager.catalog.GetBackup(info.ID)
+	require.NoError(t, err)
+	sum := sha256.Sum256(buf.Bytes())
+	entry.Checksum = hex.EncodeToString(sum[:])
+	require.NoError(t, manager.catalog.AddBackup(entry))
+
+	return info.ID
+}
+
+func TestOpenBackupFiles(t *testing.T) {
+	manager := newTestManager(t)
+	target := newMemoryTarget()
+	id := backupWithDisk(t, manager, target, ubuntuDisk(t))
+
+	files, err := manager.OpenBackupFiles(context.Background(), BrowseOptions{BackupID: id, Target: target})
+	require.NoError(t, err)
+
+	require.GreaterOrEqual(t, len(files.Filesystems), 2)
+	root, swap := files.Filesystems[0], files.Filesystems[1]
+	assert.Equal(t, "disk0p1", root.Name)
+	assert.Equal(t, "ext4", root.Type)
+	assert.Equal(t, "cloudimg-rootfs", root.Label)
+	assert.Equal(t, "disk0p2", swap.Name)
+	assert.Equal(t, "swap", swap.Type)
+
+	fsys, err := files.Filesystem("")
+	require.NoError(t, err)
+	assert.Equal(t, "disk0p1", fsys.Name)
+
+	_, err = files.Filesystem("disk0p2")
+	assert.ErrorContains(t, err, "disk0p2 is swap")
+	_, err = files.Filesystem("disk9p1")
+	assert.ErrorContains(t, err, "has no filesystem disk9p1")
+
+	entries, err := fsys.List("/etc")
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, FileEntry{
+		Name: "hostname", Path: "/etc/hostname", Mode: "-rw-r--r--", Size: 16, ModTime: entries[0].ModTime,
+	}, entries[0])
+	assert.Equal(t, "/usr/share/zoneinfo/UTC", entries[1].Target)
+
+	entries, err = fsys.List("etc/hostname")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "/etc/hostname", entries[0].Path)
+
+	data, err := fs.ReadFile(fsys.FS(), "etc/hostname")
+	require.NoError(t, err)
+	assert.Equal(t, "ubuntu-template\n", string(data))
+
+	stageDir := files.stageDir
+	require.NoError(t, files.Close())
+	assert.NoDirExists(t, stageDir)
+}
+
+func TestExtractFiles(t *testing.T) {
+	manager := newTestManager(t)
+	target := newMemoryTarget()
+	id := backupWithDisk(t, manager, target, ubuntuDisk(t))
+	ctx := context.Background()
+	dir := filepath.Join(t.TempDir(), "restored")
+
+	result, err := manager.ExtractFiles(ctx, ExtractOptions{
+		BrowseOptions: BrowseOptions{BackupID: id, Target: target},
+		Path:          "/home/ubuntu",
+		Dir:           dir,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, id, result.BackupID)
+	assert.Equal(t, "disk0p1", result.Filesystem)
+	assert.Equal(t, filepath.Join(dir, "ubuntu"), result.Destination)
+	assert.Equal(t, 1, result.Files)
+	assert.Equal(t, 2, result.Symlinks)
+
+	data, err := os.ReadFile(filepath.Join(dir, "ubuntu", ".bashrc"))
+	require.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(data, []byte("line 000001\n")))
+	assert.Equal(t, result.Bytes, int64(len(data)))
+	info, err := os.Stat(filepath.Join(dir, "ubuntu", ".bashrc"))
+	require.NoError(t, err)
+	assert.Equal(t, fs.FileMode(0600), info.Mode())
+
+	link, err := os.Readlink(filepath.Join(dir, "ubuntu", "logs"))
+	require.NoError(t, err)
+	assert.Equal(t, "../../var/log/app", link)
+
+	// A symlink named directly is extracted as the file it points to
+	result, err = manager.ExtractFiles(ctx, ExtractOptions{
+		BrowseOptions: BrowseOptions{BackupID: id, Target: target},
+		Filesystem:    "disk0p1",
+		Path:          "/etc/localtime",
+		Dir:           dir,
+	})
+	require.NoError(t, err)
+	data, err = os.ReadFile(filepath.Join(dir, "localtime"))
+	require.NoError(t, err)
+	assert.Equal(t, "TZif2 UTC\n", string(data))
+
+	// Nothing is overwritten
+	_, err = manager.ExtractFiles(ctx, ExtractOptions{
+		BrowseOptions: BrowseOptions{BackupID: id, Target: target},
+		Path:          "/home/ubuntu",
+		Dir:           dir,
+	})
+	assert.ErrorContains(t, err, "already exists")
+
+	_, err = manager.ExtractFiles(ctx, ExtractOptions{
+		BrowseOptions: BrowseOptions{BackupID: id, Target: target},
+		Path:          "/no/such/file",
+		Dir:           dir,
+	})
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestExtractCraftedNames(t *testing.T) {
+	manager := newTestManager(t)
+	target := newMemoryTarget()
+
+	// A directory entry in /etc renamed to climb out of the extract
+	// directory, as a crafted guest filesystem could
+	disk := ubuntuDisk(t)
+	require.Equal(t, 1, bytes.Count(disk, []byte("\x08\x01hostname")))
+	disk = bytes.Replace(disk, []byte("\x08\x01hostname"), []byte("\x08\x01../../hn"), 1)
+	id := backupWithDisk(t, manager, target, disk)
+
+	root := t.TempDir()
+	dir := filepath.Join(root, "a", "b")
+	result, err := manager.ExtractFiles(context.Background(), ExtractOptions{
+		BrowseOptions: BrowseOptions{BackupID: id, Target: target},
+		Path:          "/etc",
+		Dir:           dir,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 0, result.Files)
+	assert.Equal(t, 1, result.Symlinks)
+	assert.NoFileExists(t, filepath.Join(root, "hn"))
+	assert.NoFileExists(t, filepath.Join(root, "a", "hn"))
+}
+
+func TestWithinDir(t *testing.T) {
+	assert.True(t, withinDir("/restore/etc", "/restore/etc"))
+	assert.True(t, withinDir("/restore/etc", "/restore/etc/nginx/..conf"))
+	assert.False(t, withinDir("/restore/etc", "/restore/etc/../../hn"))
+	assert.False(t, withinDir("/restore/etc", "/restore/etc2"))
+	assert.False(t, withinDir("/restore/etc", "/tmp"))
+}
+
+func TestOpenBackupFilesChecksArtifact(t *testing.T) {
+	manager := newTestManager(t)
+	target := newMemoryTarget()
+	id := backupWithDisk(t, manager, target, ubuntuDisk(t))
+
+	target.data[id] = append([]byte(nil), target.data[id]...)
+	target.data[id][len(target.data[id])/2] ^= 0xff
+
+	_, err := manager.OpenBackupFiles(context.Background(), BrowseOptions{BackupID: id, Target: target})
+	assert.Error(t, err)
+
+	matches, err := filepath.Glob(filepath.Join(manager.config.TempDir, id+"-files-*"))
+	require.NoError(t, err)
+	assert.Empty(t, matches, "staged disks are removed")
+}
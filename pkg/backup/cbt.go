@@ -0,0 +1,347 @@
+package backup
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/r11/esxi-commander/internal/storage"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/ovf"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// A CBT backup holds the OVF descriptor, an index of the disks it covers,
+// the extent data of each disk and an OVA-style manifest. The first backup
+// of a chain reads every allocated extent; later ones read only the extents
+// Changed Block Tracking reports since the parent's change IDs.
+
+// cbtReadChunk bounds the size of a single ranged datastore read
+const cbtReadChunk = 8 << 20
+
+// cbtIndex lists the disks in a CBT backup
+type cbtIndex struct {
+	ParentID string    `json:"parent_id,omitempty"`
+	Disks    []cbtDisk `json:"disks"`
+}
+
+// cbtDisk describes the extents stored for one disk
+type cbtDisk struct {
+	Key      int32    `json:"key"`
+	File     string   `json:"file"` // disk file name in the OVF descriptor
+	Capacity int64    `json:"capacity"`
+	ChangeID string   `json:"change_id"`
+	Full     bool     `json:"full"` // extents cover the whole disk rather than changes since the parent
+	Extents  []extent `json:"extents"`
+}
+
+func (d cbtDisk) extentsName() string {
+	return fmt.Sprintf("disk-%d.extents", d.Key)
+}
+
+func (d cbtDisk) dataSize() int64 {
+	var size int64
+	for _, e := range d.Extents {
+		size += e.Length
+	}
+	return size
+}
+
+// changeIDKey is the catalog metadata key holding a disk's CBT change ID
+func changeIDKey(deviceKey int32) string {
+	return "change_id." + strconv.Itoa(int(deviceKey))
+}
+
+// isChainBackup reports whether a catalog entry is a CBT backup
+func isChainBackup(entry *storage.BackupEntry) bool {
+	return entry.Metadata["format"] == "cbt"
+}
+
+// incrementalParent returns the newest completed CBT backup of a VM, the
+// base for its next incremental backup
+func (m *BackupManager) incrementalParent(vmName string) (*storage.BackupEntry, error) {
+	backups, err := m.catalog.ListBackups(vmName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+
+	var parent *storage.BackupEntry
+	for _, backup := range backups {
+		if backup.Status != "completed" || !isChainBackup(backup) {
+			continue
+		}
+		if parent == nil || backup.Timestamp.After(parent.Timestamp) || backup.Supersedes(parent) {
+			parent = backup
+		}
+	}
+	return parent, nil
+}
+
+// enableChangeTracking turns on CBT for a VM. It returns false if CBT was
+// off, in which case earlier change IDs cannot be used.
+func (m *BackupManager) enableChangeTracking(ctx context.Context, vmObj *object.VirtualMachine) (bool, error) {
+	var vmMo mo.VirtualMachine
+	if err := vmObj.Properties(ctx, vmObj.Reference(), []string{"config.changeTrackingEnabled"}, &vmMo); err != nil {
+		return false, fmt.Errorf("failed to get VM properties: %w", err)
+	}
+	if vmMo.Config != nil && vmMo.Config.ChangeTrackingEnabled != nil && *vmMo.Config.ChangeTrackingEnabled {
+		return true, nil
+	}
+
+	task, err := vmObj.Reconfigure(ctx, types.VirtualMachineConfigSpec{ChangeTrackingEnabled: types.NewBool(true)})
+	if err != nil {
+		return false, fmt.Errorf("failed to enable changed block tracking: %w", err)
+	}
+	if err := task.Wait(ctx); err != nil {
+		return false, fmt.Errorf("failed to enable changed block tracking: %w", err)
+	}
+	return false, nil
+}
+
+// exportChanges writes a CBT backup of the disks as of snapshot. Disks the
+// parent has no change ID for are read in full.
+func (m *BackupManager) exportChanges(ctx context.Context, vmObj *object.VirtualMachine, snapshot types.ManagedObjectReference, parent *storage.BackupEntry, backupID string, target BackupTarget, codec Codec, opts BackupOptions) (string, int64, string, *cbtIndex, error) {
+	var snap mo.VirtualMachineSnapshot
+	if err := vmObj.Properties(ctx, snapshot, []string{"config.hardware"}, &snap); err != nil {
+		return "", 0, "", nil, fmt.Errorf("failed to get snapshot configuration: %w", err)
+	}
+
+	disks := object.VirtualDeviceList(snap.Config.Hardware.Device).SelectByType((*types.VirtualDisk)(nil))
+	if len(disks) == 0 {
+		return "", 0, "", nil, fmt.Errorf("VM has no disks")
+	}
+
+	descriptor, files, err := m.snapshotDescriptor(ctx, vmObj, snapshot, opts.VMName)
+	if err != nil {
+		return "", 0, "", nil, err
+	}
+	if len(files) != len(disks) {
+		return "", 0, "", nil, fmt.Errorf("export lease lists %d disks, snapshot has %d", len(files), len(disks))
+	}
+
+	index := &cbtIndex{}
+	sources := make(map[int32]string, len(disks))
+	for i, device := range disks {
+		disk := device.(*types.VirtualDisk)
+		backing, ok := disk.Backing.(*types.VirtualDiskFlatVer2BackingInfo)
+		if !ok || backing.Parent != nil {
+			return "", 0, "", nil, fmt.Errorf("disk %d is not a flat disk without snapshots; incremental backups need the VM's other snapshots removed", disk.Key)
+		}
+		if backing.ChangeId == "" {
+			return "", 0, "", nil, fmt.Errorf("changed block tracking is not active on disk %d", disk.Key)
+		}
+
+		changeID := "*"
+		if parent != nil && parent.Metadata[changeIDKey(disk.Key)] != "" {
+			changeID = parent.Metadata[changeIDKey(disk.Key)]
+			index.ParentID = parent.ID
+		}
+
+		extents, err := m.changedExtents(ctx, vmObj.Reference(), snapshot, disk, changeID)
+		if err != nil {
+			return "", 0, "", nil, err
+		}
+
+		index.Disks = append(index.Disks, cbtDisk{
+			Key:      disk.Key,
+			File:     files[i],
+			Capacity: disk.CapacityInBytes,
+			ChangeID: backing.ChangeId,
+			Full:     changeID == "*",
+			Extents:  extents,
+		})
+		sources[disk.Key] = flatFileName(backing.FileName)
+	}
+
+	location, size, checksum, err := m.storeArchive(ctx, backupID, target, codec, func(tw *tar.Writer) error {
+		return writeChanges(tw, opts.VMName, descriptor, index, func(w io.Writer, disk cbtDisk) error {
+			return m.readExtents(ctx, w, sources[disk.Key], disk.Extents)
+		})
+	})
+	if err != nil {
+		return "", 0, "", nil, err
+	}
+	return location, size, checksum, index, nil
+}
+
+// snapshotDescriptor creates the OVF descriptor for a snapshot and returns
+// the file name of each disk in it. The export lease is only opened to learn
+// the disk device IDs and is aborted without transferring anything.
+func (m *BackupManager) snapshotDescriptor(ctx context.Context, vmObj *object.VirtualMachine, snapshot types.ManagedObjectReference, name string) (string, []string, error) {
+	lease, err := vmObj.ExportSnapshot(ctx, &snapshot)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to request export lease: %w", err)
+	}
+
+	info, err := lease.Wait(ctx, nil)
+	if err != nil {
+		return "", nil, fmt.Errorf("export lease failed: %w", err)
+	}
+
+	descParams := types.OvfCreateDescriptorParams{Name: name}
+	var files []string
+	for _, item := range info.Items {
+		if path.Ext(item.Path) != ".vmdk" {
+			continue
+		}
+		descParams.OvfFiles = append(descParams.OvfFiles, item.File())
+		files = append(files, path.Base(item.Path))
+	}
+
+	if err := lease.Abort(ctx, nil); err != nil {
+		return "", nil, fmt.Errorf("failed to release export lease: %w", err)
+	}
+
+	desc, err := ovf.NewManager(m.client.Client()).CreateDescriptor(ctx, vmObj, descParams)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create OVF descriptor: %w", err)
+	}
+	if len(desc.Error) > 0 {
+		return "", nil, fmt.Errorf("failed to create OVF descriptor: %s", desc.Error[0].LocalizedMessage)
+	}
+
+	return desc.OvfDescriptor, files, nil
+}
+
+// changedExtents asks CBT for the extents of a disk changed since changeID;
+// "*" returns every allocated extent
+func (m *BackupManager) changedExtents(ctx context.Context, vm, snapshot types.ManagedObjectReference, disk *types.VirtualDisk, changeID string) ([]extent, error) {
+	query := m.queryChangedDiskAreas
+	if query == nil {
+		query = m.queryChangedDiskAreasAPI
+	}
+
+	var extents []extent
+	for offset := int64(0); offset < disk.CapacityInBytes; {
+		info, err := query(ctx, vm, snapshot, disk.Key, offset, changeID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query changed areas of disk %d: %w", disk.Key, err)
+		}
+		for _, area := range info.ChangedArea {
+			extents = append(extents, extent{Offset: area.Start, Length: area.Length})
+		}
+		if info.Length <= 0 {
+			break
+		}
+		offset = info.StartOffset + info.Length
+	}
+	return extents, nil
+}
+
+func (m *BackupManager) queryChangedDiskAreasAPI(ctx context.Context, vm, snapshot types.ManagedObjectReference, deviceKey int32, offset int64, changeID string) (types.DiskChangeInfo, error) {
+	res, err := methods.QueryChangedDiskAreas(ctx, m.client.Client(), &types.QueryChangedDiskAreas{
+		This:        vm,
+		Snapshot:    &snapshot,
+		DeviceKey:   deviceKey,
+		StartOffset: offset,
+		ChangeId:    changeID,
+	})
+	if err != nil {
+		return types.DiskChangeInfo{}, err
+	}
+	return res.Returnval, nil
+}
+
+// writeChanges writes the descriptor, index and extent data of a CBT backup
+// followed by the manifest. readDisk copies the extents of a disk to w.
+func writeChanges(tw *tar.Writer, name, descriptor string, index *cbtIndex, readDisk func(w io.Writer, disk cbtDisk) error) error {
+	indexData, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode backup index: %w", err)
+	}
+
+	var manifest strings.Builder
+	for _, file := range []struct {
+		name string
+		data []byte
+	}{
+		{name + ".ovf", []byte(descriptor)},
+		{name + ".cbt.json", indexData},
+	} {
+		sum := sha256.Sum256(file.data)
+		fmt.Fprintf(&manifest, "SHA256(%s)= %s\n", file.name, hex.EncodeToString(sum[:]))
+		if err := writeTarBytes(tw, file.name, file.data); err != nil {
+			return err
+		}
+	}
+
+	for _, disk := range index.Disks {
+		header := &tar.Header{
+			Name: disk.extentsName(),
+			Mode: 0600,
+			Size: disk.dataSize(),
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		hasher := sha256.New()
+		if err := readDisk(io.MultiWriter(tw, hasher), disk); err != nil {
+			return fmt.Errorf("failed to read disk %d: %w", disk.Key, err)
+		}
+		fmt.Fprintf(&manifest, "SHA256(%s)= %s\n", header.Name, hex.EncodeToString(hasher.Sum(nil)))
+	}
+
+	return writeTarBytes(tw, name+".mf", []byte(manifest.String()))
+}
+
+// readExtents copies extents of a flat disk file to w using ranged
+// datastore downloads
+func (m *BackupManager) readExtents(ctx context.Context, w io.Writer, file string, extents []extent) error {
+	var dsPath object.DatastorePath
+	if !dsPath.FromString(file) {
+		return fmt.Errorf("invalid disk path %s", file)
+	}
+
+	ds, err := m.client.Finder().Datastore(ctx, dsPath.Datastore)
+	if err != nil {
+		return fmt.Errorf("failed to find datastore %s: %w", dsPath.Datastore, err)
+	}
+
+	u, ticket, err := ds.ServiceTicket(ctx, dsPath.Path, http.MethodGet)
+	if err != nil {
+		return fmt.Errorf("failed to get datastore ticket: %w", err)
+	}
+
+	for _, e := range extents {
+		for offset := e.Offset; offset < e.Offset+e.Length; offset += cbtReadChunk {
+			length := min(int64(cbtReadChunk), e.Offset+e.Length-offset)
+			download := soap.DefaultDownload
+			download.Ticket = ticket
+			download.Headers = map[string]string{
+				"Range": fmt.Sprintf("bytes=%d-%d", offset, offset+length-1),
+			}
+
+			res, err := m.client.Client().DownloadRequest(ctx, u, &download)
+			if err != nil {
+				return err
+			}
+			if res.StatusCode != http.StatusPartialContent {
+				res.Body.Close()
+				return fmt.Errorf("ranged download of %s: %s", file, res.Status)
+			}
+			_, err = io.CopyN(w, res.Body, length)
+			res.Body.Close()
+			if err != nil {
+				return fmt.Errorf("short read at offset %d: %w", offset, err)
+			}
+		}
+	}
+	return nil
+}
+
+// flatFileName returns the data file of a flat disk given its descriptor
+func flatFileName(descriptor string) string {
+	return strings.TrimSuffix(descriptor, ".vmdk") + "-flat.vmdk"
+}
@@ -0,0 +1,187 @@
+package backup
+
+import (
+	"context"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// cbtFixture is a vcsim VM whose first disk has a flat file on the
+// simulator datastore and a scripted CBT history
+type cbtFixture struct {
+	manager *BackupManager
+	target  *memoryTarget
+	vmName  string
+	disk    *types.VirtualDisk
+	flat    *os.File
+
+	// changed areas reported per change ID and the change IDs queried
+	changes map[string][]types.DiskChangeExtent
+	queried []string
+}
+
+func newCBTFixture(t *testing.T) *cbtFixture {
+	t.Helper()
+
+	c, model := newSimulatorClient(t)
+	dir := t.TempDir()
+	f := &cbtFixture{
+		target:  newMemoryTarget(),
+		changes: make(map[string][]types.DiskChangeExtent),
+	}
+
+	var err error
+	f.manager, err = NewBackupManagerWithConfig(c, &Config{
+		CatalogPath: filepath.Join(dir, "catalog.db"),
+		TempDir:     dir,
+		ResolveTarget: func(location string) (BackupTarget, error) {
+			return f.target, nil
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { f.manager.Close() })
+
+	f.vmName = firstVMName(t, f.manager)
+	vmObj, err := c.FindVM(context.Background(), f.vmName)
+	require.NoError(t, err)
+	vm := model.Service.Context.Map.Get(vmObj.Reference()).(*simulator.VirtualMachine)
+	f.disk = object.VirtualDeviceList(vm.Config.Hardware.Device).SelectByType((*types.VirtualDisk)(nil))[0].(*types.VirtualDisk)
+
+	var dsPath object.DatastorePath
+	require.True(t, dsPath.FromString(f.disk.Backing.(*types.VirtualDiskFlatVer2BackingInfo).FileName))
+	ds := model.Service.Context.Map.Any("Datastore").(*simulator.Datastore)
+	f.flat, err = os.Create(filepath.Join(ds.Info.GetDatastoreInfo().Url, flatFileName(dsPath.Path)))
+	require.NoError(t, err)
+	t.Cleanup(func() { f.flat.Close() })
+	require.NoError(t, f.flat.Truncate(4<<20))
+
+	f.manager.queryChangedDiskAreas = func(ctx context.Context, vm, snapshot types.ManagedObjectReference, deviceKey int32, offset int64, changeID string) (types.DiskChangeInfo, error) {
+		f.queried = append(f.queried, changeID)
+		return types.DiskChangeInfo{
+			StartOffset: offset,
+			Length:      f.disk.CapacityInBytes - offset,
+			ChangedArea: f.changes[changeID],
+		}, nil
+	}
+	return f
+}
+
+// write fills an area of the disk with random data; queries against
+// sinceChangeID report it as changed
+func (f *cbtFixture) write(t *testing.T, sinceChangeID string, offset, length int64) {
+	t.Helper()
+
+	data := make([]byte, length)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	_, err = f.flat.WriteAt(data, offset)
+	require.NoError(t, err)
+
+	f.changes[sinceChangeID] = append(f.changes[sinceChangeID], types.DiskChangeExtent{Start: offset, Length: length})
+}
+
+// setChangeID sets the change ID the next snapshot of the disk reports
+func (f *cbtFixture) setChangeID(changeID string) {
+	f.disk.Backing.(*types.VirtualDiskFlatVer2BackingInfo).ChangeId = changeID
+}
+
+func (f *cbtFixture) backup(t *testing.T) *BackupInfo {
+	t.Helper()
+
+	info, err := f.manager.CreateBackup(context.Background(), BackupOptions{
+		VMName:      f.vmName,
+		Compress:    true,
+		Incremental: true,
+		Target:      f.target,
+	})
+	require.NoError(t, err)
+	return info
+}
+
+func TestIncrementalBackupChain(t *testing.T) {
+	f := newCBTFixture(t)
+	ctx := context.Background()
+
+	f.write(t, "*", 0, 128<<10)
+	f.write(t, "*", 1<<20, 64<<10)
+	f.setChangeID("cid-1")
+	full := f.backup(t)
+	assert.Empty(t, full.ParentID)
+
+	f.write(t, "cid-1", 64<<10, 4<<10)
+	f.write(t, "cid-1", 2<<20, 64<<10)
+	f.setChangeID("cid-2")
+	incr := f.backup(t)
+	assert.Equal(t, full.ID, incr.ParentID)
+	assert.Equal(t, []string{"*", "cid-1"}, f.queried)
+	assert.Less(t, incr.Size, full.Size)
+
+	entry, err := f.manager.catalog.GetBackup(incr.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "cbt", entry.Metadata["format"])
+	assert.Equal(t, "cid-2", entry.Metadata[changeIDKey(f.disk.Key)])
+
+	result, err := f.manager.VerifyBackup(ctx, VerifyOptions{BackupID: incr.ID, Target: f.target})
+	require.NoError(t, err)
+	assert.True(t, result.Passed, result.Error)
+
+	// The staged disk matches the flat file as of the incremental backup
+	stageDir := t.TempDir()
+	_, files, err := f.manager.stageChain(ctx, entry, RestoreOptions{Target: f.target}, stageDir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	data, err := os.ReadFile(files[0].path)
+	require.NoError(t, err)
+	header, grains := readGrains(t, data)
+	assert.Equal(t, uint64(f.disk.CapacityInBytes/sectorSize), header.Capacity)
+
+	want := make([]byte, 4<<20)
+	_, err = f.flat.ReadAt(want, 0)
+	require.NoError(t, err)
+	for grain := int64(0); grain < int64(len(want))/grainSize; grain++ {
+		expected := want[grain*grainSize : (grain+1)*grainSize]
+		if isZero(expected) {
+			assert.NotContains(t, grains, uint64(grain))
+			continue
+		}
+		assert.Equal(t, expected, grains[uint64(grain)], "grain %d", grain)
+	}
+
+	err = f.manager.RestoreBackup(ctx, RestoreOptions{
+		BackupID: incr.ID,
+		NewName:  "restored-vm",
+		Target:   f.target,
+	})
+	require.NoError(t, err)
+	_, err = f.manager.client.FindVM(ctx, "restored-vm")
+	assert.NoError(t, err)
+}
+
+func TestDeleteBackupRefusesChainParent(t *testing.T) {
+	f := newCBTFixture(t)
+	ctx := context.Background()
+
+	f.write(t, "*", 0, 64<<10)
+	f.setChangeID("cid-1")
+	full := f.backup(t)
+	f.write(t, "cid-1", 0, 4<<10)
+	f.setChangeID("cid-2")
+	incr := f.backup(t)
+
+	err := f.manager.DeleteBackup(ctx, full.ID)
+	assert.ErrorContains(t, err, "parent of incremental backup "+incr.ID)
+	assert.Contains(t, f.target.data, full.ID)
+
+	require.NoError(t, f.manager.DeleteBackup(ctx, incr.ID))
+	require.NoError(t, f.manager.DeleteBackup(ctx, full.ID))
+	assert.Empty(t, f.target.data)
+}
@@ -0,0 +1,98 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"math/bits"
+)
+
+// gearTable maps bytes to the pseudo-random values of the rolling gear
+// hash. It is derived from fixed seeds and must never change: chunk
+// boundaries, and so deduplication against existing repositories, depend
+// on it.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	for i := range table {
+		sum := sha256.Sum256([]byte{'c', 'e', 's', 'o', byte(i)})
+		table[i] = binary.LittleEndian.Uint64(sum[:8])
+	}
+	return table
+}()
+
+// chunker splits a stream into content-defined chunks using a gear hash,
+// so an insertion or deletion only changes the chunks around it
+type chunker struct {
+	r        io.Reader
+	buf      []byte
+	start    int // first unread byte in buf
+	end      int // end of data in buf
+	eof      bool
+	min, max int
+	mask     uint64
+}
+
+// newChunker returns a chunker producing chunks between min and max bytes
+// long, avg bytes on average; avg must be a power of two
+func newChunker(r io.Reader, min, avg, max int) *chunker {
+	maskBits := bits.Len(uint(avg)) - 1
+	return &chunker{
+		r:    r,
+		buf:  make([]byte, 2*max),
+		min:  min,
+		max:  max,
+		mask: ((1 << maskBits) - 1) << (64 - maskBits),
+	}
+}
+
+// next returns the next chunk, or io.EOF after the last one. The chunk is
+// only valid until the following call.
+func (c *chunker) next() ([]byte, error) {
+	if err := c.fill(); err != nil {
+		return nil, err
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	data := c.buf[c.start:c.end]
+	cut := len(data)
+	if cut > c.max {
+		cut = c.max
+	}
+	if cut > c.min {
+		var hash uint64
+		for i := c.min; i < cut; i++ {
+			hash = hash<<1 + gearTable[data[i]]
+			if hash&c.mask == 0 {
+				cut = i + 1
+				break
+			}
+		}
+	}
+
+	c.start += cut
+	return data[:cut], nil
+}
+
+// fill reads until at least max bytes are buffered or the stream ends
+func (c *chunker) fill() error {
+	if c.end-c.start >= c.max || c.eof {
+		return nil
+	}
+
+	copy(c.buf, c.buf[c.start:c.end])
+	c.end -= c.start
+	c.start = 0
+
+	for c.end < len(c.buf) && !c.eof {
+		n, err := c.r.Read(c.buf[c.end:])
+		c.end += n
+		if err == io.EOF {
+			c.eof = true
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,324 @@
+package backup
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/r11/esxi-commander/internal/storage"
+	"github.com/vmware/govmomi/nfc"
+	"github.com/vmware/govmomi/vim25/soap"
+)
+
+// stagedDisk is a raw disk image rebuilt from the members of a CBT chain
+type stagedDisk struct {
+	file     *os.File
+	capacity int64
+	data     []extent // ranges written so far
+}
+
+// chainMember is what one CBT backup contributes to a restore
+type chainMember struct {
+	descriptor string
+	index      *cbtIndex
+}
+
+// importChain restores a CBT backup. The chain is applied oldest first to
+// sparse raw images in the temp directory, which are then encoded as
+// streamOptimized VMDKs and uploaded through an NFC import lease.
+func (m *BackupManager) importChain(ctx context.Context, entry *storage.BackupEntry, opts RestoreOptions) error {
+	stageDir, err := os.MkdirTemp(m.config.TempDir, entry.ID+"-")
+	if err != nil {
+		return fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	defer os.RemoveAll(stageDir)
+
+	opts.Progress.report("stage chain", -1)
+	descriptor, files, err := m.stageChain(ctx, entry, opts, stageDir)
+	if err != nil {
+		return err
+	}
+
+	return m.importDescriptor(ctx, opts.NewName, descriptor, func(lease *nfc.Lease, info *nfc.LeaseInfo) error {
+		items := make(map[string]nfc.FileItem)
+		for _, item := range info.Items {
+			items[path.Base(item.Path)] = item
+		}
+
+		for _, file := range files {
+			item, ok := items[file.name]
+			if !ok {
+				return fmt.Errorf("import lease has no item for %s", file.name)
+			}
+			if err := uploadStaged(ctx, lease, item, file, opts.Progress); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// stageChain applies every backup in the chain ending at entry and writes
+// the resulting disks as streamOptimized VMDKs to stageDir. Returns the OVF
+// descriptor of entry and the staged disks.
+func (m *BackupManager) stageChain(ctx context.Context, entry *storage.BackupEntry, opts RestoreOptions, stageDir string) (string, []exportedFile, error) {
+	disks := make(map[int32]*stagedDisk)
+	defer closeStaged(disks)
+
+	last, err := m.applyChain(ctx, entry, opts, stageDir, disks)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var files []exportedFile
+	for _, disk := range last.index.Disks {
+		file, err := encodeStagedDisk(stageDir, disk.File, disks[disk.Key])
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to encode disk %d: %w", disk.Key, err)
+		}
+		files = append(files, file)
+	}
+
+	return last.descriptor, files, nil
+}
+
+// applyChain applies the chain ending at entry, oldest first, to raw disk
+// images in stageDir and returns what entry itself holds
+func (m *BackupManager) applyChain(ctx context.Context, entry *storage.BackupEntry, opts RestoreOptions, stageDir string, disks map[int32]*stagedDisk) (*chainMember, error) {
+	chain, err := m.catalog.GetChain(entry.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve backup chain: %w", err)
+	}
+
+	var last *chainMember
+	for _, member := range chain {
+		if member.Status != "completed" {
+			return nil, fmt.Errorf("backup %s in the chain is %s", member.ID, member.Status)
+		}
+
+		var primary BackupTarget
+		if member.ID == entry.ID {
+			primary = opts.Target
+		}
+
+		identities, err := loadIdentities(member, opts.IdentityFile)
+		if err != nil {
+			return nil, err
+		}
+
+		// Extents land at fixed offsets, so a replica can be applied over
+		// a copy that failed part-way
+		_, err = m.firstIntact(member, primary, func(target BackupTarget) (err error) {
+			last, err = m.applyChainMember(ctx, target, member, identities, stageDir, disks)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to apply backup %s: %w", member.ID, err)
+		}
+	}
+	return last, nil
+}
+
+// closeStaged closes and removes staged raw disk images
+func closeStaged(disks map[int32]*stagedDisk) {
+	for _, disk := range disks {
+		disk.file.Close()
+		os.Remove(disk.file.Name())
+	}
+}
+
+// applyChainMember streams one CBT backup, writing its extents into the
+// staged disks and checking the stored checksum and manifest
+func (m *BackupManager) applyChainMember(ctx context.Context, target BackupTarget, entry *storage.BackupEntry, identities []age.Identity, stageDir string, disks map[int32]*stagedDisk) (*chainMember, error) {
+	if entry.Checksum == "" {
+		return nil, fmt.Errorf("backup %s has no checksum", entry.ID)
+	}
+
+	rc, err := target.Retrieve(ctx, entry.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve backup: %w", err)
+	}
+	defer rc.Close()
+
+	hasher := sha256.New()
+	reader := io.TeeReader(rc, hasher)
+
+	member := &chainMember{}
+	var manifest map[string]string
+	digests := make(map[string]string)
+
+	err = walkArchive(reader, identities, func(header *tar.Header, r io.Reader) error {
+		fileHasher := sha256.New()
+		r = io.TeeReader(r, fileHasher)
+
+		switch name := path.Base(header.Name); {
+		case strings.HasSuffix(name, ".cbt.json"):
+			index := &cbtIndex{}
+			if err := json.NewDecoder(r).Decode(index); err != nil {
+				return fmt.Errorf("invalid backup index: %w", err)
+			}
+			if err := stageIndex(stageDir, index, disks); err != nil {
+				return err
+			}
+			member.index = index
+		case path.Ext(name) == ".ovf":
+			data, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			member.descriptor = string(data)
+		case path.Ext(name) == ".mf":
+			data, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			manifest = parseManifest(data)
+			return nil
+		case path.Ext(name) == ".extents":
+			if member.index == nil {
+				return fmt.Errorf("%s precedes the backup index", name)
+			}
+			if err := applyExtents(member.index, name, r, disks); err != nil {
+				return err
+			}
+		}
+
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			return err
+		}
+		digests[path.Base(header.Name)] = hex.EncodeToString(fileHasher.Sum(nil))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup archive: %w", err)
+	}
+
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		return nil, fmt.Errorf("failed to read backup: %w", err)
+	}
+	if checksum := hex.EncodeToString(hasher.Sum(nil)); checksum != entry.Checksum {
+		return nil, fmt.Errorf("backup checksum mismatch: catalog has %s, artifact is %s", entry.Checksum, checksum)
+	}
+
+	if manifest == nil {
+		return nil, fmt.Errorf("backup archive has no manifest")
+	}
+	for name, expected := range manifest {
+		actual, ok := digests[name]
+		if !ok {
+			return nil, fmt.Errorf("backup archive is missing %s", name)
+		}
+		if actual != expected {
+			return nil, fmt.Errorf("checksum mismatch for %s: manifest has %s, got %s", name, expected, actual)
+		}
+	}
+
+	if member.index == nil || member.descriptor == "" {
+		return nil, fmt.Errorf("backup archive has no index or OVF descriptor")
+	}
+	return member, nil
+}
+
+// stageIndex creates the raw image of every disk a backup holds in full and
+// checks that incremental disks have a base earlier in the chain
+func stageIndex(stageDir string, index *cbtIndex, disks map[int32]*stagedDisk) error {
+	for _, disk := range index.Disks {
+		staged, ok := disks[disk.Key]
+		if !disk.Full {
+			if !ok {
+				return fmt.Errorf("disk %d has no full backup earlier in the chain", disk.Key)
+			}
+			if staged.capacity < disk.Capacity {
+				if err := staged.file.Truncate(disk.Capacity); err != nil {
+					return fmt.Errorf("failed to grow disk %d: %w", disk.Key, err)
+				}
+				staged.capacity = disk.Capacity
+			}
+			continue
+		}
+
+		if ok {
+			staged.file.Close()
+		}
+		file, err := os.Create(filepath.Join(stageDir, fmt.Sprintf("disk-%d.raw", disk.Key)))
+		if err != nil {
+			return fmt.Errorf("failed to stage disk %d: %w", disk.Key, err)
+		}
+		if err := file.Truncate(disk.Capacity); err != nil {
+			file.Close()
+			return fmt.Errorf("failed to stage disk %d: %w", disk.Key, err)
+		}
+		disks[disk.Key] = &stagedDisk{file: file, capacity: disk.Capacity}
+	}
+	return nil
+}
+
+// applyExtents writes the extent data of one disk into its staged image
+func applyExtents(index *cbtIndex, name string, r io.Reader, disks map[int32]*stagedDisk) error {
+	for _, disk := range index.Disks {
+		if disk.extentsName() != name {
+			continue
+		}
+
+		staged := disks[disk.Key]
+		for _, e := range disk.Extents {
+			if _, err := io.CopyN(io.NewOffsetWriter(staged.file, e.Offset), r, e.Length); err != nil {
+				return fmt.Errorf("failed to write disk %d at %d: %w", disk.Key, e.Offset, err)
+			}
+		}
+		staged.data = mergeExtents(append(staged.data, disk.Extents...))
+		return nil
+	}
+	return fmt.Errorf("%s is not in the backup index", name)
+}
+
+// exportedFile is a disk staged locally for upload
+type exportedFile struct {
+	name string
+	path string
+	size int64
+}
+
+// encodeStagedDisk writes a staged raw image as a streamOptimized VMDK
+func encodeStagedDisk(stageDir, name string, disk *stagedDisk) (exportedFile, error) {
+	localPath := filepath.Join(stageDir, name)
+	file, err := os.Create(localPath)
+	if err != nil {
+		return exportedFile{}, err
+	}
+	defer file.Close()
+
+	counter := &countingWriter{}
+	if err := writeStreamOptimized(io.MultiWriter(file, counter), name, disk.capacity, disk.file, disk.data); err != nil {
+		return exportedFile{}, err
+	}
+
+	return exportedFile{name: name, path: localPath, size: counter.n}, file.Close()
+}
+
+// uploadStaged uploads a staged disk to its import lease item
+func uploadStaged(ctx context.Context, lease *nfc.Lease, item nfc.FileItem, f exportedFile, progress ProgressFunc) error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	opts := soap.Upload{
+		ContentLength: f.size,
+		Progress:      progress.sinker("import " + f.name),
+	}
+	if err := lease.Upload(ctx, item, file, opts); err != nil {
+		return fmt.Errorf("failed to upload %s: %w", f.name, err)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package backup
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	payload := bytes.Repeat([]byte("esxi backup payload "), 10000)
+
+	tests := []struct {
+		name    string
+		level   int
+		threads int
+	}{
+		{"none", 0, 0},
+		{"gzip", 0, 0},
+		{"gzip", 9, 0},
+		{"zstd", 0, 0},
+		{"zstd", 19, 4},
+	}
+
+	for _, tt := range tests {
+		codec, err := NewCodec(tt.name, tt.level, tt.threads)
+		require.NoError(t, err)
+		assert.Equal(t, tt.name, codec.Name())
+
+		var buf bytes.Buffer
+		w, err := codec.NewWriter(&buf)
+		require.NoError(t, err)
+		_, err = w.Write(payload)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+
+		if tt.name != "none" {
+			assert.Less(t, buf.Len(), len(payload), "%s should compress", tt.name)
+		}
+
+		r, detected, err := decompress(&buf)
+		require.NoError(t, err)
+		assert.Equal(t, tt.name, detected)
+
+		data, err := io.ReadAll(r)
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+		assert.Equal(t, payload, data)
+	}
+}
+
+func TestNewCodecRejectsInvalidSettings(t *testing.T) {
+	_, err := NewCodec("lz4", 0, 0)
+	assert.Error(t, err)
+
+	_, err = NewCodec("gzip", 12, 0)
+	assert.Error(t, err)
+
+	_, err = NewCodec("zstd", 23, 0)
+	assert.Error(t, err)
+}
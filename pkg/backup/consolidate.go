@@ -0,0 +1,186 @@
+package backup
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/r11/esxi-commander/internal/storage"
+	"github.com/r11/esxi-commander/pkg/audit"
+	"github.com/r11/esxi-commander/pkg/metrics"
+)
+
+// ConsolidateOptions configures building a synthetic full backup
+type ConsolidateOptions struct {
+	VMName       string
+	Target       BackupTarget // Target for the synthetic full; defaults to the target of the newest backup
+	IdentityFile string       // age identity file, required for encrypted chains
+	Compression  string       // Codec; defaults to the codec of the newest backup
+}
+
+// ConsolidateResult describes a synthetic full backup
+type ConsolidateResult struct {
+	Backup *BackupInfo `json:"backup"`
+	Merged []string    `json:"merged"` // chain members merged, oldest first
+}
+
+// ConsolidateBackups merges the newest incremental backup of a VM and the
+// chain it depends on into a new full backup. Only the backup target is
+// read; the VM is not touched. The new backup is verified before it is
+// marked completed and becomes the parent of later incremental backups, so
+// retention can delete the old chain without orphaning children.
+func (m *BackupManager) ConsolidateBackups(ctx context.Context, opts ConsolidateOptions) (*ConsolidateResult, error) {
+	start := time.Now()
+
+	head, err := m.incrementalParent(opts.VMName)
+	if err != nil {
+		return nil, err
+	}
+	if head == nil {
+		return nil, fmt.Errorf("VM %s has no incremental backups", opts.VMName)
+	}
+	if head.ParentID == "" {
+		return nil, fmt.Errorf("newest backup %s of VM %s is already a full backup", head.ID, opts.VMName)
+	}
+
+	chain, err := m.catalog.GetChain(head.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve backup chain: %w", err)
+	}
+
+	auditCtx := audit.GetLogger().LogOperation(ctx, "backup.consolidate", map[string]interface{}{
+		"vm":     opts.VMName,
+		"head":   head.ID,
+		"length": len(chain),
+	})
+
+	result, err := m.consolidate(ctx, head, chain, opts)
+	if err != nil {
+		auditCtx.Failure(err)
+		metrics.RecordBackupOperation("consolidate", "failure", time.Since(start).Seconds())
+		return nil, err
+	}
+
+	auditCtx.Success()
+	metrics.RecordBackupOperation("consolidate", "success", time.Since(start).Seconds())
+	return result, nil
+}
+
+func (m *BackupManager) consolidate(ctx context.Context, head *storage.BackupEntry, chain []*storage.BackupEntry, opts ConsolidateOptions) (*ConsolidateResult, error) {
+	name := opts.Compression
+	if name == "" {
+		name = head.Metadata["compression"]
+	}
+	codec, err := NewCodec(name, m.config.CompressionLevel, m.config.CompressionThreads)
+	if err != nil {
+		return nil, err
+	}
+
+	target := opts.Target
+	if target == nil {
+		target, err = m.targetFor(head.Location)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := m.checkEncryptionTarget(target); err != nil {
+		return nil, err
+	}
+
+	// The synthetic full holds the VM as of the head, so it takes the head's
+	// timestamp for retention and point-in-time restores
+	backupID := fmt.Sprintf("backup-%s-%s", head.VMName, uuid.New().String()[:8])
+	entry := &storage.BackupEntry{
+		ID:        backupID,
+		VMName:    head.VMName,
+		Timestamp: head.Timestamp,
+		Type:      "synthetic",
+		Status:    "pending",
+		Metadata: map[string]string{
+			"description":       fmt.Sprintf("Synthetic full of %s", head.ID),
+			"consolidated_from": head.ID,
+			"consolidated_at":   time.Now().UTC().Format(time.RFC3339),
+			"target":            target.GetLocation(),
+		},
+	}
+	defer m.beginBackup(backupID)()
+	if err := m.catalog.AddBackup(entry); err != nil {
+		return nil, fmt.Errorf("failed to add backup to catalog: %w", err)
+	}
+
+	stageDir, err := os.MkdirTemp(m.config.TempDir, backupID+"-")
+	if err != nil {
+		m.catalog.UpdateBackupStatus(backupID, "failed")
+		return nil, fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	defer os.RemoveAll(stageDir)
+
+	disks := make(map[int32]*stagedDisk)
+	defer closeStaged(disks)
+
+	last, err := m.applyChain(ctx, head, RestoreOptions{IdentityFile: opts.IdentityFile}, stageDir, disks)
+	if err != nil {
+		m.catalog.UpdateBackupStatus(backupID, "failed")
+		return nil, err
+	}
+
+	// Every disk is stored in full with the change IDs of the head, so the
+	// next incremental backup continues from here
+	index := &cbtIndex{}
+	for _, disk := range last.index.Disks {
+		staged := disks[disk.Key]
+		disk.Capacity = staged.capacity
+		disk.Full = true
+		disk.Extents = staged.data
+		index.Disks = append(index.Disks, disk)
+	}
+
+	location, size, checksum, err := m.storeArchive(ctx, backupID, target, codec, func(tw *tar.Writer) error {
+		return writeChanges(tw, head.VMName, last.descriptor, index, func(w io.Writer, disk cbtDisk) error {
+			for _, e := range disk.Extents {
+				if _, err := io.Copy(w, io.NewSectionReader(disks[disk.Key].file, e.Offset, e.Length)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		m.abandonBackup(ctx, target, backupID)
+		return nil, err
+	}
+
+	entry.Size = size
+	entry.Location = location
+	entry.Checksum = checksum
+	entry.Metadata["format"] = "cbt"
+	entry.Metadata["compression"] = codec.Name()
+	for _, disk := range index.Disks {
+		entry.Metadata[changeIDKey(disk.Key)] = disk.ChangeID
+	}
+	m.encryptor.recordEncryption(entry)
+
+	// Read the new artifact back before anything depends on it
+	if err := m.verifyArtifact(ctx, entry, VerifyOptions{Target: target, IdentityFile: opts.IdentityFile}, &VerifyResult{}); err != nil {
+		m.abandonBackup(ctx, target, backupID)
+		return nil, fmt.Errorf("synthetic full failed verification: %w", err)
+	}
+	now := time.Now()
+	entry.LastVerified = &now
+	entry.VerifyStatus = "passed"
+
+	entry.Status = "completed"
+	if err := m.catalog.AddBackup(entry); err != nil {
+		return nil, fmt.Errorf("failed to update catalog: %w", err)
+	}
+
+	result := &ConsolidateResult{Backup: toBackupInfo(entry)}
+	for _, member := range chain {
+		result.Merged = append(result.Merged, member.ID)
+	}
+	return result, nil
+}
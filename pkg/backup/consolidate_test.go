@@ -0,0 +1,104 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/r11/esxi-commander/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stagedGrains restores a backup's first disk into a temp directory and
+// returns its grains
+func stagedGrains(t *testing.T, f *cbtFixture, id string) map[uint64][]byte {
+	t.Helper()
+
+	entry, err := f.manager.catalog.GetBackup(id)
+	require.NoError(t, err)
+	_, files, err := f.manager.stageChain(context.Background(), entry, RestoreOptions{}, t.TempDir())
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	data, err := os.ReadFile(files[0].path)
+	require.NoError(t, err)
+	_, grains := readGrains(t, data)
+	return grains
+}
+
+func TestConsolidateBackupsBuildsSyntheticFull(t *testing.T) {
+	f := newCBTFixture(t)
+	ctx := context.Background()
+
+	f.write(t, "*", 0, 128<<10)
+	f.setChangeID("cid-1")
+	full := f.backup(t)
+	f.write(t, "cid-1", 64<<10, 64<<10)
+	f.setChangeID("cid-2")
+	incr1 := f.backup(t)
+	f.write(t, "cid-2", 1<<20, 4<<10)
+	f.setChangeID("cid-3")
+	incr2 := f.backup(t)
+
+	result, err := f.manager.ConsolidateBackups(ctx, ConsolidateOptions{VMName: f.vmName})
+	require.NoError(t, err)
+	assert.Equal(t, []string{full.ID, incr1.ID, incr2.ID}, result.Merged)
+	assert.Equal(t, "passed", result.Backup.VerifyStatus)
+
+	synthetic, err := f.manager.catalog.GetBackup(result.Backup.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "completed", synthetic.Status)
+	assert.Empty(t, synthetic.ParentID)
+	assert.Equal(t, "cid-3", synthetic.Metadata[changeIDKey(f.disk.Key)])
+	assert.NotEmpty(t, synthetic.Metadata["consolidated_at"])
+	head, err := f.manager.catalog.GetBackup(incr2.ID)
+	require.NoError(t, err)
+	assert.True(t, synthetic.Timestamp.Equal(head.Timestamp), "a synthetic full is as old as the backup it consolidates")
+	assert.Equal(t, stagedGrains(t, f, incr2.ID), stagedGrains(t, f, synthetic.ID))
+
+	// Nothing new to merge
+	_, err = f.manager.ConsolidateBackups(ctx, ConsolidateOptions{VMName: f.vmName})
+	assert.ErrorContains(t, err, "already a full backup")
+
+	// The old chain is no longer needed by anything retention keeps
+	pruned, err := f.manager.PruneBackups(ctx, PruneOptions{VMName: f.vmName, KeepLast: 1})
+	require.NoError(t, err)
+	assert.Equal(t, 3, pruned.Deleted)
+	assert.Len(t, f.target.data, 1)
+
+	f.write(t, "cid-3", 2<<20, 4<<10)
+	f.setChangeID("cid-4")
+	next := f.backup(t)
+	assert.Equal(t, synthetic.ID, next.ParentID)
+}
+
+func TestConsolidateBackupsRequiresChain(t *testing.T) {
+	f := newCBTFixture(t)
+
+	_, err := f.manager.ConsolidateBackups(context.Background(), ConsolidateOptions{VMName: f.vmName})
+	assert.ErrorContains(t, err, "no incremental backups")
+
+	// A failed synthetic full is recorded as failed and never becomes a parent
+	f.write(t, "*", 0, 64<<10)
+	f.setChangeID("cid-1")
+	full := f.backup(t)
+	f.write(t, "cid-1", 0, 4<<10)
+	f.setChangeID("cid-2")
+	f.backup(t)
+	delete(f.target.data, full.ID)
+
+	_, err = f.manager.ConsolidateBackups(context.Background(), ConsolidateOptions{VMName: f.vmName})
+	require.Error(t, err)
+
+	backups, err := f.manager.catalog.ListBackups(f.vmName)
+	require.NoError(t, err)
+	var failed []*storage.BackupEntry
+	for _, backup := range backups {
+		if backup.Type == "synthetic" {
+			failed = append(failed, backup)
+		}
+	}
+	require.Len(t, failed, 1)
+	assert.Equal(t, "failed", failed[0].Status)
+}
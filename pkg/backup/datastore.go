@@ -0,0 +1,113 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/r11/esxi-commander/pkg/esxi/client"
+	"github.com/vmware/govmomi/fault"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// DatastoreTarget stores backups as files on an ESXi datastore
+type DatastoreTarget struct {
+	client    *client.ESXiClient
+	datastore string
+	basePath  string
+}
+
+// NewDatastoreTarget creates a target that writes to basePath on the named
+// datastore. An empty datastore name selects the host's default datastore.
+func NewDatastoreTarget(c *client.ESXiClient, datastore, basePath string) *DatastoreTarget {
+	if basePath == "" {
+		basePath = "backups"
+	}
+
+	return &DatastoreTarget{
+		client:    c,
+		datastore: datastore,
+		basePath:  strings.Trim(basePath, "/"),
+	}
+}
+
+// Store uploads the backup stream to the datastore
+func (t *DatastoreTarget) Store(ctx context.Context, backupID string, reader io.Reader) (string, error) {
+	ds, err := t.resolveDatastore(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	fm := object.NewFileManager(t.client.Client())
+	err = fm.MakeDirectory(ctx, ds.Path(t.basePath), t.client.Datacenter(), true)
+	if err != nil && !fault.Is(err, &types.FileAlreadyExists{}) {
+		return "", fmt.Errorf("failed to create backup directory: %w", err)
+	}
+
+	filePath := t.filePath(backupID)
+	if err := ds.Upload(ctx, reader, filePath, &soap.DefaultUpload); err != nil {
+		return "", fmt.Errorf("failed to upload backup to datastore: %w", err)
+	}
+
+	return fmt.Sprintf("datastore://%s/%s", ds.Name(), filePath), nil
+}
+
+// Retrieve opens the stored backup for reading
+func (t *DatastoreTarget) Retrieve(ctx context.Context, backupID string) (io.ReadCloser, error) {
+	ds, err := t.resolveDatastore(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, _, err := ds.Download(ctx, t.filePath(backupID), &soap.DefaultDownload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download backup from datastore: %w", err)
+	}
+
+	return reader, nil
+}
+
+// Delete removes the stored backup from the datastore
+func (t *DatastoreTarget) Delete(ctx context.Context, backupID string) error {
+	ds, err := t.resolveDatastore(ctx)
+	if err != nil {
+		return err
+	}
+
+	fm := object.NewFileManager(t.client.Client())
+	task, err := fm.DeleteDatastoreFile(ctx, ds.Path(t.filePath(backupID)), t.client.Datacenter())
+	if err != nil {
+		return fmt.Errorf("failed to delete backup from datastore: %w", err)
+	}
+	// A file that is already gone counts as deleted, so deletes can be retried
+	if err := task.Wait(ctx); err != nil && !fault.Is(err, &types.FileNotFound{}) {
+		return fmt.Errorf("failed to delete backup from datastore: %w", err)
+	}
+
+	return nil
+}
+
+// GetLocation returns the base location of the target
+func (t *DatastoreTarget) GetLocation() string {
+	name := t.datastore
+	if name == "" {
+		name = "default"
+	}
+	return fmt.Sprintf("datastore://%s/%s", name, t.basePath)
+}
+
+func (t *DatastoreTarget) filePath(backupID string) string {
+	return path.Join(t.basePath, backupID+".ova")
+}
+
+func (t *DatastoreTarget) resolveDatastore(ctx context.Context) (*object.Datastore, error) {
+	ds, err := t.client.Finder().DatastoreOrDefault(ctx, t.datastore)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find datastore: %w", err)
+	}
+	return ds, nil
+}
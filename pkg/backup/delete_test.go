@@ -0,0 +1,178 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/r11/esxi-commander/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyTarget fails the first delete, like a target that goes away mid-prune
+type flakyTarget struct {
+	*memoryTarget
+	failed bool
+}
+
+func (t *flakyTarget) Delete(ctx context.Context, backupID string) error {
+	if !t.failed {
+		t.failed = true
+		return errors.New("connection reset")
+	}
+	return t.memoryTarget.Delete(ctx, backupID)
+}
+
+func TestDeleteBackupRemovesArtifact(t *testing.T) {
+	manager := newTestManager(t)
+	vmName := firstVMName(t, manager)
+	ctx := context.Background()
+
+	target, err := NewDirectoryTarget(t.TempDir())
+	require.NoError(t, err)
+
+	info, err := manager.CreateBackup(ctx, BackupOptions{
+		VMName:   vmName,
+		Hot:      true,
+		Compress: true,
+		Target:   target,
+	})
+	require.NoError(t, err)
+	require.FileExists(t, target.filePath(info.ID))
+
+	// file:// locations are resolved without a configured resolver
+	require.NoError(t, manager.DeleteBackup(ctx, info.ID))
+
+	_, err = os.Stat(target.filePath(info.ID))
+	assert.True(t, os.IsNotExist(err))
+	_, err = manager.catalog.GetBackup(info.ID)
+	assert.Error(t, err)
+}
+
+func TestPruneResumesInterruptedDeletes(t *testing.T) {
+	dir := t.TempDir()
+	target := &flakyTarget{memoryTarget: newMemoryTarget()}
+
+	manager, err := NewBackupManagerWithConfig(nil, &Config{
+		CatalogPath: filepath.Join(dir, "catalog.db"),
+		ResolveTarget: func(location string) (BackupTarget, error) {
+			return target, nil
+		},
+	})
+	require.NoError(t, err)
+	defer manager.Close()
+
+	ctx := context.Background()
+	old := time.Now().AddDate(0, 0, -60)
+	for i, id := range []string{"old-1", "old-2", "new"} {
+		target.data[id] = make([]byte, 100*(i+1))
+		timestamp := old.Add(time.Duration(i) * time.Hour)
+		if id == "new" {
+			timestamp = time.Now()
+		}
+		require.NoError(t, manager.catalog.AddBackup(&storage.BackupEntry{
+			ID:        id,
+			VMName:    "vm",
+			Timestamp: timestamp,
+			Size:      int64(len(target.data[id])),
+			Location:  "memory://" + id,
+			Status:    "completed",
+			Metadata:  map[string]string{},
+		}))
+	}
+
+	// The artifact delete fails, so the entry is kept and marked deleting
+	require.Error(t, manager.DeleteBackup(ctx, "old-1"))
+	entry, err := manager.catalog.GetBackup("old-1")
+	require.NoError(t, err)
+	assert.Equal(t, "deleting", entry.Status)
+	assert.Contains(t, target.data, "old-1")
+
+	result, err := manager.PruneBackups(ctx, PruneOptions{KeepLast: 1, KeepDays: 30, DryRun: true})
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Deleted, "a dry run does not resume deletes")
+	assert.Equal(t, int64(200), result.FreedBytes)
+
+	result, err = manager.PruneBackups(ctx, PruneOptions{KeepLast: 1, KeepDays: 30})
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Deleted)
+	assert.Equal(t, 0, result.Failed)
+	assert.Equal(t, int64(300), result.FreedBytes)
+
+	remaining, err := manager.catalog.ListBackups("")
+	require.NoError(t, err)
+	require.Len(t, remaining, 1)
+	assert.Equal(t, "new", remaining[0].ID)
+	assert.NotContains(t, target.data, "old-1")
+	assert.NotContains(t, target.data, "old-2")
+}
+
+func TestPruneReportsFailedDeletes(t *testing.T) {
+	target := &flakyTarget{memoryTarget: newMemoryTarget()}
+
+	manager, err := NewBackupManagerWithConfig(nil, &Config{
+		CatalogPath: filepath.Join(t.TempDir(), "catalog.db"),
+		ResolveTarget: func(location string) (BackupTarget, error) {
+			return target, nil
+		},
+	})
+	require.NoError(t, err)
+	defer manager.Close()
+
+	old := time.Now().AddDate(0, 0, -60)
+	for i, id := range []string{"old", "new"} {
+		target.data[id] = make([]byte, 100)
+		require.NoError(t, manager.catalog.AddBackup(&storage.BackupEntry{
+			ID:        id,
+			VMName:    "vm",
+			Timestamp: old.Add(time.Duration(i) * time.Hour),
+			Size:      100,
+			Location:  "memory://" + id,
+			Status:    "completed",
+			Metadata:  map[string]string{},
+		}))
+	}
+
+	result, err := manager.PruneBackups(context.Background(), PruneOptions{KeepLast: 1})
+	require.NoError(t, err)
+	assert.Equal(t, 0, result.Deleted)
+	assert.Equal(t, 1, result.Failed)
+	assert.Equal(t, map[string]string{"old": "failed to delete backup artifact: connection reset"}, result.Errors)
+}
+
+func TestDeleteFailedBackupAbortsUpload(t *testing.T) {
+	fake, target := newFakeS3(t)
+	var resolved []string
+
+	manager, err := NewBackupManagerWithConfig(nil, &Config{
+		CatalogPath: filepath.Join(t.TempDir(), "catalog.db"),
+		ResolveTarget: func(location string) (BackupTarget, error) {
+			resolved = append(resolved, location)
+			return target, nil
+		},
+	})
+	require.NoError(t, err)
+	defer manager.Close()
+
+	// A failed backup whose incomplete upload could not be aborted at the time
+	ctx := context.Background()
+	_, err = target.Store(ctx, "backup-failed", iotest.ErrReader(errors.New("connection reset")))
+	require.Error(t, err)
+	require.Len(t, fake.uploads, 1)
+	require.NoError(t, manager.catalog.AddBackup(&storage.BackupEntry{
+		ID:        "backup-failed",
+		VMName:    "vm",
+		Timestamp: time.Now(),
+		Status:    "failed",
+		Metadata:  map[string]string{"target": target.GetLocation()},
+	}))
+
+	require.NoError(t, manager.DeleteBackup(ctx, "backup-failed"))
+	assert.Equal(t, []string{"s3://backups/esxi/backup-failed"}, resolved)
+	assert.Empty(t, fake.uploads)
+}
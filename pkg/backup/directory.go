@@ -0,0 +1,236 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DirectoryTarget stores backups in a local directory, typically an NFS mount
+type DirectoryTarget struct {
+	path string
+}
+
+// DirectoryManifest is the sidecar JSON written next to each backup file
+type DirectoryManifest struct {
+	BackupID string    `json:"backup_id"`
+	File     string    `json:"file"`
+	Size     int64     `json:"size"`
+	SHA256   string    `json:"sha256"`
+	Created  time.Time `json:"created"`
+}
+
+// NewDirectoryTarget creates a target rooted at path, creating it if needed
+func NewDirectoryTarget(path string) (*DirectoryTarget, error) {
+	if path == "" {
+		return nil, fmt.Errorf("directory target path cannot be empty")
+	}
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid directory target path: %w", err)
+	}
+
+	if err := os.MkdirAll(abs, 0750); err != nil {
+		return nil, fmt.Errorf("failed to create backup directory: %w", err)
+	}
+
+	return &DirectoryTarget{path: abs}, nil
+}
+
+// Store writes the backup to a temporary file, fsyncs it and renames it into
+// place, so a crashed or failed backup never leaves a partial artifact behind
+func (t *DirectoryTarget) Store(ctx context.Context, backupID string, reader io.Reader) (string, error) {
+	finalPath := t.filePath(backupID)
+
+	hasher := sha256.New()
+	size, err := writeFileAtomic(finalPath, io.TeeReader(&contextReader{ctx: ctx, r: reader}, hasher))
+	if err != nil {
+		return "", fmt.Errorf("failed to write backup: %w", err)
+	}
+
+	manifest := DirectoryManifest{
+		BackupID: backupID,
+		File:     filepath.Base(finalPath),
+		Size:     size,
+		SHA256:   hex.EncodeToString(hasher.Sum(nil)),
+		Created:  time.Now().UTC(),
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+
+	if _, err := writeFileAtomic(t.manifestPath(backupID), bytes.NewReader(data)); err != nil {
+		os.Remove(finalPath)
+		return "", fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	return "file://" + finalPath, nil
+}
+
+// Retrieve opens the backup file for reading
+func (t *DirectoryTarget) Retrieve(ctx context.Context, backupID string) (io.ReadCloser, error) {
+	file, err := os.Open(t.filePath(backupID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open backup: %w", err)
+	}
+	return file, nil
+}
+
+// Delete removes the backup file and its manifest
+func (t *DirectoryTarget) Delete(ctx context.Context, backupID string) error {
+	if err := os.Remove(t.filePath(backupID)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete backup: %w", err)
+	}
+	if err := os.Remove(t.manifestPath(backupID)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete backup manifest: %w", err)
+	}
+	return syncDir(t.path)
+}
+
+// chattr runs chattr(1) on paths. Setting the immutable attribute needs
+// CAP_LINUX_IMMUTABLE and a filesystem that supports it, such as ext4 or
+// XFS; tests replace it.
+var chattr = func(ctx context.Context, flag string, paths ...string) error {
+	out, err := exec.CommandContext(ctx, "chattr", append([]string{flag}, paths...)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("chattr %s failed: %s: %w", flag, strings.TrimSpace(string(out)), err)
+	}
+	return nil
+}
+
+// Lock sets the immutable attribute on the backup file and its manifest.
+// The attribute does not expire: the manager clears it with Unlock when it
+// deletes the backup after the retention date.
+func (t *DirectoryTarget) Lock(ctx context.Context, backupID string, until time.Time) error {
+	return chattr(ctx, "+i", t.filePath(backupID), t.manifestPath(backupID))
+}
+
+// SetLegalHold sets the immutable attribute for a hold. Releasing a hold
+// leaves the attribute in place, since a retention lock may still need it.
+func (t *DirectoryTarget) SetLegalHold(ctx context.Context, backupID string, hold bool) error {
+	if !hold {
+		return nil
+	}
+	return chattr(ctx, "+i", t.filePath(backupID), t.manifestPath(backupID))
+}
+
+// Unlock clears the immutable attribute so the backup can be deleted. Files
+// without it are left alone, so filesystems lacking the attribute, such as
+// NFS, never need chattr.
+func (t *DirectoryTarget) Unlock(ctx context.Context, backupID string) error {
+	var paths []string
+	for _, p := range []string{t.filePath(backupID), t.manifestPath(backupID)} {
+		if isImmutable(p) {
+			paths = append(paths, p)
+		}
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+	return chattr(ctx, "-i", paths...)
+}
+
+// isImmutable reports whether path has the immutable (or append-only)
+// attribute: opening such a file for writing fails with EPERM, even for
+// root
+func isImmutable(path string) bool {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return errors.Is(err, syscall.EPERM)
+	}
+	f.Close()
+	return false
+}
+
+// GetLocation returns the base location of the target
+func (t *DirectoryTarget) GetLocation() string {
+	return "file://" + t.path
+}
+
+// ReadManifest returns the sidecar manifest of a stored backup
+func (t *DirectoryTarget) ReadManifest(backupID string) (*DirectoryManifest, error) {
+	data, err := os.ReadFile(t.manifestPath(backupID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	var manifest DirectoryManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	return &manifest, nil
+}
+
+func (t *DirectoryTarget) filePath(backupID string) string {
+	return filepath.Join(t.path, backupID+".ova")
+}
+
+func (t *DirectoryTarget) manifestPath(backupID string) string {
+	return filepath.Join(t.path, backupID+".ova.json")
+}
+
+// writeFileAtomic writes r to a temporary file next to path, fsyncs it and
+// renames it over path, then fsyncs the directory
+func writeFileAtomic(path string, r io.Reader) (int64, error) {
+	dir := filepath.Dir(path)
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return 0, err
+	}
+	tmpPath := tmp.Name()
+
+	size, err := io.Copy(tmp, r)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return 0, err
+	}
+
+	return size, syncDir(dir)
+}
+
+// syncDir fsyncs a directory so renames and removals are durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// contextReader stops a copy when its context is cancelled
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
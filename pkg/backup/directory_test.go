@@ -0,0 +1,86 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirectoryTargetRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	target, err := NewDirectoryTarget(dir)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	location, err := target.Store(ctx, "backup-test", strings.NewReader("payload"))
+	require.NoError(t, err)
+	assert.Equal(t, "file://"+filepath.Join(dir, "backup-test.ova"), location)
+
+	manifest, err := target.ReadManifest("backup-test")
+	require.NoError(t, err)
+	sum := sha256.Sum256([]byte("payload"))
+	assert.Equal(t, "backup-test", manifest.BackupID)
+	assert.Equal(t, "backup-test.ova", manifest.File)
+	assert.Equal(t, int64(len("payload")), manifest.Size)
+	assert.Equal(t, hex.EncodeToString(sum[:]), manifest.SHA256)
+
+	reader, err := target.Retrieve(ctx, "backup-test")
+	require.NoError(t, err)
+	data, err := io.ReadAll(reader)
+	reader.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "payload", string(data))
+
+	require.NoError(t, target.Delete(ctx, "backup-test"))
+	_, err = target.Retrieve(ctx, "backup-test")
+	assert.Error(t, err)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+// failingReader returns some data and then an error, like an export that
+// breaks half way through
+type failingReader struct {
+	sent bool
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if !r.sent {
+		r.sent = true
+		return copy(p, "partial"), nil
+	}
+	return 0, errors.New("export failed")
+}
+
+func TestDirectoryTargetLeavesNoPartialArtifact(t *testing.T) {
+	dir := t.TempDir()
+	target, err := NewDirectoryTarget(dir)
+	require.NoError(t, err)
+
+	_, err = target.Store(context.Background(), "backup-test", &failingReader{})
+	require.Error(t, err)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "a failed store must not leave files behind")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = target.Store(ctx, "backup-test", strings.NewReader("payload"))
+	require.ErrorIs(t, err, context.Canceled)
+
+	entries, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
@@ -0,0 +1,361 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/r11/esxi-commander/internal/storage"
+	"github.com/r11/esxi-commander/pkg/audit"
+	"github.com/r11/esxi-commander/pkg/metrics"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// DefaultDrillTimeout bounds a drill from power on to its last check
+// unless DrillOptions.Timeout is set
+const DefaultDrillTimeout = 10 * time.Minute
+
+// drillPollInterval is how often a drill checks on the guest
+var drillPollInterval = 5 * time.Second
+
+type DrillOptions struct {
+	BackupID     string // Backup to drill; empty selects the newest completed backup of VMName
+	VMName       string
+	Network      string        // Isolated port group every NIC of the drill VM is connected to
+	Target       BackupTarget  // Target holding the backup; defaults to the one its location names
+	IdentityFile string        // age identity file, required for encrypted backups
+	Timeout      time.Duration // From power on to the last check; defaults to DefaultDrillTimeout
+	WaitIP       bool          // Also wait for the guest to report an IP address
+	ProbePort    int           // Also connect to this TCP port on the guest IP; implies WaitIP
+	Progress     ProgressFunc  // Receives restore progress and drill steps; may be nil
+}
+
+// DrillResult is the outcome of a restore drill of one backup
+type DrillResult struct {
+	BackupID string `json:"backup_id"`
+	VMName   string `json:"vm_name"`
+	storage.DrillRecord
+}
+
+// DrillBackup proves a backup can be restored: it restores the backup under
+// a throwaway name, connects every NIC to an isolated network before the
+// first boot, powers the VM on and waits for the VMware Tools heartbeat and,
+// if asked, a guest IP address and an open TCP port. The drill VM is
+// destroyed whatever the outcome, which is recorded in the catalog and
+// published as metrics. A failed drill returns the result and an error.
+func (m *BackupManager) DrillBackup(ctx context.Context, opts DrillOptions) (*DrillResult, error) {
+	start := time.Now()
+
+	auditCtx := audit.GetLogger().LogOperation(ctx, "backup.drill", map[string]interface{}{
+		"backup_id":  opts.BackupID,
+		"vm":         opts.VMName,
+		"network":    opts.Network,
+		"probe_port": opts.ProbePort,
+	})
+
+	result, err := m.drill(ctx, opts)
+	if result != nil {
+		auditCtx.SetParameter("drill_vm", result.DrillVM)
+	}
+	if err != nil {
+		metrics.RecordBackupOperation("drill", "failure", time.Since(start).Seconds())
+		auditCtx.Failure(err)
+		return result, err
+	}
+
+	metrics.RecordBackupOperation("drill", "success", time.Since(start).Seconds())
+	auditCtx.Success()
+	return result, nil
+}
+
+func (m *BackupManager) drill(ctx context.Context, opts DrillOptions) (*DrillResult, error) {
+	if opts.Network == "" {
+		return nil, fmt.Errorf("a drill needs an isolated network for the drill VM")
+	}
+
+	entry, err := m.drillEntry(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Look the network up before restoring so a typo fails fast
+	network, err := m.client.Finder().Network(ctx, opts.Network)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find drill network %s: %w", opts.Network, err)
+	}
+	backing, err := network.EthernetCardBackingInfo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to use drill network %s: %w", opts.Network, err)
+	}
+
+	if opts.Target == nil {
+		opts.Target, err = m.targetFor(entry.Location)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result := &DrillResult{BackupID: entry.ID, VMName: entry.VMName}
+	result.Started = time.Now()
+	result.DrillVM = fmt.Sprintf("drill-%s-%s", entry.VMName, uuid.New().String()[:8])
+
+	drillErr := m.runDrill(ctx, entry, opts, backing, &result.DrillRecord)
+
+	// The drill VM goes whatever happened, even if the drill was cancelled
+	cleanupErr := m.destroyDrillVM(context.WithoutCancel(ctx), result.DrillVM)
+
+	result.Duration = time.Since(result.Started)
+	result.Passed = drillErr == nil
+	if drillErr != nil {
+		result.Error = drillErr.Error()
+	}
+
+	PublishDrill(entry.VMName, &result.DrillRecord)
+
+	if err := m.catalog.RecordDrill(entry.ID, &result.DrillRecord); err != nil {
+		return result, fmt.Errorf("failed to record drill: %w", err)
+	}
+
+	switch {
+	case drillErr != nil && cleanupErr != nil:
+		return result, fmt.Errorf("%w (drill VM %s left behind: %v)", drillErr, result.DrillVM, cleanupErr)
+	case drillErr != nil:
+		return result, drillErr
+	case cleanupErr != nil:
+		return result, fmt.Errorf("drill passed but drill VM %s was left behind: %w", result.DrillVM, cleanupErr)
+	}
+	return result, nil
+}
+
+// PublishDrill sets the drill metrics of a VM from its most recent drill
+func PublishDrill(vmName string, record *storage.DrillRecord) {
+	metrics.RecordBackupDrill(vmName, record.Passed, record.Started, map[string]float64{
+		"restore":   record.Restore.Seconds(),
+		"heartbeat": record.Heartbeat.Seconds(),
+		"probe":     record.Probe.Seconds(),
+		"total":     record.Duration.Seconds(),
+	})
+}
+
+// drillEntry returns the backup a drill restores
+func (m *BackupManager) drillEntry(opts DrillOptions) (*storage.BackupEntry, error) {
+	if opts.BackupID != "" {
+		entry, err := m.catalog.GetBackup(opts.BackupID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get backup from catalog: %w", err)
+		}
+		if entry.Status != "completed" {
+			return nil, fmt.Errorf("backup is not completed: %s", entry.Status)
+		}
+		return entry, nil
+	}
+
+	if opts.VMName == "" {
+		return nil, fmt.Errorf("a backup ID or VM name is required")
+	}
+
+	entries, err := m.catalog.ListBackups(opts.VMName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+
+	var latest *storage.BackupEntry
+	for _, entry := range entries {
+		if entry.Status == "completed" && (latest == nil || entry.Timestamp.After(latest.Timestamp)) {
+			latest = entry
+		}
+	}
+	if latest == nil {
+		return nil, fmt.Errorf("no completed backups of VM %s", opts.VMName)
+	}
+	return latest, nil
+}
+
+// runDrill restores, isolates and boots the drill VM and runs the checks,
+// filling in the timings of record as it goes
+func (m *BackupManager) runDrill(ctx context.Context, entry *storage.BackupEntry, opts DrillOptions, backing types.BaseVirtualDeviceBackingInfo, record *storage.DrillRecord) error {
+	restoreStart := time.Now()
+	err := m.RestoreBackup(ctx, RestoreOptions{
+		BackupID:     entry.ID,
+		NewName:      record.DrillVM,
+		Target:       opts.Target,
+		IdentityFile: opts.IdentityFile,
+		Progress:     opts.Progress,
+	})
+	if err != nil {
+		return fmt.Errorf("restore failed: %w", err)
+	}
+	record.Restore = time.Since(restoreStart)
+
+	vmObj, err := m.client.FindVM(ctx, record.DrillVM)
+	if err != nil {
+		return fmt.Errorf("failed to find drill VM: %w", err)
+	}
+
+	// The restored NICs still point at the production networks
+	if err := isolateNICs(ctx, vmObj, backing); err != nil {
+		return fmt.Errorf("failed to connect drill VM to %s: %w", opts.Network, err)
+	}
+
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = DefaultDrillTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	bootStart := time.Now()
+	opts.Progress.report("power on", -1)
+	if err := m.vmOps.PowerOn(ctx, vmObj); err != nil {
+		return err
+	}
+
+	opts.Progress.report("heartbeat", -1)
+	_, err = m.waitForGuest(ctx, vmObj.Reference(), func(heartbeat types.ManagedEntityStatus, ip string) bool {
+		return heartbeat == types.ManagedEntityStatusGreen
+	})
+	if err != nil {
+		return drillWaitError("VMware Tools heartbeat", timeout, err)
+	}
+	record.Heartbeat = time.Since(bootStart)
+
+	if !opts.WaitIP && opts.ProbePort == 0 {
+		return nil
+	}
+
+	probeStart := time.Now()
+	opts.Progress.report("guest IP", -1)
+	record.GuestIP, err = m.waitForGuest(ctx, vmObj.Reference(), func(heartbeat types.ManagedEntityStatus, ip string) bool {
+		return ip != ""
+	})
+	if err != nil {
+		return drillWaitError("guest IP address", timeout, err)
+	}
+
+	if opts.ProbePort > 0 {
+		opts.Progress.report("probe", -1)
+		if err := probeTCP(ctx, net.JoinHostPort(record.GuestIP, strconv.Itoa(opts.ProbePort))); err != nil {
+			return drillWaitError("connection to port "+strconv.Itoa(opts.ProbePort), timeout, err)
+		}
+	}
+	record.Probe = time.Since(probeStart)
+	return nil
+}
+
+// isolateNICs connects every NIC of vmObj to backing, connected at power on
+func isolateNICs(ctx context.Context, vmObj *object.VirtualMachine, backing types.BaseVirtualDeviceBackingInfo) error {
+	devices, err := vmObj.Device(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get devices: %w", err)
+	}
+
+	var spec types.VirtualMachineConfigSpec
+	for _, device := range devices {
+		nic, ok := device.(types.BaseVirtualEthernetCard)
+		if !ok {
+			continue
+		}
+
+		card := nic.GetVirtualEthernetCard()
+		card.Backing = backing
+		if card.Connectable == nil {
+			card.Connectable = &types.VirtualDeviceConnectInfo{}
+		}
+		card.Connectable.StartConnected = true
+		spec.DeviceChange = append(spec.DeviceChange, &types.VirtualDeviceConfigSpec{
+			Operation: types.VirtualDeviceConfigSpecOperationEdit,
+			Device:    device,
+		})
+	}
+	if len(spec.DeviceChange) == 0 {
+		return nil
+	}
+
+	task, err := vmObj.Reconfigure(ctx, spec)
+	if err != nil {
+		return err
+	}
+	return task.Wait(ctx)
+}
+
+// waitForGuest polls the guest's heartbeat and IP address until ready
+// accepts them and returns the address
+func (m *BackupManager) waitForGuest(ctx context.Context, ref types.ManagedObjectReference, ready func(heartbeat types.ManagedEntityStatus, ip string) bool) (string, error) {
+	read := m.guestState
+	if read == nil {
+		read = m.readGuestState
+	}
+
+	for {
+		heartbeat, ip, err := read(ctx, ref)
+		if err != nil {
+			return "", err
+		}
+		if ready(heartbeat, ip) {
+			return ip, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(drillPollInterval):
+		}
+	}
+}
+
+// readGuestState returns the VMware Tools heartbeat status and primary IP
+// address of a VM
+func (m *BackupManager) readGuestState(ctx context.Context, ref types.ManagedObjectReference) (types.ManagedEntityStatus, string, error) {
+	var vmMo mo.VirtualMachine
+	if err := m.client.RetrieveOne(ctx, ref, []string{"guestHeartbeatStatus", "guest.ipAddress"}, &vmMo); err != nil {
+		return "", "", fmt.Errorf("failed to read guest state: %w", err)
+	}
+
+	var ip string
+	if vmMo.Guest != nil {
+		ip = vmMo.Guest.IpAddress
+	}
+	return vmMo.GuestHeartbeatStatus, ip, nil
+}
+
+// probeTCP retries connecting to address until it succeeds or ctx is done
+func probeTCP(ctx context.Context, address string) error {
+	dialer := net.Dialer{Timeout: drillPollInterval}
+	for {
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		if err == nil {
+			return conn.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %v", ctx.Err(), err)
+		case <-time.After(drillPollInterval):
+		}
+	}
+}
+
+// drillWaitError describes a drill check that did not pass in time
+func drillWaitError(what string, timeout time.Duration, err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("no %s within %s", what, timeout)
+	}
+	return fmt.Errorf("failed waiting for %s: %w", what, err)
+}
+
+// destroyDrillVM powers off and destroys the drill VM, if it was created
+func (m *BackupManager) destroyDrillVM(ctx context.Context, name string) error {
+	_, err := m.client.FindVM(ctx, name)
+	var notFound *find.NotFoundError
+	if errors.As(err, &notFound) {
+		return nil
+	}
+	return m.vmOps.Delete(ctx, name)
+}
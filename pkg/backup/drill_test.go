@@ -0,0 +1,157 @@
+package backup
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// newDrillManager returns a vcsim backup manager with an "isolated" port
+// group to drill into
+func newDrillManager(t *testing.T) *BackupManager {
+	t.Helper()
+
+	c, _ := newSimulatorClient(t)
+	dir := t.TempDir()
+	manager, err := NewBackupManagerWithConfig(c, &Config{
+		CatalogPath: filepath.Join(dir, "catalog.db"),
+		TempDir:     dir,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { manager.Close() })
+
+	ctx := context.Background()
+	host, err := c.DefaultHost(ctx)
+	require.NoError(t, err)
+	networkSystem, err := host.ConfigManager().NetworkSystem(ctx)
+	require.NoError(t, err)
+	require.NoError(t, networkSystem.AddPortGroup(ctx, types.HostPortGroupSpec{
+		Name:        "isolated",
+		VswitchName: "vSwitch0",
+	}))
+
+	saved := drillPollInterval
+	drillPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { drillPollInterval = saved })
+
+	return manager
+}
+
+func TestDrillBackup(t *testing.T) {
+	manager := newDrillManager(t)
+	vmName := firstVMName(t, manager)
+	ctx := context.Background()
+
+	target, err := NewDirectoryTarget(t.TempDir())
+	require.NoError(t, err)
+	info, err := manager.CreateBackup(ctx, BackupOptions{VMName: vmName, Hot: true, Compress: true, Target: target})
+	require.NoError(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	// The guest reports its heartbeat on the third poll; by then the drill
+	// VM must be running on the isolated network only
+	polls := 0
+	var networks []string
+	manager.guestState = func(ctx context.Context, ref types.ManagedObjectReference) (types.ManagedEntityStatus, string, error) {
+		if _, _, err := manager.readGuestState(ctx, ref); err != nil {
+			return "", "", err
+		}
+		polls++
+		if polls == 1 {
+			devices, err := object.NewVirtualMachine(manager.client.Client(), ref).Device(ctx)
+			require.NoError(t, err)
+			for _, nic := range devices.SelectByType((*types.VirtualEthernetCard)(nil)) {
+				networks = append(networks, nic.GetVirtualDevice().Backing.(*types.VirtualEthernetCardNetworkBackingInfo).DeviceName)
+			}
+		}
+		if polls < 3 {
+			return types.ManagedEntityStatusGray, "", nil
+		}
+		return types.ManagedEntityStatusGreen, "127.0.0.1", nil
+	}
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	result, err := manager.DrillBackup(ctx, DrillOptions{VMName: vmName, Network: "isolated", ProbePort: port})
+	require.NoError(t, err)
+	assert.True(t, result.Passed)
+	assert.Equal(t, info.ID, result.BackupID)
+	assert.Equal(t, "127.0.0.1", result.GuestIP)
+	assert.Contains(t, result.DrillVM, "drill-"+vmName+"-")
+	assert.NotZero(t, result.Restore)
+	assert.NotZero(t, result.Heartbeat)
+
+	require.NotEmpty(t, networks)
+	for _, network := range networks {
+		assert.Equal(t, "isolated", network)
+	}
+
+	_, err = manager.client.FindVM(ctx, result.DrillVM)
+	assert.Error(t, err, "the drill VM is destroyed")
+
+	stored, err := manager.GetBackup(info.ID)
+	require.NoError(t, err)
+	require.NotNil(t, stored.LastDrill)
+	assert.True(t, stored.LastDrill.Passed)
+	assert.Equal(t, result.DrillVM, stored.LastDrill.DrillVM)
+
+	// A guest that never reports a heartbeat fails the drill, which is
+	// recorded and cleaned up all the same
+	manager.guestState = func(ctx context.Context, ref types.ManagedObjectReference) (types.ManagedEntityStatus, string, error) {
+		return types.ManagedEntityStatusGray, "", nil
+	}
+	result, err = manager.DrillBackup(ctx, DrillOptions{BackupID: info.ID, Network: "isolated", Timeout: 50 * time.Millisecond})
+	assert.ErrorContains(t, err, "no VMware Tools heartbeat within 50ms")
+	require.NotNil(t, result)
+	assert.False(t, result.Passed)
+
+	_, err = manager.client.FindVM(ctx, result.DrillVM)
+	assert.Error(t, err, "the drill VM is destroyed")
+
+	stored, err = manager.GetBackup(info.ID)
+	require.NoError(t, err)
+	assert.False(t, stored.LastDrill.Passed)
+	assert.Contains(t, stored.LastDrill.Error, "heartbeat")
+}
+
+func TestDrillBackupNeedsKnownNetwork(t *testing.T) {
+	manager := newDrillManager(t)
+	vmName := firstVMName(t, manager)
+	ctx := context.Background()
+
+	_, err := manager.CreateBackup(ctx, BackupOptions{VMName: vmName, Hot: true, Target: newMemoryTarget()})
+	require.NoError(t, err)
+
+	_, err = manager.DrillBackup(ctx, DrillOptions{VMName: vmName})
+	assert.ErrorContains(t, err, "isolated network")
+
+	_, err = manager.DrillBackup(ctx, DrillOptions{VMName: vmName, Network: "no-such-network"})
+	assert.ErrorContains(t, err, "failed to find drill network")
+
+	_, err = manager.DrillBackup(ctx, DrillOptions{VMName: "no-such-vm", Network: "isolated"})
+	assert.ErrorContains(t, err, "no completed backups")
+
+	vms, err := manager.client.ListVMs(ctx)
+	require.NoError(t, err)
+	for _, vm := range vms {
+		assert.NotRegexp(t, "^drill-", vm.Name, "no drill VM was created")
+	}
+}
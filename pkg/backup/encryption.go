@@ -0,0 +1,142 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/r11/esxi-commander/internal/storage"
+)
+
+// ageMagic starts every age-encrypted stream
+var ageMagic = []byte("age-encryption.org/v1\n")
+
+// Encryptor encrypts backup streams to a set of age recipients
+type Encryptor struct {
+	recipients   []age.Recipient
+	fingerprints []string
+}
+
+// NewEncryptor parses age public keys ("age1...") into an encryptor.
+// It returns nil when no keys are given, meaning backups are not encrypted.
+func NewEncryptor(keys []string) (*Encryptor, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	e := &Encryptor{}
+	for _, key := range keys {
+		key = strings.TrimSpace(key)
+		recipient, err := age.ParseX25519Recipient(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid age recipient %q: %w", key, err)
+		}
+		e.recipients = append(e.recipients, recipient)
+		e.fingerprints = append(e.fingerprints, RecipientFingerprint(recipient.String()))
+	}
+	return e, nil
+}
+
+// Fingerprints returns the fingerprints of the encryptor's recipients
+func (e *Encryptor) Fingerprints() []string {
+	return e.fingerprints
+}
+
+// RecipientFingerprint identifies an age public key without storing it
+func RecipientFingerprint(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "sha256:" + hex.EncodeToString(sum[:16])
+}
+
+// encryptWriter wraps w so everything written to it is encrypted; with a
+// nil encryptor the data passes through unchanged
+func (e *Encryptor) encryptWriter(w io.Writer) (io.WriteCloser, error) {
+	if e == nil {
+		return nopWriteCloser{w}, nil
+	}
+	return age.Encrypt(w, e.recipients...)
+}
+
+// recordEncryption stores the encryption scheme and recipient fingerprints
+// in the catalog entry
+func (e *Encryptor) recordEncryption(entry *storage.BackupEntry) {
+	if e == nil {
+		entry.Metadata["encryption"] = "none"
+		return
+	}
+	entry.Metadata["encryption"] = "age"
+	entry.Metadata["recipients"] = strings.Join(e.fingerprints, ",")
+}
+
+// isEncrypted reports whether a catalog entry describes an encrypted backup
+func isEncrypted(entry *storage.BackupEntry) bool {
+	return entry.Metadata["encryption"] == "age"
+}
+
+// loadIdentities reads the age identities needed to decrypt a backup. It
+// fails if the backup is encrypted and no identity file was given, or if
+// none of the identities matches a recipient recorded for the backup.
+func loadIdentities(entry *storage.BackupEntry, identityFile string) ([]age.Identity, error) {
+	if !isEncrypted(entry) {
+		return nil, nil
+	}
+	if identityFile == "" {
+		return nil, fmt.Errorf("backup %s is encrypted; an age identity file is required", entry.ID)
+	}
+
+	file, err := os.Open(identityFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open identity file: %w", err)
+	}
+	defer file.Close()
+
+	identities, err := age.ParseIdentities(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse identity file: %w", err)
+	}
+
+	recorded := strings.Split(entry.Metadata["recipients"], ",")
+	for _, identity := range identities {
+		x25519, ok := identity.(*age.X25519Identity)
+		if !ok {
+			continue
+		}
+		fingerprint := RecipientFingerprint(x25519.Recipient().String())
+		for _, r := range recorded {
+			if r == fingerprint {
+				return identities, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("identity file does not match any recipient of backup %s (%s)", entry.ID, entry.Metadata["recipients"])
+}
+
+// decrypt returns the plaintext of an age-encrypted stream; unencrypted
+// streams are returned unchanged
+func decrypt(r io.Reader, identities []age.Identity) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(ageMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if !bytes.Equal(magic, ageMagic) {
+		return br, nil
+	}
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("backup is encrypted; an age identity file is required")
+	}
+
+	plain, err := age.Decrypt(br, identities...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt backup: %w", err)
+	}
+	return plain, nil
+}
@@ -0,0 +1,93 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeIdentity generates an age identity, writes it to a file and returns
+// the file path and the matching public key
+func writeIdentity(t *testing.T) (string, string) {
+	t.Helper()
+
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "identity.txt")
+	require.NoError(t, os.WriteFile(path, []byte(identity.String()+"\n"), 0600))
+
+	return path, identity.Recipient().String()
+}
+
+func TestNewEncryptorRejectsInvalidRecipient(t *testing.T) {
+	_, err := NewEncryptor([]string{"not-an-age-key"})
+	assert.Error(t, err)
+
+	encryptor, err := NewEncryptor(nil)
+	require.NoError(t, err)
+	assert.Nil(t, encryptor)
+}
+
+func TestEncryptedBackupRequiresIdentity(t *testing.T) {
+	identityPath, recipient := writeIdentity(t)
+	otherIdentityPath, _ := writeIdentity(t)
+
+	c, _ := newSimulatorClient(t)
+	dir := t.TempDir()
+	manager, err := NewBackupManagerWithConfig(c, &Config{
+		CatalogPath: filepath.Join(dir, "catalog.db"),
+		TempDir:     dir,
+		Recipients:  []string{recipient},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { manager.Close() })
+
+	vmName := firstVMName(t, manager)
+	target := newMemoryTarget()
+	ctx := context.Background()
+
+	info, err := manager.CreateBackup(ctx, BackupOptions{
+		VMName:   vmName,
+		Hot:      true,
+		Compress: true,
+		Target:   target,
+	})
+	require.NoError(t, err)
+
+	assert.True(t, bytes.HasPrefix(target.data[info.ID], ageMagic), "stored stream must be encrypted")
+	assert.NotContains(t, string(target.data[info.ID]), vmName+".ovf")
+
+	entry, err := manager.catalog.GetBackup(info.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "age", entry.Metadata["encryption"])
+	assert.Equal(t, RecipientFingerprint(recipient), entry.Metadata["recipients"])
+	assert.NotContains(t, entry.Metadata["recipients"], recipient, "only fingerprints are stored")
+
+	// Restore and verify refuse to run without the matching identity
+	err = manager.RestoreBackup(ctx, RestoreOptions{BackupID: info.ID, NewName: "restored-vm", Target: target})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "identity file is required")
+
+	err = manager.RestoreBackup(ctx, RestoreOptions{BackupID: info.ID, NewName: "restored-vm", Target: target, IdentityFile: otherIdentityPath})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "does not match")
+
+	_, err = manager.VerifyBackup(ctx, VerifyOptions{BackupID: info.ID, Target: target})
+	assert.Error(t, err)
+
+	_, err = manager.VerifyBackup(ctx, VerifyOptions{BackupID: info.ID, Target: target, IdentityFile: identityPath})
+	require.NoError(t, err)
+
+	err = manager.RestoreBackup(ctx, RestoreOptions{BackupID: info.ID, NewName: "restored-vm", Target: target, IdentityFile: identityPath})
+	require.NoError(t, err)
+
+	_, err = manager.client.FindVM(ctx, "restored-vm")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,305 @@
+package backup
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/vmware/govmomi/nfc"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/ovf"
+	govprogress "github.com/vmware/govmomi/vim25/progress"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// exportVM exports a VM (or one of its snapshots) through an NFC lease,
+// packages it as an OVA and streams the result to the backup target.
+// Returns the target location, stored size and SHA-256 of the stored stream.
+func (m *BackupManager) exportVM(ctx context.Context, vmObj *object.VirtualMachine, snapshot *types.ManagedObjectReference, backupID string, target BackupTarget, codec Codec, opts BackupOptions) (string, int64, string, error) {
+	var lease *nfc.Lease
+	var err error
+	if snapshot != nil {
+		lease, err = vmObj.ExportSnapshot(ctx, snapshot)
+	} else {
+		lease, err = vmObj.Export(ctx)
+	}
+	if err != nil {
+		return "", 0, "", fmt.Errorf("failed to request export lease: %w", err)
+	}
+
+	info, err := lease.Wait(ctx, nil)
+	if err != nil {
+		return "", 0, "", fmt.Errorf("export lease failed: %w", err)
+	}
+
+	updater := lease.StartUpdater(ctx, info)
+	defer updater.Done()
+
+	// The descriptor comes first in the OVA, before any disk is downloaded,
+	// so it only has the file sizes the lease reports. A disk the lease has
+	// no size for is declared as an OVF chunked file instead.
+	descParams := types.OvfCreateDescriptorParams{Name: opts.VMName}
+	var disks []exportDisk
+	for _, item := range info.Items {
+		if path.Ext(item.Path) != ".vmdk" {
+			continue
+		}
+
+		file := item.File()
+		file.Size = reportedSize(info, item)
+		if file.Size == 0 {
+			file.ChunkSize = exportChunkSize
+		}
+		descParams.OvfFiles = append(descParams.OvfFiles, file)
+		disks = append(disks, exportDisk{item: item, size: file.Size})
+	}
+
+	desc, err := ovf.NewManager(m.client.Client()).CreateDescriptor(ctx, vmObj, descParams)
+	if err == nil && len(desc.Error) > 0 {
+		err = errors.New(desc.Error[0].LocalizedMessage)
+	}
+	if err != nil {
+		lease.Abort(ctx, nil)
+		return "", 0, "", fmt.Errorf("failed to create OVF descriptor: %w", err)
+	}
+
+	location, size, checksum, err := m.storeArchive(ctx, backupID, target, codec, func(tw *tar.Writer) error {
+		return m.writeExport(ctx, tw, opts, desc.OvfDescriptor, disks)
+	})
+	if err != nil {
+		lease.Abort(ctx, nil)
+		return "", 0, "", err
+	}
+
+	if err := lease.Complete(ctx); err != nil {
+		return "", 0, "", fmt.Errorf("failed to complete export lease: %w", err)
+	}
+
+	return location, size, checksum, nil
+}
+
+// exportChunkSize is the size of the chunks a disk of unknown size is split
+// into. Each chunk is held in memory until its tar entry is written.
+var exportChunkSize int64 = 64 << 20
+
+// exportDisk is a disk lease item and the size the lease reports for it,
+// 0 when the disk is exported as chunks
+type exportDisk struct {
+	item nfc.FileItem
+	size int64
+}
+
+// reportedSize returns the size the lease reports for an item's file, or 0
+// if it does not know it. govmomi puts the disk capacity in the item instead.
+func reportedSize(info *nfc.LeaseInfo, item nfc.FileItem) int64 {
+	for _, device := range info.DeviceUrl {
+		if device.Key == item.DeviceId {
+			return device.FileSize
+		}
+	}
+	return 0
+}
+
+// writeExport writes the descriptor, each disk streamed from the lease and
+// then the manifest, which needs the checksums of the disks, as an OVA
+func (m *BackupManager) writeExport(ctx context.Context, tw *tar.Writer, opts BackupOptions, descriptor string, disks []exportDisk) error {
+	ovfName := opts.VMName + ".ovf"
+	descSum := sha256.Sum256([]byte(descriptor))
+
+	var manifest strings.Builder
+	fmt.Fprintf(&manifest, "SHA256(%s)= %s\n", ovfName, hex.EncodeToString(descSum[:]))
+
+	if err := writeTarBytes(tw, ovfName, []byte(descriptor)); err != nil {
+		return err
+	}
+
+	for _, disk := range disks {
+		if err := m.exportItem(ctx, tw, &manifest, disk, opts.Progress); err != nil {
+			return err
+		}
+	}
+
+	return writeTarBytes(tw, opts.VMName+".mf", []byte(manifest.String()))
+}
+
+// exportItem downloads a disk straight into the archive and adds its
+// SHA-256 to the manifest. A tar entry needs its size up front, so a disk
+// the lease reports no size for is written as OVF chunks, each with its own
+// manifest line, instead of being staged to learn its size.
+func (m *BackupManager) exportItem(ctx context.Context, tw *tar.Writer, manifest io.Writer, disk exportDisk, progress ProgressFunc) (err error) {
+	name := path.Base(disk.item.Path)
+
+	rc, size, err := m.client.Client().Download(ctx, disk.item.URL, &soap.DefaultDownload)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %w", name, err)
+	}
+	defer rc.Close()
+
+	var r io.Reader = rc
+	if sinker := progress.sinker("export " + name); sinker != nil {
+		pr := govprogress.NewReader(ctx, sinker, rc, size)
+		defer func() { pr.Done(err) }()
+		r = pr
+	}
+
+	if disk.size == 0 {
+		return writeChunks(tw, manifest, name, r)
+	}
+	if size < 0 {
+		size = disk.size
+	}
+
+	header := &tar.Header{
+		Name: name,
+		Mode: 0600,
+		Size: size,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	hasher := sha256.New()
+	n, err := io.Copy(tw, io.TeeReader(r, hasher))
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %w", name, err)
+	}
+	if n != size {
+		return fmt.Errorf("failed to download %s: got %d of %d bytes", name, n, size)
+	}
+
+	fmt.Fprintf(manifest, "SHA256(%s)= %s\n", name, hex.EncodeToString(hasher.Sum(nil)))
+	return nil
+}
+
+// writeChunks writes r as the OVF chunked file name: tar entries
+// name.000000000, name.000000001, ... of exportChunkSize bytes, the last one
+// shorter. A disk with no data still gets its first chunk.
+func writeChunks(tw *tar.Writer, manifest io.Writer, name string, r io.Reader) error {
+	buf := make([]byte, exportChunkSize)
+	for i := 0; ; i++ {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF && i > 0 {
+			return nil
+		}
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("failed to download %s: %w", name, err)
+		}
+
+		chunk := chunkName(name, i)
+		if err := writeTarBytes(tw, chunk, buf[:n]); err != nil {
+			return err
+		}
+		sum := sha256.Sum256(buf[:n])
+		fmt.Fprintf(manifest, "SHA256(%s)= %s\n", chunk, hex.EncodeToString(sum[:]))
+
+		if n < len(buf) {
+			return nil
+		}
+	}
+}
+
+// chunkName returns the name of chunk i of the OVF chunked file name
+func chunkName(name string, i int) string {
+	return fmt.Sprintf("%s.%09d", name, i)
+}
+
+// chunkOf splits a chunk name such as disk.vmdk.000000001 into the file it
+// belongs to and its number; ok is false for a name that is not a chunk
+func chunkOf(name string) (file string, i int, ok bool) {
+	ext := path.Ext(name)
+	if len(ext) != 10 {
+		return name, 0, false
+	}
+	i, err := strconv.Atoi(ext[1:])
+	if err != nil || i < 0 {
+		return name, 0, false
+	}
+	return strings.TrimSuffix(name, ext), i, true
+}
+
+// storeArchive streams the tar archive written by fill through compression,
+// encryption and hashing to the target. Returns the target location, stored
+// size and SHA-256 of the stored stream.
+func (m *BackupManager) storeArchive(ctx context.Context, backupID string, target BackupTarget, codec Codec, fill func(*tar.Writer) error) (string, int64, string, error) {
+	pr, pw := io.Pipe()
+
+	hasher := sha256.New()
+	counter := &countingWriter{}
+	done := make(chan error, 1)
+
+	// tar -> compression -> encryption -> target; the checksum covers the
+	// stored (encrypted) bytes
+	go func() {
+		err := m.writeArchive(io.MultiWriter(pw, hasher, counter), codec, fill)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+
+	location, err := target.Store(ctx, backupID, pr)
+	pr.CloseWithError(err)
+	writeErr := <-done
+
+	if err != nil {
+		return "", 0, "", fmt.Errorf("failed to store backup: %w", err)
+	}
+	if writeErr != nil {
+		return "", 0, "", fmt.Errorf("failed to write backup archive: %w", writeErr)
+	}
+
+	return location, counter.n, hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func (m *BackupManager) writeArchive(w io.Writer, codec Codec, fill func(*tar.Writer) error) error {
+	ew, err := m.encryptor.encryptWriter(w)
+	if err != nil {
+		return fmt.Errorf("failed to start encryption: %w", err)
+	}
+
+	cw, err := codec.NewWriter(ew)
+	if err != nil {
+		return fmt.Errorf("failed to start %s compression: %w", codec.Name(), err)
+	}
+
+	tw := tar.NewWriter(cw)
+	if err := fill(tw); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := cw.Close(); err != nil {
+		return err
+	}
+	return ew.Close()
+}
+
+func writeTarBytes(tw *tar.Writer, name string, data []byte) error {
+	header := &tar.Header{
+		Name: name,
+		Mode: 0600,
+		Size: int64(len(data)),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,271 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/r11/esxi-commander/internal/storage"
+	"github.com/r11/esxi-commander/pkg/audit"
+	"github.com/r11/esxi-commander/pkg/esxi/client"
+	esxissh "github.com/r11/esxi-commander/pkg/esxi/ssh"
+	"github.com/vmware/govmomi/guest/toolbox"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/types"
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultHookTimeout bounds each hook command unless Hooks.Timeout is set
+const DefaultHookTimeout = time.Minute
+
+// maxHookOutput is how much of a hook's output is kept in the catalog
+const maxHookOutput = 64 << 10
+
+// HookRunner runs a hook command in the guest and returns its combined
+// output
+type HookRunner interface {
+	Run(ctx context.Context, command string) (string, error)
+}
+
+// Hooks are guest commands run around the backup snapshot, typically to
+// flush and freeze an application before it and thaw it afterwards. They
+// only run when the VM is powered on and a snapshot is taken.
+type Hooks struct {
+	Runner    HookRunner
+	Timeout   time.Duration // Per command; defaults to DefaultHookTimeout
+	PreFreeze []string      // Run in order before the snapshot; a failure aborts the backup
+	PostThaw  []string      // Run in order after the snapshot; a failure aborts the backup
+}
+
+// snapshotWithHooks takes the backup snapshot between the pre-freeze and
+// post-thaw hooks. Post-thaw hooks run whenever pre-freeze hooks started,
+// even if one of them failed, so an application is never left frozen. A
+// failed hook aborts the backup and removes the snapshot; every command
+// run is recorded in entry and in the audit log.
+func (m *BackupManager) snapshotWithHooks(ctx context.Context, vmObj *object.VirtualMachine, entry *storage.BackupEntry, hooks *Hooks, name string, quiesce bool) error {
+	if hooks == nil {
+		if err := m.vmOps.CreateSnapshot(ctx, vmObj, name, "Backup snapshot", false, quiesce); err != nil {
+			return fmt.Errorf("failed to create backup snapshot: %w", err)
+		}
+		return nil
+	}
+
+	// Keep the hook output in the catalog even if the backup fails
+	defer m.catalog.AddBackup(entry)
+
+	// Thawing must happen even if the backup itself was cancelled
+	thawCtx := context.WithoutCancel(ctx)
+
+	if err := m.runHooks(ctx, hooks, entry, "pre_freeze", hooks.PreFreeze); err != nil {
+		m.runHooks(thawCtx, hooks, entry, "post_thaw", hooks.PostThaw)
+		return err
+	}
+
+	snapshotErr := m.vmOps.CreateSnapshot(ctx, vmObj, name, "Backup snapshot", false, quiesce)
+	thawErr := m.runHooks(thawCtx, hooks, entry, "post_thaw", hooks.PostThaw)
+	if snapshotErr != nil {
+		return fmt.Errorf("failed to create backup snapshot: %w", snapshotErr)
+	}
+	if thawErr != nil {
+		m.removeBackupSnapshot(ctx, vmObj, name)
+		return thawErr
+	}
+	return nil
+}
+
+// runHooks runs the commands of one phase in order and stops at the first
+// failure
+func (m *BackupManager) runHooks(ctx context.Context, hooks *Hooks, entry *storage.BackupEntry, phase string, commands []string) error {
+	timeout := hooks.Timeout
+	if timeout <= 0 {
+		timeout = DefaultHookTimeout
+	}
+
+	for _, command := range commands {
+		auditCtx := audit.GetLogger().LogOperation(ctx, "backup.hook", map[string]interface{}{
+			"vm":        entry.VMName,
+			"backup_id": entry.ID,
+			"phase":     phase,
+			"command":   command,
+		})
+
+		fmt.Printf("Running %s hook: %s\n", phase, command)
+		run := storage.HookRun{Phase: phase, Command: command, Started: time.Now()}
+
+		hookCtx, cancel := context.WithTimeout(ctx, timeout)
+		output, err := hooks.Runner.Run(hookCtx, command)
+		if err != nil && hookCtx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("timed out after %s", timeout)
+		}
+		cancel()
+
+		run.Duration = time.Since(run.Started)
+		run.Output = truncateOutput(output)
+		auditCtx.SetParameter("output", run.Output)
+		if err != nil {
+			run.Error = err.Error()
+		}
+		entry.Hooks = append(entry.Hooks, run)
+
+		if err != nil {
+			err = fmt.Errorf("%s hook %q failed: %w", phase, command, err)
+			auditCtx.Failure(err)
+			return err
+		}
+		auditCtx.Success()
+	}
+	return nil
+}
+
+// truncateOutput keeps the end of long hook output, where errors usually are
+func truncateOutput(output string) string {
+	if len(output) <= maxHookOutput {
+		return output
+	}
+	return "...(truncated)\n" + output[len(output)-maxHookOutput:]
+}
+
+// removeBackupSnapshot removes the snapshot called name, if it exists
+func (m *BackupManager) removeBackupSnapshot(ctx context.Context, vmObj *object.VirtualMachine, name string) {
+	snapshots, err := m.vmOps.ListSnapshots(ctx, vmObj)
+	if err != nil {
+		return
+	}
+	for _, snapshot := range snapshots {
+		if snapshot.Name == name {
+			m.vmOps.RemoveSnapshot(ctx, vmObj, snapshot.Snapshot, false)
+			return
+		}
+	}
+}
+
+// guestHookRunner runs hook commands through VMware Tools guest operations
+type guestHookRunner struct {
+	client *client.ESXiClient
+	vmName string
+	auth   types.BaseGuestAuthentication
+}
+
+// NewGuestHookRunner runs hook commands in vmName through VMware Tools,
+// authenticating as a guest user. Commands run under /bin/sh -c, or
+// cmd.exe /c on Windows guests. A command that times out is abandoned but
+// keeps running in the guest.
+func NewGuestHookRunner(c *client.ESXiClient, vmName, user, password string) HookRunner {
+	return &guestHookRunner{
+		client: c,
+		vmName: vmName,
+		auth: &types.NamePasswordAuthentication{
+			Username: user,
+			Password: password,
+		},
+	}
+}
+
+func (r *guestHookRunner) Run(ctx context.Context, command string) (string, error) {
+	vmObj, err := r.client.FindVM(ctx, r.vmName)
+	if err != nil {
+		return "", fmt.Errorf("failed to find VM: %w", err)
+	}
+
+	tools, err := toolbox.NewClient(ctx, r.client.Client(), vmObj, r.auth)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to VMware Tools: %w", err)
+	}
+
+	// The toolbox joins the arguments into one command line for the guest
+	cmd := &exec.Cmd{Path: "/bin/sh", Args: []string{"-c", shellQuote(command)}}
+	if tools.GuestFamily == types.VirtualMachineGuestOsFamilyWindowsGuest {
+		cmd = &exec.Cmd{Path: command}
+	}
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err = tools.Run(ctx, cmd)
+	return output.String(), err
+}
+
+// shellQuote quotes s as a single POSIX shell word
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// SSHHookOptions configures running hook commands over SSH to the guest
+type SSHHookOptions struct {
+	Host       string // host or host:port of the guest
+	User       string
+	KeyPath    string
+	KnownHosts string // known_hosts file; required unless InsecureHostKey is set
+
+	InsecureHostKey bool // accept any host key when KnownHosts is empty
+}
+
+// sshHookRunner runs hook commands over SSH to the guest
+type sshHookRunner struct {
+	host   string
+	config *ssh.ClientConfig
+}
+
+// NewSSHHookRunner runs hook commands over SSH using key authentication,
+// connecting once per command
+func NewSSHHookRunner(opts SSHHookOptions) (HookRunner, error) {
+	if opts.Host == "" || opts.User == "" {
+		return nil, fmt.Errorf("SSH hooks require host and user")
+	}
+	if opts.KeyPath == "" {
+		return nil, fmt.Errorf("SSH hooks require a private key")
+	}
+	if opts.KnownHosts == "" && !opts.InsecureHostKey {
+		return nil, fmt.Errorf("SSH hooks require a known_hosts file to verify %s, or insecure_host_key to accept any host key", opts.Host)
+	}
+
+	auth, err := esxissh.PublicKeyAuth(opts.KeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	hostKeyCallback, err := esxissh.HostKeyCallback(opts.KnownHosts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sshHookRunner{
+		host: opts.Host,
+		config: &ssh.ClientConfig{
+			User:            opts.User,
+			Auth:            []ssh.AuthMethod{auth},
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         10 * time.Second,
+		},
+	}, nil
+}
+
+func (r *sshHookRunner) Run(ctx context.Context, command string) (string, error) {
+	conn, err := esxissh.Dial(r.host, r.config)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	type result struct {
+		output string
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		output, err := conn.RunCommand(command)
+		done <- result{output, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.output, res.err
+	case <-ctx.Done():
+		// Closing the connection ends the remote session
+		conn.Close()
+		return "", ctx.Err()
+	}
+}
@@ -0,0 +1,167 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeHookRunner records hook commands instead of running them in a guest.
+// Commands starting with "fail" fail and "hang" blocks until cancelled.
+type fakeHookRunner struct {
+	commands []string
+	onRun    func(command string)
+}
+
+func (r *fakeHookRunner) Run(ctx context.Context, command string) (string, error) {
+	r.commands = append(r.commands, command)
+	if r.onRun != nil {
+		r.onRun(command)
+	}
+	switch {
+	case strings.HasPrefix(command, "fail"):
+		return "boom", fmt.Errorf("exit 1")
+	case strings.HasPrefix(command, "hang"):
+		<-ctx.Done()
+		return "", ctx.Err()
+	}
+	return "ran " + command, nil
+}
+
+// backupSnapshots counts the backup snapshots of vmName
+func backupSnapshots(t *testing.T, manager *BackupManager, vmName string) int {
+	t.Helper()
+
+	ctx := context.Background()
+	vmObj, err := manager.client.FindVM(ctx, vmName)
+	require.NoError(t, err)
+	snapshots, err := manager.vmOps.ListSnapshots(ctx, vmObj)
+	require.NoError(t, err)
+
+	count := 0
+	for _, snapshot := range snapshots {
+		if strings.HasPrefix(snapshot.Name, "backup-snapshot-") {
+			count++
+		}
+	}
+	return count
+}
+
+func TestBackupHooksRunAroundSnapshot(t *testing.T) {
+	manager := newTestManager(t)
+	vmName := firstVMName(t, manager)
+
+	snapshotsSeen := make(map[string]int)
+	runner := &fakeHookRunner{}
+	runner.onRun = func(command string) {
+		snapshotsSeen[command] = backupSnapshots(t, manager, vmName)
+	}
+
+	info, err := manager.CreateBackup(context.Background(), BackupOptions{
+		VMName: vmName,
+		Hot:    true,
+		Target: newMemoryTarget(),
+		Hooks: &Hooks{
+			Runner:    runner,
+			PreFreeze: []string{"sync", "freeze"},
+			PostThaw:  []string{"thaw"},
+		},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"sync", "freeze", "thaw"}, runner.commands)
+	assert.Equal(t, map[string]int{"sync": 0, "freeze": 0, "thaw": 1}, snapshotsSeen)
+	assert.Zero(t, backupSnapshots(t, manager, vmName))
+
+	entry, err := manager.catalog.GetBackup(info.ID)
+	require.NoError(t, err)
+	require.Len(t, entry.Hooks, 3)
+	assert.Equal(t, "pre_freeze", entry.Hooks[0].Phase)
+	assert.Equal(t, "ran sync", entry.Hooks[0].Output)
+	assert.Equal(t, "post_thaw", entry.Hooks[2].Phase)
+	assert.Empty(t, entry.Hooks[2].Error)
+	assert.Len(t, info.Hooks, 3)
+}
+
+func TestBackupHooksAbortOnFailure(t *testing.T) {
+	tests := []struct {
+		name      string
+		hooks     Hooks
+		commands  []string
+		errorText string
+	}{
+		{
+			name:      "pre-freeze failure still thaws",
+			hooks:     Hooks{PreFreeze: []string{"freeze", "fail-flush", "never"}, PostThaw: []string{"thaw"}},
+			commands:  []string{"freeze", "fail-flush", "thaw"},
+			errorText: `pre_freeze hook "fail-flush" failed`,
+		},
+		{
+			name:      "pre-freeze timeout",
+			hooks:     Hooks{Timeout: 50 * time.Millisecond, PreFreeze: []string{"hang"}, PostThaw: []string{"thaw"}},
+			commands:  []string{"hang", "thaw"},
+			errorText: "timed out after 50ms",
+		},
+		{
+			name:      "post-thaw failure removes the snapshot",
+			hooks:     Hooks{PreFreeze: []string{"freeze"}, PostThaw: []string{"fail-thaw"}},
+			commands:  []string{"freeze", "fail-thaw"},
+			errorText: `post_thaw hook "fail-thaw" failed`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := newTestManager(t)
+			vmName := firstVMName(t, manager)
+			target := newMemoryTarget()
+
+			runner := &fakeHookRunner{}
+			hooks := tt.hooks
+			hooks.Runner = runner
+
+			_, err := manager.CreateBackup(context.Background(), BackupOptions{
+				VMName: vmName,
+				Hot:    true,
+				Target: target,
+				Hooks:  &hooks,
+			})
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.errorText)
+			assert.Equal(t, tt.commands, runner.commands)
+			assert.Zero(t, backupSnapshots(t, manager, vmName))
+			assert.Empty(t, target.data)
+
+			backups, err := manager.catalog.ListBackups(vmName)
+			require.NoError(t, err)
+			require.Len(t, backups, 1)
+			assert.Equal(t, "failed", backups[0].Status)
+			require.Len(t, backups[0].Hooks, len(tt.commands))
+			for i, run := range backups[0].Hooks {
+				assert.Equal(t, tt.commands[i], run.Command)
+			}
+		})
+	}
+}
+
+func TestNewSSHHookRunnerRequiresKnownHosts(t *testing.T) {
+	addr, keyPath, knownHosts := newSFTPServer(t)
+	opts := SSHHookOptions{Host: addr, User: "backup", KeyPath: keyPath}
+
+	_, err := NewSSHHookRunner(opts)
+	assert.ErrorContains(t, err, "require a known_hosts file")
+
+	opts.InsecureHostKey = true
+	_, err = NewSSHHookRunner(opts)
+	assert.NoError(t, err)
+
+	opts.InsecureHostKey = false
+	opts.KnownHosts = knownHosts
+	_, err = NewSSHHookRunner(opts)
+	assert.NoError(t, err)
+}
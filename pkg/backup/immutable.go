@@ -0,0 +1,132 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/r11/esxi-commander/internal/storage"
+	"github.com/r11/esxi-commander/pkg/audit"
+)
+
+// ImmutableTarget is a BackupTarget that can make stored backups write-once,
+// so that even a caller with the target's credentials cannot delete them
+type ImmutableTarget interface {
+	BackupTarget
+
+	// Lock protects a stored backup from deletion until the given time
+	Lock(ctx context.Context, backupID string, until time.Time) error
+
+	// SetLegalHold protects a stored backup from deletion until the hold
+	// is released, independent of any Lock
+	SetLegalHold(ctx context.Context, backupID string, hold bool) error
+
+	// Unlock lifts protection the target does not lift by itself, once
+	// the catalog no longer protects the backup
+	Unlock(ctx context.Context, backupID string) error
+}
+
+// unlockAndDelete deletes a stored backup, first unlocking it on targets
+// that keep locks until told otherwise
+func unlockAndDelete(ctx context.Context, target BackupTarget, backupID string) error {
+	if locker, ok := target.(ImmutableTarget); ok {
+		if err := locker.Unlock(ctx, backupID); err != nil {
+			return err
+		}
+	}
+	return target.Delete(ctx, backupID)
+}
+
+// HoldBackup places a legal hold on a backup. The catalog is updated first,
+// so retention and delete respect the hold even if a target fails to apply
+// it to its copy.
+func (m *BackupManager) HoldBackup(ctx context.Context, backupID, reason string) error {
+	auditCtx := audit.GetLogger().LogOperation(ctx, "backup.hold", map[string]interface{}{
+		"backup_id": backupID,
+		"reason":    reason,
+	})
+
+	err := m.hold(ctx, backupID, reason)
+	if err != nil {
+		auditCtx.Failure(err)
+		return err
+	}
+
+	auditCtx.Success()
+	return nil
+}
+
+func (m *BackupManager) hold(ctx context.Context, backupID, reason string) error {
+	entry, err := m.catalog.GetBackup(backupID)
+	if err != nil {
+		return fmt.Errorf("failed to get backup from catalog: %w", err)
+	}
+	if entry.Status == "deleting" {
+		return fmt.Errorf("backup %s is being deleted", backupID)
+	}
+
+	if err := m.catalog.SetHold(backupID, &storage.LegalHold{Reason: reason, Since: time.Now()}); err != nil {
+		return fmt.Errorf("failed to record legal hold: %w", err)
+	}
+
+	return m.setLegalHold(ctx, entry, true)
+}
+
+// ReleaseBackup releases the legal hold on a backup. The targets release
+// their copies first, so a failure leaves the backup held.
+func (m *BackupManager) ReleaseBackup(ctx context.Context, backupID string) error {
+	auditCtx := audit.GetLogger().LogOperation(ctx, "backup.release", map[string]interface{}{
+		"backup_id": backupID,
+	})
+
+	err := m.release(ctx, backupID)
+	if err != nil {
+		auditCtx.Failure(err)
+		return err
+	}
+
+	auditCtx.Success()
+	return nil
+}
+
+func (m *BackupManager) release(ctx context.Context, backupID string) error {
+	entry, err := m.catalog.GetBackup(backupID)
+	if err != nil {
+		return fmt.Errorf("failed to get backup from catalog: %w", err)
+	}
+	if entry.Hold == nil {
+		return fmt.Errorf("backup %s is not held", backupID)
+	}
+
+	if err := m.setLegalHold(ctx, entry, false); err != nil {
+		return err
+	}
+
+	if err := m.catalog.SetHold(backupID, nil); err != nil {
+		return fmt.Errorf("failed to release legal hold: %w", err)
+	}
+	return nil
+}
+
+// setLegalHold applies or releases a hold on every stored copy of a backup
+// whose target supports it
+func (m *BackupManager) setLegalHold(ctx context.Context, entry *storage.BackupEntry, hold bool) error {
+	if entry.Location == "" {
+		return nil
+	}
+
+	for _, location := range artifactLocations(entry) {
+		target, err := m.targetFor(location)
+		if err != nil {
+			return err
+		}
+		locker, ok := target.(ImmutableTarget)
+		if !ok {
+			continue
+		}
+		if err := locker.SetLegalHold(ctx, entry.ID, hold); err != nil {
+			return fmt.Errorf("failed to set legal hold at %s: %w", location, err)
+		}
+	}
+	return nil
+}
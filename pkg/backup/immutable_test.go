@@ -0,0 +1,184 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/r11/esxi-commander/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lockingTarget is a memoryTarget that refuses to delete locked or held
+// backups, like an S3 bucket with object lock
+type lockingTarget struct {
+	*memoryTarget
+	locked   map[string]time.Time
+	held     map[string]bool
+	unlocked []string
+}
+
+func newLockingTarget() *lockingTarget {
+	return &lockingTarget{
+		memoryTarget: newMemoryTarget(),
+		locked:       make(map[string]time.Time),
+		held:         make(map[string]bool),
+	}
+}
+
+func (t *lockingTarget) Lock(ctx context.Context, backupID string, until time.Time) error {
+	t.locked[backupID] = until
+	return nil
+}
+
+func (t *lockingTarget) SetLegalHold(ctx context.Context, backupID string, hold bool) error {
+	t.held[backupID] = hold
+	return nil
+}
+
+func (t *lockingTarget) Unlock(ctx context.Context, backupID string) error {
+	t.unlocked = append(t.unlocked, backupID)
+	return nil
+}
+
+func (t *lockingTarget) Delete(ctx context.Context, backupID string) error {
+	if t.held[backupID] || time.Now().Before(t.locked[backupID]) {
+		return errors.New("object is WORM protected")
+	}
+	return t.memoryTarget.Delete(ctx, backupID)
+}
+
+func TestImmutableBackupIsKeptUntilItsRetentionDate(t *testing.T) {
+	manager := newTestManager(t)
+	vmName := firstVMName(t, manager)
+	ctx := context.Background()
+
+	_, err := manager.CreateBackup(ctx, BackupOptions{VMName: vmName, Hot: true, Target: newMemoryTarget(), RetainUntil: time.Now().Add(time.Hour)})
+	assert.ErrorContains(t, err, "does not support immutable backups")
+
+	target := newLockingTarget()
+	manager.config.ResolveTarget = func(location string) (BackupTarget, error) {
+		return target, nil
+	}
+
+	until := time.Now().Add(30 * 24 * time.Hour).Truncate(time.Second)
+	locked, err := manager.CreateBackup(ctx, BackupOptions{VMName: vmName, Hot: true, Target: target, RetainUntil: until})
+	require.NoError(t, err)
+	require.NotNil(t, locked.RetainUntil)
+	assert.True(t, until.Equal(*locked.RetainUntil))
+	assert.Equal(t, until, target.locked[locked.ID])
+
+	newer, err := manager.CreateBackup(ctx, BackupOptions{VMName: vmName, Hot: true, Target: target})
+	require.NoError(t, err)
+
+	assert.ErrorContains(t, manager.DeleteBackup(ctx, locked.ID), "immutable until")
+
+	result, err := manager.PruneBackups(ctx, PruneOptions{VMName: vmName, KeepLast: 1})
+	require.NoError(t, err)
+	assert.Equal(t, 0, result.Deleted)
+	assert.Equal(t, 0, result.Failed)
+
+	entry, err := manager.catalog.GetBackup(locked.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "completed", entry.Status)
+
+	// Once the date has passed the lock is lifted and the backup deleted
+	past := time.Now().Add(-time.Hour)
+	entry.RetainUntil = &past
+	require.NoError(t, manager.catalog.AddBackup(entry))
+	target.locked[locked.ID] = past
+
+	result, err = manager.PruneBackups(ctx, PruneOptions{VMName: vmName, KeepLast: 1})
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Deleted)
+	assert.Equal(t, []string{locked.ID}, target.unlocked)
+	assert.Contains(t, target.data, newer.ID)
+}
+
+func TestLegalHoldBlocksDeletion(t *testing.T) {
+	target := newLockingTarget()
+	manager, err := NewBackupManagerWithConfig(nil, &Config{
+		CatalogPath: filepath.Join(t.TempDir(), "catalog.db"),
+		ResolveTarget: func(location string) (BackupTarget, error) {
+			return target, nil
+		},
+	})
+	require.NoError(t, err)
+	defer manager.Close()
+
+	ctx := context.Background()
+	for _, id := range []string{"evidence", "other"} {
+		target.data[id] = []byte(id)
+		require.NoError(t, manager.catalog.AddBackup(&storage.BackupEntry{
+			ID:        id,
+			VMName:    "vm",
+			Timestamp: time.Now().AddDate(0, 0, -90),
+			Location:  "memory://" + id,
+			Status:    "completed",
+			Metadata:  map[string]string{},
+		}))
+	}
+
+	require.NoError(t, manager.HoldBackup(ctx, "evidence", "case 42"))
+	assert.True(t, target.held["evidence"])
+
+	info, err := manager.GetBackup("evidence")
+	require.NoError(t, err)
+	require.NotNil(t, info.Hold)
+	assert.Equal(t, "case 42", info.Hold.Reason)
+
+	assert.ErrorContains(t, manager.DeleteBackup(ctx, "evidence"), "legal hold")
+	assert.Error(t, manager.catalog.DeleteBackup("evidence"), "the catalog refuses as well")
+
+	_, err = manager.PruneBackups(ctx, PruneOptions{})
+	assert.ErrorContains(t, err, "at least one keep rule")
+
+	// A policy that keeps neither backup still keeps the held one
+	result, err := manager.PruneBackups(ctx, PruneOptions{KeepDays: 1})
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Deleted)
+	require.NoError(t, manager.catalog.ApplyRetention(storage.RetentionPolicy{KeepWithinDays: 1}))
+	_, err = manager.catalog.GetBackup("evidence")
+	require.NoError(t, err)
+
+	require.NoError(t, manager.ReleaseBackup(ctx, "evidence"))
+	assert.False(t, target.held["evidence"])
+	assert.Error(t, manager.ReleaseBackup(ctx, "evidence"), "not held")
+
+	require.NoError(t, manager.DeleteBackup(ctx, "evidence"))
+	assert.Empty(t, target.data)
+}
+
+func TestDirectoryTargetImmutableAttribute(t *testing.T) {
+	var calls [][]string
+	saved := chattr
+	chattr = func(ctx context.Context, flag string, paths ...string) error {
+		calls = append(calls, append([]string{flag}, paths...))
+		return nil
+	}
+	defer func() { chattr = saved }()
+
+	dir := t.TempDir()
+	target, err := NewDirectoryTarget(dir)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	_, err = target.Store(ctx, "backup-1", strings.NewReader("payload"))
+	require.NoError(t, err)
+
+	require.NoError(t, target.Lock(ctx, "backup-1", time.Now().Add(time.Hour)))
+	require.NoError(t, target.SetLegalHold(ctx, "backup-1", false))
+	file, manifest := filepath.Join(dir, "backup-1.ova"), filepath.Join(dir, "backup-1.ova.json")
+	assert.Equal(t, [][]string{{"+i", file, manifest}}, calls)
+
+	// Files without the attribute are deleted without chattr
+	require.NoError(t, unlockAndDelete(ctx, target, "backup-1"))
+	assert.Len(t, calls, 1)
+	_, err = os.Stat(file)
+	assert.True(t, os.IsNotExist(err))
+}
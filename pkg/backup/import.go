@@ -0,0 +1,360 @@
+package backup
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/google/uuid"
+	"github.com/r11/esxi-commander/internal/storage"
+	"github.com/vmware/govmomi/nfc"
+	"github.com/vmware/govmomi/ovf"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// archiveIndex holds the small metadata files read from an OVA backup
+type archiveIndex struct {
+	descriptor string
+	manifest   map[string]string // file name -> sha256
+	sizes      map[string]int64  // file name -> size, over all its chunks
+}
+
+// importVM imports a VM from a backup. The artifact is read twice: once to
+// verify the stored checksum and read the OVF descriptor, and once to upload
+// the disks into the NFC import lease, so nothing is staged locally.
+func (m *BackupManager) importVM(ctx context.Context, entry *storage.BackupEntry, opts RestoreOptions) error {
+	if isChainBackup(entry) {
+		return m.importChain(ctx, entry, opts)
+	}
+
+	target := opts.Target
+	if target == nil {
+		target = NewDatastoreTarget(m.client, "", "backups")
+	}
+
+	identities, err := loadIdentities(entry, opts.IdentityFile)
+	if err != nil {
+		return err
+	}
+
+	// Fall back to a replica when the primary copy is missing or damaged
+	var index *archiveIndex
+	target, err = m.firstIntact(entry, target, func(target BackupTarget) (err error) {
+		index, err = m.readArchiveIndex(ctx, target, entry, identities)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return m.importDescriptor(ctx, opts.NewName, index.descriptor, func(lease *nfc.Lease, info *nfc.LeaseInfo) error {
+		return m.uploadDisks(ctx, target, entry, identities, lease, info, index, opts.Progress)
+	})
+}
+
+// importDescriptor creates a VM named name from an OVF descriptor and calls
+// upload to fill its disks through the NFC import lease
+func (m *BackupManager) importDescriptor(ctx context.Context, name, descriptor string, upload func(*nfc.Lease, *nfc.LeaseInfo) error) error {
+	pool, err := m.client.DefaultResourcePool(ctx)
+	if err != nil {
+		return err
+	}
+	ds, err := m.client.DefaultDatastore(ctx)
+	if err != nil {
+		return err
+	}
+	folder, err := m.client.DefaultFolder(ctx)
+	if err != nil {
+		return err
+	}
+
+	cisp := types.OvfCreateImportSpecParams{
+		EntityName: name,
+		OvfManagerCommonParams: types.OvfManagerCommonParams{
+			Locale: "US",
+		},
+	}
+
+	spec, err := ovf.NewManager(m.client.Client()).CreateImportSpec(ctx, descriptor, pool, ds, &cisp)
+	if err != nil {
+		return fmt.Errorf("failed to create import spec: %w", err)
+	}
+	if len(spec.Error) > 0 {
+		return fmt.Errorf("failed to create import spec: %s", spec.Error[0].LocalizedMessage)
+	}
+
+	vmSpec, ok := spec.ImportSpec.(*types.VirtualMachineImportSpec)
+	if !ok {
+		return fmt.Errorf("unsupported import spec type %T", spec.ImportSpec)
+	}
+	regenerateIdentity(&vmSpec.ConfigSpec)
+
+	lease, err := pool.ImportVApp(ctx, spec.ImportSpec, folder, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start import: %w", err)
+	}
+
+	info, err := lease.Wait(ctx, spec.FileItem)
+	if err != nil {
+		return fmt.Errorf("import lease failed: %w", err)
+	}
+
+	updater := lease.StartUpdater(ctx, info)
+	defer updater.Done()
+
+	if err := upload(lease, info); err != nil {
+		lease.Abort(ctx, &types.LocalizedMethodFault{
+			Fault:            &types.SystemError{Reason: err.Error()},
+			LocalizedMessage: err.Error(),
+		})
+		return err
+	}
+
+	if err := lease.Complete(ctx); err != nil {
+		return fmt.Errorf("failed to complete import lease: %w", err)
+	}
+
+	return nil
+}
+
+// readArchiveIndex streams the whole artifact once, verifying its checksum
+// against the catalog and collecting the OVF descriptor and manifest
+func (m *BackupManager) readArchiveIndex(ctx context.Context, target BackupTarget, entry *storage.BackupEntry, identities []age.Identity) (*archiveIndex, error) {
+	if entry.Checksum == "" {
+		return nil, fmt.Errorf("backup %s has no checksum", entry.ID)
+	}
+
+	rc, err := target.Retrieve(ctx, entry.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve backup: %w", err)
+	}
+	defer rc.Close()
+
+	hasher := sha256.New()
+	reader := io.TeeReader(rc, hasher)
+
+	index := &archiveIndex{sizes: make(map[string]int64)}
+	err = walkArchive(reader, identities, func(header *tar.Header, r io.Reader) error {
+		file, _, _ := chunkOf(path.Base(header.Name))
+		index.sizes[file] += header.Size
+
+		switch path.Ext(header.Name) {
+		case ".ovf":
+			data, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			index.descriptor = string(data)
+		case ".mf":
+			data, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			index.manifest = parseManifest(data)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup archive: %w", err)
+	}
+
+	// Drain anything after the tar trailer so the checksum covers every byte
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		return nil, fmt.Errorf("failed to read backup: %w", err)
+	}
+
+	checksum := hex.EncodeToString(hasher.Sum(nil))
+	if checksum != entry.Checksum {
+		return nil, fmt.Errorf("backup checksum mismatch: catalog has %s, artifact is %s", entry.Checksum, checksum)
+	}
+
+	if index.descriptor == "" {
+		return nil, fmt.Errorf("backup archive has no OVF descriptor")
+	}
+
+	return index, nil
+}
+
+// uploadDisks streams the artifact a second time, uploading each disk to
+// its lease item and checking it against the OVA manifest. The chunks of a
+// disk exported as an OVF chunked file are joined into one upload.
+func (m *BackupManager) uploadDisks(ctx context.Context, target BackupTarget, entry *storage.BackupEntry, identities []age.Identity, lease *nfc.Lease, info *nfc.LeaseInfo, index *archiveIndex, progress ProgressFunc) (err error) {
+	items := make(map[string]nfc.FileItem)
+	for _, item := range info.Items {
+		items[path.Base(item.Path)] = item
+	}
+
+	rc, err := target.Retrieve(ctx, entry.ID)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve backup: %w", err)
+	}
+	defer rc.Close()
+
+	var upload *diskUpload
+	defer func() {
+		if upload != nil {
+			upload.close(err)
+		}
+	}()
+
+	err = walkArchive(rc, identities, func(header *tar.Header, r io.Reader) error {
+		name := path.Base(header.Name)
+		file, chunk, _ := chunkOf(name)
+		if upload != nil && upload.name == file {
+			if chunk != upload.next {
+				return fmt.Errorf("backup archive has %s out of order", name)
+			}
+		} else {
+			item, ok := items[file]
+			if !ok {
+				return nil
+			}
+			if chunk != 0 {
+				return fmt.Errorf("backup archive has %s out of order", name)
+			}
+			if upload != nil {
+				if err := upload.close(nil); err != nil {
+					return err
+				}
+			}
+			upload = startDiskUpload(ctx, lease, item, file, index.sizes[file], progress)
+			delete(items, file)
+		}
+
+		hasher := sha256.New()
+		if _, err := io.Copy(upload.pw, io.TeeReader(r, hasher)); err != nil {
+			return fmt.Errorf("failed to upload %s: %w", file, err)
+		}
+		upload.next++
+
+		if expected, ok := index.manifest[name]; ok {
+			if actual := hex.EncodeToString(hasher.Sum(nil)); actual != expected {
+				return fmt.Errorf("checksum mismatch for %s: manifest has %s, got %s", name, expected, actual)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if upload != nil {
+		last := upload
+		upload = nil
+		if err := last.close(nil); err != nil {
+			return err
+		}
+	}
+
+	if len(items) > 0 {
+		var missing []string
+		for name := range items {
+			missing = append(missing, name)
+		}
+		return fmt.Errorf("backup archive is missing files: %s", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// diskUpload feeds one disk, which may span several tar entries, to its
+// lease item through a pipe
+type diskUpload struct {
+	name string
+	next int // number of the next chunk
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func startDiskUpload(ctx context.Context, lease *nfc.Lease, item nfc.FileItem, name string, size int64, progress ProgressFunc) *diskUpload {
+	pr, pw := io.Pipe()
+	upload := &diskUpload{name: name, pw: pw, done: make(chan error, 1)}
+
+	go func() {
+		opts := soap.Upload{
+			ContentLength: size,
+			Progress:      progress.sinker("import " + name),
+		}
+		err := lease.Upload(ctx, item, pr, opts)
+		pr.CloseWithError(err)
+		upload.done <- err
+	}()
+
+	return upload
+}
+
+// close ends the upload, failing it if err is set, and waits for it
+func (u *diskUpload) close(err error) error {
+	u.pw.CloseWithError(err)
+	if uploadErr := <-u.done; uploadErr != nil && err == nil {
+		return fmt.Errorf("failed to upload %s: %w", u.name, uploadErr)
+	}
+	return err
+}
+
+// walkArchive decrypts and decompresses the stream if needed and calls fn
+// for every tar entry
+func walkArchive(r io.Reader, identities []age.Identity, fn func(*tar.Header, io.Reader) error) error {
+	plain, err := decrypt(r, identities)
+	if err != nil {
+		return err
+	}
+
+	stream, _, err := decompress(plain)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	tr := tar.NewReader(stream)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := fn(header, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// parseManifest parses "SHA256(name)= digest" lines from an OVA manifest
+func parseManifest(data []byte) map[string]string {
+	manifest := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		open := strings.Index(line, "(")
+		close := strings.Index(line, ")=")
+		if open < 0 || close < open {
+			continue
+		}
+		manifest[line[open+1:close]] = strings.TrimSpace(line[close+2:])
+	}
+	return manifest
+}
+
+// regenerateIdentity gives an imported VM a fresh BIOS UUID and lets ESXi
+// generate new MAC addresses so restores never clash with the original
+func regenerateIdentity(spec *types.VirtualMachineConfigSpec) {
+	spec.Uuid = uuid.New().String()
+
+	for _, change := range spec.DeviceChange {
+		nic, ok := change.GetVirtualDeviceConfigSpec().Device.(types.BaseVirtualEthernetCard)
+		if !ok {
+			continue
+		}
+		card := nic.GetVirtualEthernetCard()
+		card.AddressType = string(types.VirtualEthernetCardMacTypeGenerated)
+		card.MacAddress = ""
+	}
+}
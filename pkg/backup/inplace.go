@@ -0,0 +1,173 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/r11/esxi-commander/internal/storage"
+	"github.com/r11/esxi-commander/pkg/audit"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// restoreInPlace replaces an existing VM with the contents of a backup.
+// The original is powered off and renamed aside so it can be put back if
+// the import fails. Unless KeepOriginal is set, the restored VM then takes
+// over its BIOS UUID and MAC addresses and only after that is it destroyed.
+func (m *BackupManager) restoreInPlace(ctx context.Context, entry *storage.BackupEntry, opts RestoreOptions) error {
+	auditCtx := audit.GetLogger().LogOperation(ctx, "backup.restore.inplace", map[string]interface{}{
+		"backup_id":     entry.ID,
+		"vm":            opts.NewName,
+		"keep_original": opts.KeepOriginal,
+	})
+
+	err := m.replaceVM(ctx, entry, opts)
+	if err != nil {
+		auditCtx.Failure(err)
+		return err
+	}
+
+	auditCtx.Success()
+	return nil
+}
+
+func (m *BackupManager) replaceVM(ctx context.Context, entry *storage.BackupEntry, opts RestoreOptions) error {
+	original, err := m.client.FindVM(ctx, opts.NewName)
+	if err != nil {
+		return fmt.Errorf("VM %s not found for in-place restore: %w", opts.NewName, err)
+	}
+
+	var originalMo mo.VirtualMachine
+	err = original.Properties(ctx, original.Reference(), []string{"config.uuid", "config.hardware.device", "runtime.powerState"}, &originalMo)
+	if err != nil {
+		return fmt.Errorf("failed to get VM properties: %w", err)
+	}
+
+	wasRunning := originalMo.Runtime.PowerState == types.VirtualMachinePowerStatePoweredOn
+	if wasRunning {
+		if err := m.vmOps.PowerOff(ctx, original); err != nil {
+			return err
+		}
+	}
+
+	asideName := fmt.Sprintf("%s-pre-restore-%s", opts.NewName, time.Now().Format("20060102150405"))
+	fmt.Printf("Moving original VM aside as '%s'...\n", asideName)
+	if err := renameVM(ctx, original, asideName); err != nil {
+		if wasRunning {
+			m.vmOps.PowerOn(ctx, original)
+		}
+		return err
+	}
+
+	if err := m.importVM(ctx, entry, opts); err != nil {
+		return m.rollbackInPlace(ctx, original, opts.NewName, asideName, wasRunning, fmt.Errorf("failed to import VM: %w", err))
+	}
+
+	restored, err := m.client.FindVM(ctx, opts.NewName)
+	if err != nil {
+		return m.rollbackInPlace(ctx, original, opts.NewName, asideName, wasRunning, fmt.Errorf("failed to find restored VM: %w", err))
+	}
+
+	if opts.KeepOriginal {
+		fmt.Printf("Original VM kept as '%s'\n", asideName)
+		return nil
+	}
+
+	// Both VMs are powered off, so the restored VM can take over the
+	// original's identity while the original is still there to roll back to
+	if err := adoptIdentity(ctx, restored, originalMo); err != nil {
+		return m.rollbackInPlace(ctx, original, opts.NewName, asideName, wasRunning, fmt.Errorf("failed to keep original UUID/MAC: %w", err))
+	}
+
+	task, err := original.Destroy(ctx)
+	if err == nil {
+		err = task.Wait(ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("VM restored, but failed to remove original VM %s, which has the same UUID and MACs; remove it before powering it on: %w", asideName, err)
+	}
+
+	return nil
+}
+
+// rollbackInPlace removes a partially imported VM and restores the original
+func (m *BackupManager) rollbackInPlace(ctx context.Context, original *object.VirtualMachine, name, asideName string, powerOn bool, cause error) error {
+	fmt.Printf("Restore failed, rolling back to original VM...\n")
+
+	if partial, err := m.client.FindVM(ctx, name); err == nil && partial.Reference() != original.Reference() {
+		if task, err := partial.Destroy(ctx); err == nil {
+			task.Wait(ctx)
+		}
+	}
+
+	if err := renameVM(ctx, original, name); err != nil {
+		return fmt.Errorf("%w (rollback failed, original VM left as %s: %v)", cause, asideName, err)
+	}
+
+	if powerOn {
+		if err := m.vmOps.PowerOn(ctx, original); err != nil {
+			return fmt.Errorf("%w (original VM restored but failed to power on: %v)", cause, err)
+		}
+	}
+
+	return cause
+}
+
+func renameVM(ctx context.Context, vmObj *object.VirtualMachine, name string) error {
+	task, err := vmObj.Rename(ctx, name)
+	if err != nil {
+		return fmt.Errorf("failed to rename VM to %s: %w", name, err)
+	}
+	if err := task.Wait(ctx); err != nil {
+		return fmt.Errorf("failed to rename VM to %s: %w", name, err)
+	}
+	return nil
+}
+
+// adoptIdentity applies the original VM's BIOS UUID and NIC MAC addresses
+// (matched by device order) to the restored VM
+func adoptIdentity(ctx context.Context, restored *object.VirtualMachine, original mo.VirtualMachine) error {
+	devices, err := restored.Device(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get devices: %w", err)
+	}
+
+	var originalMACs []string
+	for _, device := range original.Config.Hardware.Device {
+		if nic, ok := device.(types.BaseVirtualEthernetCard); ok {
+			originalMACs = append(originalMACs, nic.GetVirtualEthernetCard().MacAddress)
+		}
+	}
+
+	spec := types.VirtualMachineConfigSpec{
+		Uuid: original.Config.Uuid,
+	}
+
+	i := 0
+	for _, device := range devices {
+		nic, ok := device.(types.BaseVirtualEthernetCard)
+		if !ok {
+			continue
+		}
+		if i >= len(originalMACs) {
+			break
+		}
+
+		card := nic.GetVirtualEthernetCard()
+		card.AddressType = string(types.VirtualEthernetCardMacTypeManual)
+		card.MacAddress = originalMACs[i]
+		spec.DeviceChange = append(spec.DeviceChange, &types.VirtualDeviceConfigSpec{
+			Operation: types.VirtualDeviceConfigSpecOperationEdit,
+			Device:    device,
+		})
+		i++
+	}
+
+	task, err := restored.Reconfigure(ctx, spec)
+	if err != nil {
+		return err
+	}
+	return task.Wait(ctx)
+}
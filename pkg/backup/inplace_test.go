@@ -0,0 +1,129 @@
+package backup
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func TestRestoreInPlaceKeepsIdentity(t *testing.T) {
+	manager := newTestManager(t)
+	vmName := firstVMName(t, manager)
+	target := newMemoryTarget()
+	ctx := context.Background()
+
+	info, err := manager.CreateBackup(ctx, BackupOptions{VMName: vmName, Hot: true, Compress: true, Target: target})
+	require.NoError(t, err)
+
+	originalUUID, originalMACs := vmIdentity(t, manager, vmName)
+
+	err = manager.RestoreBackup(ctx, RestoreOptions{
+		BackupID: info.ID,
+		InPlace:  true,
+		Target:   target,
+	})
+	require.NoError(t, err)
+
+	restoredUUID, restoredMACs := vmIdentity(t, manager, vmName)
+	assert.Equal(t, originalUUID, restoredUUID)
+	assert.Equal(t, originalMACs, restoredMACs)
+
+	vms, err := manager.client.ListVMs(ctx)
+	require.NoError(t, err)
+	for _, vm := range vms {
+		assert.NotContains(t, vm.Name, "-pre-restore-", "set-aside copy should be removed")
+	}
+}
+
+func TestRestoreInPlaceRollsBackOnFailure(t *testing.T) {
+	manager := newTestManager(t)
+	vmName := firstVMName(t, manager)
+	target := newMemoryTarget()
+	ctx := context.Background()
+
+	info, err := manager.CreateBackup(ctx, BackupOptions{VMName: vmName, Hot: true, Compress: true, Target: target})
+	require.NoError(t, err)
+
+	originalVM, err := manager.client.FindVM(ctx, vmName)
+	require.NoError(t, err)
+
+	// Corrupt the artifact so the import fails after the original is set aside
+	data := target.data[info.ID]
+	data[len(data)-1] ^= 0xff
+
+	err = manager.RestoreBackup(ctx, RestoreOptions{
+		BackupID: info.ID,
+		InPlace:  true,
+		Target:   target,
+	})
+	require.Error(t, err)
+
+	vmObj, err := manager.client.FindVM(ctx, vmName)
+	require.NoError(t, err)
+	assert.Equal(t, originalVM.Reference(), vmObj.Reference())
+
+	state, err := vmObj.PowerState(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "poweredOn", string(state))
+}
+
+func TestRestoreInPlaceRollsBackWhenIdentityFails(t *testing.T) {
+	c, model := newSimulatorClient(t)
+	dir := t.TempDir()
+	manager, err := NewBackupManagerWithConfig(c, &Config{
+		CatalogPath: filepath.Join(dir, "catalog.db"),
+		TempDir:     dir,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { manager.Close() })
+
+	vmName := firstVMName(t, manager)
+	target := newMemoryTarget()
+	ctx := context.Background()
+
+	info, err := manager.CreateBackup(ctx, BackupOptions{VMName: vmName, Hot: true, Compress: true, Target: target})
+	require.NoError(t, err)
+
+	originalVM, err := manager.client.FindVM(ctx, vmName)
+	require.NoError(t, err)
+	originalUUID, originalMACs := vmIdentity(t, manager, vmName)
+
+	// Refuse the reconfigure that hands the original's UUID to the restored VM
+	model.Service.Context.Map.Handler = func(ctx *simulator.Context, method *simulator.Method) (mo.Reference, types.BaseMethodFault) {
+		if req, ok := method.Body.(*types.ReconfigVM_Task); ok && req.Spec.Uuid != "" {
+			return nil, &types.InvalidState{}
+		}
+		return nil, nil
+	}
+
+	err = manager.RestoreBackup(ctx, RestoreOptions{
+		BackupID: info.ID,
+		InPlace:  true,
+		Target:   target,
+	})
+	require.ErrorContains(t, err, "failed to keep original UUID/MAC")
+
+	// The original is back under its name with its identity, and powered on
+	vmObj, err := manager.client.FindVM(ctx, vmName)
+	require.NoError(t, err)
+	assert.Equal(t, originalVM.Reference(), vmObj.Reference())
+	uuid, macs := vmIdentity(t, manager, vmName)
+	assert.Equal(t, originalUUID, uuid)
+	assert.Equal(t, originalMACs, macs)
+
+	state, err := vmObj.PowerState(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, types.VirtualMachinePowerStatePoweredOn, state)
+
+	vms, err := manager.client.ListVMs(ctx)
+	require.NoError(t, err)
+	for _, vm := range vms {
+		assert.NotContains(t, vm.Name, "-pre-restore-")
+	}
+}
@@ -0,0 +1,66 @@
+package backup
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/r11/esxi-commander/internal/storage"
+	"github.com/r11/esxi-commander/pkg/esxi/client"
+)
+
+// TargetResolver returns the target holding a backup stored at location.
+// The manager resolves datastore://, file:// and repo:// locations itself; s3:// and
+// sftp:// locations need a resolver that knows the configured credentials.
+type TargetResolver func(location string) (BackupTarget, error)
+
+// TargetForLocation returns the target for a datastore://, file:// or
+// repo:// backup location
+func TargetForLocation(c *client.ESXiClient, location string) (BackupTarget, error) {
+	switch {
+	case strings.HasPrefix(location, "datastore://"):
+		// datastore://<datastore>/<base path>/<id>.ova
+		name, filePath, ok := strings.Cut(strings.TrimPrefix(location, "datastore://"), "/")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid datastore location: %s", location)
+		}
+		// GetLocation names the host's default datastore "default"
+		if name == "default" {
+			name = ""
+		}
+		return NewDatastoreTarget(c, name, path.Dir(filePath)), nil
+	case strings.HasPrefix(location, "file://"):
+		return NewDirectoryTarget(filepath.Dir(strings.TrimPrefix(location, "file://")))
+	case strings.HasPrefix(location, "repo://"):
+		// repo://<repository path>/<id>
+		return NewRepoTarget(filepath.Dir(strings.TrimPrefix(location, "repo://")))
+	default:
+		return nil, fmt.Errorf("no target configured for backup location %s", location)
+	}
+}
+
+// targetFor returns the target holding a stored backup
+func (m *BackupManager) targetFor(location string) (BackupTarget, error) {
+	if m.config.ResolveTarget != nil {
+		return m.config.ResolveTarget(location)
+	}
+	return TargetForLocation(m.client, location)
+}
+
+// entryTarget returns the target a backup was written to. Backups that
+// never completed have no location, only the base location of their target;
+// entries from before that was recorded are assumed to be on the default
+// target.
+func (m *BackupManager) entryTarget(entry *storage.BackupEntry) (BackupTarget, error) {
+	switch {
+	case entry.Location != "":
+		return m.targetFor(entry.Location)
+	case entry.Metadata["target"] != "":
+		return m.targetFor(entry.Metadata["target"] + "/" + entry.ID)
+	case m.config.ResolveTarget != nil:
+		return m.config.ResolveTarget("")
+	default:
+		return NewDatastoreTarget(m.client, "", "backups"), nil
+	}
+}
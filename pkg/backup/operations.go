@@ -1,23 +1,20 @@
 package backup
 
 import (
-	"archive/tar"
-	"compress/gzip"
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
-	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/r11/esxi-commander/internal/storage"
+	"github.com/r11/esxi-commander/pkg/audit"
 	"github.com/r11/esxi-commander/pkg/esxi/client"
 	"github.com/r11/esxi-commander/pkg/esxi/vm"
 	"github.com/r11/esxi-commander/pkg/metrics"
-	"github.com/vmware/govmomi/object"
+	"github.com/r11/esxi-commander/pkg/tasks"
 	"github.com/vmware/govmomi/vim25/mo"
 	"github.com/vmware/govmomi/vim25/types"
 )
@@ -25,16 +22,32 @@ import (
 type BackupManager struct {
 	client  *client.ESXiClient
 	vmOps   *vm.Operations
-	catalog *storage.BackupCatalog
-	config  *Config
+	catalog   *storage.BackupCatalog
+	config    *Config
+	encryptor *Encryptor
+	slots     chan struct{} // Holds a token per running backup, up to Config.MaxConcurrent
+
+	// Backups being written, which RecoverBackups must leave alone
+	activeMu sync.Mutex
+	active   map[string]bool
+
+	// Replaces the QueryChangedDiskAreas call in tests; vcsim does not implement it
+	queryChangedDiskAreas func(ctx context.Context, vm, snapshot types.ManagedObjectReference, deviceKey int32, offset int64, changeID string) (types.DiskChangeInfo, error)
+
+	// Replaces reading the guest heartbeat and IP address in tests; vcsim never reports a heartbeat
+	guestState func(ctx context.Context, vm types.ManagedObjectReference) (types.ManagedEntityStatus, string, error)
 }
 
 type Config struct {
-	CatalogPath     string
-	DefaultTarget   string // datastore, nfs, s3
-	Compression     string // none, gzip, zstd
-	TempDir         string
-	MaxConcurrent   int
+	CatalogPath        string
+	DefaultTarget      string   // datastore, nfs, s3
+	Compression        string   // none, gzip, zstd
+	CompressionLevel   int      // 0 selects the codec default
+	CompressionThreads int      // zstd encoder threads; 0 means one per CPU
+	Recipients         []string // age public keys; backups are encrypted when set
+	TempDir            string
+	MaxConcurrent      int      // Backups run at once by this manager; further ones wait
+	ResolveTarget      TargetResolver // Finds the target of a stored backup; see TargetForLocation
 }
 
 type BackupTarget interface {
@@ -44,10 +57,11 @@ type BackupTarget interface {
 	GetLocation() string
 }
 
-type DatastoreTarget struct {
-	client    *client.ESXiClient
-	datastore string
-	basePath  string
+// resumableTarget is a target that keeps an interrupted upload and, when
+// the same backup is stored again, reuses whatever of it still matches
+type resumableTarget interface {
+	BackupTarget
+	resumesUploads()
 }
 
 type BackupOptions struct {
@@ -55,22 +69,69 @@ type BackupOptions struct {
 	PowerOff    bool
 	Hot         bool
 	Compress    bool
+	Compression string // Codec when Compress is set; defaults to Config.Compression
+	Incremental bool   // Store only blocks changed since the last CBT backup
 	Target      BackupTarget
 	Description string
+	Hooks       *Hooks // Guest commands run around the snapshot of a running VM
+	Progress    ProgressFunc // Receives snapshot and export progress; may be nil
+	RetainUntil time.Time    // Lock the stored backup against deletion until then; needs an ImmutableTarget
+	Resume      string       // ID of an interrupted backup to write again, resuming its partial upload
 }
 
 type RestoreOptions struct {
-	BackupID    string
-	NewName     string
-	PowerOn     bool
-	Guestinfo   map[string]string // For re-IP
+	BackupID     string
+	NewName      string
+	PowerOn      bool
+	Guestinfo    map[string]string // For re-IP
+	Target       BackupTarget      // Target holding the backup; defaults to the datastore
+	InPlace      bool              // Replace the existing VM named NewName
+	KeepOriginal bool              // With InPlace, keep the replaced VM under a renamed copy
+	IdentityFile string            // age identity file, required for encrypted backups
+	Progress     ProgressFunc      // Receives import progress; may be nil
+}
+
+type VerifyOptions struct {
+	BackupID     string
+	Target       BackupTarget // Target holding the backup; defaults to the datastore
+	IdentityFile string       // age identity file, required for encrypted backups
+}
+
+// VerifyResult is the outcome of verifying one backup
+type VerifyResult struct {
+	BackupID string    `json:"backup_id"`
+	VMName   string    `json:"vm_name"`
+	Verified time.Time `json:"verified"`
+	Passed   bool      `json:"passed"`
+	Checksum string    `json:"checksum"`
+	Bytes    int64     `json:"bytes"` // Bytes read from the target
+	Files    int       `json:"files"` // OVA files checked against the manifest
+	Error    string    `json:"error,omitempty"`
 }
 
 type PruneOptions struct {
-	VMName   string // Empty string means all VMs
-	KeepLast int    // Keep last N backups per VM
-	KeepDays int    // Keep backups newer than N days
-	DryRun   bool   // Don't actually delete, just show what would be deleted
+	VMName      string // Empty string means all VMs
+	KeepLast    int    // Keep last N backups per VM
+	KeepDays    int    // Keep backups newer than N days
+	KeepDaily   int    // Keep the newest backup of each of the last N days
+	KeepWeekly  int    // Keep the newest backup of each of the last N ISO weeks
+	KeepMonthly int    // Keep the newest backup of each of the last N months
+	Timezone    string // Timezone for day/week/month boundaries; empty means local time
+	DryRun      bool   // Don't actually delete, just show what would be deleted
+}
+
+// PruneResult summarises a prune run; in a dry run it describes what would
+// have been deleted
+type PruneResult struct {
+	Deleted    int   // Backups deleted
+	Failed     int   // Backups that could not be deleted
+	FreedBytes int64 // Size of the deleted backups
+
+	// Errors says why each failed backup could not be deleted, by ID
+	Errors map[string]string
+
+	// Plan lists every backup considered with the rules that keep it
+	Plan []storage.RetentionDecision
 }
 
 type BackupInfo struct {
@@ -82,29 +143,97 @@ type BackupInfo struct {
 	Status      string    `json:"status"`
 	Type        string    `json:"type"`
 	Description string    `json:"description"`
+	ParentID    string    `json:"parent_id,omitempty"`
+
+	LastVerified *time.Time `json:"last_verified,omitempty"`
+	VerifyStatus string     `json:"verify_status,omitempty"`
+
+	Hooks []storage.HookRun `json:"hooks,omitempty"`
+
+	Replicas []storage.Replica `json:"replicas,omitempty"`
+
+	RetainUntil *time.Time         `json:"retain_until,omitempty"`
+	Hold        *storage.LegalHold `json:"hold,omitempty"`
+
+	LastDrill *storage.DrillRecord `json:"last_drill,omitempty"`
 }
 
 // NewBackupManager creates a new backup manager
 func NewBackupManager(client *client.ESXiClient, catalogPath string) (*BackupManager, error) {
-	catalog, err := storage.InitCatalog(catalogPath)
+	return NewBackupManagerWithConfig(client, &Config{CatalogPath: catalogPath})
+}
+
+// NewBackupManagerWithConfig creates a new backup manager, filling in
+// defaults for any unset configuration values
+func NewBackupManagerWithConfig(client *client.ESXiClient, cfg *Config) (*BackupManager, error) {
+	config := *cfg
+	if config.DefaultTarget == "" {
+		config.DefaultTarget = "datastore"
+	}
+	if config.Compression == "" {
+		config.Compression = "gzip"
+	}
+	if config.TempDir == "" {
+		config.TempDir = os.TempDir()
+	}
+	if config.MaxConcurrent == 0 {
+		config.MaxConcurrent = 2
+	}
+
+	encryptor, err := NewEncryptor(config.Recipients)
+	if err != nil {
+		return nil, err
+	}
+
+	catalog, err := storage.InitCatalog(config.CatalogPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize catalog: %w", err)
 	}
 
 	return &BackupManager{
-		client:  client,
-		vmOps:   vm.NewOperations(client),
-		catalog: catalog,
-		config: &Config{
-			CatalogPath:   catalogPath,
-			DefaultTarget: "datastore",
-			Compression:   "gzip",
-			TempDir:       "/tmp",
-			MaxConcurrent: 2,
-		},
+		client:    client,
+		vmOps:     vm.NewOperations(client),
+		catalog:   catalog,
+		config:    &config,
+		encryptor: encryptor,
+		slots:     make(chan struct{}, config.MaxConcurrent),
 	}, nil
 }
 
+// acquireSlot waits until fewer than Config.MaxConcurrent backups are
+// running and returns a function that frees the slot again
+func (m *BackupManager) acquireSlot(ctx context.Context) (func(), error) {
+	select {
+	case m.slots <- struct{}{}:
+		return func() { <-m.slots }, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("failed to wait for a backup slot: %w", ctx.Err())
+	}
+}
+
+// codec returns the compression codec for a backup
+func (m *BackupManager) codec(opts BackupOptions) (Codec, error) {
+	// Repositories compress each chunk; a compressed stream would not deduplicate
+	if _, ok := opts.Target.(*RepoTarget); ok || !opts.Compress {
+		return NewCodec("none", 0, 0)
+	}
+
+	name := opts.Compression
+	if name == "" {
+		name = m.config.Compression
+	}
+	return NewCodec(name, m.config.CompressionLevel, m.config.CompressionThreads)
+}
+
+// checkEncryptionTarget refuses to encrypt into a repository: every
+// encrypted stream is different, so none of its chunks would deduplicate
+func (m *BackupManager) checkEncryptionTarget(target BackupTarget) error {
+	if repo, ok := target.(*RepoTarget); ok && m.encryptor != nil {
+		return fmt.Errorf("repository %s cannot hold encrypted backups, which never deduplicate; back up without encryption recipients or to another target", repo.path)
+	}
+	return nil
+}
+
 // Close closes the backup manager
 func (m *BackupManager) Close() error {
 	if m.catalog != nil {
@@ -116,9 +245,48 @@ func (m *BackupManager) Close() error {
 // CreateBackup creates a backup of a VM
 func (m *BackupManager) CreateBackup(ctx context.Context, opts BackupOptions) (*BackupInfo, error) {
 	start := time.Now()
-	
+
+	codec, err := m.codec(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.checkEncryptionTarget(opts.Target); err != nil {
+		return nil, err
+	}
+
+	var locker ImmutableTarget
+	if !opts.RetainUntil.IsZero() {
+		var ok bool
+		if locker, ok = opts.Target.(ImmutableTarget); !ok {
+			return nil, fmt.Errorf("the backup target does not support immutable backups")
+		}
+	}
+
+	release, err := m.acquireSlot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	target := opts.Target
+	if target == nil {
+		target = NewDatastoreTarget(m.client, "", "backups")
+	}
+
 	// Generate backup ID
 	backupID := fmt.Sprintf("backup-%s-%s", opts.VMName, uuid.New().String()[:8])
+	if opts.Resume != "" {
+		if err := m.checkResumable(opts.Resume, opts.VMName, target); err != nil {
+			return nil, err
+		}
+		backupID = opts.Resume
+	}
+
+	// A resumed backup that fails before its export keeps its partial upload
+	failedStatus := "failed"
+	if opts.Resume != "" {
+		failedStatus = "interrupted"
+	}
 
 	// Determine backup type
 	backupType := "cold"
@@ -135,9 +303,11 @@ func (m *BackupManager) CreateBackup(ctx context.Context, opts BackupOptions) (*
 		Status:    "pending",
 		Metadata: map[string]string{
 			"description": opts.Description,
+			"target":      target.GetLocation(),
 		},
 	}
 
+	defer m.beginBackup(backupID)()
 	if err := m.catalog.AddBackup(entry); err != nil {
 		return nil, fmt.Errorf("failed to add backup to catalog: %w", err)
 	}
@@ -145,7 +315,7 @@ func (m *BackupManager) CreateBackup(ctx context.Context, opts BackupOptions) (*
 	// Get VM
 	vmObj, err := m.client.FindVM(ctx, opts.VMName)
 	if err != nil {
-		m.catalog.UpdateBackupStatus(backupID, "failed")
+		m.catalog.UpdateBackupStatus(backupID, failedStatus)
 		return nil, fmt.Errorf("failed to find VM: %w", err)
 	}
 
@@ -153,51 +323,43 @@ func (m *BackupManager) CreateBackup(ctx context.Context, opts BackupOptions) (*
 	var vmMo mo.VirtualMachine
 	err = vmObj.Properties(ctx, vmObj.Reference(), []string{"runtime.powerState"}, &vmMo)
 	if err != nil {
-		m.catalog.UpdateBackupStatus(backupID, "failed")
+		m.catalog.UpdateBackupStatus(backupID, failedStatus)
 		return nil, fmt.Errorf("failed to get VM properties: %w", err)
 	}
 
 	wasRunning := vmMo.Runtime.PowerState == types.VirtualMachinePowerStatePoweredOn
 
 	var snapshotName string
+	var snapshotRef *types.ManagedObjectReference
 	var backupErr error
 
-	// Handle hot backup with snapshot
-	if opts.Hot && wasRunning {
-		// Create snapshot for hot backup
-		snapshotName = fmt.Sprintf("backup-snapshot-%s", backupID)
-		fmt.Printf("Creating snapshot '%s' for hot backup...\n", snapshotName)
-		
-		err := m.vmOps.CreateSnapshot(ctx, vmObj, snapshotName, "Backup snapshot", false, true)
+	// Incremental backups need CBT; if it had to be turned on, earlier
+	// change IDs are meaningless and this backup starts a new chain
+	var parent *storage.BackupEntry
+	if opts.Incremental {
+		tracking, err := m.enableChangeTracking(ctx, vmObj)
 		if err != nil {
-			m.catalog.UpdateBackupStatus(backupID, "failed")
-			return nil, fmt.Errorf("failed to create backup snapshot: %w", err)
+			m.catalog.UpdateBackupStatus(backupID, failedStatus)
+			return nil, err
 		}
-
-		// Cleanup snapshot after backup
-		defer func() {
-			if snapshotName != "" {
-				// Find and remove the snapshot
-				snapshots, err := m.vmOps.ListSnapshots(ctx, vmObj)
-				if err == nil {
-					for _, snapshot := range snapshots {
-						if snapshot.Name == snapshotName {
-							m.vmOps.RemoveSnapshot(ctx, vmObj, snapshot.Snapshot, false)
-							break
-						}
-					}
-				}
+		if tracking {
+			parent, err = m.incrementalParent(opts.VMName)
+			if err != nil {
+				m.catalog.UpdateBackupStatus(backupID, failedStatus)
+				return nil, err
 			}
-		}()
-	} else if opts.PowerOff && wasRunning {
+		}
+	}
+
+	if opts.PowerOff && wasRunning && !opts.Hot {
 		// Power off VM for cold backup
 		task, err := vmObj.PowerOff(ctx)
 		if err != nil {
-			m.catalog.UpdateBackupStatus(backupID, "failed")
+			m.catalog.UpdateBackupStatus(backupID, failedStatus)
 			return nil, fmt.Errorf("failed to power off VM: %w", err)
 		}
-		if err := task.Wait(ctx); err != nil {
-			m.catalog.UpdateBackupStatus(backupID, "failed")
+		if err := tasks.Wait(ctx, task); err != nil {
+			m.catalog.UpdateBackupStatus(backupID, failedStatus)
 			return nil, fmt.Errorf("failed to wait for power off: %w", err)
 		}
 
@@ -212,20 +374,82 @@ func (m *BackupManager) CreateBackup(ctx context.Context, opts BackupOptions) (*
 		}()
 	}
 
-	// Export VM to OVF
-	location, size, checksum, err := m.exportVM(ctx, vmObj, backupID, opts)
+	// Hot backups export a snapshot; CBT queries always need one
+	if (opts.Hot && wasRunning) || opts.Incremental {
+		snapshotName = backupSnapshotPrefix + backupID
+		fmt.Printf("Creating snapshot '%s' for backup...\n", snapshotName)
+		opts.Progress.report("snapshot", -1)
+
+		// An interrupted run being resumed may have left its snapshot behind
+		if opts.Resume != "" {
+			m.removeBackupSnapshot(ctx, vmObj, snapshotName)
+		}
+
+		// Hooks run in the guest, so only while it is running
+		hooks := opts.Hooks
+		if !wasRunning {
+			hooks = nil
+		}
+
+		quiesce := opts.Hot && wasRunning
+		err := m.snapshotWithHooks(ctx, vmObj, entry, hooks, snapshotName, quiesce)
+		if err != nil {
+			m.catalog.UpdateBackupStatus(backupID, failedStatus)
+			return nil, err
+		}
+
+		snapshotRef, err = vmObj.FindSnapshot(ctx, snapshotName)
+		if err != nil {
+			m.catalog.UpdateBackupStatus(backupID, failedStatus)
+			return nil, fmt.Errorf("failed to find backup snapshot: %w", err)
+		}
+
+		// Cleanup snapshot after backup
+		defer m.removeBackupSnapshot(ctx, vmObj, snapshotName)
+	}
+
+	// Export VM to OVA (or its changed extents) and stream it to the target
+	var location, checksum string
+	var size int64
+	var index *cbtIndex
+	if opts.Incremental {
+		opts.Progress.report("export changes", -1)
+		location, size, checksum, index, err = m.exportChanges(ctx, vmObj, *snapshotRef, parent, backupID, target, codec, opts)
+	} else {
+		location, size, checksum, err = m.exportVM(ctx, vmObj, snapshotRef, backupID, target, codec, opts)
+	}
 	if err != nil {
 		backupErr = err
-		m.catalog.UpdateBackupStatus(backupID, "failed")
+		m.interruptBackup(ctx, target, backupID)
 		return nil, fmt.Errorf("failed to export VM: %w", err)
 	}
 
+	// A backup that should be immutable but is not counts as failed
+	if locker != nil {
+		if err := locker.Lock(ctx, backupID, opts.RetainUntil); err != nil {
+			backupErr = err
+			m.abandonBackup(ctx, target, backupID)
+			return nil, err
+		}
+		entry.RetainUntil = &opts.RetainUntil
+	}
+
 	// Update catalog with success
 	entry.Status = "completed"
 	entry.Size = size
 	entry.Location = location
 	entry.Checksum = checksum
-	
+	entry.Metadata["format"] = "ova"
+	entry.Metadata["compression"] = codec.Name()
+	if index != nil {
+		entry.Metadata["format"] = "cbt"
+		entry.ParentID = index.ParentID
+		for _, disk := range index.Disks {
+			entry.Metadata[changeIDKey(disk.Key)] = disk.ChangeID
+		}
+	}
+	m.encryptor.recordEncryption(entry)
+
 	if err := m.catalog.AddBackup(entry); err != nil {
 		return nil, fmt.Errorf("failed to update catalog: %w", err)
 	}
@@ -243,11 +467,65 @@ func (m *BackupManager) CreateBackup(ctx context.Context, opts BackupOptions) (*
 		Status:      "completed",
 		Type:        backupType,
 		Description: opts.Description,
+		ParentID:    entry.ParentID,
+		Hooks:       entry.Hooks,
+		RetainUntil: entry.RetainUntil,
 	}, nil
 }
 
+// checkResumable checks that backupID is a backup of vmName to target that
+// was interrupted, or killed and left pending, so that CreateBackup may
+// write it again. Encrypted backups cannot be resumed: every run encrypts
+// with a new file key, so no part of the interrupted upload would match.
+func (m *BackupManager) checkResumable(backupID, vmName string, target BackupTarget) error {
+	if m.encryptor != nil {
+		return fmt.Errorf("backup %s cannot be resumed: encrypted backups never match their interrupted upload; back it up again without --resume", backupID)
+	}
+
+	entry, err := m.catalog.GetBackup(backupID)
+	if err != nil {
+		return fmt.Errorf("failed to get backup from catalog: %w", err)
+	}
+	killed := entry.Status == "pending" && !m.backupActive(backupID)
+	if entry.Status != "interrupted" && !killed {
+		return fmt.Errorf("backup %s cannot be resumed: only interrupted backups can, and it is %s", backupID, entry.Status)
+	}
+	if entry.VMName != vmName {
+		return fmt.Errorf("backup %s is of VM %s, not %s", backupID, entry.VMName, vmName)
+	}
+	if location := entry.Metadata["target"]; location != target.GetLocation() {
+		return fmt.Errorf("backup %s was written to %s, not %s", backupID, location, target.GetLocation())
+	}
+	return nil
+}
+
+// interruptBackup marks a backup whose export failed as interrupted, keeping
+// its partial upload for --resume, if the target resumes uploads and the
+// backup is not encrypted. Otherwise the backup is abandoned.
+func (m *BackupManager) interruptBackup(ctx context.Context, target BackupTarget, backupID string) {
+	if _, ok := target.(resumableTarget); !ok || m.encryptor != nil {
+		m.abandonBackup(ctx, target, backupID)
+		return
+	}
+
+	fmt.Printf("Partial upload of backup %s kept; resume it with --resume %s\n", backupID, backupID)
+	m.catalog.UpdateBackupStatus(backupID, "interrupted")
+}
+
+// abandonBackup marks a backup failed and removes whatever part of it
+// reached the target, such as an incomplete S3 upload or SFTP partial file.
+// If that fails, prune and recover remove it later.
+func (m *BackupManager) abandonBackup(ctx context.Context, target BackupTarget, backupID string) {
+	if err := target.Delete(context.WithoutCancel(ctx), backupID); err != nil {
+		fmt.Printf("Failed to remove partial backup %s: %v\n", backupID, err)
+	}
+	m.catalog.UpdateBackupStatus(backupID, "failed")
+}
+
 // RestoreBackup restores a VM from a backup
 func (m *BackupManager) RestoreBackup(ctx context.Context, opts RestoreOptions) error {
+	start := time.Now()
+
 	// Get backup from catalog
 	entry, err := m.catalog.GetBackup(opts.BackupID)
 	if err != nil {
@@ -258,14 +536,26 @@ func (m *BackupManager) RestoreBackup(ctx context.Context, opts RestoreOptions)
 		return fmt.Errorf("backup is not in completed state: %s", entry.Status)
 	}
 
-	// Check if new VM name already exists
-	if _, err := m.client.FindVM(ctx, opts.NewName); err == nil {
-		return fmt.Errorf("VM with name %s already exists", opts.NewName)
-	}
+	if opts.InPlace {
+		if opts.NewName == "" {
+			opts.NewName = entry.VMName
+		}
 
-	// Restore VM from backup
-	if err := m.importVM(ctx, entry, opts); err != nil {
-		return fmt.Errorf("failed to import VM: %w", err)
+		if err := m.restoreInPlace(ctx, entry, opts); err != nil {
+			metrics.RecordBackupOperation("restore", "failure", time.Since(start).Seconds())
+			return err
+		}
+	} else {
+		// Check if new VM name already exists
+		if _, err := m.client.FindVM(ctx, opts.NewName); err == nil {
+			return fmt.Errorf("VM with name %s already exists", opts.NewName)
+		}
+
+		// Restore VM from backup
+		if err := m.importVM(ctx, entry, opts); err != nil {
+			metrics.RecordBackupOperation("restore", "failure", time.Since(start).Seconds())
+			return fmt.Errorf("failed to import VM: %w", err)
+		}
 	}
 
 	// Apply guestinfo if provided (for re-IP)
@@ -287,7 +577,7 @@ func (m *BackupManager) RestoreBackup(ctx context.Context, opts RestoreOptions)
 		if err != nil {
 			return fmt.Errorf("failed to reconfigure VM: %w", err)
 		}
-		if err := task.Wait(ctx); err != nil {
+		if err := tasks.Wait(ctx, task); err != nil {
 			return fmt.Errorf("failed to wait for reconfigure: %w", err)
 		}
 	}
@@ -303,11 +593,12 @@ func (m *BackupManager) RestoreBackup(ctx context.Context, opts RestoreOptions)
 		if err != nil {
 			return fmt.Errorf("failed to power on VM: %w", err)
 		}
-		if err := task.Wait(ctx); err != nil {
+		if err := tasks.Wait(ctx, task); err != nil {
 			return fmt.Errorf("failed to wait for power on: %w", err)
 		}
 	}
 
+	metrics.RecordBackupOperation("restore", "success", time.Since(start).Seconds())
 	return nil
 }
 
@@ -320,244 +611,299 @@ func (m *BackupManager) ListBackups(vmName string) ([]*BackupInfo, error) {
 
 	backups := make([]*BackupInfo, len(entries))
 	for i, entry := range entries {
-		backups[i] = &BackupInfo{
-			ID:       entry.ID,
-			VMName:   entry.VMName,
-			Size:     entry.Size,
-			Created:  entry.Timestamp,
-			Location: entry.Location,
-			Status:   entry.Status,
-			Type:     entry.Type,
-		}
-		if desc, ok := entry.Metadata["description"]; ok {
-			backups[i].Description = desc
-		}
+		backups[i] = toBackupInfo(entry)
 	}
 
 	return backups, nil
 }
 
-// DeleteBackup deletes a backup
-func (m *BackupManager) DeleteBackup(ctx context.Context, backupID string) error {
-	// Get backup from catalog to verify it exists
-	_, err := m.catalog.GetBackup(backupID)
+// GetBackup returns a single backup from the catalog
+func (m *BackupManager) GetBackup(backupID string) (*BackupInfo, error) {
+	entry, err := m.catalog.GetBackup(backupID)
 	if err != nil {
-		return fmt.Errorf("failed to get backup from catalog: %w", err)
+		return nil, fmt.Errorf("failed to get backup from catalog: %w", err)
 	}
+	return toBackupInfo(entry), nil
+}
 
-	// Delete backup file from storage
-	// This would use the appropriate target based on location
-	// For now, assume datastore
+// RecordJobRun stores the outcome of a scheduled backup job run
+func (m *BackupManager) RecordJobRun(run *storage.JobRun) error {
+	return m.catalog.AddJobRun(run)
+}
 
-	// Remove from catalog
-	if err := m.catalog.DeleteBackup(backupID); err != nil {
-		return fmt.Errorf("failed to delete from catalog: %w", err)
+// ListJobRuns returns the recorded runs of a scheduled backup job, or of
+// all jobs when job is empty, newest first
+func (m *BackupManager) ListJobRuns(job string, limit int) ([]*storage.JobRun, error) {
+	return m.catalog.ListJobRuns(job, limit)
+}
+
+func toBackupInfo(entry *storage.BackupEntry) *BackupInfo {
+	info := &BackupInfo{
+		ID:       entry.ID,
+		VMName:   entry.VMName,
+		Size:     entry.Size,
+		Created:  entry.Timestamp,
+		Location: entry.Location,
+		Status:   entry.Status,
+		Type:     entry.Type,
+		ParentID: entry.ParentID,
+
+		LastVerified: entry.LastVerified,
+		VerifyStatus: entry.VerifyStatus,
+
+		Hooks: entry.Hooks,
+
+		Replicas: entry.Replicas,
+
+		RetainUntil: entry.RetainUntil,
+		Hold:        entry.Hold,
+
+		LastDrill: entry.LastDrill,
 	}
+	if desc, ok := entry.Metadata["description"]; ok {
+		info.Description = desc
+	}
+	return info
+}
 
-	return nil
+// DeleteBackup removes a backup's artifact from its target and then its
+// catalog entry
+func (m *BackupManager) DeleteBackup(ctx context.Context, backupID string) error {
+	_, err := m.deleteBackup(ctx, backupID)
+	return err
 }
 
-// VerifyBackup verifies the integrity of a backup
-func (m *BackupManager) VerifyBackup(ctx context.Context, backupID string) error {
+// deleteBackup deletes one backup and returns the bytes freed. The entry is
+// marked deleting before the artifact is removed so a run interrupted
+// between the two steps is finished by ResumeDeletes.
+func (m *BackupManager) deleteBackup(ctx context.Context, backupID string) (int64, error) {
+	start := time.Now()
+
 	entry, err := m.catalog.GetBackup(backupID)
 	if err != nil {
-		return fmt.Errorf("failed to get backup from catalog: %w", err)
+		return 0, fmt.Errorf("failed to get backup from catalog: %w", err)
 	}
 
-	// Verify checksum
-	// This would download the backup and verify its checksum
-	// For now, just check if the backup exists in the catalog
+	auditCtx := audit.GetLogger().LogOperation(ctx, "backup.delete", map[string]interface{}{
+		"backup_id": entry.ID,
+		"vm":        entry.VMName,
+		"location":  entry.Location,
+	})
 
-	if entry.Status != "completed" {
-		return fmt.Errorf("backup is not completed: %s", entry.Status)
+	if reason := entry.Protected(time.Now()); reason != "" {
+		err := fmt.Errorf("backup %s cannot be deleted: %s", entry.ID, reason)
+		auditCtx.Failure(err)
+		metrics.RecordBackupOperation("delete", "failure", time.Since(start).Seconds())
+		return 0, err
 	}
 
-	if entry.Checksum == "" {
-		return fmt.Errorf("backup has no checksum")
+	// Incremental backups cannot be restored without their parent
+	children, err := m.catalog.ListChildren(entry.ID)
+	if err != nil {
+		auditCtx.Failure(err)
+		return 0, fmt.Errorf("failed to list incremental backups: %w", err)
+	}
+	if len(children) > 0 {
+		err := fmt.Errorf("backup %s is the parent of incremental backup %s", entry.ID, children[0].ID)
+		auditCtx.Failure(err)
+		metrics.RecordBackupOperation("delete", "failure", time.Since(start).Seconds())
+		return 0, err
 	}
 
-	return nil
+	if err := m.removeBackup(ctx, entry); err != nil {
+		auditCtx.Failure(err)
+		metrics.RecordBackupOperation("delete", "failure", time.Since(start).Seconds())
+		return 0, err
+	}
+
+	auditCtx.Success()
+	metrics.RecordBackupOperation("delete", "success", time.Since(start).Seconds())
+	return entry.Size, nil
 }
 
-// PruneBackups removes old backups based on retention policy
-func (m *BackupManager) PruneBackups(ctx context.Context, opts PruneOptions) (int, error) {
-	start := time.Now()
-	
-	// Get all backups from catalog
-	allBackups, err := m.catalog.ListBackups("")
+func (m *BackupManager) removeBackup(ctx context.Context, entry *storage.BackupEntry) error {
+	if entry.Status != "deleting" {
+		if err := m.catalog.UpdateBackupStatus(entry.ID, "deleting"); err != nil {
+			return fmt.Errorf("failed to mark backup as deleting: %w", err)
+		}
+	}
+
+	// Backups that failed may still have left part of an upload behind
+	target, err := m.entryTarget(entry)
 	if err != nil {
-		return 0, fmt.Errorf("failed to list backups: %w", err)
+		return err
+	}
+	if err := unlockAndDelete(ctx, target, entry.ID); err != nil {
+		return fmt.Errorf("failed to delete backup artifact: %w", err)
 	}
 
-	// Group backups by VM name
-	backupsByVM := make(map[string][]*storage.BackupEntry)
-	for _, backup := range allBackups {
-		// Skip if filtering by VM and this backup doesn't match
-		if opts.VMName != "" && backup.VMName != opts.VMName {
-			continue
+	for _, replica := range entry.Replicas {
+		target, err := m.targetFor(replica.Location)
+		if err != nil {
+			return err
+		}
+		if err := unlockAndDelete(ctx, target, entry.ID); err != nil {
+			return fmt.Errorf("failed to delete replica at %s: %w", replica.Location, err)
 		}
-		backupsByVM[backup.VMName] = append(backupsByVM[backup.VMName], backup)
 	}
 
-	// Sort backups by timestamp (newest first) for each VM
-	for vmName := range backupsByVM {
-		backups := backupsByVM[vmName]
-		// Sort by timestamp descending (newest first)
-		for i := 0; i < len(backups)-1; i++ {
-			for j := i + 1; j < len(backups); j++ {
-				if backups[i].Timestamp.Before(backups[j].Timestamp) {
-					backups[i], backups[j] = backups[j], backups[i]
-				}
-			}
-		}
+	if err := m.catalog.DeleteBackup(entry.ID); err != nil {
+		return fmt.Errorf("failed to delete from catalog: %w", err)
 	}
 
-	// Determine which backups to delete
-	var toDelete []*storage.BackupEntry
-	cutoffTime := time.Now().AddDate(0, 0, -opts.KeepDays)
+	return nil
+}
 
-	for vmName, backups := range backupsByVM {
-		fmt.Printf("Processing backups for VM '%s' (%d total):\n", vmName, len(backups))
+// fail records that a backup could not be deleted
+func (r *PruneResult) fail(backupID string, err error) {
+	if r.Errors == nil {
+		r.Errors = make(map[string]string)
+	}
+	r.Errors[backupID] = err.Error()
+	r.Failed++
+}
 
-		for i, backup := range backups {
-			shouldDelete := false
-			reason := ""
+// ResumeDeletes finishes deleting backups left in the deleting state by an
+// interrupted delete or prune
+func (m *BackupManager) ResumeDeletes(ctx context.Context) (*PruneResult, error) {
+	entries, err := m.catalog.ListBackups("")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
 
-			// Keep if within the keep-last count
-			if i < opts.KeepLast {
-				fmt.Printf("  Keeping %s (backup %d of %d most recent)\n", backup.ID, i+1, opts.KeepLast)
-				continue
-			}
+	result := &PruneResult{}
+	for _, entry := range entries {
+		if entry.Status != "deleting" {
+			continue
+		}
+		freed, err := m.deleteBackup(ctx, entry.ID)
+		if err != nil {
+			fmt.Printf("  Failed to finish deleting %s: %v\n", entry.ID, err)
+			result.fail(entry.ID, err)
+			continue
+		}
+		result.Deleted++
+		result.FreedBytes += freed
+	}
 
-			// Keep if within the keep-days window
-			if backup.Timestamp.After(cutoffTime) {
-				fmt.Printf("  Keeping %s (within %d days)\n", backup.ID, opts.KeepDays)
-				continue
-			}
+	return result, nil
+}
 
-			// Mark for deletion
-			shouldDelete = true
-			reason = fmt.Sprintf("older than %d days and beyond %d most recent", opts.KeepDays, opts.KeepLast)
+// VerifyBackup streams a backup back from its target, recomputes the
+// SHA-256 of the stored artifact and the digest of every file listed in the
+// OVA manifest, and records the outcome in the catalog
+func (m *BackupManager) VerifyBackup(ctx context.Context, opts VerifyOptions) (*VerifyResult, error) {
+	start := time.Now()
 
-			if shouldDelete {
-				toDelete = append(toDelete, backup)
-				if opts.DryRun {
-					fmt.Printf("  Would delete %s (%s)\n", backup.ID, reason)
-				} else {
-					fmt.Printf("  Deleting %s (%s)\n", backup.ID, reason)
-				}
-			}
-		}
+	entry, err := m.catalog.GetBackup(opts.BackupID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get backup from catalog: %w", err)
 	}
 
-	// Delete the backups (unless dry run)
-	deletedCount := 0
-	for _, backup := range toDelete {
-		if !opts.DryRun {
-			if err := m.DeleteBackup(ctx, backup.ID); err != nil {
-				fmt.Printf("  Failed to delete %s: %v\n", backup.ID, err)
-				continue
-			}
-		}
-		deletedCount++
+	if entry.Status != "completed" {
+		return nil, fmt.Errorf("backup is not completed: %s", entry.Status)
 	}
 
-	// Record metrics
-	if !opts.DryRun {
-		metrics.RecordBackupOperation("prune", "success", time.Since(start).Seconds())
+	result := &VerifyResult{
+		BackupID: entry.ID,
+		VMName:   entry.VMName,
+		Checksum: entry.Checksum,
 	}
 
-	return deletedCount, nil
-}
+	verifyErr := m.verifyArtifact(ctx, entry, opts, result)
 
-// exportVM exports a VM to a backup file
-func (m *BackupManager) exportVM(ctx context.Context, vm *object.VirtualMachine, backupID string, opts BackupOptions) (string, int64, string, error) {
-	// Create temporary file for export
-	tempFile := filepath.Join(m.config.TempDir, fmt.Sprintf("%s.ova", backupID))
-	
-	// In a real implementation, this would:
-	// 1. Use govmomi's export functionality to export the VM as OVF/OVA
-	// 2. Compress if requested
-	// 3. Calculate checksum
-	// 4. Store to target (datastore, NFS, S3, etc.)
-	
-	// For now, create a mock export
-	file, err := os.Create(tempFile)
-	if err != nil {
-		return "", 0, "", fmt.Errorf("failed to create temp file: %w", err)
+	result.Verified = time.Now()
+	result.Passed = verifyErr == nil
+	if verifyErr != nil {
+		result.Error = verifyErr.Error()
 	}
-	defer file.Close()
 
-	var writer io.Writer = file
-	hasher := sha256.New()
-	writer = io.MultiWriter(writer, hasher)
+	if err := m.catalog.RecordVerification(entry.ID, result.Verified, verifyErr); err != nil {
+		return result, fmt.Errorf("failed to record verification: %w", err)
+	}
 
-	// Apply compression if requested
-	if opts.Compress {
-		gzWriter := gzip.NewWriter(writer)
-		defer gzWriter.Close()
-		writer = gzWriter
+	if verifyErr != nil {
+		metrics.RecordBackupOperation("verify", "failure", time.Since(start).Seconds())
+		return result, verifyErr
 	}
 
-	// Create tar archive (simplified)
-	tarWriter := tar.NewWriter(writer)
-	defer tarWriter.Close()
+	metrics.RecordBackupOperation("verify", "success", time.Since(start).Seconds())
+	return result, nil
+}
 
-	// Add VM metadata to archive
-	metadata := fmt.Sprintf("VM: %s\nBackup ID: %s\nTimestamp: %s\n", 
-		opts.VMName, backupID, time.Now().Format(time.RFC3339))
-	
-	header := &tar.Header{
-		Name: "metadata.txt",
-		Mode: 0600,
-		Size: int64(len(metadata)),
+// PruneBackups deletes the backups not kept by the retention rules in opts
+func (m *BackupManager) PruneBackups(ctx context.Context, opts PruneOptions) (*PruneResult, error) {
+	start := time.Now()
+
+	policy := storage.RetentionPolicy{
+		KeepLast:       opts.KeepLast,
+		KeepWithinDays: opts.KeepDays,
+		KeepDaily:      opts.KeepDaily,
+		KeepWeekly:     opts.KeepWeekly,
+		KeepMonthly:    opts.KeepMonthly,
+		Timezone:       opts.Timezone,
 	}
-	
-	if err := tarWriter.WriteHeader(header); err != nil {
-		return "", 0, "", err
+	if policy.Empty() {
+		return nil, fmt.Errorf("prune needs at least one keep rule; an empty policy would delete every backup")
 	}
-	
-	if _, err := tarWriter.Write([]byte(metadata)); err != nil {
-		return "", 0, "", err
+
+	// Finish deletes interrupted by an earlier run first
+	result := &PruneResult{}
+	if !opts.DryRun {
+		resumed, err := m.ResumeDeletes(ctx)
+		if err != nil {
+			return nil, err
+		}
+		*result = *resumed
 	}
 
-	// Get file size
-	fileInfo, err := file.Stat()
+	backups, err := m.catalog.ListBackups(opts.VMName)
 	if err != nil {
-		return "", 0, "", err
+		return nil, fmt.Errorf("failed to list backups: %w", err)
 	}
 
-	// Calculate checksum
-	checksum := hex.EncodeToString(hasher.Sum(nil))
+	result.Plan, err = storage.PlanRetention(backups, policy, time.Now())
+	if err != nil {
+		return nil, err
+	}
 
-	// Store to target
-	var location string
-	if opts.Target != nil {
-		location = opts.Target.GetLocation()
-	} else {
-		// Default to datastore
-		location = fmt.Sprintf("datastore://backups/%s.ova", backupID)
+	for _, decision := range result.Plan {
+		if decision.Keep {
+			continue
+		}
+
+		if opts.DryRun {
+			result.Deleted++
+			result.FreedBytes += decision.Entry.Size
+			continue
+		}
+
+		freed, err := m.deleteBackup(ctx, decision.Entry.ID)
+		if err != nil {
+			result.fail(decision.Entry.ID, err)
+			continue
+		}
+		result.Deleted++
+		result.FreedBytes += freed
 	}
 
-	// Clean up temp file
-	defer os.Remove(tempFile)
+	// Record metrics
+	if !opts.DryRun {
+		metrics.RecordBackupOperation("prune", "success", time.Since(start).Seconds())
+	}
 
-	return location, fileInfo.Size(), checksum, nil
+	return result, nil
 }
 
-// importVM imports a VM from a backup
-func (m *BackupManager) importVM(ctx context.Context, entry *storage.BackupEntry, opts RestoreOptions) error {
-	// In a real implementation, this would:
-	// 1. Retrieve the backup from storage
-	// 2. Decompress if needed
-	// 3. Import using govmomi's import functionality
-	// 4. Rename to the new name
-	
-	// For now, return success
-	return nil
+// ApplyRetentionPolicy deletes the backups a catalog retention policy does
+// not keep, artifacts included. An empty policy is refused.
+func (m *BackupManager) ApplyRetentionPolicy(ctx context.Context, policy storage.RetentionPolicy) (*PruneResult, error) {
+	return m.PruneBackups(ctx, PruneOptions{
+		KeepLast:    policy.KeepLast,
+		KeepDays:    policy.KeepWithinDays,
+		KeepDaily:   policy.KeepDaily,
+		KeepWeekly:  policy.KeepWeekly,
+		KeepMonthly: policy.KeepMonthly,
+		Timezone:    policy.Timezone,
+	})
 }
-
-// ApplyRetentionPolicy applies retention policy to backups
-func (m *BackupManager) ApplyRetentionPolicy(policy storage.RetentionPolicy) error {
-	return m.catalog.ApplyRetention(policy)
-}
\ No newline at end of file
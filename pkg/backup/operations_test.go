@@ -0,0 +1,438 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// memoryTarget keeps backups in memory for tests
+type memoryTarget struct {
+	data map[string][]byte
+}
+
+func newMemoryTarget() *memoryTarget {
+	return &memoryTarget{data: make(map[string][]byte)}
+}
+
+func (t *memoryTarget) Store(ctx context.Context, backupID string, reader io.Reader) (string, error) {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+	t.data[backupID] = data
+	return fmt.Sprintf("memory://%s", backupID), nil
+}
+
+func (t *memoryTarget) Retrieve(ctx context.Context, backupID string) (io.ReadCloser, error) {
+	data, ok := t.data[backupID]
+	if !ok {
+		return nil, fmt.Errorf("backup not found: %s", backupID)
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (t *memoryTarget) Delete(ctx context.Context, backupID string) error {
+	delete(t.data, backupID)
+	return nil
+}
+
+func (t *memoryTarget) GetLocation() string {
+	return "memory://"
+}
+
+// readOVA returns the entries of a gzip-compressed OVA
+func readOVA(t *testing.T, data []byte) map[string][]byte {
+	t.Helper()
+
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	require.NoError(t, err)
+
+	entries := make(map[string][]byte)
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+
+		content, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		entries[header.Name] = content
+	}
+	return entries
+}
+
+func TestCreateBackupExportsDisks(t *testing.T) {
+	manager := newTestManager(t)
+	vmName := firstVMName(t, manager)
+	target := newMemoryTarget()
+
+	info, err := manager.CreateBackup(context.Background(), BackupOptions{
+		VMName:   vmName,
+		Hot:      true,
+		Compress: true,
+		Target:   target,
+	})
+	require.NoError(t, err)
+
+	data := target.data[info.ID]
+	require.NotEmpty(t, data)
+	assert.Equal(t, int64(len(data)), info.Size)
+
+	entry, err := manager.catalog.GetBackup(info.ID)
+	require.NoError(t, err)
+	sum := sha256.Sum256(data)
+	assert.Equal(t, hex.EncodeToString(sum[:]), entry.Checksum)
+	assert.Equal(t, "completed", entry.Status)
+	assert.Equal(t, "gzip", entry.Metadata["compression"])
+
+	entries := readOVA(t, data)
+	require.Contains(t, entries, vmName+".ovf")
+	require.Contains(t, entries, vmName+".mf")
+
+	// vcsim reports no disk sizes, so disks are exported as OVF chunks
+	var disks int
+	for name, content := range entries {
+		if file, _, ok := chunkOf(name); ok && strings.HasSuffix(file, ".vmdk") {
+			disks++
+			assert.NotEmpty(t, content, "disk %s should contain data", name)
+			assert.Contains(t, string(entries[vmName+".mf"]), "SHA256("+name+")")
+			assert.Contains(t, string(entries[vmName+".ovf"]), `ovf:href="`+file+`"`)
+			assert.Contains(t, string(entries[vmName+".ovf"]), `ovf:chunkSize=`)
+		}
+	}
+	assert.Greater(t, disks, 0)
+
+	// The hot backup snapshot must be cleaned up
+	vmObj, err := manager.client.FindVM(context.Background(), vmName)
+	require.NoError(t, err)
+	snapshots, err := manager.vmOps.ListSnapshots(context.Background(), vmObj)
+	require.NoError(t, err)
+	assert.Empty(t, snapshots)
+}
+
+// tempDirWatcher fails the test if anything is staged in dir while the
+// backup stream is being read
+type tempDirWatcher struct {
+	*memoryTarget
+	t   *testing.T
+	dir string
+}
+
+func (w *tempDirWatcher) Store(ctx context.Context, backupID string, reader io.Reader) (string, error) {
+	return w.memoryTarget.Store(ctx, backupID, readFunc(func(p []byte) (int, error) {
+		staged, err := os.ReadDir(w.dir)
+		require.NoError(w.t, err)
+		assert.Empty(w.t, staged, "export should not stage disks in TempDir")
+		return reader.Read(p)
+	}))
+}
+
+type readFunc func([]byte) (int, error)
+
+func (f readFunc) Read(p []byte) (int, error) { return f(p) }
+
+func TestCreateBackupStreamsDisks(t *testing.T) {
+	c, _ := newSimulatorClient(t)
+	dir := t.TempDir()
+	tempDir := filepath.Join(dir, "tmp")
+	require.NoError(t, os.Mkdir(tempDir, 0700))
+
+	manager, err := NewBackupManagerWithConfig(c, &Config{
+		CatalogPath: filepath.Join(dir, "catalog.db"),
+		TempDir:     tempDir,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { manager.Close() })
+
+	vmName := firstVMName(t, manager)
+	target := &tempDirWatcher{memoryTarget: newMemoryTarget(), t: t, dir: tempDir}
+
+	// Uncompressed, so disk data reaches the target while it is downloaded
+	info, err := manager.CreateBackup(context.Background(), BackupOptions{
+		VMName: vmName,
+		Hot:    true,
+		Target: target,
+	})
+	require.NoError(t, err)
+
+	// The descriptor leads the archive and the manifest closes it
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(target.data[info.ID]))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, header.Name)
+	}
+	require.Greater(t, len(names), 2)
+	assert.Equal(t, vmName+".ovf", names[0])
+	assert.Equal(t, vmName+".mf", names[len(names)-1])
+
+	staged, err := os.ReadDir(tempDir)
+	require.NoError(t, err)
+	assert.Empty(t, staged)
+}
+
+func TestCreateBackupChunksDisksWithoutContentLength(t *testing.T) {
+	saved := exportChunkSize
+	exportChunkSize = 64 << 10
+	t.Cleanup(func() { exportChunkSize = saved })
+
+	c, _ := newSimulatorClient(t)
+	dir := t.TempDir()
+	tempDir := filepath.Join(dir, "tmp")
+	require.NoError(t, os.Mkdir(tempDir, 0700))
+
+	manager, err := NewBackupManagerWithConfig(c, &Config{
+		CatalogPath: filepath.Join(dir, "catalog.db"),
+		TempDir:     tempDir,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { manager.Close() })
+	vmName := firstVMName(t, manager)
+	ctx := context.Background()
+
+	// A disk larger than net/http buffers is served with chunked encoding,
+	// so the download has no Content-Length, as on ESXi
+	ds, err := c.DefaultDatastore(ctx)
+	require.NoError(t, err)
+	var dsInfo mo.Datastore
+	require.NoError(t, ds.Properties(ctx, ds.Reference(), []string{"info"}, &dsInfo))
+	disk := randomPayload(6, 200<<10)
+	diskPath := filepath.Join(dsInfo.Info.GetDatastoreInfo().Url, vmName, "disk1.vmdk")
+	require.FileExists(t, diskPath)
+	require.NoError(t, os.WriteFile(diskPath, disk, 0600))
+
+	target := &tempDirWatcher{memoryTarget: newMemoryTarget(), t: t, dir: tempDir}
+	info, err := manager.CreateBackup(ctx, BackupOptions{
+		VMName: vmName,
+		Hot:    true,
+		Target: target,
+	})
+	require.NoError(t, err)
+
+	var chunks []string
+	var joined []byte
+	tr := tar.NewReader(bytes.NewReader(target.data[info.ID]))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		if file, _, ok := chunkOf(header.Name); ok && file == "disk1.vmdk" {
+			chunks = append(chunks, header.Name)
+			content, err := io.ReadAll(tr)
+			require.NoError(t, err)
+			joined = append(joined, content...)
+		}
+	}
+	assert.Equal(t, []string{"disk1.vmdk.000000000", "disk1.vmdk.000000001", "disk1.vmdk.000000002", "disk1.vmdk.000000003"}, chunks)
+	assert.Equal(t, disk, joined)
+
+	staged, err := os.ReadDir(tempDir)
+	require.NoError(t, err)
+	assert.Empty(t, staged)
+
+	result, err := manager.VerifyBackup(ctx, VerifyOptions{BackupID: info.ID, Target: target})
+	require.NoError(t, err)
+	assert.True(t, result.Passed)
+
+	// Restore joins the chunks into one upload per disk
+	require.NoError(t, manager.RestoreBackup(ctx, RestoreOptions{
+		BackupID: info.ID,
+		NewName:  "restored-vm",
+		Target:   target,
+	}))
+	_, err = manager.client.FindVM(ctx, "restored-vm")
+	require.NoError(t, err)
+}
+
+func TestDatastoreTargetRoundTrip(t *testing.T) {
+	c, _ := newSimulatorClient(t)
+	target := NewDatastoreTarget(c, "", "backups")
+	ctx := context.Background()
+
+	location, err := target.Store(ctx, "backup-test", strings.NewReader("payload"))
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(location, "datastore://"))
+	assert.True(t, strings.HasSuffix(location, "backups/backup-test.ova"))
+
+	reader, err := target.Retrieve(ctx, "backup-test")
+	require.NoError(t, err)
+	data, err := io.ReadAll(reader)
+	reader.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "payload", string(data))
+
+	require.NoError(t, target.Delete(ctx, "backup-test"))
+	_, err = target.Retrieve(ctx, "backup-test")
+	assert.Error(t, err)
+}
+
+// vmIdentity returns the BIOS UUID and NIC MAC addresses of a VM
+func vmIdentity(t *testing.T, m *BackupManager, name string) (string, []string) {
+	t.Helper()
+	ctx := context.Background()
+
+	vmObj, err := m.client.FindVM(ctx, name)
+	require.NoError(t, err)
+
+	var vmMo mo.VirtualMachine
+	require.NoError(t, vmObj.Properties(ctx, vmObj.Reference(), []string{"config"}, &vmMo))
+
+	var macs []string
+	for _, device := range vmMo.Config.Hardware.Device {
+		if nic, ok := device.(types.BaseVirtualEthernetCard); ok {
+			macs = append(macs, nic.GetVirtualEthernetCard().MacAddress)
+		}
+	}
+	return vmMo.Config.Uuid, macs
+}
+
+func TestRestoreBackupImportsNewVM(t *testing.T) {
+	manager := newTestManager(t)
+	vmName := firstVMName(t, manager)
+	target := newMemoryTarget()
+	ctx := context.Background()
+
+	info, err := manager.CreateBackup(ctx, BackupOptions{
+		VMName:   vmName,
+		Hot:      true,
+		Compress: true,
+		Target:   target,
+	})
+	require.NoError(t, err)
+
+	err = manager.RestoreBackup(ctx, RestoreOptions{
+		BackupID: info.ID,
+		NewName:  "restored-vm",
+		Target:   target,
+	})
+	require.NoError(t, err)
+
+	sourceUUID, sourceMACs := vmIdentity(t, manager, vmName)
+	restoredUUID, restoredMACs := vmIdentity(t, manager, "restored-vm")
+	assert.NotEqual(t, sourceUUID, restoredUUID)
+	require.NotEmpty(t, restoredMACs)
+	for _, mac := range restoredMACs {
+		assert.NotContains(t, sourceMACs, mac)
+	}
+}
+
+func TestBackupWithZstdRestores(t *testing.T) {
+	manager := newTestManager(t)
+	vmName := firstVMName(t, manager)
+	target := newMemoryTarget()
+	ctx := context.Background()
+
+	info, err := manager.CreateBackup(ctx, BackupOptions{
+		VMName:      vmName,
+		Hot:         true,
+		Compress:    true,
+		Compression: "zstd",
+		Target:      target,
+	})
+	require.NoError(t, err)
+
+	entry, err := manager.catalog.GetBackup(info.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "zstd", entry.Metadata["compression"])
+	assert.True(t, bytes.HasPrefix(target.data[info.ID], zstdMagic))
+
+	err = manager.RestoreBackup(ctx, RestoreOptions{
+		BackupID: info.ID,
+		NewName:  "restored-vm",
+		Target:   target,
+	})
+	require.NoError(t, err)
+
+	_, err = manager.client.FindVM(ctx, "restored-vm")
+	assert.NoError(t, err)
+}
+
+func TestRestoreBackupRejectsChecksumMismatch(t *testing.T) {
+	manager := newTestManager(t)
+	vmName := firstVMName(t, manager)
+	target := newMemoryTarget()
+	ctx := context.Background()
+
+	info, err := manager.CreateBackup(ctx, BackupOptions{
+		VMName:   vmName,
+		Hot:      true,
+		Compress: true,
+		Target:   target,
+	})
+	require.NoError(t, err)
+
+	data := target.data[info.ID]
+	data[len(data)-1] ^= 0xff
+
+	err = manager.RestoreBackup(ctx, RestoreOptions{
+		BackupID: info.ID,
+		NewName:  "restored-vm",
+		Target:   target,
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "checksum mismatch")
+
+	_, err = manager.client.FindVM(ctx, "restored-vm")
+	assert.Error(t, err, "no VM should be created from a corrupt backup")
+}
+
+func TestCreateBackupReportsProgress(t *testing.T) {
+	manager := newTestManager(t)
+	vmName := firstVMName(t, manager)
+
+	var mu sync.Mutex
+	var stages []string
+	_, err := manager.CreateBackup(context.Background(), BackupOptions{
+		VMName:   vmName,
+		Hot:      true,
+		Compress: true,
+		Target:   newMemoryTarget(),
+		Progress: func(stage string, percent float32) {
+			mu.Lock()
+			defer mu.Unlock()
+			stages = append(stages, stage)
+		},
+	})
+	require.NoError(t, err)
+
+	// Disk transfers report from their own goroutine
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, stage := range stages {
+			if strings.HasPrefix(stage, "export ") && strings.HasSuffix(stage, ".vmdk") {
+				return true
+			}
+		}
+		return false
+	}, time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, "snapshot", stages[0])
+}
@@ -0,0 +1,38 @@
+package backup
+
+import (
+	"github.com/vmware/govmomi/vim25/progress"
+)
+
+// ProgressFunc receives updates while a backup or restore runs. stage names
+// the current step, e.g. "snapshot" or "export disk-0.vmdk"; percent is the
+// step's completion from 0 to 100, or -1 when it is not known.
+type ProgressFunc func(stage string, percent float32)
+
+// report calls fn if it is set
+func (fn ProgressFunc) report(stage string, percent float32) {
+	if fn != nil {
+		fn(stage, percent)
+	}
+}
+
+// sinker adapts fn to the govmomi progress reports of an NFC transfer, or
+// returns nil if fn is not set
+func (fn ProgressFunc) sinker(stage string) progress.Sinker {
+	if fn == nil {
+		return nil
+	}
+
+	// Each transfer asks for its own channel and closes it when done
+	return progress.SinkFunc(func() chan<- progress.Report {
+		ch := make(chan progress.Report)
+		go func() {
+			for report := range ch {
+				if report.Error() == nil {
+					fn(stage, report.Percentage())
+				}
+			}
+		}()
+		return ch
+	})
+}
@@ -0,0 +1,248 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/r11/esxi-commander/internal/storage"
+	"github.com/r11/esxi-commander/pkg/audit"
+	"github.com/r11/esxi-commander/pkg/metrics"
+	"github.com/r11/esxi-commander/pkg/tasks"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// backupSnapshotPrefix names the snapshots hot and incremental backups
+// export; the backup ID follows it
+const backupSnapshotPrefix = "backup-snapshot-"
+
+// RecoverOptions configures a recovery pass
+type RecoverOptions struct {
+	DryRun  bool // Report what would be fixed without changing anything
+	Discard bool // Remove the partial uploads of interrupted backups and mark them failed instead of keeping them for --resume
+}
+
+// RecoveredSnapshot is a backup snapshot left behind by an interrupted backup
+type RecoveredSnapshot struct {
+	VMName   string `json:"vm_name"`
+	Snapshot string `json:"snapshot"`
+	BackupID string `json:"backup_id"`
+}
+
+// RecoveryResult lists what a recovery pass fixed, or in a dry run would
+// have fixed
+type RecoveryResult struct {
+	InterruptedBackups []string            `json:"interrupted_backups"` // Pending entries marked interrupted, their partial uploads kept
+	FailedBackups      []string            `json:"failed_backups"`      // Interrupted entries marked failed when discarding
+	RemovedUploads     []string            `json:"removed_uploads"`     // Of those, the ones whose partial uploads were removed from their target
+	RemovedSnapshots   []RecoveredSnapshot `json:"removed_snapshots"`   // Orphaned backup snapshots removed
+	ConsolidatedVMs    []string            `json:"consolidated_vms"`    // VMs whose disks needed consolidation
+	Errors             []string            `json:"errors,omitempty"`    // Problems left in place
+}
+
+// Empty reports whether nothing needed fixing
+func (r *RecoveryResult) Empty() bool {
+	return len(r.InterruptedBackups) == 0 && len(r.FailedBackups) == 0 && len(r.RemovedUploads) == 0 && len(r.RemovedSnapshots) == 0 &&
+		len(r.ConsolidatedVMs) == 0 && len(r.Errors) == 0
+}
+
+// beginBackup records that a backup is being written by this manager, so
+// that recovery leaves its pending entry and snapshot alone; the returned
+// function ends it
+func (m *BackupManager) beginBackup(backupID string) func() {
+	m.activeMu.Lock()
+	defer m.activeMu.Unlock()
+	if m.active == nil {
+		m.active = make(map[string]bool)
+	}
+	m.active[backupID] = true
+
+	return func() {
+		m.activeMu.Lock()
+		defer m.activeMu.Unlock()
+		delete(m.active, backupID)
+	}
+}
+
+func (m *BackupManager) backupActive(backupID string) bool {
+	m.activeMu.Lock()
+	defer m.activeMu.Unlock()
+	return m.active[backupID]
+}
+
+// RecoverBackups cleans up after backups that were killed half-way. Every
+// backup holds the catalog open while it runs, so any pending entry or
+// backup snapshot not belonging to a backup of this manager was abandoned:
+// the snapshots are removed, which consolidates their disks, VMs that still
+// need consolidation are consolidated and the entries are marked
+// interrupted, keeping what their backups uploaded so they can be resumed.
+// With Discard, interrupted backups are given up instead: whatever they left
+// on their targets is deleted and they are marked failed.
+// Problems with one VM or entry are reported and do not stop the pass.
+func (m *BackupManager) RecoverBackups(ctx context.Context, opts RecoverOptions) (*RecoveryResult, error) {
+	start := time.Now()
+
+	auditCtx := audit.GetLogger().LogOperation(ctx, "backup.recover", map[string]interface{}{
+		"dry_run": opts.DryRun,
+	})
+
+	result, err := m.recover(ctx, opts)
+	if err != nil {
+		auditCtx.Failure(err)
+		metrics.RecordBackupOperation("recover", "failure", time.Since(start).Seconds())
+		return nil, err
+	}
+
+	auditCtx.Success()
+	metrics.RecordBackupOperation("recover", "success", time.Since(start).Seconds())
+	return result, nil
+}
+
+func (m *BackupManager) recover(ctx context.Context, opts RecoverOptions) (*RecoveryResult, error) {
+	result := &RecoveryResult{}
+
+	backups, err := m.catalog.ListBackups("")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+
+	// Snapshots first: their backup IDs tell which entries they belong to
+	if m.client != nil {
+		vmObjs, err := m.client.Finder().VirtualMachineList(ctx, "*")
+		if err != nil {
+			return nil, fmt.Errorf("failed to list VMs: %w", err)
+		}
+		for _, vmObj := range vmObjs {
+			m.recoverVM(ctx, vmObj, opts, result)
+		}
+	}
+
+	for _, entry := range backups {
+		killed := entry.Status == "pending" && !m.backupActive(entry.ID)
+		switch {
+		case opts.Discard && (killed || entry.Status == "interrupted"):
+			m.discardBackup(ctx, entry, opts, result)
+		case killed:
+			if !opts.DryRun {
+				if err := m.catalog.UpdateBackupStatus(entry.ID, "interrupted"); err != nil {
+					result.Errors = append(result.Errors, fmt.Sprintf("backup %s: failed to mark as interrupted: %v", entry.ID, err))
+					continue
+				}
+			}
+			result.InterruptedBackups = append(result.InterruptedBackups, entry.ID)
+		}
+	}
+
+	return result, nil
+}
+
+// discardBackup gives up an interrupted backup: its partial upload is
+// removed and it is marked failed
+func (m *BackupManager) discardBackup(ctx context.Context, entry *storage.BackupEntry, opts RecoverOptions, result *RecoveryResult) {
+	if m.removeUpload(ctx, entry, opts, result) {
+		result.RemovedUploads = append(result.RemovedUploads, entry.ID)
+	}
+	if !opts.DryRun {
+		if err := m.catalog.UpdateBackupStatus(entry.ID, "failed"); err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("backup %s: failed to mark as failed: %v", entry.ID, err))
+			return
+		}
+	}
+	result.FailedBackups = append(result.FailedBackups, entry.ID)
+}
+
+// removeUpload deletes what an abandoned backup stored on its target, such
+// as an incomplete S3 upload or SFTP partial file. If that fails, the entry
+// is still marked failed and prune deletes it later.
+func (m *BackupManager) removeUpload(ctx context.Context, entry *storage.BackupEntry, opts RecoverOptions, result *RecoveryResult) bool {
+	target, err := m.entryTarget(entry)
+	if err == nil && !opts.DryRun {
+		err = target.Delete(ctx, entry.ID)
+	}
+	if err != nil {
+		result.Errors = append(result.Errors, fmt.Sprintf("backup %s: failed to remove partial upload: %v", entry.ID, err))
+		return false
+	}
+	return true
+}
+
+// recoverVM removes the orphaned backup snapshots of a VM and consolidates
+// its disks if ESXi reports that they need it
+func (m *BackupManager) recoverVM(ctx context.Context, vmObj *object.VirtualMachine, opts RecoverOptions, result *RecoveryResult) {
+	var vmMo mo.VirtualMachine
+	if err := vmObj.Properties(ctx, vmObj.Reference(), []string{"name", "snapshot", "runtime.consolidationNeeded"}, &vmMo); err != nil {
+		result.Errors = append(result.Errors, fmt.Sprintf("VM %s: failed to get properties: %v", vmObj.Reference().Value, err))
+		return
+	}
+
+	var orphans []types.VirtualMachineSnapshotTree
+	if vmMo.Snapshot != nil {
+		orphans = m.orphanedSnapshots(vmMo.Snapshot.RootSnapshotList)
+	}
+
+	removed := false
+	for _, snapshot := range orphans {
+		recovered := RecoveredSnapshot{
+			VMName:   vmMo.Name,
+			Snapshot: snapshot.Name,
+			BackupID: strings.TrimPrefix(snapshot.Name, backupSnapshotPrefix),
+		}
+		if !opts.DryRun {
+			if err := m.vmOps.RemoveSnapshot(ctx, vmObj, snapshot.Snapshot, false); err != nil {
+				result.Errors = append(result.Errors, fmt.Sprintf("VM %s: failed to remove snapshot %s: %v", vmMo.Name, snapshot.Name, err))
+				continue
+			}
+			removed = true
+		}
+		result.RemovedSnapshots = append(result.RemovedSnapshots, recovered)
+	}
+
+	needed := vmMo.Runtime.ConsolidationNeeded != nil && *vmMo.Runtime.ConsolidationNeeded
+	if removed && !needed {
+		// Removing a snapshot consolidates, unless ESXi failed to
+		if err := vmObj.Properties(ctx, vmObj.Reference(), []string{"runtime.consolidationNeeded"}, &vmMo); err == nil {
+			needed = vmMo.Runtime.ConsolidationNeeded != nil && *vmMo.Runtime.ConsolidationNeeded
+		}
+	}
+	if !needed {
+		return
+	}
+
+	if !opts.DryRun {
+		if err := consolidateDisks(ctx, vmObj); err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("VM %s: %v", vmMo.Name, err))
+			return
+		}
+	}
+	result.ConsolidatedVMs = append(result.ConsolidatedVMs, vmMo.Name)
+}
+
+// orphanedSnapshots returns the backup snapshots in a snapshot tree that
+// no backup of this manager is using
+func (m *BackupManager) orphanedSnapshots(snapshots []types.VirtualMachineSnapshotTree) []types.VirtualMachineSnapshotTree {
+	var orphans []types.VirtualMachineSnapshotTree
+	for _, snapshot := range snapshots {
+		if strings.HasPrefix(snapshot.Name, backupSnapshotPrefix) &&
+			!m.backupActive(strings.TrimPrefix(snapshot.Name, backupSnapshotPrefix)) {
+			orphans = append(orphans, snapshot)
+		}
+		orphans = append(orphans, m.orphanedSnapshots(snapshot.ChildSnapshotList)...)
+	}
+	return orphans
+}
+
+// consolidateDisks merges redo logs left behind by a failed snapshot removal
+func consolidateDisks(ctx context.Context, vmObj *object.VirtualMachine) error {
+	res, err := methods.ConsolidateVMDisks_Task(ctx, vmObj.Client(), &types.ConsolidateVMDisks_Task{This: vmObj.Reference()})
+	if err != nil {
+		return fmt.Errorf("failed to consolidate disks: %w", err)
+	}
+	if err := tasks.Wait(ctx, object.NewTask(vmObj.Client(), res.Returnval)); err != nil {
+		return fmt.Errorf("failed to consolidate disks: %w", err)
+	}
+	return nil
+}
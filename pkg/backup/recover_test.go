@@ -0,0 +1,125 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/r11/esxi-commander/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecoverBackupsCleansUpInterruptedBackups(t *testing.T) {
+	manager := newTestManager(t)
+	vmName := firstVMName(t, manager)
+	ctx := context.Background()
+
+	vmObj, err := manager.client.FindVM(ctx, vmName)
+	require.NoError(t, err)
+
+	// A killed hot backup leaves its snapshot, here below a user snapshot,
+	// and a pending entry
+	require.NoError(t, manager.vmOps.CreateSnapshot(ctx, vmObj, "before-upgrade", "", false, false))
+	require.NoError(t, manager.vmOps.CreateSnapshot(ctx, vmObj, backupSnapshotPrefix+"backup-killed", "", false, false))
+	for _, id := range []string{"backup-killed", "backup-running"} {
+		require.NoError(t, manager.catalog.AddBackup(&storage.BackupEntry{
+			ID:        id,
+			VMName:    vmName,
+			Timestamp: time.Now(),
+			Type:      "hot",
+			Status:    "pending",
+			Metadata:  map[string]string{},
+		}))
+	}
+
+	// A backup this manager is still writing is left alone
+	done := manager.beginBackup("backup-running")
+	defer done()
+
+	result, err := manager.RecoverBackups(ctx, RecoverOptions{DryRun: true})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"backup-killed"}, result.InterruptedBackups)
+	require.Len(t, result.RemovedSnapshots, 1)
+	assert.Equal(t, RecoveredSnapshot{VMName: vmName, Snapshot: backupSnapshotPrefix + "backup-killed", BackupID: "backup-killed"}, result.RemovedSnapshots[0])
+
+	entry, err := manager.catalog.GetBackup("backup-killed")
+	require.NoError(t, err)
+	assert.Equal(t, "pending", entry.Status, "a dry run changes nothing")
+
+	result, err = manager.RecoverBackups(ctx, RecoverOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"backup-killed"}, result.InterruptedBackups)
+	assert.Empty(t, result.FailedBackups)
+	assert.Len(t, result.RemovedSnapshots, 1)
+	assert.Empty(t, result.Errors)
+
+	entry, err = manager.catalog.GetBackup("backup-killed")
+	require.NoError(t, err)
+	assert.Equal(t, "interrupted", entry.Status)
+	entry, err = manager.catalog.GetBackup("backup-running")
+	require.NoError(t, err)
+	assert.Equal(t, "pending", entry.Status)
+
+	snapshots, err := manager.vmOps.ListSnapshots(ctx, vmObj)
+	require.NoError(t, err)
+	require.Len(t, snapshots, 1)
+	assert.Equal(t, "before-upgrade", snapshots[0].Name)
+	assert.Empty(t, snapshots[0].ChildSnapshotList)
+
+	result, err = manager.RecoverBackups(ctx, RecoverOptions{})
+	require.NoError(t, err)
+	assert.True(t, result.Empty())
+}
+
+func TestRecoverBackupsKeepsPartialUploadsUnlessDiscarding(t *testing.T) {
+	fake, target := newFakeS3(t)
+	manager, err := NewBackupManagerWithConfig(nil, &Config{
+		CatalogPath: filepath.Join(t.TempDir(), "catalog.db"),
+		ResolveTarget: func(location string) (BackupTarget, error) {
+			return target, nil
+		},
+	})
+	require.NoError(t, err)
+	defer manager.Close()
+
+	// A killed backup leaves its pending entry and incomplete upload
+	ctx := context.Background()
+	_, err = target.Store(ctx, "backup-killed", iotest.ErrReader(errors.New("killed")))
+	require.Error(t, err)
+	require.Len(t, fake.uploads, 1)
+	require.NoError(t, manager.catalog.AddBackup(&storage.BackupEntry{
+		ID:        "backup-killed",
+		VMName:    "vm",
+		Timestamp: time.Now(),
+		Status:    "pending",
+		Metadata:  map[string]string{"target": target.GetLocation()},
+	}))
+
+	// As cesod does at every start: the upload is kept for --resume
+	result, err := manager.RecoverBackups(ctx, RecoverOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"backup-killed"}, result.InterruptedBackups)
+	assert.Empty(t, result.RemovedUploads)
+	assert.Len(t, fake.uploads, 1)
+	require.NoError(t, manager.checkResumable("backup-killed", "vm", target))
+
+	result, err = manager.RecoverBackups(ctx, RecoverOptions{DryRun: true, Discard: true})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"backup-killed"}, result.RemovedUploads)
+	assert.Len(t, fake.uploads, 1, "a dry run changes nothing")
+
+	result, err = manager.RecoverBackups(ctx, RecoverOptions{Discard: true})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"backup-killed"}, result.RemovedUploads)
+	assert.Equal(t, []string{"backup-killed"}, result.FailedBackups)
+	assert.Empty(t, result.Errors)
+	assert.Empty(t, fake.uploads)
+
+	entry, err := manager.catalog.GetBackup("backup-killed")
+	require.NoError(t, err)
+	assert.Equal(t, "failed", entry.Status)
+}
@@ -0,0 +1,201 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/r11/esxi-commander/internal/storage"
+	"github.com/r11/esxi-commander/pkg/audit"
+	"github.com/r11/esxi-commander/pkg/metrics"
+)
+
+// ReplicateOptions configures copying a stored backup to another target
+type ReplicateOptions struct {
+	BackupID string
+	Target   BackupTarget // Target receiving the copy
+	Progress ProgressFunc // Receives copy and verify progress; may be nil
+}
+
+// ReplicateBackup copies a completed backup to another target. The artifact
+// is streamed from the first stored copy that can be read, checked against
+// the catalog checksum on the way, and read back from the new copy before
+// it is recorded as a replica.
+func (m *BackupManager) ReplicateBackup(ctx context.Context, opts ReplicateOptions) (*storage.Replica, error) {
+	start := time.Now()
+
+	params := map[string]interface{}{
+		"backup_id": opts.BackupID,
+	}
+	if opts.Target != nil {
+		params["target"] = opts.Target.GetLocation()
+	}
+	auditCtx := audit.GetLogger().LogOperation(ctx, "backup.replicate", params)
+
+	replica, err := m.replicate(ctx, opts)
+	if err != nil {
+		auditCtx.Failure(err)
+		metrics.RecordBackupOperation("replicate", "failure", time.Since(start).Seconds())
+		return nil, err
+	}
+
+	auditCtx.Success()
+	metrics.RecordBackupOperation("replicate", "success", time.Since(start).Seconds())
+	return replica, nil
+}
+
+func (m *BackupManager) replicate(ctx context.Context, opts ReplicateOptions) (*storage.Replica, error) {
+	if opts.Target == nil {
+		return nil, fmt.Errorf("no replication target")
+	}
+
+	entry, err := m.catalog.GetBackup(opts.BackupID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get backup from catalog: %w", err)
+	}
+	if entry.Status != "completed" {
+		return nil, fmt.Errorf("backup is not completed: %s", entry.Status)
+	}
+	if entry.Checksum == "" {
+		return nil, fmt.Errorf("backup %s has no checksum", entry.ID)
+	}
+
+	base := opts.Target.GetLocation()
+	for _, location := range artifactLocations(entry) {
+		if location == base || strings.HasPrefix(location, base+"/") {
+			return nil, fmt.Errorf("backup %s is already stored at %s", entry.ID, location)
+		}
+	}
+
+	var location string
+	_, err = m.firstIntact(entry, nil, func(source BackupTarget) (err error) {
+		location, err = copyArtifact(ctx, source, opts.Target, entry, opts.Progress)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy backup: %w", err)
+	}
+
+	// Read the copy back so a target that mangles data on the way in is
+	// caught now rather than at restore time
+	opts.Progress.report("verify replica", -1)
+	if err := checkArtifact(ctx, opts.Target, entry); err != nil {
+		opts.Target.Delete(ctx, entry.ID)
+		return nil, fmt.Errorf("failed to verify replica: %w", err)
+	}
+
+	// Copies of an immutable or held backup are protected as well, on
+	// targets that can do it
+	if locker, ok := opts.Target.(ImmutableTarget); ok {
+		if entry.RetainUntil != nil && time.Now().Before(*entry.RetainUntil) {
+			if err := locker.Lock(ctx, entry.ID, *entry.RetainUntil); err != nil {
+				return nil, fmt.Errorf("failed to lock replica: %w", err)
+			}
+		}
+		if entry.Hold != nil {
+			if err := locker.SetLegalHold(ctx, entry.ID, true); err != nil {
+				return nil, fmt.Errorf("failed to hold replica: %w", err)
+			}
+		}
+	}
+
+	replica := storage.Replica{
+		Location: location,
+		Created:  time.Now(),
+	}
+	if err := m.catalog.AddReplica(entry.ID, replica); err != nil {
+		return nil, fmt.Errorf("failed to record replica: %w", err)
+	}
+
+	return &replica, nil
+}
+
+// copyArtifact streams a backup from source to dest, removing the copy if
+// the stream does not match the catalog checksum
+func copyArtifact(ctx context.Context, source, dest BackupTarget, entry *storage.BackupEntry, progress ProgressFunc) (string, error) {
+	rc, err := source.Retrieve(ctx, entry.ID)
+	if err != nil {
+		return "", fmt.Errorf("failed to retrieve backup: %w", err)
+	}
+	defer rc.Close()
+
+	progress.report("replicate", -1)
+
+	hasher := sha256.New()
+	location, err := dest.Store(ctx, entry.ID, io.TeeReader(&contextReader{ctx: ctx, r: rc}, hasher))
+	if err != nil {
+		return "", fmt.Errorf("failed to store replica: %w", err)
+	}
+
+	if checksum := hex.EncodeToString(hasher.Sum(nil)); checksum != entry.Checksum {
+		dest.Delete(ctx, entry.ID)
+		return "", fmt.Errorf("backup checksum mismatch: catalog has %s, artifact is %s", entry.Checksum, checksum)
+	}
+
+	return location, nil
+}
+
+// checkArtifact reads a stored backup and compares it with the catalog
+// checksum
+func checkArtifact(ctx context.Context, target BackupTarget, entry *storage.BackupEntry) error {
+	rc, err := target.Retrieve(ctx, entry.ID)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve backup: %w", err)
+	}
+	defer rc.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, &contextReader{ctx: ctx, r: rc}); err != nil {
+		return fmt.Errorf("failed to read backup: %w", err)
+	}
+
+	if checksum := hex.EncodeToString(hasher.Sum(nil)); checksum != entry.Checksum {
+		return fmt.Errorf("backup checksum mismatch: catalog has %s, artifact is %s", entry.Checksum, checksum)
+	}
+	return nil
+}
+
+// artifactLocations returns where copies of a backup are stored, the
+// primary location first
+func artifactLocations(entry *storage.BackupEntry) []string {
+	locations := []string{entry.Location}
+	for _, replica := range entry.Replicas {
+		locations = append(locations, replica.Location)
+	}
+	return locations
+}
+
+// firstIntact calls read with the target of each stored copy of a backup,
+// the primary first and then the replicas, until one succeeds, and returns
+// that target. primary, when set, is used instead of resolving the primary
+// location. A backup without replicas fails with the error of its primary.
+func (m *BackupManager) firstIntact(entry *storage.BackupEntry, primary BackupTarget, read func(BackupTarget) error) (BackupTarget, error) {
+	var errs []error
+	for i, location := range artifactLocations(entry) {
+		target := primary
+		if i > 0 || target == nil {
+			var err error
+			target, err = m.targetFor(location)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", location, err))
+				continue
+			}
+		}
+
+		err := read(target)
+		if err == nil {
+			return target, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", location, err))
+	}
+
+	if len(errs) == 1 {
+		return nil, errors.Unwrap(errs[0])
+	}
+	return nil, errors.Join(errs...)
+}
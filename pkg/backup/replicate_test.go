@@ -0,0 +1,82 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplicateBackupAndRestoreFromReplica(t *testing.T) {
+	manager := newTestManager(t)
+	vmName := firstVMName(t, manager)
+	ctx := context.Background()
+
+	// file:// locations are resolved without a configured resolver
+	primary, err := NewDirectoryTarget(t.TempDir())
+	require.NoError(t, err)
+	offsite, err := NewDirectoryTarget(t.TempDir())
+	require.NoError(t, err)
+
+	info, err := manager.CreateBackup(ctx, BackupOptions{VMName: vmName, Hot: true, Compress: true, Target: primary})
+	require.NoError(t, err)
+
+	_, err = manager.ReplicateBackup(ctx, ReplicateOptions{BackupID: info.ID, Target: primary})
+	assert.ErrorContains(t, err, "already stored")
+
+	replica, err := manager.ReplicateBackup(ctx, ReplicateOptions{BackupID: info.ID, Target: offsite})
+	require.NoError(t, err)
+	assert.Equal(t, "file://"+offsite.filePath(info.ID), replica.Location)
+
+	stored, err := manager.GetBackup(info.ID)
+	require.NoError(t, err)
+	require.Len(t, stored.Replicas, 1)
+	assert.Equal(t, replica.Location, stored.Replicas[0].Location)
+
+	// A damaged primary is skipped for the replica, both when copying
+	// further and when restoring
+	require.NoError(t, os.WriteFile(primary.filePath(info.ID), []byte("garbage"), 0600))
+
+	third, err := NewDirectoryTarget(t.TempDir())
+	require.NoError(t, err)
+	_, err = manager.ReplicateBackup(ctx, ReplicateOptions{BackupID: info.ID, Target: third})
+	require.NoError(t, err)
+
+	err = manager.RestoreBackup(ctx, RestoreOptions{BackupID: info.ID, NewName: "restored-vm", Target: primary})
+	require.NoError(t, err)
+	_, err = manager.client.FindVM(ctx, "restored-vm")
+	assert.NoError(t, err)
+
+	// Delete removes every copy
+	require.NoError(t, manager.DeleteBackup(ctx, info.ID))
+	for _, target := range []*DirectoryTarget{primary, offsite, third} {
+		assert.NoFileExists(t, target.filePath(info.ID))
+	}
+}
+
+func TestReplicateBackupRejectsDamagedSource(t *testing.T) {
+	manager := newTestManager(t)
+	vmName := firstVMName(t, manager)
+	ctx := context.Background()
+
+	primary := newMemoryTarget()
+	info, err := manager.CreateBackup(ctx, BackupOptions{VMName: vmName, Hot: true, Compress: true, Target: primary})
+	require.NoError(t, err)
+	primary.data[info.ID][len(primary.data[info.ID])-1] ^= 0xff
+
+	manager.config.ResolveTarget = func(location string) (BackupTarget, error) {
+		return primary, nil
+	}
+
+	offsite, err := NewDirectoryTarget(t.TempDir())
+	require.NoError(t, err)
+	_, err = manager.ReplicateBackup(ctx, ReplicateOptions{BackupID: info.ID, Target: offsite})
+	assert.ErrorContains(t, err, "checksum mismatch")
+	assert.NoFileExists(t, offsite.filePath(info.ID), "a bad copy is removed")
+
+	stored, err := manager.GetBackup(info.ID)
+	require.NoError(t, err)
+	assert.Empty(t, stored.Replicas)
+}
@@ -0,0 +1,454 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Default chunk sizes of new repositories
+const (
+	repoMinChunk = 256 << 10
+	repoAvgChunk = 1 << 20
+	repoMaxChunk = 4 << 20
+)
+
+// RepoTarget stores backups in a content-addressed, deduplicating
+// repository in a local directory (or NFS mount). Streams are split into
+// content-defined chunks, each stored once under its SHA-256 and compressed
+// with zstd; a per-backup index lists the chunks of the stream. Deleting a
+// backup only removes its index; GC reclaims chunks no index references.
+// A backup being stored has no index yet, so Store holds the repository
+// lock shared and GC exclusively.
+//
+// Layout:
+//
+//	config.json              chunking parameters, fixed at creation
+//	lock                     repository lock
+//	chunks/<ab>/<sha256>     zstd-compressed chunks
+//	indexes/<backup-id>.json chunk lists
+type RepoTarget struct {
+	path   string
+	config repoConfig
+}
+
+// repoConfig is the config.json of a repository
+type repoConfig struct {
+	Version  int `json:"version"`
+	MinChunk int `json:"min_chunk"`
+	AvgChunk int `json:"avg_chunk"`
+	MaxChunk int `json:"max_chunk"`
+}
+
+// RepoIndex lists the chunks of one stored backup
+type RepoIndex struct {
+	BackupID string      `json:"backup_id"`
+	Size     int64       `json:"size"`
+	SHA256   string      `json:"sha256"`
+	Created  time.Time   `json:"created"`
+	Chunks   []RepoChunk `json:"chunks"`
+}
+
+// RepoChunk is a reference to a stored chunk
+type RepoChunk struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"` // uncompressed
+}
+
+// RepoStats summarizes the space used by a repository
+type RepoStats struct {
+	Backups           int     `json:"backups"`
+	LogicalBytes      int64   `json:"logical_bytes"` // total size of all backup streams
+	Chunks            int     `json:"chunks"`        // distinct chunks referenced
+	UniqueBytes       int64   `json:"unique_bytes"`  // uncompressed size of referenced chunks
+	StoredBytes       int64   `json:"stored_bytes"`  // on-disk size of referenced chunks
+	Unreferenced      int     `json:"unreferenced_chunks"`
+	UnreferencedBytes int64   `json:"unreferenced_bytes"` // on-disk size GC would reclaim
+	DedupRatio        float64 `json:"dedup_ratio"`        // logical / unique bytes
+	CompressionRatio  float64 `json:"compression_ratio"`  // unique / stored bytes
+}
+
+// RepoGCResult reports the chunks removed (or, in a dry run, removable) by GC
+type RepoGCResult struct {
+	Chunks int   `json:"chunks"`
+	Bytes  int64 `json:"bytes"`
+}
+
+// NewRepoTarget opens the repository at path, creating it if needed
+func NewRepoTarget(path string) (*RepoTarget, error) {
+	return openRepo(path, repoConfig{
+		Version:  1,
+		MinChunk: repoMinChunk,
+		AvgChunk: repoAvgChunk,
+		MaxChunk: repoMaxChunk,
+	})
+}
+
+// openRepo opens a repository, initializing it with config if it does not
+// exist yet
+func openRepo(path string, config repoConfig) (*RepoTarget, error) {
+	if path == "" {
+		return nil, fmt.Errorf("repository path cannot be empty")
+	}
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid repository path: %w", err)
+	}
+
+	for _, dir := range []string{"chunks", "indexes"} {
+		if err := os.MkdirAll(filepath.Join(abs, dir), 0750); err != nil {
+			return nil, fmt.Errorf("failed to create repository: %w", err)
+		}
+	}
+
+	configPath := filepath.Join(abs, "config.json")
+	data, err := os.ReadFile(configPath)
+	switch {
+	case os.IsNotExist(err):
+		data, err = json.MarshalIndent(config, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		if _, err := writeFileAtomic(configPath, bytes.NewReader(data)); err != nil {
+			return nil, fmt.Errorf("failed to write repository config: %w", err)
+		}
+	case err != nil:
+		return nil, fmt.Errorf("failed to read repository config: %w", err)
+	default:
+		if err := json.Unmarshal(data, &config); err != nil {
+			return nil, fmt.Errorf("failed to parse repository config: %w", err)
+		}
+		if config.Version != 1 {
+			return nil, fmt.Errorf("unsupported repository version %d", config.Version)
+		}
+	}
+
+	return &RepoTarget{path: abs, config: config}, nil
+}
+
+// Store chunks the stream, writes the chunks not yet in the repository and
+// then the backup's index. GC waits until it is done.
+func (t *RepoTarget) Store(ctx context.Context, backupID string, reader io.Reader) (string, error) {
+	lock, err := t.lock(syscall.LOCK_SH)
+	if err != nil {
+		return "", err
+	}
+	defer lock.Close()
+
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		return "", err
+	}
+	defer encoder.Close()
+
+	hasher := sha256.New()
+	index := RepoIndex{BackupID: backupID, Created: time.Now().UTC()}
+	chunks := newChunker(io.TeeReader(&contextReader{ctx: ctx, r: reader}, hasher), t.config.MinChunk, t.config.AvgChunk, t.config.MaxChunk)
+
+	for {
+		data, err := chunks.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to read backup stream: %w", err)
+		}
+
+		sum := sha256.Sum256(data)
+		chunk := RepoChunk{Hash: hex.EncodeToString(sum[:]), Size: int64(len(data))}
+		if err := t.writeChunk(encoder, chunk.Hash, data); err != nil {
+			return "", err
+		}
+		index.Chunks = append(index.Chunks, chunk)
+		index.Size += chunk.Size
+	}
+	index.SHA256 = hex.EncodeToString(hasher.Sum(nil))
+
+	data, err := json.Marshal(index)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal index: %w", err)
+	}
+	if _, err := writeFileAtomic(t.indexPath(backupID), bytes.NewReader(data)); err != nil {
+		return "", fmt.Errorf("failed to write index: %w", err)
+	}
+
+	return "repo://" + filepath.Join(t.path, backupID), nil
+}
+
+// writeChunk stores a chunk unless it already exists
+func (t *RepoTarget) writeChunk(encoder *zstd.Encoder, hash string, data []byte) error {
+	chunkPath := t.chunkPath(hash)
+	if _, err := os.Stat(chunkPath); err == nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(chunkPath), 0750); err != nil {
+		return fmt.Errorf("failed to create chunk directory: %w", err)
+	}
+	if _, err := writeFileAtomic(chunkPath, bytes.NewReader(encoder.EncodeAll(data, nil))); err != nil {
+		return fmt.Errorf("failed to write chunk %s: %w", hash, err)
+	}
+	return nil
+}
+
+// Retrieve returns the backup stream reassembled from its chunks; each
+// chunk is checked against its hash as it is read
+func (t *RepoTarget) Retrieve(ctx context.Context, backupID string) (io.ReadCloser, error) {
+	index, err := t.ReadIndex(backupID)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &repoReader{ctx: ctx, repo: t, decoder: decoder, chunks: index.Chunks}, nil
+}
+
+// Delete removes the backup's index; its chunks are reclaimed by GC
+func (t *RepoTarget) Delete(ctx context.Context, backupID string) error {
+	if err := os.Remove(t.indexPath(backupID)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete backup index: %w", err)
+	}
+	return syncDir(filepath.Join(t.path, "indexes"))
+}
+
+// GetLocation returns the base location of the repository
+func (t *RepoTarget) GetLocation() string {
+	return "repo://" + t.path
+}
+
+// ReadIndex returns the chunk index of a stored backup
+func (t *RepoTarget) ReadIndex(backupID string) (*RepoIndex, error) {
+	data, err := os.ReadFile(t.indexPath(backupID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup index: %w", err)
+	}
+
+	var index RepoIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("failed to parse backup index: %w", err)
+	}
+	return &index, nil
+}
+
+// Stats reports how much space the repository uses and saves
+func (t *RepoTarget) Stats(ctx context.Context) (*RepoStats, error) {
+	referenced, indexes, err := t.references()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &RepoStats{Backups: len(indexes)}
+	for _, index := range indexes {
+		stats.LogicalBytes += index.Size
+	}
+	for _, size := range referenced {
+		stats.Chunks++
+		stats.UniqueBytes += size
+	}
+
+	err = t.walkChunks(ctx, func(hash string, info fs.FileInfo) error {
+		if _, ok := referenced[hash]; ok {
+			stats.StoredBytes += info.Size()
+		} else {
+			stats.Unreferenced++
+			stats.UnreferencedBytes += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if stats.UniqueBytes > 0 {
+		stats.DedupRatio = float64(stats.LogicalBytes) / float64(stats.UniqueBytes)
+	}
+	if stats.StoredBytes > 0 {
+		stats.CompressionRatio = float64(stats.UniqueBytes) / float64(stats.StoredBytes)
+	}
+	return stats, nil
+}
+
+// GC removes chunks no backup index references. It fails rather than wait
+// while a backup is being stored, since that backup has no index yet.
+func (t *RepoTarget) GC(ctx context.Context, dryRun bool) (*RepoGCResult, error) {
+	lock, err := t.lock(syscall.LOCK_EX | syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return nil, fmt.Errorf("repository %s is busy storing a backup; run gc again once it finishes", t.path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+
+	referenced, _, err := t.references()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &RepoGCResult{}
+	err = t.walkChunks(ctx, func(hash string, info fs.FileInfo) error {
+		if _, ok := referenced[hash]; ok {
+			return nil
+		}
+		if !dryRun {
+			if err := os.Remove(t.chunkPath(hash)); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove chunk %s: %w", hash, err)
+			}
+		}
+		result.Chunks++
+		result.Bytes += info.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// references returns the uncompressed size of every chunk referenced by an
+// index, and the indexes
+func (t *RepoTarget) references() (map[string]int64, []*RepoIndex, error) {
+	entries, err := os.ReadDir(filepath.Join(t.path, "indexes"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list indexes: %w", err)
+	}
+
+	referenced := make(map[string]int64)
+	var indexes []*RepoIndex
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") || filepath.Ext(name) != ".json" {
+			continue
+		}
+
+		index, err := t.ReadIndex(strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, chunk := range index.Chunks {
+			referenced[chunk.Hash] = chunk.Size
+		}
+		indexes = append(indexes, index)
+	}
+
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i].BackupID < indexes[j].BackupID })
+	return referenced, indexes, nil
+}
+
+// walkChunks calls fn for every chunk file, skipping temporary files
+func (t *RepoTarget) walkChunks(ctx context.Context, fn func(hash string, info fs.FileInfo) error) error {
+	return filepath.WalkDir(filepath.Join(t.path, "chunks"), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() || !isChunkHash(d.Name()) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return fn(d.Name(), info)
+	})
+}
+
+// lock takes the repository lock with flock; closing the file releases it.
+// On NFS the lock is forwarded to the server, so it holds across hosts.
+func (t *RepoTarget) lock(how int) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(t.path, "lock"), os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open repository lock: %w", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock repository: %w", err)
+	}
+	return f, nil
+}
+
+func (t *RepoTarget) chunkPath(hash string) string {
+	return filepath.Join(t.path, "chunks", hash[:2], hash)
+}
+
+func (t *RepoTarget) indexPath(backupID string) string {
+	return filepath.Join(t.path, "indexes", backupID+".json")
+}
+
+func isChunkHash(name string) bool {
+	if len(name) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
+
+// repoReader streams a backup chunk by chunk
+type repoReader struct {
+	ctx     context.Context
+	repo    *RepoTarget
+	decoder *zstd.Decoder
+	chunks  []RepoChunk
+	current bytes.Reader
+}
+
+func (r *repoReader) Read(p []byte) (int, error) {
+	for r.current.Len() == 0 {
+		if len(r.chunks) == 0 {
+			return 0, io.EOF
+		}
+		if err := r.ctx.Err(); err != nil {
+			return 0, err
+		}
+		if err := r.load(r.chunks[0]); err != nil {
+			return 0, err
+		}
+		r.chunks = r.chunks[1:]
+	}
+	return r.current.Read(p)
+}
+
+// load decompresses and checks the next chunk
+func (r *repoReader) load(chunk RepoChunk) error {
+	compressed, err := os.ReadFile(r.repo.chunkPath(chunk.Hash))
+	if err != nil {
+		return fmt.Errorf("failed to read chunk %s: %w", chunk.Hash, err)
+	}
+
+	data, err := r.decoder.DecodeAll(compressed, nil)
+	if err != nil {
+		return fmt.Errorf("failed to decompress chunk %s: %w", chunk.Hash, err)
+	}
+	if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != chunk.Hash {
+		return fmt.Errorf("chunk %s is corrupt", chunk.Hash)
+	}
+
+	r.current.Reset(data)
+	return nil
+}
+
+func (r *repoReader) Close() error {
+	r.decoder.Close()
+	return nil
+}
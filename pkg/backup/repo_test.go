@@ -0,0 +1,251 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// smallChunks keeps test repositories to a few kilobytes per chunk
+var smallChunks = repoConfig{Version: 1, MinChunk: 1 << 10, AvgChunk: 4 << 10, MaxChunk: 16 << 10}
+
+// randomPayload returns size reproducible pseudo-random bytes
+func randomPayload(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func chunkHashes(t *testing.T, data []byte) map[string]bool {
+	t.Helper()
+
+	hashes := make(map[string]bool)
+	chunks := newChunker(bytes.NewReader(data), smallChunks.MinChunk, smallChunks.AvgChunk, smallChunks.MaxChunk)
+	var joined []byte
+	for {
+		chunk, err := chunks.next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		require.LessOrEqual(t, len(chunk), smallChunks.MaxChunk)
+		joined = append(joined, chunk...)
+		hashes[string(chunk)] = true
+	}
+	require.Equal(t, data, joined)
+	return hashes
+}
+
+func TestChunkerBoundariesSurviveInsertion(t *testing.T) {
+	data := randomPayload(1, 1<<20)
+	edited := append(append(append([]byte(nil), data[:300<<10]...), "inserted bytes"...), data[300<<10:]...)
+
+	original := chunkHashes(t, data)
+	changed := chunkHashes(t, edited)
+
+	shared := 0
+	for chunk := range changed {
+		if original[chunk] {
+			shared++
+		}
+	}
+	assert.Greater(t, len(original), 100)
+	assert.GreaterOrEqual(t, len(changed)-shared, 1)
+	assert.LessOrEqual(t, len(changed)-shared, 3, "only the chunks around the insertion change")
+}
+
+func TestRepoTargetDeduplicates(t *testing.T) {
+	repo, err := openRepo(t.TempDir(), smallChunks)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	base := randomPayload(2, 512<<10)
+	clone := append(append([]byte(nil), base[:400<<10]...), randomPayload(3, 8<<10)...)
+
+	location, err := repo.Store(ctx, "backup-a", bytes.NewReader(base))
+	require.NoError(t, err)
+	assert.Equal(t, "repo://"+filepath.Join(repo.path, "backup-a"), location)
+	_, err = repo.Store(ctx, "backup-b", bytes.NewReader(clone))
+	require.NoError(t, err)
+
+	for id, want := range map[string][]byte{"backup-a": base, "backup-b": clone} {
+		rc, err := repo.Retrieve(ctx, id)
+		require.NoError(t, err)
+		got, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		rc.Close()
+		assert.Equal(t, want, got, id)
+	}
+
+	stats, err := repo.Stats(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, stats.Backups)
+	assert.Equal(t, int64(len(base)+len(clone)), stats.LogicalBytes)
+	assert.Greater(t, stats.DedupRatio, 1.6)
+	assert.Zero(t, stats.Unreferenced)
+
+	// Reopening keeps the chunk size of the existing repository
+	reopened, err := NewRepoTarget(repo.path)
+	require.NoError(t, err)
+	assert.Equal(t, smallChunks, reopened.config)
+
+	require.NoError(t, repo.Delete(ctx, "backup-b"))
+	stats, err = repo.Stats(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.Backups)
+	assert.Positive(t, stats.Unreferenced)
+
+	dryRun, err := repo.GC(ctx, true)
+	require.NoError(t, err)
+	assert.Equal(t, stats.Unreferenced, dryRun.Chunks)
+
+	removed, err := repo.GC(ctx, false)
+	require.NoError(t, err)
+	assert.Equal(t, dryRun, removed)
+
+	stats, err = repo.Stats(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, stats.Unreferenced)
+
+	rc, err := repo.Retrieve(ctx, "backup-a")
+	require.NoError(t, err)
+	got, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Equal(t, base, got)
+}
+
+func TestRepoTargetGCWaitsForStore(t *testing.T) {
+	repo, err := openRepo(t.TempDir(), smallChunks)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	payload := randomPayload(4, 64<<10)
+	pr, pw := io.Pipe()
+	stored := make(chan error, 1)
+	go func() {
+		_, err := repo.Store(ctx, "backup-a", pr)
+		stored <- err
+	}()
+
+	// Store has read the first half, so its chunks have no index yet
+	_, err = pw.Write(payload[:32<<10])
+	require.NoError(t, err)
+
+	_, err = repo.GC(ctx, false)
+	require.ErrorContains(t, err, "busy storing a backup")
+
+	_, err = pw.Write(payload[32<<10:])
+	require.NoError(t, err)
+	require.NoError(t, pw.Close())
+	require.NoError(t, <-stored)
+
+	result, err := repo.GC(ctx, false)
+	require.NoError(t, err)
+	assert.Zero(t, result.Chunks)
+
+	rc, err := repo.Retrieve(ctx, "backup-a")
+	require.NoError(t, err)
+	got, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Equal(t, payload, got)
+}
+
+func TestRepoTargetDetectsCorruptChunk(t *testing.T) {
+	repo, err := openRepo(t.TempDir(), smallChunks)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	_, err = repo.Store(ctx, "backup-a", bytes.NewReader(randomPayload(5, 64<<10)))
+	require.NoError(t, err)
+
+	index, err := repo.ReadIndex("backup-a")
+	require.NoError(t, err)
+	other, err := os.ReadFile(repo.chunkPath(index.Chunks[1].Hash))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(repo.chunkPath(index.Chunks[0].Hash), other, 0600))
+
+	rc, err := repo.Retrieve(ctx, "backup-a")
+	require.NoError(t, err)
+	_, err = io.ReadAll(rc)
+	assert.ErrorContains(t, err, "is corrupt")
+}
+
+func TestBackupToRepoTarget(t *testing.T) {
+	manager := newTestManager(t)
+	vmName := firstVMName(t, manager)
+	repo, err := NewRepoTarget(t.TempDir())
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	info, err := manager.CreateBackup(ctx, BackupOptions{
+		VMName:   vmName,
+		Hot:      true,
+		Compress: true,
+		Target:   repo,
+	})
+	require.NoError(t, err)
+
+	entry, err := manager.catalog.GetBackup(info.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "none", entry.Metadata["compression"], "repositories compress chunks, not the stream")
+
+	// The catalog location alone finds the repository again
+	target, err := TargetForLocation(nil, info.Location)
+	require.NoError(t, err)
+	result, err := manager.VerifyBackup(ctx, VerifyOptions{BackupID: info.ID, Target: target})
+	require.NoError(t, err)
+	assert.True(t, result.Passed)
+}
+
+func TestRepoTargetDeduplicatesRepeatedBackups(t *testing.T) {
+	_, recipient := writeIdentity(t)
+	c, _ := newSimulatorClient(t)
+	dir := t.TempDir()
+	repo, err := NewRepoTarget(filepath.Join(dir, "repo"))
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	encrypted, err := NewBackupManagerWithConfig(c, &Config{
+		CatalogPath: filepath.Join(dir, "encrypted.db"),
+		TempDir:     dir,
+		Recipients:  []string{recipient},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { encrypted.Close() })
+	vmName := firstVMName(t, encrypted)
+
+	// Encrypted streams never share chunks, so they are refused
+	for i := 0; i < 2; i++ {
+		_, err = encrypted.CreateBackup(ctx, BackupOptions{VMName: vmName, Hot: true, Compress: true, Target: repo})
+		require.ErrorContains(t, err, "cannot hold encrypted backups")
+	}
+	backups, err := encrypted.catalog.ListBackups("")
+	require.NoError(t, err)
+	assert.Empty(t, backups)
+	stats, err := repo.Stats(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, stats.Backups)
+
+	plain, err := NewBackupManagerWithConfig(c, &Config{
+		CatalogPath: filepath.Join(dir, "plain.db"),
+		TempDir:     dir,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { plain.Close() })
+
+	for i := 0; i < 2; i++ {
+		_, err = plain.CreateBackup(ctx, BackupOptions{VMName: vmName, Hot: true, Compress: true, Target: repo})
+		require.NoError(t, err)
+	}
+	stats, err = repo.Stats(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, stats.Backups)
+	assert.Greater(t, stats.DedupRatio, 1.9)
+}
@@ -0,0 +1,372 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+const (
+	// DefaultS3PartSize is the multipart part size used when none is configured.
+	// At S3's limit of 10,000 parts it allows backups of up to 640 GiB.
+	DefaultS3PartSize = 64 << 20
+
+	minS3PartSize = 5 << 20
+	maxS3Parts    = 10000
+)
+
+// S3Options configures an S3-compatible backup target
+type S3Options struct {
+	Endpoint  string // host[:port] or URL; http:// disables TLS (e.g. local MinIO)
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string // falls back to AWS_* / MINIO_* environment credentials
+	SecretKey string
+	PathStyle bool   // force path-style bucket addressing
+	PartSize  int64  // multipart part size in bytes
+	LockMode  string // object lock mode of immutable backups: governance (default) or compliance
+}
+
+// S3Target stores backups as objects in an S3-compatible bucket. Uploads are
+// streamed as multipart uploads, so only one part is ever held in memory.
+type S3Target struct {
+	core     *minio.Core
+	bucket   string
+	prefix   string
+	partSize int64
+	lockMode minio.RetentionMode
+}
+
+// NewS3Target creates an S3 target. It does not contact the endpoint.
+func NewS3Target(opts S3Options) (*S3Target, error) {
+	if opts.Bucket == "" {
+		return nil, fmt.Errorf("S3 bucket cannot be empty")
+	}
+
+	endpoint, secure, err := parseS3Endpoint(opts.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	partSize := opts.PartSize
+	if partSize == 0 {
+		partSize = DefaultS3PartSize
+	}
+	if partSize < minS3PartSize {
+		return nil, fmt.Errorf("S3 part size must be at least %d bytes", minS3PartSize)
+	}
+
+	lockMode := minio.Governance
+	switch opts.LockMode {
+	case "", "governance":
+	case "compliance":
+		lockMode = minio.Compliance
+	default:
+		return nil, fmt.Errorf("S3 object lock mode must be governance or compliance, not %q", opts.LockMode)
+	}
+
+	creds := credentials.NewStaticV4(opts.AccessKey, opts.SecretKey, "")
+	if opts.AccessKey == "" {
+		creds = credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.EnvMinio{},
+		})
+	}
+
+	lookup := minio.BucketLookupAuto
+	if opts.PathStyle {
+		lookup = minio.BucketLookupPath
+	}
+
+	core, err := minio.NewCore(endpoint, &minio.Options{
+		Creds:        creds,
+		Secure:       secure,
+		Region:       opts.Region,
+		BucketLookup: lookup,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 client: %w", err)
+	}
+
+	return &S3Target{
+		core:     core,
+		bucket:   opts.Bucket,
+		prefix:   strings.Trim(opts.Prefix, "/"),
+		partSize: partSize,
+		lockMode: lockMode,
+	}, nil
+}
+
+// Store streams the backup as a multipart upload. If an earlier upload of the
+// same backup was interrupted, its parts are reused wherever the new stream
+// produces identical data, which an encrypted stream never does. A failed
+// upload is left in place; Delete aborts it.
+func (t *S3Target) Store(ctx context.Context, backupID string, reader io.Reader) (string, error) {
+	key := t.objectKey(backupID)
+
+	uploadID, uploaded, err := t.resumableUpload(ctx, key)
+	if err != nil {
+		return "", err
+	}
+
+	var parts []minio.CompletePart
+	buf := make([]byte, t.partSize)
+	for partNumber := 1; ; partNumber++ {
+		n, readErr := io.ReadFull(reader, buf)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			return "", fmt.Errorf("failed to read backup stream for upload %s: %w", uploadID, readErr)
+		}
+		// S3 needs at least one part, even for an empty object
+		if n == 0 && len(parts) > 0 {
+			break
+		}
+		if partNumber > maxS3Parts {
+			return "", fmt.Errorf("backup exceeds %d parts of %d bytes; increase the S3 part size", maxS3Parts, t.partSize)
+		}
+
+		part, err := t.uploadPart(ctx, key, uploadID, partNumber, buf[:n], uploaded[partNumber])
+		if err != nil {
+			return "", fmt.Errorf("failed to upload part %d of upload %s: %w", partNumber, uploadID, err)
+		}
+		parts = append(parts, part)
+
+		if readErr != nil {
+			break
+		}
+	}
+
+	if _, err := t.core.CompleteMultipartUpload(ctx, t.bucket, key, uploadID, parts, minio.PutObjectOptions{}); err != nil {
+		return "", fmt.Errorf("failed to complete upload: %w", err)
+	}
+
+	return fmt.Sprintf("s3://%s/%s", t.bucket, key), nil
+}
+
+func (t *S3Target) resumesUploads() {}
+
+// Retrieve opens the backup object for reading
+func (t *S3Target) Retrieve(ctx context.Context, backupID string) (io.ReadCloser, error) {
+	reader, _, _, err := t.core.GetObject(ctx, t.bucket, t.objectKey(backupID), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve backup: %w", err)
+	}
+	return reader, nil
+}
+
+// Delete aborts any incomplete uploads of the backup and removes every
+// version of its object, delete markers included. Object lock buckets are
+// versioned, so deleting just the key would only add a delete marker and
+// free nothing. A version still under retention fails the delete.
+func (t *S3Target) Delete(ctx context.Context, backupID string) error {
+	key := t.objectKey(backupID)
+
+	uploads, err := t.incompleteUploads(ctx, key)
+	if err != nil {
+		return err
+	}
+	for _, upload := range uploads {
+		if err := t.core.AbortMultipartUpload(ctx, t.bucket, key, upload.UploadID); err != nil {
+			return fmt.Errorf("failed to abort upload %s: %w", upload.UploadID, err)
+		}
+	}
+
+	listCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for object := range t.core.Client.ListObjects(listCtx, t.bucket, minio.ListObjectsOptions{Prefix: key, WithVersions: true}) {
+		if object.Err != nil {
+			return fmt.Errorf("failed to list versions of backup: %w", object.Err)
+		}
+		if object.Key != key {
+			continue
+		}
+		if err := t.core.RemoveObject(ctx, t.bucket, key, minio.RemoveObjectOptions{VersionID: object.VersionID}); err != nil {
+			return fmt.Errorf("failed to delete version %s of backup: %w", object.VersionID, err)
+		}
+	}
+	return nil
+}
+
+// Lock sets an object lock retention period on the backup object; the
+// bucket must have object lock enabled. In compliance mode nobody can
+// shorten it, in governance mode only users allowed to bypass governance.
+func (t *S3Target) Lock(ctx context.Context, backupID string, until time.Time) error {
+	until = until.UTC()
+	err := t.core.PutObjectRetention(ctx, t.bucket, t.objectKey(backupID), minio.PutObjectRetentionOptions{
+		Mode:            &t.lockMode,
+		RetainUntilDate: &until,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to lock backup object: %w", err)
+	}
+	return nil
+}
+
+// SetLegalHold places or releases an object lock legal hold on the backup
+// object
+func (t *S3Target) SetLegalHold(ctx context.Context, backupID string, hold bool) error {
+	status := minio.LegalHoldDisabled
+	if hold {
+		status = minio.LegalHoldEnabled
+	}
+	err := t.core.PutObjectLegalHold(ctx, t.bucket, t.objectKey(backupID), minio.PutObjectLegalHoldOptions{
+		Status: &status,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set legal hold on backup object: %w", err)
+	}
+	return nil
+}
+
+// Unlock cannot lift object lock retention, which only expires by itself.
+// It fails while the backup object is still retained, and otherwise does
+// nothing.
+func (t *S3Target) Unlock(ctx context.Context, backupID string) error {
+	mode, until, err := t.core.GetObjectRetention(ctx, t.bucket, t.objectKey(backupID), "")
+	if err != nil {
+		switch minio.ToErrorResponse(err).Code {
+		case "NoSuchObjectLockConfiguration", "NoSuchKey", "InvalidRequest", "MethodNotAllowed":
+			// Not retained, not locked at all, or already deleted
+			return nil
+		}
+		return fmt.Errorf("failed to get retention of backup object: %w", err)
+	}
+	if until != nil && until.After(time.Now()) {
+		return fmt.Errorf("backup object is retained in %s mode until %s, which cannot be lifted here; wait for it to expire", *mode, until.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// GetLocation returns the base location of the target
+func (t *S3Target) GetLocation() string {
+	if t.prefix == "" {
+		return fmt.Sprintf("s3://%s", t.bucket)
+	}
+	return fmt.Sprintf("s3://%s/%s", t.bucket, t.prefix)
+}
+
+func (t *S3Target) objectKey(backupID string) string {
+	return path.Join(t.prefix, backupID+".ova")
+}
+
+// resumableUpload returns the most recent incomplete upload for key and its
+// parts, or starts a new multipart upload
+func (t *S3Target) resumableUpload(ctx context.Context, key string) (string, map[int]minio.ObjectPart, error) {
+	uploads, err := t.incompleteUploads(ctx, key)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(uploads) == 0 {
+		uploadID, err := t.core.NewMultipartUpload(ctx, t.bucket, key, minio.PutObjectOptions{
+			ContentType: "application/x-tar",
+		})
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to start upload: %w", err)
+		}
+		return uploadID, nil, nil
+	}
+
+	latest := uploads[0]
+	for _, upload := range uploads[1:] {
+		if upload.Initiated.After(latest.Initiated) {
+			latest = upload
+		}
+	}
+
+	parts := make(map[int]minio.ObjectPart)
+	marker := 0
+	for {
+		result, err := t.core.ListObjectParts(ctx, t.bucket, key, latest.UploadID, marker, 1000)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to list parts of upload %s: %w", latest.UploadID, err)
+		}
+		for _, part := range result.ObjectParts {
+			parts[part.PartNumber] = part
+		}
+		if !result.IsTruncated {
+			break
+		}
+		marker = result.NextPartNumberMarker
+	}
+
+	return latest.UploadID, parts, nil
+}
+
+// incompleteUploads lists the multipart uploads in progress for key
+func (t *S3Target) incompleteUploads(ctx context.Context, key string) ([]minio.ObjectMultipartInfo, error) {
+	var uploads []minio.ObjectMultipartInfo
+	keyMarker, uploadIDMarker := "", ""
+	for {
+		result, err := t.core.ListMultipartUploads(ctx, t.bucket, key, keyMarker, uploadIDMarker, "", 1000)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list incomplete uploads: %w", err)
+		}
+		for _, upload := range result.Uploads {
+			if upload.Key == key {
+				uploads = append(uploads, upload)
+			}
+		}
+		if !result.IsTruncated {
+			return uploads, nil
+		}
+		keyMarker, uploadIDMarker = result.NextKeyMarker, result.NextUploadIDMarker
+	}
+}
+
+// uploadPart uploads one part, skipping it if the interrupted upload already
+// holds a part with the same number and content
+func (t *S3Target) uploadPart(ctx context.Context, key, uploadID string, partNumber int, data []byte, existing minio.ObjectPart) (minio.CompletePart, error) {
+	md5sum := md5.Sum(data)
+	if existing.PartNumber == partNumber && existing.Size == int64(len(data)) &&
+		strings.Trim(existing.ETag, `"`) == hex.EncodeToString(md5sum[:]) {
+		return minio.CompletePart{PartNumber: partNumber, ETag: existing.ETag}, nil
+	}
+
+	sha := sha256.Sum256(data)
+	part, err := t.core.PutObjectPart(ctx, t.bucket, key, uploadID, partNumber, bytes.NewReader(data), int64(len(data)), minio.PutObjectPartOptions{
+		Md5Base64:            base64.StdEncoding.EncodeToString(md5sum[:]),
+		Sha256Hex:            hex.EncodeToString(sha[:]),
+		DisableContentSha256: true,
+	})
+	if err != nil {
+		return minio.CompletePart{}, err
+	}
+
+	return minio.CompletePart{PartNumber: partNumber, ETag: part.ETag}, nil
+}
+
+// parseS3Endpoint accepts "host[:port]" or a URL and reports whether TLS is used
+func parseS3Endpoint(endpoint string) (string, bool, error) {
+	if endpoint == "" {
+		return "s3.amazonaws.com", true, nil
+	}
+	if !strings.Contains(endpoint, "://") {
+		return endpoint, true, nil
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", false, fmt.Errorf("invalid S3 endpoint %q: %w", endpoint, err)
+	}
+	switch u.Scheme {
+	case "https":
+		return u.Host, true, nil
+	case "http":
+		return u.Host, false, nil
+	default:
+		return "", false, fmt.Errorf("invalid S3 endpoint scheme %q", u.Scheme)
+	}
+}
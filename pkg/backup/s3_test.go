@@ -0,0 +1,596 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/r11/esxi-commander/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeS3 is a minimal in-process S3 server covering the path-style object,
+// multipart, versioning and object lock calls used by S3Target. Signatures
+// are not checked.
+type fakeS3 struct {
+	mu        sync.Mutex
+	objects   map[string][]byte
+	versioned bool                     // keep every version, as object lock buckets do
+	versions  map[string][]fakeVersion // of a versioned bucket, oldest first
+	uploads   map[string]*fakeUpload
+	retention map[string]fakeRetention
+	legalHold map[string]string
+	nextID    int
+	putParts  int
+	failPart  int // fail this part number once, then clear
+}
+
+type fakeRetention struct {
+	Mode            string
+	RetainUntilDate time.Time
+}
+
+type fakeVersion struct {
+	id     string
+	data   []byte
+	marker bool
+}
+
+type fakeUpload struct {
+	key       string
+	initiated time.Time
+	parts     map[int][]byte
+}
+
+type fakePart struct {
+	PartNumber int
+	ETag       string
+	Size       int64
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *S3Target) {
+	t.Helper()
+
+	fake := &fakeS3{
+		objects:   make(map[string][]byte),
+		versions:  make(map[string][]fakeVersion),
+		uploads:   make(map[string]*fakeUpload),
+		retention: make(map[string]fakeRetention),
+		legalHold: make(map[string]string),
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	target, err := NewS3Target(S3Options{
+		Endpoint:  server.URL,
+		Region:    "us-east-1",
+		Bucket:    "backups",
+		Prefix:    "esxi",
+		AccessKey: "test",
+		SecretKey: "test-secret",
+		PathStyle: true,
+		PartSize:  minS3PartSize,
+	})
+	require.NoError(t, err)
+
+	return fake, target
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+	uploadID := query.Get("uploadId")
+
+	switch {
+	case r.Method == http.MethodGet && key == "" && query.Has("uploads"):
+		type upload struct {
+			Key       string
+			UploadId  string
+			Initiated time.Time
+		}
+		result := struct {
+			XMLName xml.Name `xml:"ListMultipartUploadsResult"`
+			Bucket  string
+			Uploads []upload `xml:"Upload"`
+		}{Bucket: bucket}
+		for id, u := range f.uploads {
+			if strings.HasPrefix(u.key, query.Get("prefix")) {
+				result.Uploads = append(result.Uploads, upload{Key: u.key, UploadId: id, Initiated: u.initiated})
+			}
+		}
+		writeXML(w, result)
+
+	case r.Method == http.MethodGet && key == "" && query.Has("versions"):
+		type version struct {
+			Key       string
+			VersionId string
+			IsLatest  bool
+			Size      int64
+		}
+		var keys []string
+		for k := range f.objects {
+			if !f.versioned && strings.HasPrefix(k, query.Get("prefix")) {
+				keys = append(keys, k)
+			}
+		}
+		for k := range f.versions {
+			if strings.HasPrefix(k, query.Get("prefix")) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+
+		var body bytes.Buffer
+		body.WriteString(`<ListVersionsResult><Name>` + bucket + `</Name><IsTruncated>false</IsTruncated>`)
+		enc := xml.NewEncoder(&body)
+		for _, k := range keys {
+			if !f.versioned {
+				enc.EncodeElement(version{Key: k, VersionId: "null", IsLatest: true, Size: int64(len(f.objects[k]))}, xml.StartElement{Name: xml.Name{Local: "Version"}})
+				continue
+			}
+			versions := f.versions[k]
+			for i := len(versions) - 1; i >= 0; i-- {
+				v := version{Key: k, VersionId: versions[i].id, IsLatest: i == len(versions)-1, Size: int64(len(versions[i].data))}
+				name := "Version"
+				if versions[i].marker {
+					name = "DeleteMarker"
+				}
+				enc.EncodeElement(v, xml.StartElement{Name: xml.Name{Local: name}})
+			}
+		}
+		enc.Flush()
+		body.WriteString(`</ListVersionsResult>`)
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write(body.Bytes())
+
+	case r.Method == http.MethodGet && query.Has("retention"):
+		retention, ok := f.retention[key]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchObjectLockConfiguration")
+			return
+		}
+		writeXML(w, struct {
+			XMLName         xml.Name `xml:"Retention"`
+			Mode            string
+			RetainUntilDate time.Time
+		}{Mode: retention.Mode, RetainUntilDate: retention.RetainUntilDate})
+
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.nextID++
+		id := fmt.Sprintf("upload-%d", f.nextID)
+		f.uploads[id] = &fakeUpload{key: key, initiated: time.Now(), parts: make(map[int][]byte)}
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: bucket, Key: key, UploadId: id})
+
+	case r.Method == http.MethodPut && query.Has("retention"):
+		var retention fakeRetention
+		if err := xml.NewDecoder(r.Body).Decode(&retention); err != nil {
+			writeS3Error(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		f.retention[key] = retention
+
+	case r.Method == http.MethodPut && query.Has("legal-hold"):
+		var hold struct{ Status string }
+		if err := xml.NewDecoder(r.Body).Decode(&hold); err != nil {
+			writeS3Error(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		f.legalHold[key] = hold.Status
+
+	case r.Method == http.MethodPut && uploadID != "":
+		upload, ok := f.uploads[uploadID]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		data, _ := io.ReadAll(r.Body)
+		if number == f.failPart {
+			f.failPart = 0
+			writeS3Error(w, http.StatusBadRequest, "InvalidPart")
+			return
+		}
+		f.putParts++
+		upload.parts[number] = data
+		w.Header().Set("ETag", etag(data))
+
+	case r.Method == http.MethodGet && uploadID != "":
+		upload, ok := f.uploads[uploadID]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		result := struct {
+			XMLName  xml.Name `xml:"ListPartsResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+			Parts    []fakePart `xml:"Part"`
+		}{Bucket: bucket, Key: key, UploadId: uploadID}
+		for number, data := range upload.parts {
+			result.Parts = append(result.Parts, fakePart{PartNumber: number, ETag: etag(data), Size: int64(len(data))})
+		}
+		sort.Slice(result.Parts, func(i, j int) bool { return result.Parts[i].PartNumber < result.Parts[j].PartNumber })
+		writeXML(w, result)
+
+	case r.Method == http.MethodPost && uploadID != "":
+		upload, ok := f.uploads[uploadID]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		var complete struct {
+			Parts []fakePart `xml:"Part"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&complete); err != nil {
+			writeS3Error(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		var object bytes.Buffer
+		for _, part := range complete.Parts {
+			data, ok := upload.parts[part.PartNumber]
+			if !ok || etag(data) != `"`+strings.Trim(part.ETag, `"`)+`"` {
+				writeS3Error(w, http.StatusBadRequest, "InvalidPart")
+				return
+			}
+			object.Write(data)
+		}
+		f.putObject(key, object.Bytes())
+		delete(f.uploads, uploadID)
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: bucket, Key: key, ETag: etag(object.Bytes())})
+
+	case r.Method == http.MethodDelete && uploadID != "":
+		delete(f.uploads, uploadID)
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodGet:
+		data, ok := f.objects[key]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("ETag", etag(data))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Write(data)
+
+	case r.Method == http.MethodDelete && query.Has("versionId"):
+		if retention, ok := f.retention[key]; ok && retention.RetainUntilDate.After(time.Now()) {
+			writeS3Error(w, http.StatusForbidden, "AccessDenied")
+			return
+		}
+		f.removeVersion(key, query.Get("versionId"))
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		if f.versioned {
+			f.nextID++
+			f.versions[key] = append(f.versions[key], fakeVersion{id: fmt.Sprintf("v%d", f.nextID), marker: true})
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeS3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// putObject stores a completed object, as a new version if versioned
+func (f *fakeS3) putObject(key string, data []byte) {
+	f.objects[key] = data
+	if f.versioned {
+		f.nextID++
+		f.versions[key] = append(f.versions[key], fakeVersion{id: fmt.Sprintf("v%d", f.nextID), data: data})
+	}
+}
+
+// removeVersion permanently deletes one version of an object
+func (f *fakeS3) removeVersion(key, id string) {
+	if !f.versioned {
+		if id == "null" {
+			delete(f.objects, key)
+		}
+		return
+	}
+
+	versions := f.versions[key]
+	for i, v := range versions {
+		if v.id == id {
+			versions = append(versions[:i], versions[i+1:]...)
+			break
+		}
+	}
+	delete(f.objects, key)
+	if len(versions) == 0 {
+		delete(f.versions, key)
+		return
+	}
+	f.versions[key] = versions
+	if latest := versions[len(versions)-1]; !latest.marker {
+		f.objects[key] = latest.data
+	}
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(v)
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: code})
+}
+
+// testPayload returns deterministic data spanning several parts
+func testPayload(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func TestS3TargetMultipartRoundTrip(t *testing.T) {
+	fake, target := newFakeS3(t)
+	ctx := context.Background()
+	payload := testPayload(2*minS3PartSize + 1234)
+
+	location, err := target.Store(ctx, "backup-test", bytes.NewReader(payload))
+	require.NoError(t, err)
+	assert.Equal(t, "s3://backups/esxi/backup-test.ova", location)
+	assert.Equal(t, 3, fake.putParts)
+	assert.Empty(t, fake.uploads)
+
+	reader, err := target.Retrieve(ctx, "backup-test")
+	require.NoError(t, err)
+	data, err := io.ReadAll(reader)
+	reader.Close()
+	require.NoError(t, err)
+	assert.Equal(t, payload, data)
+
+	require.NoError(t, target.Delete(ctx, "backup-test"))
+	_, err = target.Retrieve(ctx, "backup-test")
+	assert.Error(t, err)
+}
+
+func TestS3TargetStoresEmptyBackup(t *testing.T) {
+	fake, target := newFakeS3(t)
+
+	_, err := target.Store(context.Background(), "backup-empty", bytes.NewReader(nil))
+	require.NoError(t, err)
+	assert.Contains(t, fake.objects, "esxi/backup-empty.ova")
+	assert.Empty(t, fake.objects["esxi/backup-empty.ova"])
+}
+
+func TestS3TargetResumesInterruptedUpload(t *testing.T) {
+	fake, target := newFakeS3(t)
+	ctx := context.Background()
+	payload := testPayload(3*minS3PartSize + 10)
+
+	fake.failPart = 3
+	_, err := target.Store(ctx, "backup-test", bytes.NewReader(payload))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to upload part 3")
+	require.Len(t, fake.uploads, 1)
+	assert.Equal(t, 2, fake.putParts)
+
+	// Retrying the same stream only uploads the parts that are missing
+	_, err = target.Store(ctx, "backup-test", bytes.NewReader(payload))
+	require.NoError(t, err)
+	assert.Equal(t, 4, fake.putParts)
+	assert.Empty(t, fake.uploads)
+	assert.Equal(t, payload, fake.objects["esxi/backup-test.ova"])
+}
+
+func TestS3TargetDeleteAbortsIncompleteUploads(t *testing.T) {
+	fake, target := newFakeS3(t)
+	ctx := context.Background()
+
+	_, err := target.Store(ctx, "backup-test", io.MultiReader(
+		bytes.NewReader(testPayload(minS3PartSize)),
+		iotest.ErrReader(errors.New("export failed")),
+	))
+	require.Error(t, err)
+	require.Len(t, fake.uploads, 1)
+
+	require.NoError(t, target.Delete(ctx, "backup-test"))
+	assert.Empty(t, fake.uploads)
+}
+
+func TestCreateBackupKeepsFailedS3UploadForResume(t *testing.T) {
+	manager := newTestManager(t)
+	vmName := firstVMName(t, manager)
+	fake, target := newFakeS3(t)
+	ctx := context.Background()
+
+	fake.failPart = 1
+	_, err := manager.CreateBackup(ctx, BackupOptions{VMName: vmName, Hot: true, Compress: true, Target: target})
+	require.Error(t, err)
+	assert.Len(t, fake.uploads, 1)
+
+	backups, err := manager.catalog.ListBackups(vmName)
+	require.NoError(t, err)
+	require.Len(t, backups, 1)
+	assert.Equal(t, "interrupted", backups[0].Status)
+	assert.Equal(t, "s3://backups/esxi", backups[0].Metadata["target"])
+
+	info, err := manager.CreateBackup(ctx, BackupOptions{VMName: vmName, Hot: true, Compress: true, Target: target, Resume: backups[0].ID})
+	require.NoError(t, err)
+	assert.Equal(t, backups[0].ID, info.ID)
+	assert.Empty(t, fake.uploads)
+}
+
+func TestCreateBackupAbortsFailedEncryptedS3Upload(t *testing.T) {
+	_, recipient := writeIdentity(t)
+	c, _ := newSimulatorClient(t)
+	dir := t.TempDir()
+	manager, err := NewBackupManagerWithConfig(c, &Config{
+		CatalogPath: filepath.Join(dir, "catalog.db"),
+		TempDir:     dir,
+		Recipients:  []string{recipient},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { manager.Close() })
+	vmName := firstVMName(t, manager)
+	fake, target := newFakeS3(t)
+	ctx := context.Background()
+
+	// A new key every run means nothing of the upload could be reused
+	fake.failPart = 1
+	_, err = manager.CreateBackup(ctx, BackupOptions{VMName: vmName, Hot: true, Compress: true, Target: target})
+	require.Error(t, err)
+	assert.Empty(t, fake.uploads)
+
+	backups, err := manager.catalog.ListBackups(vmName)
+	require.NoError(t, err)
+	require.Len(t, backups, 1)
+	assert.Equal(t, "failed", backups[0].Status)
+
+	_, err = manager.CreateBackup(ctx, BackupOptions{VMName: vmName, Hot: true, Compress: true, Target: target, Resume: backups[0].ID})
+	assert.ErrorContains(t, err, "encrypted backups never match")
+}
+
+func TestCreateBackupResumesInterruptedS3Upload(t *testing.T) {
+	manager := newTestManager(t)
+	vmName := firstVMName(t, manager)
+	fake, target := newFakeS3(t)
+	ctx := context.Background()
+
+	// A killed backup leaves its pending entry and incomplete upload
+	backupID := "backup-" + vmName + "-killed"
+	require.NoError(t, manager.catalog.AddBackup(&storage.BackupEntry{
+		ID:        backupID,
+		VMName:    vmName,
+		Timestamp: time.Now(),
+		Status:    "pending",
+		Metadata:  map[string]string{"target": target.GetLocation()},
+	}))
+	_, err := target.Store(ctx, backupID, iotest.ErrReader(errors.New("killed")))
+	require.Error(t, err)
+	require.Len(t, fake.uploads, 1)
+
+	info, err := manager.CreateBackup(ctx, BackupOptions{VMName: vmName, Hot: true, Compress: true, Target: target, Resume: backupID})
+	require.NoError(t, err)
+	assert.Equal(t, backupID, info.ID)
+	assert.Equal(t, "s3://backups/esxi/"+backupID+".ova", info.Location)
+	assert.Empty(t, fake.uploads)
+	assert.Contains(t, fake.objects, "esxi/"+backupID+".ova")
+
+	// Only interrupted backups can be resumed
+	_, err = manager.CreateBackup(ctx, BackupOptions{VMName: vmName, Hot: true, Compress: true, Target: target, Resume: backupID})
+	assert.ErrorContains(t, err, "cannot be resumed")
+}
+
+func TestS3TargetObjectLock(t *testing.T) {
+	fake, target := newFakeS3(t)
+	ctx := context.Background()
+
+	_, err := target.Store(ctx, "backup-test", bytes.NewReader([]byte("payload")))
+	require.NoError(t, err)
+
+	until := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, target.Lock(ctx, "backup-test", until))
+	assert.Equal(t, "GOVERNANCE", fake.retention["esxi/backup-test.ova"].Mode)
+	assert.True(t, until.Equal(fake.retention["esxi/backup-test.ova"].RetainUntilDate))
+
+	require.NoError(t, target.SetLegalHold(ctx, "backup-test", true))
+	assert.Equal(t, "ON", fake.legalHold["esxi/backup-test.ova"])
+	require.NoError(t, target.SetLegalHold(ctx, "backup-test", false))
+	assert.Equal(t, "OFF", fake.legalHold["esxi/backup-test.ova"])
+
+	_, err = NewS3Target(S3Options{Bucket: "backups", LockMode: "strict"})
+	assert.Error(t, err)
+}
+
+func TestS3TargetDeleteRemovesAllVersions(t *testing.T) {
+	fake, target := newFakeS3(t)
+	fake.versioned = true
+	ctx := context.Background()
+	key := "esxi/backup-test.ova"
+
+	// Two uploads of the backup and a delete that only left a delete marker
+	for i := 0; i < 2; i++ {
+		_, err := target.Store(ctx, "backup-test", bytes.NewReader(testPayload(1024)))
+		require.NoError(t, err)
+	}
+	require.NoError(t, target.core.RemoveObject(ctx, "backups", key, minio.RemoveObjectOptions{}))
+	require.Len(t, fake.versions[key], 3)
+
+	// Retention cannot be lifted, so neither Unlock nor Delete pretend it was
+	fake.retention[key] = fakeRetention{Mode: "COMPLIANCE", RetainUntilDate: time.Now().Add(time.Hour)}
+	assert.ErrorContains(t, target.Unlock(ctx, "backup-test"), "cannot be lifted")
+	assert.Error(t, target.Delete(ctx, "backup-test"))
+	assert.Len(t, fake.versions[key], 3)
+
+	fake.retention[key] = fakeRetention{Mode: "COMPLIANCE", RetainUntilDate: time.Now().Add(-time.Hour)}
+	require.NoError(t, target.Unlock(ctx, "backup-test"))
+	require.NoError(t, target.Delete(ctx, "backup-test"))
+	assert.Empty(t, fake.versions)
+	assert.Empty(t, fake.objects)
+}
+
+func TestParseS3Endpoint(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		host     string
+		secure   bool
+		wantErr  bool
+	}{
+		{"", "s3.amazonaws.com", true, false},
+		{"minio.local:9000", "minio.local:9000", true, false},
+		{"http://minio.local:9000", "minio.local:9000", false, false},
+		{"https://s3.example.com", "s3.example.com", true, false},
+		{"ftp://example.com", "", false, true},
+	}
+
+	for _, tt := range tests {
+		host, secure, err := parseS3Endpoint(tt.endpoint)
+		if tt.wantErr {
+			assert.Error(t, err, tt.endpoint)
+			continue
+		}
+		require.NoError(t, err, tt.endpoint)
+		assert.Equal(t, tt.host, host, tt.endpoint)
+		assert.Equal(t, tt.secure, secure, tt.endpoint)
+	}
+}
@@ -0,0 +1,242 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/pkg/sftp"
+	esxissh "github.com/r11/esxi-commander/pkg/esxi/ssh"
+	"golang.org/x/crypto/ssh"
+)
+
+// resumeChunkSize is how much of an interrupted upload is compared at a time
+const resumeChunkSize = 1 << 20
+
+// SFTPOptions configures an SFTP backup target
+type SFTPOptions struct {
+	Host       string // host or host:port
+	User       string
+	KeyPath    string
+	KnownHosts string // known_hosts file; required unless InsecureHostKey is set
+	Path       string // remote backup directory
+
+	InsecureHostKey bool // accept any host key when KnownHosts is empty
+}
+
+// SFTPTarget stores backups on a remote host over SFTP. Uploads go to a
+// partial file that is renamed into place once complete; an interrupted
+// upload is resumed from the first byte that differs from the new stream.
+type SFTPTarget struct {
+	host   string
+	path   string
+	config *ssh.ClientConfig
+}
+
+// sftpSession is one SSH connection with an SFTP client on top
+type sftpSession struct {
+	*sftp.Client
+	conn *esxissh.SSHClient
+}
+
+func (s *sftpSession) Close() error {
+	s.Client.Close()
+	return s.conn.Close()
+}
+
+// NewSFTPTarget creates an SFTP target using key authentication. The key and
+// known hosts are loaded up front; connections are made per operation.
+func NewSFTPTarget(opts SFTPOptions) (*SFTPTarget, error) {
+	if opts.Host == "" || opts.User == "" || opts.Path == "" {
+		return nil, fmt.Errorf("SFTP target requires host, user and path")
+	}
+	if opts.KeyPath == "" {
+		return nil, fmt.Errorf("SFTP target requires a private key")
+	}
+	if opts.KnownHosts == "" && !opts.InsecureHostKey {
+		return nil, fmt.Errorf("SFTP target requires a known_hosts file to verify %s, or insecure_host_key to accept any host key", opts.Host)
+	}
+
+	auth, err := esxissh.PublicKeyAuth(opts.KeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	hostKeyCallback, err := esxissh.HostKeyCallback(opts.KnownHosts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SFTPTarget{
+		host: opts.Host,
+		path: path.Clean(opts.Path),
+		config: &ssh.ClientConfig{
+			User:            opts.User,
+			Auth:            []ssh.AuthMethod{auth},
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         10 * time.Second,
+		},
+	}, nil
+}
+
+// Store uploads the backup to a partial file, resuming an earlier
+// interrupted upload where its content matches, and renames it into place
+func (t *SFTPTarget) Store(ctx context.Context, backupID string, reader io.Reader) (string, error) {
+	session, err := t.connect()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+
+	if err := session.MkdirAll(t.path); err != nil {
+		return "", fmt.Errorf("failed to create backup directory: %w", err)
+	}
+
+	partialPath := t.partialPath(backupID)
+	file, err := session.OpenFile(partialPath, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %w", partialPath, err)
+	}
+	defer file.Close()
+
+	stream := &contextReader{ctx: ctx, r: reader}
+	offset, pending, err := resumeOffset(file, stream)
+	if err != nil {
+		return "", fmt.Errorf("failed to resume upload: %w", err)
+	}
+
+	if err := file.Truncate(offset); err != nil {
+		return "", fmt.Errorf("failed to truncate %s: %w", partialPath, err)
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return "", fmt.Errorf("failed to seek %s: %w", partialPath, err)
+	}
+
+	if _, err := io.Copy(file, io.MultiReader(bytes.NewReader(pending), stream)); err != nil {
+		return "", fmt.Errorf("failed to upload backup to %s: %w", partialPath, err)
+	}
+	if err := file.Close(); err != nil {
+		return "", fmt.Errorf("failed to close %s: %w", partialPath, err)
+	}
+
+	finalPath := t.filePath(backupID)
+	if err := session.PosixRename(partialPath, finalPath); err != nil {
+		return "", fmt.Errorf("failed to rename backup into place: %w", err)
+	}
+
+	return fmt.Sprintf("sftp://%s@%s%s", t.config.User, t.host, finalPath), nil
+}
+
+// Retrieve opens the remote backup file; closing it closes the connection
+func (t *SFTPTarget) Retrieve(ctx context.Context, backupID string) (io.ReadCloser, error) {
+	session, err := t.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := session.Open(t.filePath(backupID))
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("failed to open backup: %w", err)
+	}
+
+	return &sftpReader{File: file, session: session}, nil
+}
+
+func (t *SFTPTarget) resumesUploads() {}
+
+// Delete removes the backup and any partial upload of it
+func (t *SFTPTarget) Delete(ctx context.Context, backupID string) error {
+	session, err := t.connect()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	for _, p := range []string{t.filePath(backupID), t.partialPath(backupID)} {
+		if err := session.Remove(p); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete %s: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// GetLocation returns the base location of the target
+func (t *SFTPTarget) GetLocation() string {
+	return fmt.Sprintf("sftp://%s@%s%s", t.config.User, t.host, t.path)
+}
+
+func (t *SFTPTarget) connect() (*sftpSession, error) {
+	conn, err := esxissh.Dial(t.host, t.config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", t.host, err)
+	}
+
+	client, err := sftp.NewClient(conn.Client())
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to start SFTP session: %w", err)
+	}
+
+	return &sftpSession{Client: client, conn: conn}, nil
+}
+
+func (t *SFTPTarget) filePath(backupID string) string {
+	return path.Join(t.path, backupID+".ova")
+}
+
+func (t *SFTPTarget) partialPath(backupID string) string {
+	return path.Join(t.path, "."+backupID+".ova.partial")
+}
+
+// sftpReader closes the SFTP session together with the file
+type sftpReader struct {
+	*sftp.File
+	session *sftpSession
+}
+
+func (r *sftpReader) Close() error {
+	r.File.Close()
+	return r.session.Close()
+}
+
+// resumeOffset compares an existing partial upload with the start of the
+// stream. It returns the length of the matching prefix, which need not be
+// uploaded again, and any bytes read from the stream beyond that point.
+func resumeOffset(partial io.ReaderAt, stream io.Reader) (int64, []byte, error) {
+	var offset int64
+	streamBuf := make([]byte, resumeChunkSize)
+	partialBuf := make([]byte, resumeChunkSize)
+
+	for {
+		n, err := io.ReadFull(stream, streamBuf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, nil, err
+		}
+		if n == 0 {
+			return offset, nil, nil
+		}
+
+		m, readErr := partial.ReadAt(partialBuf[:n], offset)
+		if readErr != nil && readErr != io.EOF {
+			return 0, nil, readErr
+		}
+
+		same := 0
+		for same < m && partialBuf[same] == streamBuf[same] {
+			same++
+		}
+		offset += int64(same)
+
+		if same < n {
+			return offset, append([]byte(nil), streamBuf[same:n]...), nil
+		}
+		if err != nil {
+			return offset, nil, nil
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// newSFTPServer starts an in-process SSH server with the SFTP subsystem that
+// accepts a single generated client key, and returns its address, the path
+// of that key and the path of a known_hosts file holding its host key
+func newSFTPServer(t *testing.T) (string, string, string) {
+	t.Helper()
+
+	_, hostPriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	hostSigner, err := ssh.NewSignerFromKey(hostPriv)
+	require.NoError(t, err)
+
+	clientPub, clientPriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	authorized, err := ssh.NewPublicKey(clientPub)
+	require.NoError(t, err)
+
+	block, err := ssh.MarshalPrivateKey(clientPriv, "")
+	require.NoError(t, err)
+	keyPath := filepath.Join(t.TempDir(), "id_ed25519")
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(block), 0600))
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unauthorized key")
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSFTP(conn, config)
+		}
+	}()
+
+	addr := listener.Addr().String()
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{addr}, hostSigner.PublicKey())
+	require.NoError(t, os.WriteFile(knownHosts, []byte(line+"\n"), 0600))
+
+	return addr, keyPath, knownHosts
+}
+
+func serveSFTP(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					server, err := sftp.NewServer(channel)
+					if err == nil {
+						server.Serve()
+					}
+					channel.Close()
+				}
+			}
+		}()
+	}
+}
+
+func newTestSFTPTarget(t *testing.T) (*SFTPTarget, string) {
+	t.Helper()
+
+	addr, keyPath, knownHosts := newSFTPServer(t)
+	dir := filepath.Join(t.TempDir(), "backups")
+
+	target, err := NewSFTPTarget(SFTPOptions{
+		Host:       addr,
+		User:       "backup",
+		KeyPath:    keyPath,
+		KnownHosts: knownHosts,
+		Path:       dir,
+	})
+	require.NoError(t, err)
+
+	return target, dir
+}
+
+func TestSFTPTargetRoundTrip(t *testing.T) {
+	target, dir := newTestSFTPTarget(t)
+	ctx := context.Background()
+	payload := testPayload(3*resumeChunkSize + 17)
+
+	location, err := target.Store(ctx, "backup-test", bytes.NewReader(payload))
+	require.NoError(t, err)
+	assert.Equal(t, "sftp://backup@"+target.host+filepath.Join(dir, "backup-test.ova"), location)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "only the final file should remain")
+
+	reader, err := target.Retrieve(ctx, "backup-test")
+	require.NoError(t, err)
+	data, err := io.ReadAll(reader)
+	require.NoError(t, reader.Close())
+	require.NoError(t, err)
+	assert.Equal(t, payload, data)
+
+	require.NoError(t, target.Delete(ctx, "backup-test"))
+	_, err = target.Retrieve(ctx, "backup-test")
+	assert.Error(t, err)
+}
+
+func TestSFTPTargetResumesInterruptedUpload(t *testing.T) {
+	target, dir := newTestSFTPTarget(t)
+	ctx := context.Background()
+	payload := testPayload(3*resumeChunkSize + 17)
+
+	broken := io.MultiReader(
+		bytes.NewReader(payload[:2*resumeChunkSize]),
+		iotest.ErrReader(errors.New("export failed")),
+	)
+	_, err := target.Store(ctx, "backup-test", broken)
+	require.Error(t, err)
+
+	partial, err := os.ReadFile(filepath.Join(dir, ".backup-test.ova.partial"))
+	require.NoError(t, err)
+	assert.Equal(t, payload[:2*resumeChunkSize], partial)
+	_, err = os.Stat(filepath.Join(dir, "backup-test.ova"))
+	assert.True(t, os.IsNotExist(err), "no final file after a failed upload")
+
+	// Corrupt the partial upload so the resume has to rewrite its tail
+	partial[resumeChunkSize+5] ^= 0xff
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".backup-test.ova.partial"), partial, 0644))
+
+	_, err = target.Store(ctx, "backup-test", bytes.NewReader(payload))
+	require.NoError(t, err)
+
+	stored, err := os.ReadFile(filepath.Join(dir, "backup-test.ova"))
+	require.NoError(t, err)
+	assert.Equal(t, payload, stored)
+	_, err = os.Stat(filepath.Join(dir, ".backup-test.ova.partial"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestResumeOffset(t *testing.T) {
+	stream := testPayload(2*resumeChunkSize + 100)
+
+	tests := []struct {
+		name    string
+		partial []byte
+		offset  int64
+	}{
+		{"no partial", nil, 0},
+		{"matching prefix", stream[:resumeChunkSize+10], resumeChunkSize + 10},
+		{"complete", stream, int64(len(stream))},
+		{"longer than stream", append(append([]byte(nil), stream...), 1, 2, 3), int64(len(stream))},
+		{"diverging", append(append([]byte(nil), stream[:50]...), ^stream[50]), 50},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			offset, pending, err := resumeOffset(bytes.NewReader(tt.partial), bytes.NewReader(stream))
+			require.NoError(t, err)
+			assert.Equal(t, tt.offset, offset)
+
+			// pending must hold exactly the stream bytes read past the offset
+			assert.True(t, bytes.Equal(stream[offset:offset+int64(len(pending))], pending))
+		})
+	}
+}
+
+func TestNewSFTPTargetRequiresKey(t *testing.T) {
+	_, err := NewSFTPTarget(SFTPOptions{Host: "backup.example.com", User: "backup", Path: "/srv/backups"})
+	assert.Error(t, err)
+}
+
+func TestNewSFTPTargetRequiresKnownHosts(t *testing.T) {
+	addr, keyPath, _ := newSFTPServer(t)
+	opts := SFTPOptions{Host: addr, User: "backup", KeyPath: keyPath, Path: "/srv/backups"}
+
+	_, err := NewSFTPTarget(opts)
+	assert.ErrorContains(t, err, "requires a known_hosts file")
+
+	opts.InsecureHostKey = true
+	_, err = NewSFTPTarget(opts)
+	assert.NoError(t, err)
+}
+
+func TestSFTPTargetRejectsUnknownHostKey(t *testing.T) {
+	addr, keyPath, _ := newSFTPServer(t)
+	_, _, otherHosts := newSFTPServer(t)
+
+	// known_hosts lists another server's key for this address
+	data, err := os.ReadFile(otherHosts)
+	require.NoError(t, err)
+	_, _, otherKey, _, _, err := ssh.ParseKnownHosts(data)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(otherHosts, []byte(knownhosts.Line([]string{addr}, otherKey)+"\n"), 0600))
+
+	target, err := NewSFTPTarget(SFTPOptions{Host: addr, User: "backup", KeyPath: keyPath, KnownHosts: otherHosts, Path: t.TempDir()})
+	require.NoError(t, err)
+
+	_, err = target.Store(context.Background(), "backup-test", bytes.NewReader([]byte("payload")))
+	assert.ErrorContains(t, err, "key mismatch")
+}
+
+// brokenStoreTarget cuts the backup stream off after limit bytes, like an
+// export that fails half-way
+type brokenStoreTarget struct {
+	*SFTPTarget
+	limit int64
+}
+
+func (t *brokenStoreTarget) Store(ctx context.Context, backupID string, reader io.Reader) (string, error) {
+	broken := io.MultiReader(io.LimitReader(reader, t.limit), iotest.ErrReader(errors.New("export failed")))
+	return t.SFTPTarget.Store(ctx, backupID, broken)
+}
+
+func TestCreateBackupKeepsSFTPPartial(t *testing.T) {
+	c, _ := newSimulatorClient(t)
+	sftpTarget, dir := newTestSFTPTarget(t)
+	tempDir := t.TempDir()
+	manager, err := NewBackupManagerWithConfig(c, &Config{
+		CatalogPath: filepath.Join(tempDir, "catalog.db"),
+		TempDir:     tempDir,
+		ResolveTarget: func(location string) (BackupTarget, error) {
+			return sftpTarget, nil
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { manager.Close() })
+	vmName := firstVMName(t, manager)
+	target := &brokenStoreTarget{SFTPTarget: sftpTarget, limit: 4096}
+	ctx := context.Background()
+
+	_, err = manager.CreateBackup(ctx, BackupOptions{VMName: vmName, Hot: true, Compress: true, Target: target})
+	require.ErrorContains(t, err, "export failed")
+
+	backups, err := manager.catalog.ListBackups(vmName)
+	require.NoError(t, err)
+	require.Len(t, backups, 1)
+	assert.Equal(t, "interrupted", backups[0].Status)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "the partial upload is kept for --resume")
+
+	// Deleting the interrupted backup removes it
+	require.NoError(t, manager.DeleteBackup(ctx, backups[0].ID))
+	entries, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
@@ -0,0 +1,115 @@
+package backup
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/r11/esxi-commander/pkg/esxi/client"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// ovfManager extends the simulator's OvfManager with CreateDescriptor,
+// which vcsim does not implement
+type ovfManager struct {
+	*simulator.OvfManager
+}
+
+func (m *ovfManager) CreateDescriptor(ctx *simulator.Context, req *types.CreateDescriptor) soap.HasFault {
+	var refs, disks, items strings.Builder
+	for i, f := range req.Cdp.OvfFiles {
+		chunkSize := ""
+		if f.ChunkSize > 0 {
+			chunkSize = fmt.Sprintf(` ovf:chunkSize="%d"`, f.ChunkSize)
+		}
+		fmt.Fprintf(&refs, `<File ovf:href="%s" ovf:id="file%d" ovf:size="%d"%s/>`, f.Path, i, f.Size, chunkSize)
+		fmt.Fprintf(&disks, `<Disk ovf:capacity="1" ovf:capacityAllocationUnits="byte * 2^20" ovf:diskId="vmdisk%d" ovf:fileRef="file%d" ovf:format="http://www.vmware.com/interfaces/specifications/vmdk.html#streamOptimized"/>`, i, i)
+		fmt.Fprintf(&items, `<Item><rasd:AddressOnParent>%d</rasd:AddressOnParent><rasd:ElementName>disk%d</rasd:ElementName><rasd:HostResource>ovf:/disk/vmdisk%d</rasd:HostResource><rasd:InstanceID>%d</rasd:InstanceID><rasd:Parent>1</rasd:Parent><rasd:ResourceType>17</rasd:ResourceType></Item>`, i, i, i, i+10)
+	}
+
+	descriptor := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<Envelope xmlns="http://schemas.dmtf.org/ovf/envelope/1" xmlns:ovf="http://schemas.dmtf.org/ovf/envelope/1" xmlns:rasd="http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_ResourceAllocationSettingData" xmlns:vssd="http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_VirtualSystemSettingData">
+<References>%s</References>
+<DiskSection><Info>Virtual disks</Info>%s</DiskSection>
+<VirtualSystem ovf:id="%s">
+<Info>A virtual machine</Info>
+<Name>%s</Name>
+<VirtualHardwareSection>
+<Info>Virtual hardware</Info>
+<System><vssd:ElementName>Virtual Hardware Family</vssd:ElementName><vssd:InstanceID>0</vssd:InstanceID><vssd:VirtualSystemType>vmx-13</vssd:VirtualSystemType></System>
+<Item><rasd:ElementName>SCSI controller 0</rasd:ElementName><rasd:InstanceID>1</rasd:InstanceID><rasd:ResourceSubType>lsilogic</rasd:ResourceSubType><rasd:ResourceType>6</rasd:ResourceType></Item>
+<Item><rasd:Connection>VM Network</rasd:Connection><rasd:ElementName>Network adapter 1</rasd:ElementName><rasd:InstanceID>2</rasd:InstanceID><rasd:ResourceSubType>VmxNet3</rasd:ResourceSubType><rasd:ResourceType>10</rasd:ResourceType></Item>
+%s
+</VirtualHardwareSection>
+</VirtualSystem>
+</Envelope>`, refs.String(), disks.String(), req.Cdp.Name, req.Cdp.Name, items.String())
+
+	return &methods.CreateDescriptorBody{
+		Res: &types.CreateDescriptorResponse{
+			Returnval: types.OvfCreateDescriptorResult{OvfDescriptor: descriptor},
+		},
+	}
+}
+
+// newSimulatorClient starts an ESX model vcsim instance and returns a
+// connected client, with CreateDescriptor patched in
+func newSimulatorClient(t *testing.T) (*client.ESXiClient, *simulator.Model) {
+	t.Helper()
+
+	model := simulator.ESX()
+	require.NoError(t, model.Create())
+	model.Service.TLS = new(tls.Config)
+	t.Cleanup(model.Remove)
+
+	ref := model.Service.Context.Map.Get(types.ManagedObjectReference{Type: "OvfManager", Value: "ha-ovf-manager"})
+	model.Service.Context.Map.Put(&ovfManager{ref.(*simulator.OvfManager)})
+
+	server := model.Service.NewServer()
+	t.Cleanup(server.Close)
+
+	password, _ := server.URL.User.Password()
+	c, err := client.NewClient(&client.Config{
+		Host:     server.URL.Host,
+		User:     server.URL.User.Username(),
+		Password: password,
+		Insecure: true,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+
+	return c, model
+}
+
+// newTestManager returns a backup manager backed by vcsim and a temporary catalog
+func newTestManager(t *testing.T) *BackupManager {
+	t.Helper()
+
+	c, _ := newSimulatorClient(t)
+	dir := t.TempDir()
+
+	manager, err := NewBackupManagerWithConfig(c, &Config{
+		CatalogPath: filepath.Join(dir, "catalog.db"),
+		TempDir:     dir,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { manager.Close() })
+
+	return manager
+}
+
+// firstVMName returns the name of a VM from the simulator inventory
+func firstVMName(t *testing.T, m *BackupManager) string {
+	t.Helper()
+
+	vms, err := m.client.ListVMs(context.Background())
+	require.NoError(t, err)
+	require.NotEmpty(t, vms)
+	return vms[0].Name
+}
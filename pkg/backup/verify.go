@@ -0,0 +1,107 @@
+package backup
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/r11/esxi-commander/internal/storage"
+)
+
+// verifyArtifact reads the stored artifact once, checking the full-stream
+// checksum against the catalog and each archived file against the OVA
+// manifest. Counters in result are filled in as the stream is read.
+func (m *BackupManager) verifyArtifact(ctx context.Context, entry *storage.BackupEntry, opts VerifyOptions, result *VerifyResult) error {
+	if entry.Checksum == "" {
+		return fmt.Errorf("backup has no checksum")
+	}
+
+	// Encrypted backups can only be verified with a matching identity
+	identities, err := loadIdentities(entry, opts.IdentityFile)
+	if err != nil {
+		return err
+	}
+
+	target := opts.Target
+	if target == nil {
+		target = NewDatastoreTarget(m.client, "", "backups")
+	}
+
+	rc, err := target.Retrieve(ctx, entry.ID)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve backup: %w", err)
+	}
+	defer rc.Close()
+
+	hasher := sha256.New()
+	counter := &countingWriter{}
+	reader := io.TeeReader(&contextReader{ctx: ctx, r: rc}, io.MultiWriter(hasher, counter))
+
+	digests := make(map[string]string)
+	var manifest map[string]string
+	err = walkArchive(reader, identities, func(header *tar.Header, r io.Reader) error {
+		name := path.Base(header.Name)
+		if path.Ext(name) == ".mf" {
+			data, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			manifest = parseManifest(data)
+			return nil
+		}
+
+		fileHasher := sha256.New()
+		if _, err := io.Copy(fileHasher, r); err != nil {
+			return fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		digests[name] = hex.EncodeToString(fileHasher.Sum(nil))
+		return nil
+	})
+
+	// Drain anything after the tar trailer so the checksum covers every byte
+	if err == nil {
+		_, err = io.Copy(io.Discard, reader)
+	}
+	result.Bytes = counter.n
+	if err != nil {
+		return fmt.Errorf("failed to read backup archive: %w", err)
+	}
+
+	if checksum := hex.EncodeToString(hasher.Sum(nil)); checksum != entry.Checksum {
+		return fmt.Errorf("backup checksum mismatch: catalog has %s, artifact is %s", entry.Checksum, checksum)
+	}
+
+	if manifest == nil {
+		return fmt.Errorf("backup archive has no manifest")
+	}
+
+	names := make([]string, 0, len(manifest))
+	for name := range manifest {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var missing []string
+	for _, name := range names {
+		actual, ok := digests[name]
+		if !ok {
+			missing = append(missing, name)
+			continue
+		}
+		if actual != manifest[name] {
+			return fmt.Errorf("checksum mismatch for %s: manifest has %s, got %s", name, manifest[name], actual)
+		}
+		result.Files++
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("backup archive is missing files: %s", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
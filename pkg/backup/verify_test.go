@@ -0,0 +1,94 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyBackupRecordsResult(t *testing.T) {
+	manager := newTestManager(t)
+	vmName := firstVMName(t, manager)
+	target := newMemoryTarget()
+	ctx := context.Background()
+
+	info, err := manager.CreateBackup(ctx, BackupOptions{
+		VMName:   vmName,
+		Hot:      true,
+		Compress: true,
+		Target:   target,
+	})
+	require.NoError(t, err)
+
+	result, err := manager.VerifyBackup(ctx, VerifyOptions{BackupID: info.ID, Target: target})
+	require.NoError(t, err)
+	assert.True(t, result.Passed)
+	assert.Equal(t, int64(len(target.data[info.ID])), result.Bytes)
+	assert.Greater(t, result.Files, 1, "descriptor and disks are checked against the manifest")
+
+	entry, err := manager.catalog.GetBackup(info.ID)
+	require.NoError(t, err)
+	require.NotNil(t, entry.LastVerified)
+	assert.Equal(t, "passed", entry.VerifyStatus)
+	assert.Empty(t, entry.VerifyError)
+
+	// A corrupted artifact fails and the failure is recorded
+	data := target.data[info.ID]
+	data[len(data)-1] ^= 0xff
+
+	result, err = manager.VerifyBackup(ctx, VerifyOptions{BackupID: info.ID, Target: target})
+	require.Error(t, err)
+	assert.False(t, result.Passed)
+
+	entry, err = manager.catalog.GetBackup(info.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "failed", entry.VerifyStatus)
+	assert.NotEmpty(t, entry.VerifyError)
+}
+
+func TestVerifyBackupChecksManifestDigests(t *testing.T) {
+	manager := newTestManager(t)
+	vmName := firstVMName(t, manager)
+	target := newMemoryTarget()
+	ctx := context.Background()
+
+	info, err := manager.CreateBackup(ctx, BackupOptions{
+		VMName:   vmName,
+		Hot:      true,
+		Compress: true,
+		Target:   target,
+	})
+	require.NoError(t, err)
+
+	// Rewrite a disk inside the archive and update the catalog checksum so
+	// only the per-file digest can catch the change
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, content := range readOVA(t, target.data[info.ID]) {
+		if strings.Contains(name, ".vmdk") {
+			content = append([]byte("tampered"), content...)
+		}
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}))
+		_, err := tw.Write(content)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	target.data[info.ID] = buf.Bytes()
+
+	entry, err := manager.catalog.GetBackup(info.ID)
+	require.NoError(t, err)
+	sum := sha256.Sum256(buf.Bytes())
+	entry.Checksum = hex.EncodeToString(sum[:])
+	require.NoError(t, manager.catalog.AddBackup(entry))
+
+	_, err = manager.VerifyBackup(ctx, VerifyOptions{BackupID: info.ID, Target: target})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "checksum mismatch for")
+}
@@ -0,0 +1,430 @@
+package backup
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// streamOptimized VMDK layout constants (VMware Virtual Disk Format 1.1)
+const (
+	sectorSize      = 512
+	grainSectors    = 128 // 64 KiB grains
+	grainSize       = grainSectors * sectorSize
+	gtEntries       = 512 // grains per grain table
+	vmdkMagic       = 0x564d444b
+	vmdkFlags       = 1 | flagCompressed | flagMarkers // valid newline test
+	gdAtEnd         = ^uint64(0)
+	markerEOS       = 0
+	markerGT        = 1
+	markerGD        = 2
+	markerFooter    = 3
+	compressDeflate = 1
+	flagCompressed  = 1 << 16
+	flagMarkers     = 1 << 17
+	grainCacheSize  = 64 // decompressed grains kept by streamReader
+)
+
+// sparseExtentHeader is the on-disk header of a sparse VMDK extent
+type sparseExtentHeader struct {
+	MagicNumber        uint32
+	Version            uint32
+	Flags              uint32
+	Capacity           uint64
+	GrainSize          uint64
+	DescriptorOffset   uint64
+	DescriptorSize     uint64
+	NumGTEsPerGT       uint32
+	RgdOffset          uint64
+	GdOffset           uint64
+	OverHead           uint64
+	UncleanShutdown    uint8
+	SingleEndLineChar  byte
+	NonEndLineChar     byte
+	DoubleEndLineChar1 byte
+	DoubleEndLineChar2 byte
+	CompressAlgorithm  uint16
+	Pad                [433]byte
+}
+
+// extent is a byte range of a disk
+type extent struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// mergeExtents sorts extents and joins overlapping or adjacent ones
+func mergeExtents(extents []extent) []extent {
+	sorted := append([]extent(nil), extents...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Offset < sorted[j].Offset })
+
+	var merged []extent
+	for _, e := range sorted {
+		if e.Length <= 0 {
+			continue
+		}
+		if n := len(merged); n > 0 && e.Offset <= merged[n-1].Offset+merged[n-1].Length {
+			if end := e.Offset + e.Length; end > merged[n-1].Offset+merged[n-1].Length {
+				merged[n-1].Length = end - merged[n-1].Offset
+			}
+			continue
+		}
+		merged = append(merged, e)
+	}
+	return merged
+}
+
+// sectorWriter tracks the sector position of a VMDK being streamed
+type sectorWriter struct {
+	w   io.Writer
+	pos int64 // bytes written
+}
+
+func (s *sectorWriter) Write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	s.pos += int64(n)
+	return n, err
+}
+
+func (s *sectorWriter) sector() uint64 {
+	return uint64(s.pos / sectorSize)
+}
+
+// pad fills the current sector with zeros
+func (s *sectorWriter) pad() error {
+	if rem := s.pos % sectorSize; rem != 0 {
+		_, err := s.Write(make([]byte, sectorSize-rem))
+		return err
+	}
+	return nil
+}
+
+// writeMarker writes a metadata marker sector
+func (s *sectorWriter) writeMarker(sectors uint64, kind uint32) error {
+	marker := make([]byte, sectorSize)
+	binary.LittleEndian.PutUint64(marker[0:], sectors)
+	binary.LittleEndian.PutUint32(marker[12:], kind)
+	_, err := s.Write(marker)
+	return err
+}
+
+// writeStreamOptimized encodes a raw disk image as a streamOptimized VMDK,
+// the format NFC import leases accept. Only grains overlapping the given
+// data extents are read from disk; everything else is left sparse.
+func writeStreamOptimized(w io.Writer, name string, capacity int64, disk io.ReaderAt, data []extent) error {
+	capacitySectors := uint64((capacity + sectorSize - 1) / sectorSize)
+	numGrains := (capacitySectors + grainSectors - 1) / grainSectors
+	numGTs := (numGrains + gtEntries - 1) / gtEntries
+
+	descriptor := vmdkDescriptor(name, capacitySectors)
+	descriptorSectors := uint64((len(descriptor) + sectorSize - 1) / sectorSize)
+
+	header := sparseExtentHeader{
+		MagicNumber:        vmdkMagic,
+		Version:            3,
+		Flags:              vmdkFlags,
+		Capacity:           capacitySectors,
+		GrainSize:          grainSectors,
+		DescriptorOffset:   1,
+		DescriptorSize:     descriptorSectors,
+		NumGTEsPerGT:       gtEntries,
+		GdOffset:           gdAtEnd,
+		OverHead:           1 + descriptorSectors,
+		SingleEndLineChar:  '\n',
+		NonEndLineChar:     ' ',
+		DoubleEndLineChar1: '\r',
+		DoubleEndLineChar2: '\n',
+		CompressAlgorithm:  compressDeflate,
+	}
+
+	sw := &sectorWriter{w: w}
+	if err := binary.Write(sw, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(sw, descriptor); err != nil {
+		return err
+	}
+	if err := sw.pad(); err != nil {
+		return err
+	}
+
+	grains := grainsWithData(mergeExtents(data))
+	buf := make([]byte, grainSize)
+	gd := make([]uint32, numGTs)
+
+	for gt := uint64(0); gt < numGTs; gt++ {
+		table := make([]uint32, gtEntries)
+
+		for len(grains) > 0 && grains[0]/gtEntries == gt {
+			grain := grains[0]
+			grains = grains[1:]
+
+			offset := int64(grain) * grainSize
+			length := int64(grainSize)
+			if offset+length > capacity {
+				length = capacity - offset
+			}
+			n, err := disk.ReadAt(buf[:length], offset)
+			if err != nil && err != io.EOF {
+				return fmt.Errorf("failed to read disk at %d: %w", offset, err)
+			}
+			clear(buf[n:length])
+			if isZero(buf[:length]) {
+				continue
+			}
+
+			table[grain%gtEntries] = uint32(sw.sector())
+			if err := writeGrain(sw, grain*grainSectors, buf[:length]); err != nil {
+				return err
+			}
+		}
+
+		if err := sw.writeMarker(gtEntries*4/sectorSize, markerGT); err != nil {
+			return err
+		}
+		gd[gt] = uint32(sw.sector())
+		if err := binary.Write(sw, binary.LittleEndian, table); err != nil {
+			return err
+		}
+	}
+
+	gdSectors := (numGTs*4 + sectorSize - 1) / sectorSize
+	if err := sw.writeMarker(gdSectors, markerGD); err != nil {
+		return err
+	}
+	header.GdOffset = sw.sector()
+	if err := binary.Write(sw, binary.LittleEndian, gd); err != nil {
+		return err
+	}
+	if err := sw.pad(); err != nil {
+		return err
+	}
+
+	if err := sw.writeMarker(1, markerFooter); err != nil {
+		return err
+	}
+	if err := binary.Write(sw, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	return sw.writeMarker(0, markerEOS)
+}
+
+// writeGrain writes a grain marker followed by the compressed grain data
+func writeGrain(sw *sectorWriter, lba uint64, data []byte) error {
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	if _, err := zw.Write(data); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	marker := make([]byte, 12)
+	binary.LittleEndian.PutUint64(marker[0:], lba)
+	binary.LittleEndian.PutUint32(marker[8:], uint32(compressed.Len()))
+	if _, err := sw.Write(marker); err != nil {
+		return err
+	}
+	if _, err := sw.Write(compressed.Bytes()); err != nil {
+		return err
+	}
+	return sw.pad()
+}
+
+// grainsWithData returns the grain numbers overlapping the extents in order
+func grainsWithData(extents []extent) []uint64 {
+	var grains []uint64
+	for _, e := range extents {
+		first := uint64(e.Offset / grainSize)
+		last := uint64((e.Offset + e.Length - 1) / grainSize)
+		for g := first; g <= last; g++ {
+			if n := len(grains); n == 0 || grains[n-1] < g {
+				grains = append(grains, g)
+			}
+		}
+	}
+	return grains
+}
+
+func vmdkDescriptor(name string, capacitySectors uint64) string {
+	cylinders := capacitySectors / (255 * 63)
+	if cylinders > 65535 {
+		cylinders = 65535
+	}
+
+	return fmt.Sprintf(`# Disk DescriptorFile
+version=1
+CID=fffffffe
+parentCID=ffffffff
+createType="streamOptimized"
+
+# Extent description
+RW %d SPARSE "%s"
+
+# The Disk Data Base
+#DDB
+
+ddb.adapterType = "lsilogic"
+ddb.geometry.cylinders = "%d"
+ddb.geometry.heads = "255"
+ddb.geometry.sectors = "63"
+ddb.virtualHWVersion = "4"
+`, capacitySectors, name, cylinders)
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// streamReader reads a streamOptimized VMDK as the raw disk it holds.
+// Grains are found by scanning the markers once, so neither the footer nor
+// the grain directory is needed.
+type streamReader struct {
+	file       io.ReaderAt
+	capacity   int64
+	grainBytes int64
+	grains     []int64 // file offset of each grain's marker, 0 if unallocated
+
+	mu    sync.Mutex
+	cache map[int64][]byte
+	order []int64
+}
+
+// openStreamOptimized indexes the grains of a streamOptimized VMDK of
+// size bytes
+func openStreamOptimized(file io.ReaderAt, size int64) (*streamReader, error) {
+	var header sparseExtentHeader
+	if err := binary.Read(io.NewSectionReader(file, 0, sectorSize), binary.LittleEndian, &header); err != nil {
+		return nil, fmt.Errorf("failed to read VMDK header: %w", err)
+	}
+	if header.MagicNumber != vmdkMagic {
+		return nil, fmt.Errorf("not a sparse VMDK")
+	}
+	if header.Flags&flagCompressed == 0 || header.Flags&flagMarkers == 0 || header.CompressAlgorithm != compressDeflate {
+		return nil, fmt.Errorf("not a streamOptimized VMDK")
+	}
+	if header.GrainSize == 0 || header.GrainSize > 2048 {
+		return nil, fmt.Errorf("invalid VMDK grain size of %d sectors", header.GrainSize)
+	}
+
+	r := &streamReader{
+		file:       file,
+		capacity:   int64(header.Capacity) * sectorSize,
+		grainBytes: int64(header.GrainSize) * sectorSize,
+		cache:      make(map[int64][]byte),
+	}
+	r.grains = make([]int64, (r.capacity+r.grainBytes-1)/r.grainBytes)
+
+	marker := make([]byte, 16)
+	for pos := int64(header.OverHead) * sectorSize; pos+int64(len(marker)) <= size; {
+		if _, err := file.ReadAt(marker, pos); err != nil {
+			return nil, fmt.Errorf("failed to read VMDK marker at %d: %w", pos, err)
+		}
+		value := binary.LittleEndian.Uint64(marker[0:])
+
+		// A grain marker holds its LBA and compressed size; metadata
+		// markers have a zero size and are followed by value sectors
+		if length := int64(binary.LittleEndian.Uint32(marker[8:])); length != 0 {
+			grain := value / header.GrainSize
+			if value%header.GrainSize != 0 || grain >= uint64(len(r.grains)) {
+				return nil, fmt.Errorf("invalid VMDK grain at sector %d", value)
+			}
+			r.grains[grain] = pos
+			pos += (12 + length + sectorSize - 1) / sectorSize * sectorSize
+			continue
+		}
+
+		switch kind := binary.LittleEndian.Uint32(marker[12:]); kind {
+		case markerEOS:
+			return r, nil
+		case markerGT, markerGD, markerFooter:
+			pos += (1 + int64(value)) * sectorSize
+		default:
+			return nil, fmt.Errorf("unknown VMDK marker %d at %d", kind, pos)
+		}
+	}
+	return nil, fmt.Errorf("VMDK is truncated: no end-of-stream marker")
+}
+
+// Size returns the capacity of the disk
+func (r *streamReader) Size() int64 {
+	return r.capacity
+}
+
+func (r *streamReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset")
+	}
+
+	n := 0
+	for n < len(p) && off < r.capacity {
+		within := off % r.grainBytes
+		want := min(int64(len(p)-n), r.grainBytes-within, r.capacity-off)
+
+		data, err := r.grain(off / r.grainBytes)
+		if err != nil {
+			return n, err
+		}
+		chunk := p[n : n+int(want)]
+		copied := 0
+		if within < int64(len(data)) {
+			copied = copy(chunk, data[within:])
+		}
+		clear(chunk[copied:])
+
+		n += int(want)
+		off += want
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// grain returns the decompressed data of a grain, or nil if it is not
+// allocated
+func (r *streamReader) grain(index int64) ([]byte, error) {
+	pos := r.grains[index]
+	if pos == 0 {
+		return nil, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if data, ok := r.cache[index]; ok {
+		return data, nil
+	}
+
+	marker := make([]byte, 12)
+	if _, err := r.file.ReadAt(marker, pos); err != nil {
+		return nil, fmt.Errorf("failed to read VMDK grain %d: %w", index, err)
+	}
+	compressed := io.NewSectionReader(r.file, pos+12, int64(binary.LittleEndian.Uint32(marker[8:])))
+	zr, err := zlib.NewReader(compressed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress VMDK grain %d: %w", index, err)
+	}
+	data, err := io.ReadAll(io.LimitReader(zr, r.grainBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress VMDK grain %d: %w", index, err)
+	}
+
+	if len(r.order) == grainCacheSize {
+		delete(r.cache, r.order[0])
+		r.order = r.order[1:]
+	}
+	r.cache[index] = data
+	r.order = append(r.order, index)
+	return data, nil
+}
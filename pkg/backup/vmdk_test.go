@@ -0,0 +1,141 @@
+package backup
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readGrains decodes a streamOptimized VMDK through its footer, grain
+// directory and grain tables and returns the data of each allocated grain
+func readGrains(t *testing.T, data []byte) (sparseExtentHeader, map[uint64][]byte) {
+	t.Helper()
+
+	var header, footer sparseExtentHeader
+	require.NoError(t, binary.Read(bytes.NewReader(data), binary.LittleEndian, &header))
+	require.Equal(t, uint32(vmdkMagic), header.MagicNumber)
+	require.Equal(t, gdAtEnd, header.GdOffset)
+
+	require.NoError(t, binary.Read(bytes.NewReader(data[len(data)-2*sectorSize:]), binary.LittleEndian, &footer))
+	require.Equal(t, uint32(vmdkMagic), footer.MagicNumber)
+
+	numGrains := (header.Capacity + grainSectors - 1) / grainSectors
+	gd := make([]uint32, (numGrains+gtEntries-1)/gtEntries)
+	require.NoError(t, binary.Read(bytes.NewReader(data[footer.GdOffset*sectorSize:]), binary.LittleEndian, gd))
+
+	grains := make(map[uint64][]byte)
+	for i, gtSector := range gd {
+		table := make([]uint32, gtEntries)
+		require.NoError(t, binary.Read(bytes.NewReader(data[int64(gtSector)*sectorSize:]), binary.LittleEndian, table))
+
+		for j, sector := range table {
+			if sector == 0 {
+				continue
+			}
+			grain := data[int64(sector)*sectorSize:]
+			lba := binary.LittleEndian.Uint64(grain[0:])
+			size := binary.LittleEndian.Uint32(grain[8:])
+			index := uint64(i)*gtEntries + uint64(j)
+			require.Equal(t, index*grainSectors, lba)
+
+			zr, err := zlib.NewReader(bytes.NewReader(grain[12 : 12+size]))
+			require.NoError(t, err)
+			grains[index], err = io.ReadAll(zr)
+			require.NoError(t, err)
+		}
+	}
+	return header, grains
+}
+
+func TestWriteStreamOptimizedRoundTrip(t *testing.T) {
+	// Not a multiple of the grain size, with data in the first, a middle and
+	// the partial last grain
+	capacity := int64(5*grainSize + 3*sectorSize)
+	disk := make([]byte, capacity)
+	copy(disk[100:], "first grain")
+	copy(disk[2*grainSize+grainSize/2:], bytes.Repeat([]byte{0xab}, grainSize))
+	copy(disk[capacity-10:], "last grain")
+
+	data := []extent{
+		{Offset: 0, Length: 4096},
+		{Offset: 2*grainSize + grainSize/2, Length: grainSize},
+		{Offset: capacity - 10, Length: 10},
+		{Offset: 4 * grainSize, Length: 100}, // reported but all zero
+	}
+
+	var out bytes.Buffer
+	require.NoError(t, writeStreamOptimized(&out, "disk.vmdk", capacity, bytes.NewReader(disk), data))
+	assert.Zero(t, out.Len()%sectorSize)
+
+	header, grains := readGrains(t, out.Bytes())
+	assert.Equal(t, uint64(capacity/sectorSize), header.Capacity)
+	assert.Contains(t, string(out.Bytes()[sectorSize:]), `createType="streamOptimized"`)
+
+	require.Len(t, grains, 4)
+	for index, grain := range grains {
+		start := int64(index) * grainSize
+		assert.Equal(t, disk[start:start+int64(len(grain))], grain, "grain %d", index)
+	}
+	assert.Len(t, grains[5], 3*sectorSize)
+}
+
+func TestStreamReaderRoundTrip(t *testing.T) {
+	capacity := int64(200*grainSize + 7*sectorSize)
+	disk := make([]byte, capacity)
+	copy(disk[sectorSize:], "near the start")
+	copy(disk[150*grainSize-20:], bytes.Repeat([]byte("spans two grains "), 10))
+	copy(disk[capacity-8:], "the end!")
+	data := []extent{{Offset: 0, Length: capacity}}
+
+	var out bytes.Buffer
+	require.NoError(t, writeStreamOptimized(&out, "disk.vmdk", capacity, bytes.NewReader(disk), data))
+
+	r, err := openStreamOptimized(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	require.NoError(t, err)
+	assert.Equal(t, capacity, r.Size())
+
+	// Whole-disk and unaligned reads, including unallocated grains
+	got, err := io.ReadAll(io.NewSectionReader(r, 0, r.Size()))
+	require.NoError(t, err)
+	assert.Equal(t, disk, got)
+
+	buf := make([]byte, 100)
+	n, err := r.ReadAt(buf, 150*grainSize-50)
+	require.NoError(t, err)
+	assert.Equal(t, disk[150*grainSize-50:150*grainSize+50], buf[:n])
+
+	n, err = r.ReadAt(buf, capacity-8)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, "the end!", string(buf[:n]))
+}
+
+func TestStreamReaderRejects(t *testing.T) {
+	_, err := openStreamOptimized(bytes.NewReader(make([]byte, 4096)), 4096)
+	assert.ErrorContains(t, err, "not a sparse VMDK")
+
+	var out bytes.Buffer
+	disk := make([]byte, grainSize)
+	copy(disk, "data")
+	require.NoError(t, writeStreamOptimized(&out, "disk.vmdk", grainSize, bytes.NewReader(disk), []extent{{Offset: 0, Length: 4}}))
+
+	// Cut off before the end-of-stream marker
+	truncated := out.Bytes()[:out.Len()-sectorSize]
+	_, err = openStreamOptimized(bytes.NewReader(truncated), int64(len(truncated)))
+	assert.ErrorContains(t, err, "truncated")
+}
+
+func TestMergeExtents(t *testing.T) {
+	merged := mergeExtents([]extent{
+		{Offset: 100, Length: 50},
+		{Offset: 0, Length: 10},
+		{Offset: 10, Length: 5},
+		{Offset: 120, Length: 10},
+		{Offset: 200, Length: 0},
+	})
+	assert.Equal(t, []extent{{Offset: 0, Length: 15}, {Offset: 100, Length: 50}}, merged)
+}
@@ -2,8 +2,13 @@ package backup
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"os"
+	"strings"
+	"time"
 
+	"github.com/r11/esxi-commander/internal/storage"
 	"github.com/r11/esxi-commander/pkg/backup"
 	"github.com/r11/esxi-commander/pkg/config"
 	"github.com/r11/esxi-commander/pkg/esxi/client"
@@ -37,6 +42,15 @@ func init() {
 		NewDeleteCommand(),
 		NewVerifyCommand(),
 		NewPruneCommand(),
+		NewConsolidateCommand(),
+		NewRepoCommand(),
+		NewHistoryCommand(),
+		NewRecoverCommand(),
+		NewReplicateCommand(),
+		NewHoldCommand(),
+		NewDrillCommand(),
+		NewBrowseCommand(),
+		NewExtractCommand(),
 	)
 }
 
@@ -45,24 +59,53 @@ func NewDeleteCommand() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "delete <backup-id>",
 		Short: "Delete a backup",
-		Long:  `Delete a backup from storage and remove it from the catalog.`,
-		Args:  cobra.ExactArgs(1),
-		RunE:  runDelete,
+		Long: `Delete a backup from storage and remove it from the catalog.
+
+The artifact is removed from the target recorded in the backup's location
+first; the catalog entry is only removed once that succeeds. An interrupted
+delete leaves the entry marked "deleting" and is finished by running delete
+or prune again.`,
+		Args: cobra.ExactArgs(1),
+		RunE: runDelete,
 	}
 
 	return cmd
 }
 
+var verifyFlags struct {
+	identity string
+	all      bool
+	since    string
+	json     bool
+}
+
 // NewVerifyCommand creates the backup verify command
 func NewVerifyCommand() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "verify <backup-id>",
+		Use:   "verify [backup-id]",
 		Short: "Verify backup integrity",
-		Long:  `Verify the integrity of a backup by checking its checksum.`,
-		Args:  cobra.ExactArgs(1),
-		RunE:  runVerify,
+		Long: `Verify the integrity of a backup end to end.
+
+The backup is streamed back from its target, its SHA-256 is recomputed and
+compared with the catalog, and every file inside the OVA is checked against
+the OVA manifest. The result and time of the check are recorded in the
+catalog.
+
+Use --all to verify every completed backup, optionally limited with --since
+to backups created within a duration (e.g. 24h) or after a date
+(YYYY-MM-DD). --json prints a report of all results.
+
+Encrypted backups require the age identity file matching one of the
+recipients the backup was encrypted to.`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: runVerify,
 	}
 
+	cmd.Flags().StringVar(&verifyFlags.identity, "identity", "", "age identity file for encrypted backups (default: backup.encryption.identity_file)")
+	cmd.Flags().BoolVar(&verifyFlags.all, "all", false, "Verify all completed backups")
+	cmd.Flags().StringVar(&verifyFlags.since, "since", "", "With --all, only verify backups created within a duration (24h) or after a date (2006-01-02)")
+	cmd.Flags().BoolVar(&verifyFlags.json, "json", false, "Output a JSON report")
+
 	return cmd
 }
 
@@ -96,7 +139,10 @@ func runDelete(cmd *cobra.Command, args []string) error {
 	}
 
 	// Create backup manager
-	backupManager, err := backup.NewBackupManager(esxiClient, catalogPath)
+	backupManager, err := backup.NewBackupManagerWithConfig(esxiClient, &backup.Config{
+		CatalogPath:   catalogPath,
+		ResolveTarget: LocationResolver(cfg, esxiClient),
+	})
 	if err != nil {
 		return fmt.Errorf("failed to create backup manager: %w", err)
 	}
@@ -115,7 +161,21 @@ func runDelete(cmd *cobra.Command, args []string) error {
 }
 
 func runVerify(cmd *cobra.Command, args []string) error {
-	backupID := args[0]
+	if verifyFlags.all == (len(args) == 1) {
+		return fmt.Errorf("specify either a backup ID or --all")
+	}
+	if verifyFlags.since != "" && !verifyFlags.all {
+		return fmt.Errorf("--since requires --all")
+	}
+
+	var since time.Time
+	if verifyFlags.since != "" {
+		var err error
+		since, err = parseSince(verifyFlags.since, time.Now())
+		if err != nil {
+			return err
+		}
+	}
 
 	// Load configuration
 	cfg, err := config.Load("")
@@ -123,19 +183,10 @@ func runVerify(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("failed to load config: %w", err)
 	}
 
-	// Create ESXi client
-	clientConfig := &client.Config{
-		Host:     cfg.ESXi.Host,
-		User:     cfg.ESXi.User,
-		Password: cfg.ESXi.Password,
-		Insecure: cfg.ESXi.Insecure,
-	}
-
-	esxiClient, err := client.NewClient(clientConfig)
-	if err != nil {
-		return fmt.Errorf("failed to create ESXi client: %w", err)
-	}
-	defer esxiClient.Close()
+	// Targets are resolved lazily: ESXi is only contacted for backups
+	// stored on a datastore
+	resolve, closeResolver := offlineResolver(cfg)
+	defer closeResolver()
 
 	// Get catalog path from config
 	catalogPath := cfg.Backup.CatalogPath
@@ -144,61 +195,221 @@ func runVerify(cmd *cobra.Command, args []string) error {
 	}
 
 	// Create backup manager
-	backupManager, err := backup.NewBackupManager(esxiClient, catalogPath)
+	backupManager, err := backup.NewBackupManagerWithConfig(nil, &backup.Config{
+		CatalogPath:   catalogPath,
+		ResolveTarget: resolve,
+	})
 	if err != nil {
 		return fmt.Errorf("failed to create backup manager: %w", err)
 	}
 	defer backupManager.Close()
 
-	// Verify the backup
+	// Collect the backups to verify
+	var backups []*backup.BackupInfo
+	if verifyFlags.all {
+		all, err := backupManager.ListBackups("")
+		if err != nil {
+			return fmt.Errorf("failed to list backups: %w", err)
+		}
+		for _, info := range all {
+			if info.Status == "completed" && !info.Created.Before(since) {
+				backups = append(backups, info)
+			}
+		}
+	} else {
+		info, err := backupManager.GetBackup(args[0])
+		if err != nil {
+			return err
+		}
+		backups = append(backups, info)
+	}
+
+	// Verify the backups
 	ctx := context.Background()
-	fmt.Printf("Verifying backup '%s'...\n", backupID)
-	
-	if err := backupManager.VerifyBackup(ctx, backupID); err != nil {
-		return fmt.Errorf("backup verification failed: %w", err)
+	results := make([]*backup.VerifyResult, 0, len(backups))
+	failed := 0
+	for _, info := range backups {
+		if !verifyFlags.json {
+			fmt.Printf("Verifying backup '%s'...\n", info.ID)
+		}
+
+		result, err := verifyOne(ctx, backupManager, info, cfg, resolve)
+		results = append(results, result)
+		if err != nil {
+			failed++
+			if !verifyFlags.json {
+				fmt.Printf("  FAILED: %v\n", err)
+			}
+			continue
+		}
+		if !verifyFlags.json {
+			fmt.Printf("  OK: %d files, %.2f MB\n", result.Files, float64(result.Bytes)/(1024*1024))
+		}
 	}
 
-	fmt.Printf("Backup '%s' verified successfully\n", backupID)
+	if verifyFlags.json {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(results); err != nil {
+			return fmt.Errorf("failed to encode JSON: %w", err)
+		}
+	} else {
+		fmt.Printf("\nVerified %d backups: %d passed, %d failed\n", len(results), len(results)-failed, failed)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("backup verification failed for %d of %d backups", failed, len(results))
+	}
 	return nil
 }
 
+// verifyOne verifies a single backup against the target its location points
+// to; the returned result is never nil so it can always go into the report
+func verifyOne(ctx context.Context, m *backup.BackupManager, info *backup.BackupInfo, cfg *config.Config, resolve backup.TargetResolver) (*backup.VerifyResult, error) {
+	target, err := resolve(info.Location)
+	if err == nil {
+		var result *backup.VerifyResult
+		result, err = m.VerifyBackup(ctx, backup.VerifyOptions{
+			BackupID:     info.ID,
+			Target:       target,
+			IdentityFile: identityFile(verifyFlags.identity, cfg),
+		})
+		if result != nil {
+			return result, err
+		}
+	}
+
+	return &backup.VerifyResult{
+		BackupID: info.ID,
+		VMName:   info.VMName,
+		Verified: time.Now(),
+		Error:    err.Error(),
+	}, err
+}
+
+// parseSince accepts a duration relative to now (24h, 168h) or a date
+func parseSince(value string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid --since value %q: expected a duration (24h) or date (2006-01-02)", value)
+}
+
+var pruneFlags struct {
+	keepLast    int
+	keepDays    int
+	keepDaily   int
+	keepWeekly  int
+	keepMonthly int
+	timezone    string
+	policy      bool
+	vmName      string
+	dryRun      bool
+}
+
 // NewPruneCommand creates the backup prune command
 func NewPruneCommand() *cobra.Command {
-	var (
-		keepLast  int
-		vmName    string
-		dryRun    bool
-		keepDays  int
-	)
-
 	cmd := &cobra.Command{
 		Use:   "prune",
 		Short: "Prune old backups based on retention policy",
 		Long: `Prune old backups based on retention policy.
-		
+
 This command removes old backups to free up storage space while
 keeping the specified number of recent backups or backups within
-a time window.`,
-		RunE: func(cmd *cobra.Command, args []string) error {
-			return runPrune(cmd, keepLast, vmName, dryRun, keepDays)
-		},
+a time window.
+
+With --policy the grandfather-father-son policy in backup.retention is
+applied: the newest backup of each of the last keep_daily days,
+keep_weekly ISO weeks and keep_monthly months is kept, in addition to the
+keep_last most recent backups. Days, weeks and months are calendar periods
+in backup.retention.timezone. The --keep-* and --timezone flags override
+the configured values.
+
+A backup is kept if any rule keeps it. --dry-run prints the plan with the
+rules that keep each backup.`,
+		RunE: runPrune,
 	}
 
-	cmd.Flags().IntVar(&keepLast, "keep-last", 5, "Keep last N backups per VM")
-	cmd.Flags().StringVar(&vmName, "vm", "", "Prune backups for specific VM (default: all VMs)")
-	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Show what would be deleted without deleting")
-	cmd.Flags().IntVar(&keepDays, "keep-days", 30, "Keep backups newer than N days")
+	cmd.Flags().IntVar(&pruneFlags.keepLast, "keep-last", 5, "Keep last N backups per VM")
+	cmd.Flags().StringVar(&pruneFlags.vmName, "vm", "", "Prune backups for specific VM (default: all VMs)")
+	cmd.Flags().BoolVar(&pruneFlags.dryRun, "dry-run", false, "Show what would be deleted without deleting")
+	cmd.Flags().IntVar(&pruneFlags.keepDays, "keep-days", 30, "Keep backups newer than N days")
+	cmd.Flags().BoolVar(&pruneFlags.policy, "policy", false, "Apply the backup.retention policy from the configuration")
+	cmd.Flags().IntVar(&pruneFlags.keepDaily, "keep-daily", 0, "Keep the newest backup of each of the last N days")
+	cmd.Flags().IntVar(&pruneFlags.keepWeekly, "keep-weekly", 0, "Keep the newest backup of each of the last N ISO weeks")
+	cmd.Flags().IntVar(&pruneFlags.keepMonthly, "keep-monthly", 0, "Keep the newest backup of each of the last N months")
+	cmd.Flags().StringVar(&pruneFlags.timezone, "timezone", "", "Timezone for day/week/month boundaries (default: backup.retention.timezone or local)")
 
 	return cmd
 }
 
-func runPrune(cmd *cobra.Command, keepLast int, vmName string, dryRun bool, keepDays int) error {
+// pruneOptions builds the prune options from the flags, starting from
+// backup.retention when --policy is given. Options without any keep rule
+// would delete every backup and are refused.
+func pruneOptions(cmd *cobra.Command, cfg *config.Config) (backup.PruneOptions, error) {
+	opts := backup.PruneOptions{
+		VMName:   pruneFlags.vmName,
+		KeepLast: pruneFlags.keepLast,
+		KeepDays: pruneFlags.keepDays,
+		Timezone: cfg.Backup.Retention.Timezone,
+		DryRun:   pruneFlags.dryRun,
+	}
+
+	if pruneFlags.policy {
+		retention := cfg.Backup.Retention
+		opts.KeepLast = retention.KeepLast
+		opts.KeepDays = 0
+		opts.KeepDaily = retention.KeepDaily
+		opts.KeepWeekly = retention.KeepWeekly
+		opts.KeepMonthly = retention.KeepMonthly
+	}
+
+	flags := cmd.Flags()
+	if flags.Changed("keep-last") {
+		opts.KeepLast = pruneFlags.keepLast
+	}
+	if flags.Changed("keep-days") {
+		opts.KeepDays = pruneFlags.keepDays
+	}
+	if flags.Changed("keep-daily") {
+		opts.KeepDaily = pruneFlags.keepDaily
+	}
+	if flags.Changed("keep-weekly") {
+		opts.KeepWeekly = pruneFlags.keepWeekly
+	}
+	if flags.Changed("keep-monthly") {
+		opts.KeepMonthly = pruneFlags.keepMonthly
+	}
+	if flags.Changed("timezone") {
+		opts.Timezone = pruneFlags.timezone
+	}
+
+	if opts.KeepLast+opts.KeepDays+opts.KeepDaily+opts.KeepWeekly+opts.KeepMonthly == 0 {
+		if pruneFlags.policy {
+			return opts, fmt.Errorf("backup.retention needs at least one keep_* rule, or pass a --keep-* flag")
+		}
+		return opts, fmt.Errorf("prune needs at least one --keep-* rule")
+	}
+	return opts, nil
+}
+
+func runPrune(cmd *cobra.Command, args []string) error {
 	// Load configuration
 	cfg, err := config.Load("")
 	if err != nil {
 		return fmt.Errorf("failed to load config: %w", err)
 	}
 
+	opts, err := pruneOptions(cmd, cfg)
+	if err != nil {
+		return err
+	}
+
 	// Create ESXi client
 	clientConfig := &client.Config{
 		Host:     cfg.ESXi.Host,
@@ -220,7 +431,10 @@ func runPrune(cmd *cobra.Command, keepLast int, vmName string, dryRun bool, keep
 	}
 
 	// Create backup manager
-	backupManager, err := backup.NewBackupManager(esxiClient, catalogPath)
+	backupManager, err := backup.NewBackupManagerWithConfig(esxiClient, &backup.Config{
+		CatalogPath:   catalogPath,
+		ResolveTarget: LocationResolver(cfg, esxiClient),
+	})
 	if err != nil {
 		return fmt.Errorf("failed to create backup manager: %w", err)
 	}
@@ -228,21 +442,47 @@ func runPrune(cmd *cobra.Command, keepLast int, vmName string, dryRun bool, keep
 
 	// Run pruning
 	ctx := context.Background()
-	prunedCount, err := backupManager.PruneBackups(ctx, backup.PruneOptions{
-		VMName:   vmName,
-		KeepLast: keepLast,
-		KeepDays: keepDays,
-		DryRun:   dryRun,
-	})
+	result, err := backupManager.PruneBackups(ctx, opts)
 	if err != nil {
 		return fmt.Errorf("failed to prune backups: %w", err)
 	}
 
-	if dryRun {
-		fmt.Printf("Would delete %d backups\n", prunedCount)
+	printPrunePlan(result.Plan, result.Errors, opts.DryRun)
+
+	freedMB := float64(result.FreedBytes) / (1024 * 1024)
+	if opts.DryRun {
+		fmt.Printf("Would delete %d backups, freeing %.2f MB\n", result.Deleted, freedMB)
 	} else {
-		fmt.Printf("Deleted %d backups\n", prunedCount)
+		fmt.Printf("Deleted %d backups, freed %.2f MB\n", result.Deleted, freedMB)
 	}
 
+	if result.Failed > 0 {
+		return fmt.Errorf("failed to delete %d backups; run prune again to resume", result.Failed)
+	}
 	return nil
 }
+
+// printPrunePlan lists each VM's backups, newest first, with the rules that
+// keep them or why they could not be deleted
+func printPrunePlan(plan []storage.RetentionDecision, errs map[string]string, dryRun bool) {
+	vmName := ""
+	for _, decision := range plan {
+		entry := decision.Entry
+		if entry.VMName != vmName {
+			vmName = entry.VMName
+			fmt.Printf("VM '%s':\n", vmName)
+		}
+
+		created := entry.Timestamp.Format("2006-01-02 15:04")
+		switch {
+		case decision.Keep:
+			fmt.Printf("  keep    %s  %s  (%s)\n", entry.ID, created, strings.Join(decision.Reasons, ", "))
+		case dryRun:
+			fmt.Printf("  delete  %s  %s  (not kept by any rule)\n", entry.ID, created)
+		case errs[entry.ID] != "":
+			fmt.Printf("  failed  %s  %s  (%s)\n", entry.ID, created, errs[entry.ID])
+		default:
+			fmt.Printf("  deleted %s  %s  (not kept by any rule)\n", entry.ID, created)
+		}
+	}
+}
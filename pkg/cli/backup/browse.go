@@ -0,0 +1,199 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/r11/esxi-commander/pkg/backup"
+	"github.com/r11/esxi-commander/pkg/config"
+	"github.com/r11/esxi-commander/pkg/esxi/client"
+	"github.com/spf13/cobra"
+)
+
+var browseFlags struct {
+	fs          string
+	filesystems bool
+	identity    string
+	json        bool
+}
+
+// NewBrowseCommand creates the backup browse command
+func NewBrowseCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "browse <backup-id> [path]",
+		Short: "List the files in a backup",
+		Long: `List the files in a backup without restoring it or touching ESXi.
+
+The backup's disks are copied from the artifact to backup.temp_dir, with
+the checksum verified, and opened read-only. Partition tables (MBR or GPT)
+are read and ext2, ext3 and ext4 filesystems can be browsed; the largest
+one is used unless --fs names another. --filesystems lists every partition
+found, including ones that cannot be browsed such as swap or LVM.
+
+Paths are absolute within the filesystem, e.g. /etc/nginx, and default to
+/. Copy files out with backup extract. ESXi is only contacted for backups
+stored on a datastore.`,
+		Args: cobra.RangeArgs(1, 2),
+		RunE: runBrowse,
+	}
+
+	cmd.Flags().StringVar(&browseFlags.fs, "fs", "", "Filesystem to browse, e.g. disk0p1 (default: the largest ext2/3/4 filesystem)")
+	cmd.Flags().BoolVar(&browseFlags.filesystems, "filesystems", false, "List the filesystems in the backup instead of files")
+	cmd.Flags().StringVar(&browseFlags.identity, "identity", "", "age identity file for encrypted backups (default: backup.encryption.identity_file)")
+	cmd.Flags().BoolVar(&browseFlags.json, "json", false, "Output in JSON format")
+
+	return cmd
+}
+
+func runBrowse(cmd *cobra.Command, args []string) error {
+	cfg, err := config.Load("")
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	backupManager, closeManager, err := newOfflineManager(cfg)
+	if err != nil {
+		return err
+	}
+	defer closeManager()
+
+	files, err := backupManager.OpenBackupFiles(context.Background(), backup.BrowseOptions{
+		BackupID:     args[0],
+		IdentityFile: identityFile(browseFlags.identity, cfg),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to open backup: %w", err)
+	}
+	defer files.Close()
+
+	if browseFlags.filesystems {
+		return printFilesystems(files.Filesystems)
+	}
+
+	fsys, err := files.Filesystem(browseFlags.fs)
+	if err != nil {
+		return err
+	}
+	name := "/"
+	if len(args) > 1 {
+		name = args[1]
+	}
+	entries, err := fsys.List(name)
+	if err != nil {
+		return fmt.Errorf("failed to list %s: %w", name, err)
+	}
+
+	if browseFlags.json {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(entries)
+	}
+
+	description := fsys.Type
+	if fsys.Label != "" {
+		description += ", " + fsys.Label
+	}
+	fmt.Printf("%s (%s):%s\n", fsys.Name, description, name)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "MODE\tUID\tGID\tSIZE\tMODIFIED\tNAME")
+	for _, entry := range entries {
+		display := entry.Name
+		switch {
+		case entry.Target != "":
+			display += " -> " + entry.Target
+		case entry.IsDir:
+			display += "/"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\n",
+			entry.Mode, entry.UID, entry.GID, formatSize(entry.Size), formatTime(entry.ModTime), display)
+	}
+	return w.Flush()
+}
+
+func printFilesystems(filesystems []*backup.BackupFilesystem) error {
+	if browseFlags.json {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(filesystems)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tTYPE\tLABEL\tSIZE\tPARTITION\tDISK")
+	for _, fsys := range filesystems {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			fsys.Name, orDash(fsys.Type), orDash(fsys.Label), formatSize(fsys.Partition.Size), fsys.Partition.TypeName(), fsys.Disk)
+	}
+	return w.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// newOfflineManager creates a backup manager for commands that only read
+// backup artifacts. It connects to ESXi only when a backup stored on a
+// datastore is read; the returned function closes both.
+func newOfflineManager(cfg *config.Config) (*backup.BackupManager, func(), error) {
+	resolve, closeResolver := offlineResolver(cfg)
+
+	catalogPath := cfg.Backup.CatalogPath
+	if catalogPath == "" {
+		catalogPath = "/var/lib/ceso/backup.db"
+	}
+
+	backupManager, err := backup.NewBackupManagerWithConfig(nil, &backup.Config{
+		CatalogPath:   catalogPath,
+		TempDir:       cfg.Backup.TempDir,
+		ResolveTarget: resolve,
+	})
+	if err != nil {
+		closeResolver()
+		return nil, nil, fmt.Errorf("failed to create backup manager: %w", err)
+	}
+
+	return backupManager, func() {
+		backupManager.Close()
+		closeResolver()
+	}, nil
+}
+
+// offlineResolver finds the target of a stored backup like
+// LocationResolver, but only connects to ESXi for locations that need it:
+// datastore and default-target locations. The returned function closes
+// that connection if one was made.
+func offlineResolver(cfg *config.Config) (backup.TargetResolver, func()) {
+	var esxiClient *client.ESXiClient
+	resolve := func(location string) (backup.BackupTarget, error) {
+		offline := false
+		for _, scheme := range []string{"file://", "s3://", "sftp://", "repo://"} {
+			offline = offline || strings.HasPrefix(location, scheme)
+		}
+		if !offline && esxiClient == nil {
+			c, err := client.NewClient(&client.Config{
+				Host:     cfg.ESXi.Host,
+				User:     cfg.ESXi.User,
+				Password: cfg.ESXi.Password,
+				Insecure: cfg.ESXi.Insecure,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to create ESXi client for %s: %w", location, err)
+			}
+			esxiClient = c
+		}
+		return targetForLocation(location, cfg, esxiClient)
+	}
+
+	return resolve, func() {
+		if esxiClient != nil {
+			esxiClient.Close()
+		}
+	}
+}
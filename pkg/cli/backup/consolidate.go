@@ -0,0 +1,106 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/r11/esxi-commander/pkg/backup"
+	"github.com/r11/esxi-commander/pkg/config"
+	"github.com/r11/esxi-commander/pkg/esxi/client"
+	"github.com/spf13/cobra"
+)
+
+var consolidateFlags struct {
+	identity    string
+	compression string
+}
+
+// NewConsolidateCommand creates the backup consolidate command
+func NewConsolidateCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "consolidate <vm-name>",
+		Short: "Merge an incremental chain into a synthetic full backup",
+		Long: `Merge the newest incremental backup of a VM and the chain it depends on
+into a new full backup.
+
+The synthetic full is built from the backup artifacts alone; the VM is not
+touched. It is stored next to the newest backup, read back and checked
+against its checksum and manifest before it is marked completed. Later
+incremental backups continue from it, so once retention no longer keeps
+them the old chain members can be pruned without orphaning children.`,
+		Args: cobra.ExactArgs(1),
+		RunE: runConsolidate,
+	}
+
+	cmd.Flags().StringVar(&consolidateFlags.identity, "identity", "", "age identity file for encrypted backups (default: backup.encryption.identity_file)")
+	cmd.Flags().StringVar(&consolidateFlags.compression, "compression", "", "Compression codec (none, gzip, zstd; default: that of the newest backup)")
+
+	return cmd
+}
+
+func runConsolidate(cmd *cobra.Command, args []string) error {
+	vmName := args[0]
+
+	// Load configuration
+	cfg, err := config.Load("")
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	// Create ESXi client, needed for datastore targets
+	clientConfig := &client.Config{
+		Host:     cfg.ESXi.Host,
+		User:     cfg.ESXi.User,
+		Password: cfg.ESXi.Password,
+		Insecure: cfg.ESXi.Insecure,
+	}
+
+	esxiClient, err := client.NewClient(clientConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create ESXi client: %w", err)
+	}
+	defer esxiClient.Close()
+
+	// Get catalog path from config
+	catalogPath := cfg.Backup.CatalogPath
+	if catalogPath == "" {
+		catalogPath = "/var/lib/ceso/backup.db"
+	}
+
+	// Create backup manager
+	backupManager, err := backup.NewBackupManagerWithConfig(esxiClient, &backup.Config{
+		CatalogPath:        catalogPath,
+		CompressionLevel:   cfg.Backup.CompressionLevel,
+		CompressionThreads: cfg.Backup.CompressionThreads,
+		TempDir:            cfg.Backup.TempDir,
+		Recipients:         cfg.Backup.Encryption.Recipients,
+		ResolveTarget:      LocationResolver(cfg, esxiClient),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create backup manager: %w", err)
+	}
+	defer backupManager.Close()
+
+	fmt.Printf("Consolidating incremental backups of VM '%s'...\n", vmName)
+	result, err := backupManager.ConsolidateBackups(context.Background(), backup.ConsolidateOptions{
+		VMName:       vmName,
+		IdentityFile: identityFile(consolidateFlags.identity, cfg),
+		Compression:  consolidateFlags.compression,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to consolidate backups: %w", err)
+	}
+
+	info := result.Backup
+	fmt.Printf("\nSynthetic full backup created:\n")
+	fmt.Printf("  ID:       %s\n", info.ID)
+	fmt.Printf("  VM:       %s\n", info.VMName)
+	fmt.Printf("  Merged:   %s\n", strings.Join(result.Merged, " -> "))
+	fmt.Printf("  Size:     %.2f MB\n", float64(info.Size)/(1024*1024))
+	fmt.Printf("  Location: %s\n", info.Location)
+	fmt.Printf("  Verified: %s\n", info.VerifyStatus)
+	fmt.Println("\nThe merged backups can now be removed with 'ceso backup prune'.")
+
+	return nil
+}
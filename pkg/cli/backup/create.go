@@ -5,19 +5,27 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/r11/esxi-commander/pkg/backup"
+	"github.com/r11/esxi-commander/pkg/cli/task"
 	"github.com/r11/esxi-commander/pkg/config"
 	"github.com/r11/esxi-commander/pkg/esxi/client"
 	"github.com/spf13/cobra"
 )
 
 var createFlags struct {
-	compress    bool
-	powerOff    bool
-	hot         bool
-	target      string
-	description string
+	compress         bool
+	compression      string
+	compressionLevel int
+	powerOff         bool
+	hot              bool
+	incremental      bool
+	target           string
+	description      string
+	skipHooks        bool
+	immutableDays    int
+	resume           string
 }
 
 // NewCreateCommand creates the backup create command
@@ -28,21 +36,51 @@ func NewCreateCommand() *cobra.Command {
 		Long: `Create a backup of a virtual machine.
 
 This command creates a cold backup of the specified VM by exporting it
-to OVF/OVA format and storing it in the configured backup target.`,
+to OVF/OVA format and storing it in the configured backup target.
+
+With --incremental, Changed Block Tracking is enabled on the VM and only
+the blocks changed since its previous incremental backup are stored. The
+first incremental backup of a VM holds all allocated blocks and starts
+the chain; restoring any backup in the chain needs all of its parents.
+
+Hooks configured for the VM under backup.hooks run in the guest, through
+VMware Tools or SSH, before and after the snapshot of a running VM. A
+failing or timed-out hook aborts the backup; post-thaw hooks always run
+once pre-freeze hooks have started. Hook output is recorded in the
+catalog and the audit log.
+
+With --immutable-days, or backup.immutable_days, the stored backup is
+locked against deletion for that many days: with S3 object lock on s3
+targets and the immutable attribute (chattr +i) on nfs targets. Other
+targets refuse immutable backups.
+
+A backup whose upload to an S3 or SFTP target fails is marked interrupted
+and keeps what it had uploaded; one that was killed is left pending.
+--resume <backup-id> writes either again to the same target under the same
+ID, reusing the parts an S3 upload had already stored and the partial file
+of an SFTP upload. Deleting or pruning the backup removes the partial
+upload instead. Encrypted backups cannot be resumed, since every run uses
+a new key, and other failed backups remove whatever they had stored.`,
 		Args: cobra.ExactArgs(1),
 		RunE: runCreate,
 	}
 
 	cmd.Flags().BoolVar(&createFlags.compress, "compress", true, "Compress the backup")
+	cmd.Flags().StringVar(&createFlags.compression, "compression", "", "Compression codec (none, gzip, zstd; default: backup.compression)")
+	cmd.Flags().IntVar(&createFlags.compressionLevel, "compression-level", 0, "Compression level (gzip 1-9, zstd 1-22; default: backup.compression_level)")
 	cmd.Flags().BoolVar(&createFlags.powerOff, "power-off", false, "Power off VM before backup (cold backup)")
 	cmd.Flags().BoolVar(&createFlags.hot, "hot", false, "Create hot backup using snapshots (VM stays running)")
-	cmd.Flags().StringVar(&createFlags.target, "target", "datastore", "Backup target (datastore, nfs, s3)")
+	cmd.Flags().BoolVar(&createFlags.incremental, "incremental", false, "Store only blocks changed since the previous incremental backup (uses CBT)")
+	cmd.Flags().StringVar(&createFlags.target, "target", "", "Backup target (datastore, nfs, s3, or a backup.targets name; default: backup.default_target)")
 	cmd.Flags().StringVar(&createFlags.description, "description", "", "Backup description")
+	cmd.Flags().BoolVar(&createFlags.skipHooks, "skip-hooks", false, "Do not run the pre-freeze and post-thaw hooks configured for the VM")
+	cmd.Flags().IntVar(&createFlags.immutableDays, "immutable-days", 0, "Lock the backup against deletion for N days (default: backup.immutable_days)")
+	cmd.Flags().StringVar(&createFlags.resume, "resume", "", "Resume the interrupted backup with this ID")
 
 	return cmd
 }
 
-func runCreate(cmd *cobra.Command, args []string) error {
+func runCreate(cmd *cobra.Command, args []string) (err error) {
 	vmName := args[0]
 
 	// Load configuration
@@ -80,7 +118,21 @@ func runCreate(cmd *cobra.Command, args []string) error {
 	}
 
 	// Create backup manager
-	backupManager, err := backup.NewBackupManager(esxiClient, catalogPath)
+	compressionLevel := cfg.Backup.CompressionLevel
+	if cmd.Flags().Changed("compression-level") {
+		compressionLevel = createFlags.compressionLevel
+	}
+
+	backupManager, err := backup.NewBackupManagerWithConfig(esxiClient, &backup.Config{
+		CatalogPath:        catalogPath,
+		DefaultTarget:      cfg.Backup.DefaultTarget,
+		Compression:        cfg.Backup.Compression,
+		CompressionLevel:   compressionLevel,
+		CompressionThreads: cfg.Backup.CompressionThreads,
+		TempDir:            cfg.Backup.TempDir,
+		Recipients:         cfg.Backup.Encryption.Recipients,
+		MaxConcurrent:      cfg.Backup.MaxConcurrent,
+	})
 	if err != nil {
 		return fmt.Errorf("failed to create backup manager: %w", err)
 	}
@@ -97,20 +149,27 @@ func runCreate(cmd *cobra.Command, args []string) error {
 		PowerOff:    createFlags.powerOff,
 		Hot:         createFlags.hot,
 		Compress:    createFlags.compress,
+		Compression: createFlags.compression,
+		Incremental: createFlags.incremental,
 		Description: createFlags.description,
+		RetainUntil: RetainUntil(cfg.Backup.ImmutableDays),
+		Resume:      createFlags.resume,
+	}
+	if cmd.Flags().Changed("immutable-days") {
+		opts.RetainUntil = RetainUntil(createFlags.immutableDays)
+	}
+
+	// Create backup target based on flag, falling back to backup.default_target
+	opts.Target, err = NewTarget(createFlags.target, cfg, esxiClient)
+	if err != nil {
+		return err
 	}
 
-	// Create backup target based on flag
-	switch createFlags.target {
-	case "datastore":
-		// Default datastore target
-		// opts.Target would be set here
-	case "nfs":
-		return fmt.Errorf("NFS target not yet implemented")
-	case "s3":
-		return fmt.Errorf("S3 target not yet implemented")
-	default:
-		return fmt.Errorf("unknown target: %s", createFlags.target)
+	if !createFlags.skipHooks {
+		opts.Hooks, err = BackupHooks(vmName, cfg, esxiClient)
+		if err != nil {
+			return err
+		}
 	}
 
 	// Create the backup
@@ -123,20 +182,35 @@ func runCreate(cmd *cobra.Command, args []string) error {
 		fmt.Println("Creating backup of VM in current state")
 	}
 
+	ctx, t := task.Track(ctx, cfg.Tasks.DBPath, "backup.create", vmName)
+	result := ""
+	defer func() { t.Finish(result, err) }()
+	opts.Progress = t.Progress
+
 	backupInfo, err := backupManager.CreateBackup(ctx, opts)
 	if err != nil {
 		return fmt.Errorf("failed to create backup: %w", err)
 	}
+	result = backupInfo.ID
 
 	// Display result
 	fmt.Printf("\nBackup created successfully:\n")
 	fmt.Printf("  ID:       %s\n", backupInfo.ID)
 	fmt.Printf("  VM:       %s\n", backupInfo.VMName)
 	fmt.Printf("  Type:     %s backup\n", backupInfo.Type)
+	if backupInfo.ParentID != "" {
+		fmt.Printf("  Parent:   %s\n", backupInfo.ParentID)
+	}
 	fmt.Printf("  Size:     %.2f MB\n", float64(backupInfo.Size)/(1024*1024))
 	fmt.Printf("  Created:  %s\n", backupInfo.Created.Format("2006-01-02 15:04:05"))
 	fmt.Printf("  Location: %s\n", backupInfo.Location)
 	fmt.Printf("  Status:   %s\n", backupInfo.Status)
+	if backupInfo.RetainUntil != nil {
+		fmt.Printf("  Locked:   until %s\n", backupInfo.RetainUntil.Format("2006-01-02 15:04:05"))
+	}
+	for _, hook := range backupInfo.Hooks {
+		fmt.Printf("  Hook:     %s %q (%s)\n", hook.Phase, hook.Command, hook.Duration.Round(time.Millisecond))
+	}
 
 	return nil
 }
\ No newline at end of file
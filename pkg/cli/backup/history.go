@@ -0,0 +1,94 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/r11/esxi-commander/internal/storage"
+	"github.com/r11/esxi-commander/pkg/config"
+	"github.com/spf13/cobra"
+)
+
+var historyFlags struct {
+	limit int
+	json  bool
+}
+
+// NewHistoryCommand creates the backup history command
+func NewHistoryCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "history [job]",
+		Short: "Show the runs of scheduled backup jobs",
+		Long: `Show the runs of the scheduled backup jobs cesod runs from backup.jobs,
+newest first, with the backup taken of each VM.
+
+A run is "skipped" when it came due while the previous run of the same job
+was still going.`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: runHistory,
+	}
+
+	cmd.Flags().IntVar(&historyFlags.limit, "limit", 20, "Maximum number of runs to show (0 for all)")
+	cmd.Flags().BoolVar(&historyFlags.json, "json", false, "Output in JSON format")
+
+	return cmd
+}
+
+func runHistory(cmd *cobra.Command, args []string) error {
+	cfg, err := config.Load("")
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	catalogPath := cfg.Backup.CatalogPath
+	if catalogPath == "" {
+		catalogPath = "/var/lib/ceso/backup.db"
+	}
+
+	catalog, err := storage.InitCatalog(catalogPath)
+	if err != nil {
+		return fmt.Errorf("failed to open catalog: %w", err)
+	}
+	defer catalog.Close()
+
+	job := ""
+	if len(args) == 1 {
+		job = args[0]
+	}
+	runs, err := catalog.ListJobRuns(job, historyFlags.limit)
+	if err != nil {
+		return fmt.Errorf("failed to list job runs: %w", err)
+	}
+
+	if historyFlags.json {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(runs)
+	}
+
+	if len(runs) == 0 {
+		fmt.Println("No job runs recorded")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintln(w, "RUN\tJOB\tSTARTED\tDURATION\tSTATUS\tVM\tBACKUP\tERROR")
+	for _, run := range runs {
+		duration := run.Finished.Sub(run.Started).Round(time.Second)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t\t\t%s\n",
+			run.ID, run.Job, formatTime(run.Started), duration, run.Status, run.Error)
+		for _, vm := range run.VMs {
+			backupID := vm.BackupID
+			if backupID == "" {
+				backupID = "-"
+			}
+			fmt.Fprintf(w, "\t\t\t\t%s\t%s\t%s\t%s\n", vm.Status, vm.VMName, backupID, vm.Error)
+		}
+	}
+	return nil
+}
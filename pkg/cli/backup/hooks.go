@@ -0,0 +1,50 @@
+package backup
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/r11/esxi-commander/pkg/backup"
+	"github.com/r11/esxi-commander/pkg/config"
+	"github.com/r11/esxi-commander/pkg/esxi/client"
+)
+
+// BackupHooks returns the hooks configured for vmName in backup.hooks, or
+// nil if it has none
+func BackupHooks(vmName string, cfg *config.Config, esxiClient *client.ESXiClient) (*backup.Hooks, error) {
+	hookCfg, ok := cfg.Backup.Hooks[vmName]
+	if !ok || len(hookCfg.PreFreeze)+len(hookCfg.PostThaw) == 0 {
+		return nil, nil
+	}
+
+	var runner backup.HookRunner
+	switch hookCfg.Transport {
+	case "", "guest":
+		if hookCfg.User == "" {
+			return nil, fmt.Errorf("backup.hooks.%s: guest hooks require user", vmName)
+		}
+		runner = backup.NewGuestHookRunner(esxiClient, vmName, hookCfg.User, hookCfg.Password)
+	case "ssh":
+		var err error
+		runner, err = backup.NewSSHHookRunner(backup.SSHHookOptions{
+			Host:       hookCfg.Host,
+			User:       hookCfg.User,
+			KeyPath:    hookCfg.SSHKey,
+			KnownHosts: hookCfg.KnownHosts,
+
+			InsecureHostKey: hookCfg.InsecureHostKey,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("backup.hooks.%s: %w", vmName, err)
+		}
+	default:
+		return nil, fmt.Errorf("backup.hooks.%s: unsupported transport %q", vmName, hookCfg.Transport)
+	}
+
+	return &backup.Hooks{
+		Runner:    runner,
+		Timeout:   time.Duration(hookCfg.Timeout) * time.Second,
+		PreFreeze: hookCfg.PreFreeze,
+		PostThaw:  hookCfg.PostThaw,
+	}, nil
+}
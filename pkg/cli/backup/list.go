@@ -104,8 +104,8 @@ func outputTable(backups []*backup.BackupInfo) error {
 	defer w.Flush()
 
 	// Header
-	fmt.Fprintln(w, "ID\tVM NAME\tSIZE\tCREATED\tSTATUS\tTYPE\tDESCRIPTION")
-	fmt.Fprintln(w, "---\t---\t---\t---\t---\t---\t---")
+	fmt.Fprintln(w, "ID\tVM NAME\tSIZE\tCREATED\tSTATUS\tDRILL\tTYPE\tDESCRIPTION")
+	fmt.Fprintln(w, "---\t---\t---\t---\t---\t---\t---\t---")
 
 	// Data rows
 	for _, b := range backups {
@@ -115,13 +115,27 @@ func outputTable(backups []*backup.BackupInfo) error {
 		if desc == "" {
 			desc = "-"
 		}
+		status := b.Status
+		if b.Hold != nil {
+			status += " (held)"
+		} else if b.RetainUntil != nil && time.Now().Before(*b.RetainUntil) {
+			status += " (locked)"
+		}
+		drill := "-"
+		if b.LastDrill != nil {
+			drill = "failed"
+			if b.LastDrill.Passed {
+				drill = "passed"
+			}
+		}
 
-		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
 			b.ID,
 			b.VMName,
 			sizeStr,
 			timeStr,
-			b.Status,
+			status,
+			drill,
 			b.Type,
 			desc,
 		)
@@ -0,0 +1,142 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/r11/esxi-commander/pkg/backup"
+	"github.com/r11/esxi-commander/pkg/config"
+	"github.com/r11/esxi-commander/pkg/esxi/client"
+	"github.com/spf13/cobra"
+)
+
+var recoverFlags struct {
+	dryRun  bool
+	discard bool
+	json    bool
+}
+
+// NewRecoverCommand creates the backup recover command
+func NewRecoverCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "recover",
+		Short: "Clean up after interrupted backups",
+		Long: `Clean up after backups that were killed half-way.
+
+A backup killed after taking its snapshot leaves the backup-snapshot-<id>
+snapshot on the VM and its catalog entry pending. Since every backup holds
+the catalog while it runs, no backup can be running while this command
+does, so every such snapshot is removed, consolidating its disks, VMs that
+still need their disks consolidated are consolidated, and every pending
+entry is marked interrupted. What its backup had uploaded, such as an
+incomplete S3 upload or SFTP partial file, is kept for
+'ceso backup create --resume <backup-id>'.
+
+--discard gives up interrupted backups instead: their partial uploads are
+removed from their targets and they are marked failed. Deleting or pruning
+an interrupted backup removes its partial upload as well.
+
+cesod runs the same recovery, without --discard, when it starts.`,
+		Args: cobra.NoArgs,
+		RunE: runRecover,
+	}
+
+	cmd.Flags().BoolVar(&recoverFlags.dryRun, "dry-run", false, "Show what would be fixed without changing anything")
+	cmd.Flags().BoolVar(&recoverFlags.discard, "discard", false, "Remove the partial uploads of interrupted backups and mark them failed")
+	cmd.Flags().BoolVar(&recoverFlags.json, "json", false, "Output in JSON format")
+
+	return cmd
+}
+
+func runRecover(cmd *cobra.Command, args []string) error {
+	cfg, err := config.Load("")
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	esxiClient, err := client.NewClient(&client.Config{
+		Host:     cfg.ESXi.Host,
+		User:     cfg.ESXi.User,
+		Password: cfg.ESXi.Password,
+		Insecure: cfg.ESXi.Insecure,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create ESXi client: %w", err)
+	}
+	defer esxiClient.Close()
+
+	catalogPath := cfg.Backup.CatalogPath
+	if catalogPath == "" {
+		catalogPath = "/var/lib/ceso/backup.db"
+	}
+
+	backupManager, err := backup.NewBackupManagerWithConfig(esxiClient, &backup.Config{
+		CatalogPath:   catalogPath,
+		ResolveTarget: LocationResolver(cfg, esxiClient),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create backup manager: %w", err)
+	}
+	defer backupManager.Close()
+
+	result, err := backupManager.RecoverBackups(context.Background(), backup.RecoverOptions{
+		DryRun:  recoverFlags.dryRun,
+		Discard: recoverFlags.discard,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to recover backups: %w", err)
+	}
+
+	if recoverFlags.json {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(result); err != nil {
+			return err
+		}
+	} else {
+		printRecovery(result, recoverFlags.dryRun)
+	}
+
+	if len(result.Errors) > 0 {
+		return fmt.Errorf("%d problems could not be fixed", len(result.Errors))
+	}
+	return nil
+}
+
+// printRecovery reports what a recovery pass fixed
+func printRecovery(result *backup.RecoveryResult, dryRun bool) {
+	if result.Empty() {
+		fmt.Println("Nothing to recover")
+		return
+	}
+
+	removed, consolidated, marked := "Removed", "Consolidated", "Marked"
+	if dryRun {
+		removed, consolidated, marked = "Would remove", "Would consolidate", "Would mark"
+	}
+	uploads := make(map[string]bool)
+	for _, id := range result.RemovedUploads {
+		uploads[id] = true
+	}
+
+	for _, snapshot := range result.RemovedSnapshots {
+		fmt.Printf("%s snapshot '%s' of VM '%s'\n", removed, snapshot.Snapshot, snapshot.VMName)
+	}
+	for _, vmName := range result.ConsolidatedVMs {
+		fmt.Printf("%s disks of VM '%s'\n", consolidated, vmName)
+	}
+	for _, id := range result.InterruptedBackups {
+		fmt.Printf("%s backup %s as interrupted; resume it with 'ceso backup create --resume %s'\n", marked, id, id)
+	}
+	for _, id := range result.FailedBackups {
+		if uploads[id] {
+			fmt.Printf("%s partial upload of backup %s\n", removed, id)
+		}
+		fmt.Printf("%s backup %s as failed\n", marked, id)
+	}
+	for _, problem := range result.Errors {
+		fmt.Printf("Error: %s\n", problem)
+	}
+}
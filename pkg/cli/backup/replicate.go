@@ -0,0 +1,106 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/r11/esxi-commander/pkg/backup"
+	"github.com/r11/esxi-commander/pkg/config"
+	"github.com/r11/esxi-commander/pkg/esxi/client"
+	"github.com/spf13/cobra"
+)
+
+var replicateFlags struct {
+	to   string
+	json bool
+}
+
+// NewReplicateCommand creates the backup replicate command
+func NewReplicateCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "replicate <backup-id> --to <target>",
+		Short: "Copy a backup to another target",
+		Long: `Copy a stored backup to another target, e.g. an offsite SFTP server.
+
+The artifact is streamed from its primary location, or from an existing
+replica if the primary cannot be read, and checked against the catalog
+checksum on the way. The copy is then read back and checked again before
+its location is recorded in the catalog. Restore falls back to the
+replicas when the primary copy is missing or damaged, and delete and prune
+remove them along with the backup.
+
+Backup jobs replicate every new backup to the targets in their copy_to
+setting.`,
+		Args: cobra.ExactArgs(1),
+		RunE: runReplicate,
+	}
+
+	cmd.Flags().StringVar(&replicateFlags.to, "to", "", "Target to copy the backup to (datastore, nfs, s3 or a name from backup.targets)")
+	cmd.Flags().BoolVar(&replicateFlags.json, "json", false, "Output in JSON format")
+	cmd.MarkFlagRequired("to")
+
+	return cmd
+}
+
+func runReplicate(cmd *cobra.Command, args []string) error {
+	backupID := args[0]
+
+	cfg, err := config.Load("")
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	// Create ESXi client, needed for datastore targets
+	esxiClient, err := client.NewClient(&client.Config{
+		Host:     cfg.ESXi.Host,
+		User:     cfg.ESXi.User,
+		Password: cfg.ESXi.Password,
+		Insecure: cfg.ESXi.Insecure,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create ESXi client: %w", err)
+	}
+	defer esxiClient.Close()
+
+	catalogPath := cfg.Backup.CatalogPath
+	if catalogPath == "" {
+		catalogPath = "/var/lib/ceso/backup.db"
+	}
+
+	backupManager, err := backup.NewBackupManagerWithConfig(esxiClient, &backup.Config{
+		CatalogPath:   catalogPath,
+		ResolveTarget: LocationResolver(cfg, esxiClient),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create backup manager: %w", err)
+	}
+	defer backupManager.Close()
+
+	target, err := NewTarget(replicateFlags.to, cfg, esxiClient)
+	if err != nil {
+		return err
+	}
+
+	if !replicateFlags.json {
+		fmt.Printf("Replicating backup %s to %s...\n", backupID, target.GetLocation())
+	}
+	replica, err := backupManager.ReplicateBackup(context.Background(), backup.ReplicateOptions{
+		BackupID: backupID,
+		Target:   target,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to replicate backup: %w", err)
+	}
+
+	if replicateFlags.json {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(replica)
+	}
+
+	fmt.Printf("Replica verified and recorded:\n")
+	fmt.Printf("  Location: %s\n", replica.Location)
+	return nil
+}
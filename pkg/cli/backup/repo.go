@@ -0,0 +1,131 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/r11/esxi-commander/pkg/backup"
+	"github.com/r11/esxi-commander/pkg/config"
+	"github.com/spf13/cobra"
+)
+
+var repoFlags struct {
+	target string
+	json   bool
+	dryRun bool
+}
+
+// NewRepoCommand creates the backup repo command
+func NewRepoCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "repo",
+		Short: "Manage deduplicating backup repositories",
+		Long: `Manage deduplicating backup repositories.
+
+A repository is a backup target (backup.targets entry with type "repo")
+that splits backup streams into content-defined chunks and stores each
+chunk once, so near-identical VMs and successive full backups share most
+of their data. Backups stored in a repository are not compressed as a
+stream; each chunk is compressed with zstd instead. Encrypted backups
+would never deduplicate, so backups are refused while
+backup.encryption.recipients is set.
+
+Deleting or pruning a backup only removes its index; run 'repo gc'
+afterwards to reclaim the chunks no backup references any more.`,
+	}
+
+	cmd.PersistentFlags().StringVar(&repoFlags.target, "target", "", "Repository target name in backup.targets (default: backup.default_target)")
+
+	stats := &cobra.Command{
+		Use:   "stats",
+		Short: "Show repository size and deduplication ratio",
+		Args:  cobra.NoArgs,
+		RunE:  runRepoStats,
+	}
+	stats.Flags().BoolVar(&repoFlags.json, "json", false, "Output in JSON format")
+
+	gc := &cobra.Command{
+		Use:   "gc",
+		Short: "Remove chunks no backup references",
+		Long: `Remove chunks no backup references.
+
+A backup that is still being stored has no index yet, so gc refuses to run
+until it finishes; new backups wait for a running gc.`,
+		Args: cobra.NoArgs,
+		RunE: runRepoGC,
+	}
+	gc.Flags().BoolVar(&repoFlags.dryRun, "dry-run", false, "Show what would be removed without removing")
+
+	cmd.AddCommand(stats, gc)
+	return cmd
+}
+
+// openRepository opens the repository selected by --target
+func openRepository() (*backup.RepoTarget, error) {
+	cfg, err := config.Load("")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+
+	name := repoFlags.target
+	if name == "" {
+		name = cfg.Backup.DefaultTarget
+	}
+	named, ok := cfg.Backup.Targets[name]
+	if !ok || named.Type != "repo" {
+		return nil, fmt.Errorf("target %q is not a repository; configure it in backup.targets with type \"repo\"", name)
+	}
+	return backup.NewRepoTarget(named.Path)
+}
+
+func runRepoStats(cmd *cobra.Command, args []string) error {
+	repo, err := openRepository()
+	if err != nil {
+		return err
+	}
+
+	stats, err := repo.Stats(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to read repository: %w", err)
+	}
+
+	if repoFlags.json {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(stats)
+	}
+
+	fmt.Printf("Repository:        %s\n", repo.GetLocation())
+	fmt.Printf("Backups:           %d\n", stats.Backups)
+	fmt.Printf("Logical size:      %s\n", formatSize(stats.LogicalBytes))
+	fmt.Printf("Unique data:       %s in %d chunks\n", formatSize(stats.UniqueBytes), stats.Chunks)
+	fmt.Printf("Stored size:       %s\n", formatSize(stats.StoredBytes))
+	fmt.Printf("Dedup ratio:       %.2fx\n", stats.DedupRatio)
+	fmt.Printf("Compression ratio: %.2fx\n", stats.CompressionRatio)
+	if stats.Unreferenced > 0 {
+		fmt.Printf("Reclaimable:       %s in %d chunks (run 'ceso backup repo gc')\n", formatSize(stats.UnreferencedBytes), stats.Unreferenced)
+	}
+
+	return nil
+}
+
+func runRepoGC(cmd *cobra.Command, args []string) error {
+	repo, err := openRepository()
+	if err != nil {
+		return err
+	}
+
+	result, err := repo.GC(context.Background(), repoFlags.dryRun)
+	if err != nil {
+		return fmt.Errorf("failed to collect garbage: %w", err)
+	}
+
+	if repoFlags.dryRun {
+		fmt.Printf("Would remove %d chunks, freeing %s\n", result.Chunks, formatSize(result.Bytes))
+	} else {
+		fmt.Printf("Removed %d chunks, freed %s\n", result.Chunks, formatSize(result.Bytes))
+	}
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 
 	"github.com/r11/esxi-commander/pkg/backup"
+	"github.com/r11/esxi-commander/pkg/cli/task"
 	"github.com/r11/esxi-commander/pkg/cloudinit"
 	"github.com/r11/esxi-commander/pkg/config"
 	"github.com/r11/esxi-commander/pkg/esxi/client"
@@ -12,12 +13,15 @@ import (
 )
 
 var restoreFlags struct {
-	asNew    string
-	powerOn  bool
-	ip       string
-	gateway  string
-	dns      []string
-	sshKey   string
+	asNew        string
+	inPlace      bool
+	keepOriginal bool
+	powerOn      bool
+	ip           string
+	gateway      string
+	dns          []string
+	sshKey       string
+	identity     string
 }
 
 // NewRestoreCommand creates the backup restore command
@@ -27,29 +31,42 @@ func NewRestoreCommand() *cobra.Command {
 		Short: "Restore a virtual machine from backup",
 		Long: `Restore a virtual machine from a backup.
 
-This command restores a VM from a backup, optionally with a new name
-and network configuration for re-IP.`,
+This command restores a VM from a backup, either as a new VM (--as-new)
+with optional network configuration for re-IP, or in place (--in-place)
+over the VM the backup was taken from.
+
+An in-place restore powers off the existing VM and renames it aside. If
+the import fails the original is renamed back and powered on again; on
+success it is removed (unless --keep-original) and the restored VM keeps
+its BIOS UUID and MAC addresses.`,
 		Args: cobra.ExactArgs(1),
 		RunE: runRestore,
 	}
 
-	cmd.Flags().StringVar(&restoreFlags.asNew, "as-new", "", "Restore with a new VM name (required)")
+	cmd.Flags().StringVar(&restoreFlags.asNew, "as-new", "", "Restore with a new VM name")
+	cmd.Flags().BoolVar(&restoreFlags.inPlace, "in-place", false, "Restore over the original VM")
+	cmd.Flags().BoolVar(&restoreFlags.keepOriginal, "keep-original", false, "With --in-place, keep the replaced VM under a renamed copy")
 	cmd.Flags().BoolVar(&restoreFlags.powerOn, "power-on", true, "Power on VM after restore")
 	cmd.Flags().StringVar(&restoreFlags.ip, "ip", "", "IP address for restored VM (CIDR notation)")
 	cmd.Flags().StringVar(&restoreFlags.gateway, "gateway", "", "Gateway for restored VM")
 	cmd.Flags().StringSliceVar(&restoreFlags.dns, "dns", []string{}, "DNS servers for restored VM")
 	cmd.Flags().StringVar(&restoreFlags.sshKey, "ssh-key", "", "SSH public key for restored VM")
-
-	cmd.MarkFlagRequired("as-new")
+	cmd.Flags().StringVar(&restoreFlags.identity, "identity", "", "age identity file for encrypted backups (default: backup.encryption.identity_file)")
 
 	return cmd
 }
 
-func runRestore(cmd *cobra.Command, args []string) error {
+func runRestore(cmd *cobra.Command, args []string) (err error) {
 	backupID := args[0]
 
-	if restoreFlags.asNew == "" {
-		return fmt.Errorf("--as-new flag is required")
+	if restoreFlags.asNew == "" && !restoreFlags.inPlace {
+		return fmt.Errorf("either --as-new or --in-place is required")
+	}
+	if restoreFlags.asNew != "" && restoreFlags.inPlace {
+		return fmt.Errorf("cannot use both --as-new and --in-place flags")
+	}
+	if restoreFlags.keepOriginal && !restoreFlags.inPlace {
+		return fmt.Errorf("--keep-original requires --in-place")
 	}
 
 	// Load configuration
@@ -82,7 +99,11 @@ func runRestore(cmd *cobra.Command, args []string) error {
 	}
 
 	// Create backup manager
-	backupManager, err := backup.NewBackupManager(esxiClient, catalogPath)
+	backupManager, err := backup.NewBackupManagerWithConfig(esxiClient, &backup.Config{
+		CatalogPath:   catalogPath,
+		TempDir:       cfg.Backup.TempDir,
+		ResolveTarget: LocationResolver(cfg, esxiClient),
+	})
 	if err != nil {
 		return fmt.Errorf("failed to create backup manager: %w", err)
 	}
@@ -90,15 +111,33 @@ func runRestore(cmd *cobra.Command, args []string) error {
 
 	// Build restore options
 	opts := backup.RestoreOptions{
-		BackupID: backupID,
-		NewName:  restoreFlags.asNew,
-		PowerOn:  restoreFlags.powerOn,
+		BackupID:     backupID,
+		NewName:      restoreFlags.asNew,
+		PowerOn:      restoreFlags.powerOn,
+		InPlace:      restoreFlags.inPlace,
+		KeepOriginal: restoreFlags.keepOriginal,
+		IdentityFile: identityFile(restoreFlags.identity, cfg),
+	}
+
+	info, err := backupManager.GetBackup(backupID)
+	if err != nil {
+		return err
+	}
+
+	opts.Target, err = targetForLocation(info.Location, cfg, esxiClient)
+	if err != nil {
+		return err
+	}
+
+	vmName := restoreFlags.asNew
+	if restoreFlags.inPlace {
+		vmName = info.VMName
 	}
 
 	// Build guestinfo for re-IP if network options provided
 	if restoreFlags.ip != "" {
 		data := &cloudinit.CloudInitData{
-			Hostname: restoreFlags.asNew,
+			Hostname: vmName,
 			IP:       restoreFlags.ip,
 			Gateway:  restoreFlags.gateway,
 			DNS:      restoreFlags.dns,
@@ -117,11 +156,19 @@ func runRestore(cmd *cobra.Command, args []string) error {
 	}
 
 	// Restore the backup
-	fmt.Printf("Restoring backup '%s' as VM '%s'...\n", backupID, restoreFlags.asNew)
+	if restoreFlags.inPlace {
+		fmt.Printf("Restoring backup '%s' in place over VM '%s'...\n", backupID, vmName)
+	} else {
+		fmt.Printf("Restoring backup '%s' as VM '%s'...\n", backupID, vmName)
+	}
 	if restoreFlags.ip != "" {
 		fmt.Printf("Configuring network: IP=%s, Gateway=%s\n", restoreFlags.ip, restoreFlags.gateway)
 	}
 
+	ctx, t := task.Track(ctx, cfg.Tasks.DBPath, "backup.restore", backupID)
+	defer func() { t.Finish(vmName, err) }()
+	opts.Progress = t.Progress
+
 	if err := backupManager.RestoreBackup(ctx, opts); err != nil {
 		return fmt.Errorf("failed to restore backup: %w", err)
 	}
@@ -129,7 +176,7 @@ func runRestore(cmd *cobra.Command, args []string) error {
 	// Display result
 	fmt.Printf("\nBackup restored successfully:\n")
 	fmt.Printf("  Backup ID: %s\n", backupID)
-	fmt.Printf("  VM Name:   %s\n", restoreFlags.asNew)
+	fmt.Printf("  VM Name:   %s\n", vmName)
 	if restoreFlags.powerOn {
 		fmt.Printf("  Status:    Powered On\n")
 	} else {
@@ -0,0 +1,146 @@
+package backup
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/r11/esxi-commander/pkg/backup"
+	"github.com/r11/esxi-commander/pkg/config"
+	"github.com/r11/esxi-commander/pkg/esxi/client"
+)
+
+// NewTarget creates the backup target selected by name (--target or
+// backup.default_target)
+func NewTarget(name string, cfg *config.Config, esxiClient *client.ESXiClient) (backup.BackupTarget, error) {
+	if name == "" {
+		name = cfg.Backup.DefaultTarget
+	}
+
+	switch name {
+	case "", "datastore":
+		return backup.NewDatastoreTarget(esxiClient, cfg.Backup.Datastore.Name, cfg.Backup.Datastore.Path), nil
+	case "nfs":
+		if cfg.Backup.NFS.Path == "" {
+			return nil, fmt.Errorf("backup.nfs.path must be set to use the nfs target")
+		}
+		return backup.NewDirectoryTarget(cfg.Backup.NFS.Path)
+	case "s3":
+		if cfg.Backup.S3.Bucket == "" {
+			return nil, fmt.Errorf("backup.s3.bucket must be set to use the s3 target")
+		}
+		return backup.NewS3Target(s3Options(cfg.Backup.S3))
+	}
+
+	named, ok := cfg.Backup.Targets[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown target: %s", name)
+	}
+
+	switch named.Type {
+	case "sftp":
+		return backup.NewSFTPTarget(sftpOptions(named))
+	case "nfs":
+		return backup.NewDirectoryTarget(named.Path)
+	case "repo":
+		return backup.NewRepoTarget(named.Path)
+	default:
+		return nil, fmt.Errorf("backup.targets.%s: unsupported type %q", name, named.Type)
+	}
+}
+
+// targetForLocation creates the target holding a backup stored at location
+func targetForLocation(location string, cfg *config.Config, esxiClient *client.ESXiClient) (backup.BackupTarget, error) {
+	switch {
+	case location == "":
+		// Backups that failed before their target was recorded
+		return NewTarget("", cfg, esxiClient)
+	case strings.HasPrefix(location, "file://"):
+		return backup.NewDirectoryTarget(filepath.Dir(strings.TrimPrefix(location, "file://")))
+	case strings.HasPrefix(location, "s3://"):
+		// The bucket and prefix come from the location; endpoint and
+		// credentials from the configuration
+		bucket, key, _ := strings.Cut(strings.TrimPrefix(location, "s3://"), "/")
+		opts := s3Options(cfg.Backup.S3)
+		opts.Bucket = bucket
+		opts.Prefix = path.Dir(key)
+		return backup.NewS3Target(opts)
+	case strings.HasPrefix(location, "sftp://"):
+		return sftpTargetForLocation(location, cfg)
+	case strings.HasPrefix(location, "datastore://"), strings.HasPrefix(location, "repo://"):
+		return backup.TargetForLocation(esxiClient, location)
+	}
+	return NewTarget("datastore", cfg, esxiClient)
+}
+
+// LocationResolver lets the backup manager find the target of any stored
+// backup using the configured credentials
+func LocationResolver(cfg *config.Config, esxiClient *client.ESXiClient) backup.TargetResolver {
+	return func(location string) (backup.BackupTarget, error) {
+		return targetForLocation(location, cfg, esxiClient)
+	}
+}
+
+// sftpTargetForLocation finds the configured SFTP target whose user, host
+// and directory match location, since credentials are not stored with it
+func sftpTargetForLocation(location string, cfg *config.Config) (backup.BackupTarget, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup location %s: %w", location, err)
+	}
+
+	for _, named := range cfg.Backup.Targets {
+		if named.Type == "sftp" && named.Host == u.Host && named.User == u.User.Username() &&
+			path.Clean(named.Path) == path.Dir(u.Path) {
+			return backup.NewSFTPTarget(sftpOptions(named))
+		}
+	}
+	return nil, fmt.Errorf("no backup.targets entry matches %s", location)
+}
+
+func s3Options(cfg config.S3TargetConfig) backup.S3Options {
+	return backup.S3Options{
+		Endpoint:  cfg.Endpoint,
+		Region:    cfg.Region,
+		Bucket:    cfg.Bucket,
+		Prefix:    cfg.Prefix,
+		AccessKey: cfg.AccessKey,
+		SecretKey: cfg.SecretKey,
+		PathStyle: cfg.PathStyle,
+		PartSize:  int64(cfg.PartSizeMB) << 20,
+		LockMode:  cfg.LockMode,
+	}
+}
+
+func sftpOptions(cfg config.TargetConfig) backup.SFTPOptions {
+	return backup.SFTPOptions{
+		Host:       cfg.Host,
+		User:       cfg.User,
+		KeyPath:    cfg.SSHKey,
+		KnownHosts: cfg.KnownHosts,
+		Path:       cfg.Path,
+
+		InsecureHostKey: cfg.InsecureHostKey,
+	}
+}
+
+// identityFile returns the age identity file from the --identity flag or
+// backup.encryption.identity_file
+func identityFile(flag string, cfg *config.Config) string {
+	if flag != "" {
+		return flag
+	}
+	return cfg.Backup.Encryption.IdentityFile
+}
+
+// RetainUntil returns until when a backup created now is immutable, or the
+// zero time if days is not positive
+func RetainUntil(days int) time.Time {
+	if days <= 0 {
+		return time.Time{}
+	}
+	return time.Now().AddDate(0, 0, days)
+}
@@ -65,12 +65,62 @@ func runHealth(cmd *cobra.Command, args []string) error {
 	}
 	defer esxiClient.Close()
 
-	ctx := context.Background()
+	health, err := GetHealth(context.Background(), esxiClient)
+	if err != nil {
+		return err
+	}
+
+	jsonOutput, _ := cmd.Flags().GetBool("json")
+	if jsonOutput {
+		output, err := json.MarshalIndent(health, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal JSON: %w", err)
+		}
+		fmt.Println(string(output))
+	} else {
+		fmt.Printf("ESXi Host Health Status\n")
+		fmt.Printf("=======================\n\n")
+		fmt.Printf("Overall Status: %s\n", health.OverallStatus)
+
+		if len(health.Issues) > 0 {
+			fmt.Printf("\nIssues:\n")
+			for _, issue := range health.Issues {
+				fmt.Printf("  ! %s\n", issue)
+			}
+		}
+
+		if len(health.Alarms) > 0 {
+			fmt.Printf("\nActive Alarms:\n")
+			for _, alarm := range health.Alarms {
+				fmt.Printf("  - %s: %s\n", alarm.Name, alarm.Status)
+			}
+		}
 
+		if len(health.Sensors) > 0 {
+			fmt.Printf("\nSensors:\n")
+			for _, sensor := range health.Sensors {
+				fmt.Printf("  - %s (%s): %s", sensor.Name, sensor.Type, sensor.Status)
+				if sensor.Value != "" {
+					fmt.Printf(" - %s", sensor.Value)
+				}
+				fmt.Printf("\n")
+			}
+		}
+
+		if len(health.Issues) == 0 && len(health.Alarms) == 0 {
+			fmt.Printf("\n✓ No health issues detected\n")
+		}
+	}
+
+	return nil
+}
+
+// GetHealth collects the alarms and status issues of the host
+func GetHealth(ctx context.Context, esxiClient *client.ESXiClient) (*HealthStatus, error) {
 	// Get host information
 	host, err := esxiClient.GetHostSystem(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to get host system: %w", err)
+		return nil, fmt.Errorf("failed to get host system: %w", err)
 	}
 
 	var hostObj mo.HostSystem
@@ -81,7 +131,7 @@ func runHealth(cmd *cobra.Command, args []string) error {
 		"triggeredAlarmState",
 	}, &hostObj)
 	if err != nil {
-		return fmt.Errorf("failed to get host properties: %w", err)
+		return nil, fmt.Errorf("failed to get host properties: %w", err)
 	}
 
 	health := &HealthStatus{
@@ -127,47 +177,5 @@ func runHealth(cmd *cobra.Command, args []string) error {
 	}
 	health.Sensors = sensors
 
-	jsonOutput, _ := cmd.Flags().GetBool("json")
-	if jsonOutput {
-		output, err := json.MarshalIndent(health, "", "  ")
-		if err != nil {
-			return fmt.Errorf("failed to marshal JSON: %w", err)
-		}
-		fmt.Println(string(output))
-	} else {
-		fmt.Printf("ESXi Host Health Status\n")
-		fmt.Printf("=======================\n\n")
-		fmt.Printf("Overall Status: %s\n", health.OverallStatus)
-
-		if len(health.Issues) > 0 {
-			fmt.Printf("\nIssues:\n")
-			for _, issue := range health.Issues {
-				fmt.Printf("  ! %s\n", issue)
-			}
-		}
-
-		if len(health.Alarms) > 0 {
-			fmt.Printf("\nActive Alarms:\n")
-			for _, alarm := range health.Alarms {
-				fmt.Printf("  - %s: %s\n", alarm.Name, alarm.Status)
-			}
-		}
-
-		if len(health.Sensors) > 0 {
-			fmt.Printf("\nSensors:\n")
-			for _, sensor := range health.Sensors {
-				fmt.Printf("  - %s (%s): %s", sensor.Name, sensor.Type, sensor.Status)
-				if sensor.Value != "" {
-					fmt.Printf(" - %s", sensor.Value)
-				}
-				fmt.Printf("\n")
-			}
-		}
-
-		if len(health.Issues) == 0 && len(health.Alarms) == 0 {
-			fmt.Printf("\n✓ No health issues detected\n")
-		}
-	}
-
-	return nil
-}
\ No newline at end of file
+	return health, nil
+}
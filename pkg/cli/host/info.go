@@ -60,12 +60,46 @@ func runInfo(cmd *cobra.Command, args []string) error {
 	}
 	defer esxiClient.Close()
 
-	ctx := context.Background()
+	hostInfo, err := GetInfo(context.Background(), esxiClient)
+	if err != nil {
+		return err
+	}
+
+	jsonOutput, _ := cmd.Flags().GetBool("json")
+	if jsonOutput {
+		output, err := json.MarshalIndent(hostInfo, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal JSON: %w", err)
+		}
+		fmt.Println(string(output))
+	} else {
+		fmt.Printf("ESXi Host Information\n")
+		fmt.Printf("====================\n\n")
+		fmt.Printf("Name:               %s\n", hostInfo.Name)
+		fmt.Printf("Version:            %s (Build %s)\n", hostInfo.Version, hostInfo.Build)
+		fmt.Printf("Hardware:\n")
+		fmt.Printf("  Vendor:           %s\n", hostInfo.Vendor)
+		fmt.Printf("  Model:            %s\n", hostInfo.Model)
+		fmt.Printf("  CPU Sockets:      %d\n", hostInfo.CPUSockets)
+		fmt.Printf("  CPU Cores:        %d\n", hostInfo.CPUCores)
+		fmt.Printf("  CPU Threads:      %d\n", hostInfo.CPUThreads)
+		fmt.Printf("  CPU Model:        %s\n", hostInfo.CPUModel)
+		fmt.Printf("  Memory:           %d GB\n", hostInfo.MemoryTotal)
+		fmt.Printf("Status:\n")
+		fmt.Printf("  Power State:      %s\n", hostInfo.PowerState)
+		fmt.Printf("  Connection:       %s\n", hostInfo.ConnectionState)
+		fmt.Printf("  Maintenance Mode: %t\n", hostInfo.InMaintenanceMode)
+	}
 
+	return nil
+}
+
+// GetInfo collects the hardware, software and status information of the host
+func GetInfo(ctx context.Context, esxiClient *client.ESXiClient) (*HostInfo, error) {
 	// Get host information
 	host, err := esxiClient.GetHostSystem(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to get host system: %w", err)
+		return nil, fmt.Errorf("failed to get host system: %w", err)
 	}
 
 	var hostObj mo.HostSystem
@@ -76,7 +110,7 @@ func runInfo(cmd *cobra.Command, args []string) error {
 		"config",
 	}, &hostObj)
 	if err != nil {
-		return fmt.Errorf("failed to get host properties: %w", err)
+		return nil, fmt.Errorf("failed to get host properties: %w", err)
 	}
 
 	hostInfo := &HostInfo{
@@ -95,31 +129,5 @@ func runInfo(cmd *cobra.Command, args []string) error {
 		InMaintenanceMode: hostObj.Runtime.InMaintenanceMode,
 	}
 
-	jsonOutput, _ := cmd.Flags().GetBool("json")
-	if jsonOutput {
-		output, err := json.MarshalIndent(hostInfo, "", "  ")
-		if err != nil {
-			return fmt.Errorf("failed to marshal JSON: %w", err)
-		}
-		fmt.Println(string(output))
-	} else {
-		fmt.Printf("ESXi Host Information\n")
-		fmt.Printf("====================\n\n")
-		fmt.Printf("Name:               %s\n", hostInfo.Name)
-		fmt.Printf("Version:            %s (Build %s)\n", hostInfo.Version, hostInfo.Build)
-		fmt.Printf("Hardware:\n")
-		fmt.Printf("  Vendor:           %s\n", hostInfo.Vendor)
-		fmt.Printf("  Model:            %s\n", hostInfo.Model)
-		fmt.Printf("  CPU Sockets:      %d\n", hostInfo.CPUSockets)
-		fmt.Printf("  CPU Cores:        %d\n", hostInfo.CPUCores)
-		fmt.Printf("  CPU Threads:      %d\n", hostInfo.CPUThreads)
-		fmt.Printf("  CPU Model:        %s\n", hostInfo.CPUModel)
-		fmt.Printf("  Memory:           %d GB\n", hostInfo.MemoryTotal)
-		fmt.Printf("Status:\n")
-		fmt.Printf("  Power State:      %s\n", hostInfo.PowerState)
-		fmt.Printf("  Connection:       %s\n", hostInfo.ConnectionState)
-		fmt.Printf("  Maintenance Mode: %t\n", hostInfo.InMaintenanceMode)
-	}
-
-	return nil
-}
\ No newline at end of file
+	return hostInfo, nil
+}
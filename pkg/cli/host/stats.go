@@ -88,12 +88,55 @@ func runStats(cmd *cobra.Command, args []string) error {
 	}
 	defer esxiClient.Close()
 
-	ctx := context.Background()
+	stats, err := GetStats(context.Background(), esxiClient)
+	if err != nil {
+		return err
+	}
 
+	jsonOutput, _ := cmd.Flags().GetBool("json")
+	if jsonOutput {
+		output, err := json.MarshalIndent(stats, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal JSON: %w", err)
+		}
+		fmt.Println(string(output))
+	} else {
+		fmt.Printf("ESXi Host Resource Statistics\n")
+		fmt.Printf("============================\n")
+		fmt.Printf("Timestamp: %s\n\n", stats.Timestamp.Format("2006-01-02 15:04:05"))
+		
+		fmt.Printf("CPU:\n")
+		fmt.Printf("  Usage:      %d MHz / %d MHz (%.1f%%)\n", 
+			stats.CPU.UsageMHz, stats.CPU.TotalMHz, stats.CPU.UsagePercent)
+		
+		fmt.Printf("\nMemory:\n")
+		fmt.Printf("  Usage:      %d MB / %d MB (%.1f%%)\n", 
+			stats.Memory.UsageMB, stats.Memory.TotalMB, stats.Memory.UsagePercent)
+		
+		fmt.Printf("\nVirtual Machines:\n")
+		fmt.Printf("  Total:      %d\n", stats.VMs.Total)
+		fmt.Printf("  Running:    %d\n", stats.VMs.Running)
+		fmt.Printf("  Stopped:    %d\n", stats.VMs.Stopped)
+		fmt.Printf("  Suspended:  %d\n", stats.VMs.Suspended)
+
+		fmt.Printf("\nDatastores:\n")
+		for _, ds := range stats.Datastores {
+			fmt.Printf("  %s:\n", ds.Name)
+			fmt.Printf("    Capacity:   %d GB\n", ds.CapacityGB)
+			fmt.Printf("    Free:       %d GB\n", ds.FreeSpaceGB)
+			fmt.Printf("    Usage:      %.1f%%\n", ds.UsagePercent)
+		}
+	}
+
+	return nil
+}
+
+// GetStats collects the current resource usage of the host
+func GetStats(ctx context.Context, esxiClient *client.ESXiClient) (*HostStats, error) {
 	// Get host information
 	host, err := esxiClient.GetHostSystem(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to get host system: %w", err)
+		return nil, fmt.Errorf("failed to get host system: %w", err)
 	}
 
 	var hostObj mo.HostSystem
@@ -104,7 +147,7 @@ func runStats(cmd *cobra.Command, args []string) error {
 		"datastore",
 	}, &hostObj)
 	if err != nil {
-		return fmt.Errorf("failed to get host properties: %w", err)
+		return nil, fmt.Errorf("failed to get host properties: %w", err)
 	}
 
 	stats := &HostStats{
@@ -188,40 +231,5 @@ func runStats(cmd *cobra.Command, args []string) error {
 		Suspended: suspended,
 	}
 
-	jsonOutput, _ := cmd.Flags().GetBool("json")
-	if jsonOutput {
-		output, err := json.MarshalIndent(stats, "", "  ")
-		if err != nil {
-			return fmt.Errorf("failed to marshal JSON: %w", err)
-		}
-		fmt.Println(string(output))
-	} else {
-		fmt.Printf("ESXi Host Resource Statistics\n")
-		fmt.Printf("============================\n")
-		fmt.Printf("Timestamp: %s\n\n", stats.Timestamp.Format("2006-01-02 15:04:05"))
-		
-		fmt.Printf("CPU:\n")
-		fmt.Printf("  Usage:      %d MHz / %d MHz (%.1f%%)\n", 
-			stats.CPU.UsageMHz, stats.CPU.TotalMHz, stats.CPU.UsagePercent)
-		
-		fmt.Printf("\nMemory:\n")
-		fmt.Printf("  Usage:      %d MB / %d MB (%.1f%%)\n", 
-			stats.Memory.UsageMB, stats.Memory.TotalMB, stats.Memory.UsagePercent)
-		
-		fmt.Printf("\nVirtual Machines:\n")
-		fmt.Printf("  Total:      %d\n", stats.VMs.Total)
-		fmt.Printf("  Running:    %d\n", stats.VMs.Running)
-		fmt.Printf("  Stopped:    %d\n", stats.VMs.Stopped)
-		fmt.Printf("  Suspended:  %d\n", stats.VMs.Suspended)
-
-		fmt.Printf("\nDatastores:\n")
-		for _, ds := range stats.Datastores {
-			fmt.Printf("  %s:\n", ds.Name)
-			fmt.Printf("    Capacity:   %d GB\n", ds.CapacityGB)
-			fmt.Printf("    Free:       %d GB\n", ds.FreeSpaceGB)
-			fmt.Printf("    Usage:      %.1f%%\n", ds.UsagePercent)
-		}
-	}
-
-	return nil
-}
\ No newline at end of file
+	return stats, nil
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/r11/esxi-commander/pkg/cli/host"
 	"github.com/r11/esxi-commander/pkg/cli/pci"
 	"github.com/r11/esxi-commander/pkg/cli/setup"
+	"github.com/r11/esxi-commander/pkg/cli/task"
 	"github.com/r11/esxi-commander/pkg/cli/template"
 	"github.com/r11/esxi-commander/pkg/cli/vm"
 	"github.com/r11/esxi-commander/pkg/security"
@@ -46,6 +47,7 @@ func init() {
 	rootCmd.AddCommand(template.TemplateCmd)
 	rootCmd.AddCommand(pci.PciCmd)
 	rootCmd.AddCommand(host.HostCmd)
+	rootCmd.AddCommand(task.TaskCmd)
 	rootCmd.AddCommand(setup.SetupCmd)
 	rootCmd.AddCommand(examples.ExamplesCmd)
 }
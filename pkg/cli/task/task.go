@@ -0,0 +1,277 @@
+package task
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/r11/esxi-commander/internal/storage"
+	"github.com/r11/esxi-commander/pkg/config"
+	"github.com/r11/esxi-commander/pkg/esxi/client"
+	"github.com/r11/esxi-commander/pkg/tasks"
+	"github.com/spf13/cobra"
+)
+
+var TaskCmd = &cobra.Command{
+	Use:   "task",
+	Short: "Follow and cancel long-running operations",
+	Long: `Follow and cancel long-running operations.
+
+VM create and clone, backup create and restore run as tasks with a durable
+ID, whether started by ceso or cesod. A task records its state transitions
+and the ESXi task it is waiting on. When the process running a task exits
+without finishing it, the task becomes "interrupted"; running the same
+operation again resumes it under the same ID and, for create and clone,
+waits for the clone ESXi already has underway.`,
+}
+
+var taskFlags struct {
+	json bool
+	all  bool
+}
+
+func init() {
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List tasks, newest first",
+		Args:  cobra.NoArgs,
+		RunE:  runList,
+	}
+	listCmd.Flags().BoolVar(&taskFlags.all, "all", false, "Include tasks that finished")
+
+	showCmd := &cobra.Command{
+		Use:   "show <task-id>",
+		Short: "Show a task and its history",
+		Args:  cobra.ExactArgs(1),
+		RunE:  runShow,
+	}
+
+	waitCmd := &cobra.Command{
+		Use:   "wait <task-id>",
+		Short: "Wait for a task to finish",
+		Long: `Wait for a task to finish. The command fails if the task does not
+succeed.`,
+		Args: cobra.ExactArgs(1),
+		RunE: runWait,
+	}
+
+	cancelCmd := &cobra.Command{
+		Use:   "cancel <task-id>",
+		Short: "Cancel a running task",
+		Long: `Cancel a running task. The process running it stops at its next check,
+and the ESXi task it is waiting on is cancelled.`,
+		Args: cobra.ExactArgs(1),
+		RunE: runCancel,
+	}
+
+	for _, cmd := range []*cobra.Command{listCmd, showCmd, waitCmd, cancelCmd} {
+		cmd.Flags().BoolVar(&taskFlags.json, "json", false, "Output in JSON format")
+		TaskCmd.AddCommand(cmd)
+	}
+}
+
+// Track starts tracking an operation in the task database at path and
+// prints its ID. Tracking is best effort: if the database can't be used,
+// the operation runs untracked and the returned task is nil.
+func Track(ctx context.Context, path, kind, target string) (context.Context, *tasks.Task) {
+	ctx, t, err := tasks.NewManager(path).Start(ctx, kind, target)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: operation not tracked as a task: %v\n", err)
+		return ctx, nil
+	}
+	fmt.Printf("Task: %s\n", t.ID())
+	return ctx, t
+}
+
+func manager() (*tasks.Manager, *config.Config, error) {
+	cfg, err := config.Load("")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load config: %w", err)
+	}
+	return tasks.NewManager(cfg.Tasks.DBPath), cfg, nil
+}
+
+func runList(cmd *cobra.Command, args []string) error {
+	m, _, err := manager()
+	if err != nil {
+		return err
+	}
+
+	entries, err := m.List()
+	if err != nil {
+		return fmt.Errorf("failed to list tasks: %w", err)
+	}
+	if !taskFlags.all {
+		var active []*storage.TaskEntry
+		for _, e := range entries {
+			if !e.Done() {
+				active = append(active, e)
+			}
+		}
+		entries = active
+	}
+
+	if taskFlags.json {
+		return outputJSON(entries)
+	}
+
+	if len(entries) == 0 {
+		fmt.Println("No tasks")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintln(w, "ID\tKIND\tTARGET\tSTATE\tSTAGE\tPROGRESS\tSTARTED")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			e.ID, e.Kind, e.Target, e.State, dash(e.Stage), percent(e), e.Created.Format("2006-01-02 15:04:05"))
+	}
+	return nil
+}
+
+func runShow(cmd *cobra.Command, args []string) error {
+	m, _, err := manager()
+	if err != nil {
+		return err
+	}
+
+	e, err := m.Get(args[0])
+	if err != nil {
+		return err
+	}
+
+	if taskFlags.json {
+		return outputJSON(e)
+	}
+	printTask(e)
+	return nil
+}
+
+func runWait(cmd *cobra.Command, args []string) error {
+	m, _, err := manager()
+	if err != nil {
+		return err
+	}
+
+	e, err := m.Wait(cmd.Context(), args[0])
+	if err != nil {
+		return err
+	}
+
+	if taskFlags.json {
+		if err := outputJSON(e); err != nil {
+			return err
+		}
+	} else {
+		printTask(e)
+	}
+
+	if e.State != storage.TaskSucceeded {
+		return fmt.Errorf("task %s %s", e.ID, e.State)
+	}
+	return nil
+}
+
+func runCancel(cmd *cobra.Command, args []string) error {
+	m, cfg, err := manager()
+	if err != nil {
+		return err
+	}
+
+	e, err := m.Get(args[0])
+	if err != nil {
+		return err
+	}
+
+	// The ESXi task can only be cancelled with a connection to the host
+	var esxiClient *client.ESXiClient
+	if e.ESXiTask != "" {
+		esxiClient, err = client.NewClient(&client.Config{
+			Host:     cfg.ESXi.Host,
+			User:     cfg.ESXi.User,
+			Password: cfg.ESXi.Password,
+			Insecure: cfg.ESXi.Insecure,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create ESXi client: %w", err)
+		}
+		defer esxiClient.Close()
+	}
+
+	ctx := cmd.Context()
+	if esxiClient != nil {
+		e, err = m.Cancel(ctx, esxiClient.Client(), e.ID)
+	} else {
+		e, err = m.Cancel(ctx, nil, e.ID)
+	}
+	if err != nil {
+		return err
+	}
+
+	if taskFlags.json {
+		return outputJSON(e)
+	}
+	if e.State == storage.TaskCancelled {
+		fmt.Printf("Task %s cancelled\n", e.ID)
+	} else {
+		fmt.Printf("Cancellation of task %s requested\n", e.ID)
+	}
+	return nil
+}
+
+func printTask(e *storage.TaskEntry) {
+	fmt.Printf("ID:       %s\n", e.ID)
+	fmt.Printf("Kind:     %s\n", e.Kind)
+	fmt.Printf("Target:   %s\n", e.Target)
+	fmt.Printf("State:    %s\n", e.State)
+	if e.Stage != "" {
+		fmt.Printf("Stage:    %s (%s)\n", e.Stage, percent(e))
+	}
+	if e.Result != "" {
+		fmt.Printf("Result:   %s\n", e.Result)
+	}
+	if e.Error != "" {
+		fmt.Printf("Error:    %s\n", e.Error)
+	}
+	if e.ESXiTask != "" {
+		fmt.Printf("ESXi:     %s\n", e.ESXiTask)
+	}
+	fmt.Printf("Process:  %d on %s\n", e.PID, e.Host)
+	fmt.Printf("Started:  %s\n", e.Created.Format("2006-01-02 15:04:05"))
+	if e.Finished != nil {
+		fmt.Printf("Finished: %s (%s)\n", e.Finished.Format("2006-01-02 15:04:05"), e.Finished.Sub(e.Created).Round(time.Second))
+	}
+
+	fmt.Println("\nHistory:")
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+	for _, h := range e.History {
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%s\n", h.Time.Format("15:04:05"), h.State, dash(h.Stage), h.Note)
+	}
+}
+
+func outputJSON(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func percent(e *storage.TaskEntry) string {
+	if e.Percent < 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.0f%%", e.Percent)
+}
+
+func dash(s string) string {
+	if strings.TrimSpace(s) == "" {
+		return "-"
+	}
+	return s
+}
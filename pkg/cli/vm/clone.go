@@ -9,6 +9,7 @@ import (
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"github.com/r11/esxi-commander/pkg/cli/task"
 	"github.com/r11/esxi-commander/pkg/cloudinit"
 	"github.com/r11/esxi-commander/pkg/esxi/client"
 	"github.com/r11/esxi-commander/pkg/esxi/vm"
@@ -36,7 +37,7 @@ func init() {
 	cloneCmd.Flags().StringVar(&cloneSSHKey, "ssh-key", "", "SSH public key for ubuntu user")
 }
 
-func runClone(cmd *cobra.Command, args []string) error {
+func runClone(cmd *cobra.Command, args []string) (err error) {
 	sourceName := args[0]
 	destName := args[1]
 	ctx := context.Background()
@@ -97,9 +98,13 @@ func runClone(cmd *cobra.Command, args []string) error {
 		}
 	}
 
+	ctx, t := task.Track(ctx, viper.GetString("tasks.db_path"), "vm.clone", destName)
+	defer func() { t.Finish(destName, err) }()
+
 	start := time.Now()
 
 	vmOps := vm.NewOperations(esxi)
+	t.Progress("clone", -1)
 	newVM, err := vmOps.CloneVM(ctx, sourceName, destName, guestinfo)
 	if err != nil {
 		return fmt.Errorf("failed to clone VM: %w", err)
@@ -107,6 +112,7 @@ func runClone(cmd *cobra.Command, args []string) error {
 
 	duration := time.Since(start)
 
+	t.Progress("power on", -1)
 	if err := vmOps.PowerOn(ctx, newVM); err != nil {
 		return fmt.Errorf("failed to power on VM: %w", err)
 	}
@@ -9,6 +9,7 @@ import (
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"github.com/r11/esxi-commander/pkg/cli/task"
 	"github.com/r11/esxi-commander/pkg/cloudinit"
 	"github.com/r11/esxi-commander/pkg/esxi/client"
 	"github.com/r11/esxi-commander/pkg/esxi/pci"
@@ -49,7 +50,7 @@ func init() {
 	createCmd.MarkFlagRequired("template")
 }
 
-func runCreate(cmd *cobra.Command, args []string) error {
+func runCreate(cmd *cobra.Command, args []string) (err error) {
 	vmName := args[0]
 	ctx := context.Background()
 	
@@ -137,9 +138,13 @@ func runCreate(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("failed to build cloud-init: %w", err)
 	}
 	
+	ctx, t := task.Track(ctx, viper.GetString("tasks.db_path"), "vm.create", vmName)
+	defer func() { t.Finish(vmName, err) }()
+	
 	start := time.Now()
 	
 	vmOps := vm.NewOperations(esxi)
+	t.Progress("clone", -1)
 	newVM, err := vmOps.CreateFromTemplate(ctx, &vm.CreateOptions{
 		Name:      vmName,
 		Template:  template,
@@ -156,6 +161,7 @@ func runCreate(cmd *cobra.Command, args []string) error {
 	// Attach GPU if specified (VM must be powered off for PCI attachment)
 	if gpu != "" {
 		fmt.Printf("Attaching GPU device %s...\n", gpu)
+		t.Progress("attach gpu", -1)
 		pciAttachment := pci.NewAttachment(esxi)
 		
 		// Validate GPU device first
@@ -173,6 +179,7 @@ func runCreate(cmd *cobra.Command, args []string) error {
 	
 	duration := time.Since(start)
 	
+	t.Progress("power on", -1)
 	if err := vmOps.PowerOn(ctx, newVM); err != nil {
 		return fmt.Errorf("failed to power on VM: %w", err)
 	}
@@ -0,0 +1,222 @@
+package vm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/r11/esxi-commander/pkg/esxi/client"
+	"github.com/r11/esxi-commander/pkg/esxi/vm"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var reconfigureCmd = &cobra.Command{
+	Use:   "reconfigure <name>",
+	Short: "Change a VM's CPU, memory, disk and resource allocation",
+	Long: `Change the CPU, memory, disk size, hot-add settings and resource
+allocation of an existing VM. Only the flags given are changed.
+
+CPUs and memory can be added to a running VM when CPU or memory hot add
+is enabled on it; removing them, changing cores per socket and turning
+hot add on or off need the VM powered off. Disks can only grow, and not
+while the VM has snapshots.
+
+--reservation, --limit and --shares take cpu= and mem= values, e.g.
+--reservation cpu=2000,mem=4096. CPU is in MHz and memory in MB, limits
+can be "unlimited" and shares are low, normal, high or a number.
+
+With --dry-run the changes are validated and shown without applying them.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runReconfigure,
+}
+
+var reconfigureFlags struct {
+	cpu            int
+	coresPerSocket int
+	memory         int
+	cpuHotAdd      bool
+	memHotAdd      bool
+	disk           string
+	diskSize       int
+	reservation    string
+	limit          string
+	shares         string
+}
+
+func init() {
+	reconfigureCmd.Flags().IntVar(&reconfigureFlags.cpu, "cpu", 0, "Number of vCPUs")
+	reconfigureCmd.Flags().IntVar(&reconfigureFlags.coresPerSocket, "cores-per-socket", 0, "Cores per CPU socket")
+	reconfigureCmd.Flags().IntVar(&reconfigureFlags.memory, "memory", 0, "Memory in GB")
+	reconfigureCmd.Flags().BoolVar(&reconfigureFlags.cpuHotAdd, "cpu-hot-add", false, "Enable CPU hot add (--cpu-hot-add=false disables it)")
+	reconfigureCmd.Flags().BoolVar(&reconfigureFlags.memHotAdd, "mem-hot-add", false, "Enable memory hot add (--mem-hot-add=false disables it)")
+	reconfigureCmd.Flags().IntVar(&reconfigureFlags.diskSize, "disk-size", 0, "Grow the disk to this size in GB")
+	reconfigureCmd.Flags().StringVar(&reconfigureFlags.disk, "disk", "", "Disk to grow, e.g. \"Hard disk 2\" (default: the first disk)")
+	reconfigureCmd.Flags().StringVar(&reconfigureFlags.reservation, "reservation", "", "Reservations, e.g. cpu=2000,mem=4096 (MHz, MB)")
+	reconfigureCmd.Flags().StringVar(&reconfigureFlags.limit, "limit", "", "Limits, e.g. cpu=4000,mem=unlimited (MHz, MB)")
+	reconfigureCmd.Flags().StringVar(&reconfigureFlags.shares, "shares", "", "Shares, e.g. cpu=high,mem=normal (low, normal, high or a number)")
+}
+
+func runReconfigure(cmd *cobra.Command, args []string) error {
+	vmName := args[0]
+	ctx := context.Background()
+
+	opts, err := reconfigureOptions(cmd)
+	if err != nil {
+		return err
+	}
+
+	esxiCfg := &client.Config{
+		Host:     viper.GetString("esxi.host"),
+		User:     viper.GetString("esxi.user"),
+		Password: os.Getenv("ESXI_PASSWORD"),
+		Insecure: viper.GetBool("esxi.insecure"),
+		Timeout:  30 * time.Second,
+	}
+
+	if esxiCfg.Password == "" {
+		esxiCfg.Password = viper.GetString("esxi.password")
+	}
+
+	esxi, err := client.NewClient(esxiCfg)
+	if err != nil {
+		return fmt.Errorf("failed to connect to ESXi: %w", err)
+	}
+	defer esxi.Close()
+
+	vmOps := vm.NewOperations(esxi)
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	jsonOutput, _ := cmd.Flags().GetBool("json")
+
+	var plan *vm.ReconfigurePlan
+	if dryRun {
+		plan, err = vmOps.PlanReconfigure(ctx, vmName, opts)
+	} else {
+		plan, err = vmOps.Reconfigure(ctx, vmName, opts)
+	}
+	if err != nil {
+		return err
+	}
+
+	if jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(plan)
+	}
+
+	if len(plan.Changes) == 0 {
+		fmt.Printf("VM '%s' already has these settings; nothing to change\n", vmName)
+		return nil
+	}
+
+	if dryRun {
+		fmt.Printf("[DRY-RUN] Would reconfigure VM '%s' (%s):\n", vmName, plan.PowerState)
+	} else {
+		fmt.Printf("✅ VM '%s' reconfigured:\n", vmName)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "  SETTING\tFROM\tTO")
+	for _, change := range plan.Changes {
+		fmt.Fprintf(w, "  %s\t%s\t%s\n", change.Setting, change.From, change.To)
+	}
+	return w.Flush()
+}
+
+// reconfigureOptions builds the reconfigure options from the flags that
+// were given on the command line
+func reconfigureOptions(cmd *cobra.Command) (vm.ReconfigureOptions, error) {
+	var opts vm.ReconfigureOptions
+	flags := cmd.Flags()
+
+	if flags.Changed("cpu") {
+		opts.CPU = int32Ptr(reconfigureFlags.cpu)
+	}
+	if flags.Changed("cores-per-socket") {
+		opts.CoresPerSocket = int32Ptr(reconfigureFlags.coresPerSocket)
+	}
+	if flags.Changed("memory") {
+		if reconfigureFlags.memory < 1 {
+			return opts, fmt.Errorf("--memory must be at least 1 GB")
+		}
+		memoryMB := int64(reconfigureFlags.memory) * 1024
+		opts.MemoryMB = &memoryMB
+	}
+	if flags.Changed("cpu-hot-add") {
+		opts.CPUHotAdd = &reconfigureFlags.cpuHotAdd
+	}
+	if flags.Changed("mem-hot-add") {
+		opts.MemoryHotAdd = &reconfigureFlags.memHotAdd
+	}
+	if flags.Changed("disk-size") {
+		diskGB := int64(reconfigureFlags.diskSize)
+		opts.DiskGB = &diskGB
+	} else if flags.Changed("disk") {
+		return opts, fmt.Errorf("--disk needs --disk-size")
+	}
+	opts.Disk = reconfigureFlags.disk
+
+	reservations, err := parseAllocationFlag("reservation", reconfigureFlags.reservation)
+	if err != nil {
+		return opts, err
+	}
+	limits, err := parseAllocationFlag("limit", reconfigureFlags.limit)
+	if err != nil {
+		return opts, err
+	}
+	shares, err := parseAllocationFlag("shares", reconfigureFlags.shares)
+	if err != nil {
+		return opts, err
+	}
+
+	for resource, allocation := range map[string]*vm.AllocationChange{"cpu": &opts.CPUAllocation, "mem": &opts.MemoryAllocation} {
+		if value, ok := reservations[resource]; ok {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 0 {
+				return opts, fmt.Errorf("invalid --reservation %s=%s: must be a number", resource, value)
+			}
+			allocation.Reservation = &n
+		}
+		if value, ok := limits[resource]; ok {
+			n := int64(-1)
+			if value != "unlimited" {
+				n, err = strconv.ParseInt(value, 10, 64)
+				if err != nil || n < 0 {
+					return opts, fmt.Errorf("invalid --limit %s=%s: must be a number or unlimited", resource, value)
+				}
+			}
+			allocation.Limit = &n
+		}
+		allocation.Shares = shares[resource]
+	}
+
+	return opts, nil
+}
+
+// parseAllocationFlag parses a cpu=...,mem=... flag value
+func parseAllocationFlag(flag, value string) (map[string]string, error) {
+	values := make(map[string]string)
+	if value == "" {
+		return values, nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		key, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if key == "memory" {
+			key = "mem"
+		}
+		if !ok || v == "" || (key != "cpu" && key != "mem") {
+			return nil, fmt.Errorf("invalid --%s %q: expected cpu=<value>,mem=<value>", flag, pair)
+		}
+		values[key] = v
+	}
+	return values, nil
+}
+
+func int32Ptr(n int) *int32 {
+	v := int32(n)
+	return &v
+}
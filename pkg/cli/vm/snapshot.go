@@ -260,7 +260,7 @@ func runSnapshotRevert(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("failed to list snapshots: %w", err)
 	}
 
-	snapshotRef, found := findSnapshotByName(snapshots, snapshotName)
+	snapshotRef, found := FindSnapshotByName(snapshots, snapshotName)
 	if !found {
 		return fmt.Errorf("snapshot '%s' not found", snapshotName)
 	}
@@ -311,7 +311,7 @@ func runSnapshotDelete(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("failed to list snapshots: %w", err)
 	}
 
-	snapshotRef, found := findSnapshotByName(snapshots, snapshotName)
+	snapshotRef, found := FindSnapshotByName(snapshots, snapshotName)
 	if !found {
 		return fmt.Errorf("snapshot '%s' not found", snapshotName)
 	}
@@ -330,13 +330,14 @@ func runSnapshotDelete(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
-func findSnapshotByName(snapshots []types.VirtualMachineSnapshotTree, name string) (types.ManagedObjectReference, bool) {
+// FindSnapshotByName returns the snapshot named name anywhere in the tree
+func FindSnapshotByName(snapshots []types.VirtualMachineSnapshotTree, name string) (types.ManagedObjectReference, bool) {
 	for _, snap := range snapshots {
 		if snap.Name == name {
 			return snap.Snapshot, true
 		}
 		if len(snap.ChildSnapshotList) > 0 {
-			if ref, found := findSnapshotByName(snap.ChildSnapshotList, name); found {
+			if ref, found := FindSnapshotByName(snap.ChildSnapshotList, name); found {
 				return ref, true
 			}
 		}
@@ -24,4 +24,5 @@ func init() {
 	VmCmd.AddCommand(consoleCmd)
 	VmCmd.AddCommand(NewSnapshotCommand())
 	VmCmd.AddCommand(statsCmd)
+	VmCmd.AddCommand(reconfigureCmd)
 }
@@ -14,6 +14,8 @@ type Config struct {
 	Security SecurityConfig `yaml:"security"`
 	Backup   BackupConfig   `yaml:"backup"`
 	Metrics  MetricsConfig  `yaml:"metrics"`
+	API      APIConfig      `yaml:"api"`
+	Tasks    TasksConfig    `yaml:"tasks"`
 }
 
 type ESXiConfig struct {
@@ -40,17 +42,134 @@ type SecurityConfig struct {
 }
 
 type BackupConfig struct {
-	CatalogPath   string           `yaml:"catalog_path"`
-	DefaultTarget string           `yaml:"default_target"`
-	Compression   string           `yaml:"compression"`
-	Retention     RetentionConfig  `yaml:"retention"`
+	CatalogPath        string                  `yaml:"catalog_path"`
+	DefaultTarget      string                  `yaml:"default_target"`
+	Compression        string                  `yaml:"compression"`
+	CompressionLevel   int                     `yaml:"compression_level"`
+	CompressionThreads int                     `yaml:"compression_threads"`
+	TempDir            string                  `yaml:"temp_dir"`
+	Retention          RetentionConfig         `yaml:"retention"`
+	Datastore          DatastoreTargetConfig   `yaml:"datastore"`
+	NFS                DirectoryTargetConfig   `yaml:"nfs"`
+	S3                 S3TargetConfig          `yaml:"s3"`
+	Targets            map[string]TargetConfig `yaml:"targets"`
+	Encryption         EncryptionConfig        `yaml:"encryption"`
+	Hooks              map[string]HookConfig   `yaml:"hooks"`          // Keyed by VM name
+	MaxConcurrent      int                     `yaml:"max_concurrent"` // Backups run at once; default 2
+	ImmutableDays      int                     `yaml:"immutable_days"` // Lock new backups against deletion for N days; 0 disables
+	Drill              DrillConfig             `yaml:"drill"`          // Defaults for ceso backup drill and drill jobs
+	Jobs               []JobConfig             `yaml:"jobs"`           // Scheduled by cesod
+}
+
+// JobConfig is a backup job cesod runs on a cron schedule
+type JobConfig struct {
+	Name        string           `yaml:"name"`
+	Schedule    string           `yaml:"schedule"` // cron expression, e.g. "0 2 * * *", or @daily
+	Timezone    string           `yaml:"timezone"` // IANA name the schedule is evaluated in; default local time
+	VMs         []string         `yaml:"vms"`
+	Tags        []string         `yaml:"tags"` // Also select VMs whose notes have a "tags:" line with any of these
+	Mode        string           `yaml:"mode"` // hot (default) or cold
+	Incremental bool             `yaml:"incremental"`
+	Target      string           `yaml:"target"`
+	CopyTo      []string         `yaml:"copy_to"` // Targets each new backup is replicated to
+	Description string           `yaml:"description"`
+	Retention   *RetentionConfig `yaml:"retention"` // Pruning after each run; omit to keep every backup
+
+	// Makes this a drill job: the newest backup of each selected VM is
+	// restore-tested instead of a backup being taken. Unset fields fall back
+	// to backup.drill.
+	Drill *DrillConfig `yaml:"drill"`
+}
+
+// DrillConfig configures restore drills
+type DrillConfig struct {
+	Network   string `yaml:"network"`    // Isolated port group the drill VM is connected to
+	Timeout   int    `yaml:"timeout"`    // Seconds from power on to the last check; default 600
+	WaitIP    bool   `yaml:"wait_ip"`    // Also wait for the guest to report an IP address
+	ProbePort int    `yaml:"probe_port"` // Also connect to this TCP port on the guest IP
+}
+
+// HookConfig configures the guest commands run around a VM's backup
+// snapshot
+type HookConfig struct {
+	Transport  string   `yaml:"transport"` // guest (VMware Tools, default) or ssh
+	User       string   `yaml:"user"`
+	Password   string   `yaml:"password"`    // guest
+	Host       string   `yaml:"host"`        // host or host:port (ssh)
+	SSHKey     string   `yaml:"ssh_key"`     // ssh
+	KnownHosts string   `yaml:"known_hosts"` // ssh
+	Timeout    int      `yaml:"timeout"`     // Seconds per command; default 60
+	PreFreeze  []string `yaml:"pre_freeze"`
+	PostThaw   []string `yaml:"post_thaw"`
+
+	InsecureHostKey bool `yaml:"insecure_host_key"` // ssh: accept any host key instead of known_hosts
+}
+
+// EncryptionConfig configures age encryption of backup streams
+type EncryptionConfig struct {
+	Recipients   []string `yaml:"recipients"`    // age public keys (age1...)
+	IdentityFile string   `yaml:"identity_file"` // default identity for restore/verify
+}
+
+type DatastoreTargetConfig struct {
+	Name string `yaml:"name"`
+	Path string `yaml:"path"`
+}
+
+// DirectoryTargetConfig configures a local or NFS-mounted backup directory
+type DirectoryTargetConfig struct {
+	Path string `yaml:"path"`
+}
+
+// S3TargetConfig configures an S3-compatible bucket (AWS S3, MinIO, ...)
+type S3TargetConfig struct {
+	Endpoint   string `yaml:"endpoint"`
+	Region     string `yaml:"region"`
+	Bucket     string `yaml:"bucket"`
+	Prefix     string `yaml:"prefix"`
+	AccessKey  string `yaml:"access_key"`
+	SecretKey  string `yaml:"secret_key"`
+	PathStyle  bool   `yaml:"path_style"`
+	PartSizeMB int    `yaml:"part_size_mb"`
+	LockMode   string `yaml:"object_lock_mode"` // governance (default) or compliance
+}
+
+// TargetConfig is a named backup target under backup.targets, selected with
+// --target <name>
+type TargetConfig struct {
+	Type       string `yaml:"type"` // sftp, nfs, repo
+	Host       string `yaml:"host"` // host or host:port (sftp)
+	User       string `yaml:"user"`
+	SSHKey     string `yaml:"ssh_key"`
+	KnownHosts string `yaml:"known_hosts"`
+	Path       string `yaml:"path"`
+
+	InsecureHostKey bool `yaml:"insecure_host_key"` // sftp: accept any host key instead of known_hosts
 }
 
 type RetentionConfig struct {
-	KeepLast    int `yaml:"keep_last"`
-	KeepDaily   int `yaml:"keep_daily"`
-	KeepWeekly  int `yaml:"keep_weekly"`
-	KeepMonthly int `yaml:"keep_monthly"`
+	KeepLast    int    `yaml:"keep_last"`
+	KeepDaily   int    `yaml:"keep_daily"`
+	KeepWeekly  int    `yaml:"keep_weekly"`
+	KeepMonthly int    `yaml:"keep_monthly"`
+	Timezone    string `yaml:"timezone"` // IANA name for day/week/month boundaries
+}
+
+// APIConfig configures the JSON-RPC and REST APIs served by cesod
+type APIConfig struct {
+	Socket   string `yaml:"socket"`    // Unix socket path; default /run/ceso/cesod.sock
+	Listen   string `yaml:"listen"`    // host:port for JSON-RPC over TLS; empty disables it
+	TLSCert  string `yaml:"tls_cert"`  // Server certificate for listen
+	TLSKey   string `yaml:"tls_key"`
+	ClientCA string `yaml:"client_ca"` // CA that signs client certificates; required with listen
+
+	HTTPListen string `yaml:"http_listen"` // host:port for the REST API; empty disables it
+	Token      string `yaml:"token"`       // Bearer token REST clients must send; required with http_listen
+}
+
+// TasksConfig configures where long-running operations are tracked
+type TasksConfig struct {
+	DBPath string `yaml:"db_path"` // Shared by ceso and cesod; default /var/lib/ceso/tasks.db
 }
 
 type MetricsConfig struct {
@@ -101,6 +220,12 @@ func Load(path string) (*Config, error) {
 	if config.Backup.Compression == "" {
 		config.Backup.Compression = "gzip"
 	}
+	if config.Tasks.DBPath == "" {
+		config.Tasks.DBPath = "/var/lib/ceso/tasks.db"
+	}
+	if config.API.Socket == "" {
+		config.API.Socket = "/run/ceso/cesod.sock"
+	}
 	if config.Metrics.Port == 0 {
 		config.Metrics.Port = 9090
 	}
@@ -0,0 +1,858 @@
+package diskfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	superblockOffset = 1024
+	superblockSize   = 1024
+	ext4Magic        = 0xef53
+	rootInode        = 2
+	maxSymlinkHops   = 40
+)
+
+// Superblock feature flags
+const (
+	compatHasJournal   = 0x4
+	compatSparseSuper2 = 0x200
+
+	incompatCompression = 0x1
+	incompatFiletype    = 0x2
+	incompatRecover     = 0x4
+	incompatJournalDev  = 0x8
+	incompatMetaBG      = 0x10
+	incompatExtents     = 0x40
+	incompat64Bit       = 0x80
+	incompatMMP         = 0x100
+	incompatFlexBG      = 0x200
+	incompatEAInode     = 0x400
+	incompatDirData     = 0x1000
+	incompatCsumSeed    = 0x2000
+	incompatLargeDir    = 0x4000
+	incompatInlineData  = 0x8000
+	incompatEncrypt     = 0x10000
+	incompatCasefold    = 0x20000
+
+	roCompatSparseSuper = 0x1
+
+	// Features that change nothing a reader of files and directories needs
+	// to know about. Encrypted and inline-data inodes are refused one by one.
+	supportedIncompat = incompatFiletype | incompatRecover | incompatMetaBG |
+		incompatExtents | incompat64Bit | incompatMMP | incompatFlexBG |
+		incompatEAInode | incompatCsumSeed | incompatLargeDir |
+		incompatInlineData | incompatEncrypt | incompatCasefold
+)
+
+// Inode flags
+const (
+	inodeEncrypted  = 0x800
+	inodeExtents    = 0x80000
+	inodeInlineData = 0x10000000
+)
+
+const (
+	extentMagic      = 0xf30a
+	extentMaxDepth   = 5
+	extentUnwritten  = 32768
+	inodeBlockBytes  = 60
+	maxSymlinkLength = 4096
+)
+
+// superblock holds the superblock fields the reader uses
+type superblock struct {
+	inodesCount    uint32
+	blocksCount    uint64
+	firstDataBlock uint32
+	blockSize      int64
+	blocksPerGroup uint32
+	inodesPerGroup uint32
+	inodeSize      int64
+	compat         uint32
+	incompat       uint32
+	roCompat       uint32
+	label          string
+	descSize       int64
+	firstMetaBG    uint32
+	backupBGs      [2]uint32
+}
+
+func parseSuperblock(b []byte) (*superblock, error) {
+	le := binary.LittleEndian
+	if le.Uint16(b[0x38:]) != ext4Magic {
+		return nil, fmt.Errorf("not an ext2/3/4 filesystem")
+	}
+
+	logBlockSize := le.Uint32(b[0x18:])
+	if logBlockSize > 6 {
+		return nil, fmt.Errorf("invalid block size 1024<<%d", logBlockSize)
+	}
+
+	sb := &superblock{
+		inodesCount:    le.Uint32(b[0x00:]),
+		blocksCount:    uint64(le.Uint32(b[0x04:])),
+		firstDataBlock: le.Uint32(b[0x14:]),
+		blockSize:      1024 << logBlockSize,
+		blocksPerGroup: le.Uint32(b[0x20:]),
+		inodesPerGroup: le.Uint32(b[0x28:]),
+		inodeSize:      128,
+		descSize:       32,
+	}
+
+	// Revision 0 filesystems have fixed inode sizes and no features
+	if le.Uint32(b[0x4c:]) >= 1 {
+		sb.inodeSize = int64(le.Uint16(b[0x58:]))
+		sb.compat = le.Uint32(b[0x5c:])
+		sb.incompat = le.Uint32(b[0x60:])
+		sb.roCompat = le.Uint32(b[0x64:])
+		sb.label = strings.TrimRight(string(b[0x78:0x88]), "\x00")
+		sb.firstMetaBG = le.Uint32(b[0x104:])
+		sb.backupBGs = [2]uint32{le.Uint32(b[0x24c:]), le.Uint32(b[0x250:])}
+	}
+	if sb.incompat&incompat64Bit != 0 {
+		sb.blocksCount |= uint64(le.Uint32(b[0x150:])) << 32
+		if size := int64(le.Uint16(b[0xfe:])); size >= 32 {
+			sb.descSize = size
+		}
+	}
+
+	if sb.blocksPerGroup == 0 || sb.inodesPerGroup == 0 {
+		return nil, fmt.Errorf("invalid superblock: empty block groups")
+	}
+	if sb.inodeSize < 128 || sb.inodeSize > sb.blockSize || sb.inodeSize&(sb.inodeSize-1) != 0 {
+		return nil, fmt.Errorf("invalid superblock: inode size %d", sb.inodeSize)
+	}
+	if sb.descSize > sb.blockSize || sb.descSize&(sb.descSize-1) != 0 {
+		return nil, fmt.Errorf("invalid superblock: group descriptor size %d", sb.descSize)
+	}
+	return sb, nil
+}
+
+// kind names the filesystem the way blkid does
+func (sb *superblock) kind() string {
+	switch {
+	case sb.incompat&(incompatExtents|incompat64Bit|incompatFlexBG) != 0:
+		return "ext4"
+	case sb.compat&compatHasJournal != 0:
+		return "ext3"
+	}
+	return "ext2"
+}
+
+// hasSuper reports whether a block group holds a superblock backup, and
+// so its group descriptors in a meta_bg layout start one block later
+func (sb *superblock) hasSuper(group uint32) bool {
+	switch {
+	case group == 0:
+		return true
+	case sb.compat&compatSparseSuper2 != 0:
+		return group == sb.backupBGs[0] || group == sb.backupBGs[1]
+	case sb.roCompat&roCompatSparseSuper == 0 || group == 1:
+		return true
+	}
+	for _, base := range []uint32{3, 5, 7} {
+		n := base
+		for n < group {
+			n *= base
+		}
+		if n == group {
+			return true
+		}
+	}
+	return false
+}
+
+// Ext4 is a read-only ext2, ext3 or ext4 filesystem. It implements
+// fs.FS, fs.ReadDirFS, fs.StatFS and fs.ReadLinkFS; symlinks are resolved
+// within the filesystem and followed except by Lstat, ReadLink and ReadDir.
+type Ext4 struct {
+	disk io.ReaderAt
+	sb   *superblock
+
+	mu          sync.Mutex
+	inodeTables map[uint32]int64
+}
+
+// InodeStat is the Sys() value of the file infos an Ext4 returns
+type InodeStat struct {
+	Inode uint32
+	UID   uint32
+	GID   uint32
+	Links uint16
+}
+
+// inode holds the inode fields the reader uses
+type inode struct {
+	num   uint32
+	mode  uint16
+	uid   uint32
+	gid   uint32
+	size  int64
+	mtime time.Time
+	links uint16
+	flags uint32
+	block [inodeBlockBytes]byte
+}
+
+// extent maps a run of logical file blocks to physical blocks
+type extent struct {
+	logical  uint64
+	length   uint64
+	physical uint64
+}
+
+// OpenExt4 opens the ext2, ext3 or ext4 filesystem on disk, which is
+// usually a Partition section. A filesystem that needs journal recovery
+// is read as it is on disk, as fsck would see it before replaying.
+func OpenExt4(disk io.ReaderAt) (*Ext4, error) {
+	b := make([]byte, superblockSize)
+	if _, err := disk.ReadAt(b, superblockOffset); err != nil {
+		return nil, fmt.Errorf("failed to read superblock: %w", err)
+	}
+	sb, err := parseSuperblock(b)
+	if err != nil {
+		return nil, err
+	}
+	if unsupported := sb.incompat &^ supportedIncompat; unsupported != 0 {
+		return nil, fmt.Errorf("unsupported ext4 features 0x%x", unsupported)
+	}
+
+	return &Ext4{disk: disk, sb: sb, inodeTables: make(map[uint32]int64)}, nil
+}
+
+// Kind returns ext2, ext3 or ext4
+func (e *Ext4) Kind() string {
+	return e.sb.kind()
+}
+
+// Label returns the volume label
+func (e *Ext4) Label() string {
+	return e.sb.label
+}
+
+// Size returns the size of the filesystem in bytes
+func (e *Ext4) Size() int64 {
+	return int64(e.sb.blocksCount) * e.sb.blockSize
+}
+
+// Open opens the named file or directory for reading
+func (e *Ext4) Open(name string) (fs.File, error) {
+	ino, err := e.lookup("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	info := &fileInfo{name: path.Base(name), ino: ino}
+
+	switch {
+	case ino.isDir():
+		entries, err := e.readDir(ino)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return &dirFile{info: info, entries: entries}, nil
+	case ino.mode&0xf000 == 0x8000:
+		r, err := e.fileReader(ino)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return &regularFile{info: info, SectionReader: io.NewSectionReader(r, 0, ino.size)}, nil
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("not a regular file or directory")}
+}
+
+// Stat returns the file info of the named file, following symlinks
+func (e *Ext4) Stat(name string) (fs.FileInfo, error) {
+	ino, err := e.lookup("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{name: path.Base(name), ino: ino}, nil
+}
+
+// Lstat returns the file info of the named file without following a
+// symlink in the last element
+func (e *Ext4) Lstat(name string) (fs.FileInfo, error) {
+	ino, err := e.lookup("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{name: path.Base(name), ino: ino}, nil
+}
+
+// ReadDir returns the entries of the named directory sorted by name.
+// Entries describe symlinks rather than their targets.
+func (e *Ext4) ReadDir(name string) ([]fs.DirEntry, error) {
+	ino, err := e.lookup("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if !ino.isDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	entries, err := e.readDir(ino)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return entries, nil
+}
+
+// ReadLink returns the target of the named symlink
+func (e *Ext4) ReadLink(name string) (string, error) {
+	ino, err := e.lookup("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if !ino.isSymlink() {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: errors.New("not a symlink")}
+	}
+	target, err := e.readlink(ino)
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	return target, nil
+}
+
+// lookup finds the inode of a slash-separated fs.FS path
+func (e *Ext4) lookup(op, name string, follow bool) (*inode, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	hops := 0
+	ino, err := e.walk(name, follow, &hops)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return ino, nil
+}
+
+// walk resolves name from the root directory. A symlink is replaced by
+// its target and the resulting path walked again from the root, so
+// absolute targets stay inside the filesystem.
+func (e *Ext4) walk(name string, follow bool, hops *int) (*inode, error) {
+	ino, err := e.readInode(rootInode)
+	if err != nil {
+		return nil, err
+	}
+	if name == "." {
+		return ino, nil
+	}
+
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		if !ino.isDir() {
+			return nil, errors.New("not a directory")
+		}
+		num, err := e.findEntry(ino, part)
+		if err != nil {
+			return nil, err
+		}
+		child, err := e.readInode(num)
+		if err != nil {
+			return nil, err
+		}
+
+		last := i == len(parts)-1
+		if child.isSymlink() && (follow || !last) {
+			if *hops++; *hops > maxSymlinkHops {
+				return nil, errors.New("too many levels of symbolic links")
+			}
+			target, err := e.readlink(child)
+			if err != nil {
+				return nil, err
+			}
+			if !strings.HasPrefix(target, "/") {
+				target = path.Join(strings.Join(parts[:i], "/"), target)
+			}
+			next := strings.TrimPrefix(path.Clean("/"+path.Join(append([]string{target}, parts[i+1:]...)...)), "/")
+			if next == "" {
+				next = "."
+			}
+			return e.walk(next, follow, hops)
+		}
+		ino = child
+	}
+	return ino, nil
+}
+
+// inodeTable returns the byte offset of a block group's inode table
+func (e *Ext4) inodeTable(group uint32) (int64, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if offset, ok := e.inodeTables[group]; ok {
+		return offset, nil
+	}
+
+	sb := e.sb
+	perBlock := uint32(sb.blockSize / sb.descSize)
+	var descOffset int64
+	if metaGroup := group / perBlock; sb.incompat&incompatMetaBG != 0 && metaGroup >= sb.firstMetaBG {
+		// With meta_bg each group of descriptors sits in the first block
+		// group it describes, after any superblock backup
+		first := metaGroup * perBlock
+		block := int64(sb.firstDataBlock) + int64(first)*int64(sb.blocksPerGroup)
+		if sb.hasSuper(first) {
+			block++
+		}
+		descOffset = block*sb.blockSize + int64(group%perBlock)*sb.descSize
+	} else {
+		descOffset = (int64(sb.firstDataBlock)+1)*sb.blockSize + int64(group)*sb.descSize
+	}
+
+	desc := make([]byte, sb.descSize)
+	if _, err := e.disk.ReadAt(desc, descOffset); err != nil {
+		return 0, fmt.Errorf("failed to read group descriptor %d: %w", group, err)
+	}
+	table := uint64(binary.LittleEndian.Uint32(desc[0x08:]))
+	if sb.descSize >= 64 {
+		table |= uint64(binary.LittleEndian.Uint32(desc[0x28:])) << 32
+	}
+	if table == 0 || table >= sb.blocksCount {
+		return 0, fmt.Errorf("invalid inode table block %d in group %d", table, group)
+	}
+
+	e.inodeTables[group] = int64(table) * sb.blockSize
+	return e.inodeTables[group], nil
+}
+
+func (e *Ext4) readInode(num uint32) (*inode, error) {
+	if num == 0 || num > e.sb.inodesCount {
+		return nil, fmt.Errorf("invalid inode number %d", num)
+	}
+	group := (num - 1) / e.sb.inodesPerGroup
+	table, err := e.inodeTable(group)
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, e.sb.inodeSize)
+	offset := table + int64((num-1)%e.sb.inodesPerGroup)*e.sb.inodeSize
+	if _, err := e.disk.ReadAt(b, offset); err != nil {
+		return nil, fmt.Errorf("failed to read inode %d: %w", num, err)
+	}
+
+	le := binary.LittleEndian
+	ino := &inode{
+		num:   num,
+		mode:  le.Uint16(b[0x00:]),
+		uid:   uint32(le.Uint16(b[0x02:])) | uint32(le.Uint16(b[0x78:]))<<16,
+		gid:   uint32(le.Uint16(b[0x18:])) | uint32(le.Uint16(b[0x7a:]))<<16,
+		size:  int64(uint64(le.Uint32(b[0x04:])) | uint64(le.Uint32(b[0x6c:]))<<32),
+		links: le.Uint16(b[0x1a:]),
+		flags: le.Uint32(b[0x20:]),
+	}
+	copy(ino.block[:], b[0x28:0x28+inodeBlockBytes])
+	if ino.size < 0 {
+		return nil, fmt.Errorf("invalid size of inode %d", num)
+	}
+
+	// Large inodes carry extra epoch bits and nanoseconds for timestamps
+	seconds := int64(int32(le.Uint32(b[0x10:])))
+	var nanos int64
+	if e.sb.inodeSize > 128 && le.Uint16(b[0x80:]) >= 0x0c {
+		extra := le.Uint32(b[0x88:])
+		seconds += int64(extra&3) << 32
+		nanos = int64(extra >> 2)
+	}
+	ino.mtime = time.Unix(seconds, nanos)
+
+	return ino, nil
+}
+
+func (ino *inode) isDir() bool {
+	return ino.mode&0xf000 == 0x4000
+}
+
+func (ino *inode) isSymlink() bool {
+	return ino.mode&0xf000 == 0xa000
+}
+
+// checkReadable refuses inodes whose data the reader cannot decode
+func (ino *inode) checkReadable() error {
+	switch {
+	case ino.flags&inodeEncrypted != 0:
+		return errors.New("file is encrypted")
+	case ino.flags&inodeInlineData != 0:
+		return errors.New("inline data is not supported")
+	}
+	return nil
+}
+
+// fileReader returns a reader of the data of an inode
+func (e *Ext4) fileReader(ino *inode) (*blockReader, error) {
+	if err := ino.checkReadable(); err != nil {
+		return nil, err
+	}
+
+	var extents []extent
+	var err error
+	if ino.flags&inodeExtents != 0 {
+		err = e.readExtentNode(ino.block[:], extentMaxDepth, &extents)
+	} else {
+		extents, err = e.readBlockMap(ino)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to map blocks of inode %d: %w", ino.num, err)
+	}
+
+	sort.Slice(extents, func(i, j int) bool { return extents[i].logical < extents[j].logical })
+	for _, ext := range extents {
+		if ext.physical+ext.length > e.sb.blocksCount {
+			return nil, fmt.Errorf("inode %d has blocks beyond the end of the filesystem", ino.num)
+		}
+	}
+	return &blockReader{e: e, size: ino.size, extents: extents}, nil
+}
+
+// readExtentNode appends the extents of an extent tree node. Unwritten
+// extents read as zeros, so they are left out like holes.
+func (e *Ext4) readExtentNode(node []byte, maxDepth int, extents *[]extent) error {
+	le := binary.LittleEndian
+	if len(node) < 12 || le.Uint16(node[0:]) != extentMagic {
+		return errors.New("invalid extent header")
+	}
+	entries := int(le.Uint16(node[2:]))
+	depth := int(le.Uint16(node[6:]))
+	if 12+entries*12 > len(node) {
+		return errors.New("extent node overflows")
+	}
+	if depth > maxDepth {
+		return errors.New("extent tree too deep")
+	}
+
+	for i := 0; i < entries; i++ {
+		entry := node[12+i*12:]
+		if depth == 0 {
+			length := uint64(le.Uint16(entry[4:]))
+			if length > extentUnwritten {
+				continue
+			}
+			*extents = append(*extents, extent{
+				logical:  uint64(le.Uint32(entry[0:])),
+				length:   length,
+				physical: uint64(le.Uint16(entry[6:]))<<32 | uint64(le.Uint32(entry[8:])),
+			})
+			continue
+		}
+
+		leaf := uint64(le.Uint16(entry[8:]))<<32 | uint64(le.Uint32(entry[4:]))
+		if leaf >= e.sb.blocksCount {
+			return fmt.Errorf("extent index points to block %d beyond the filesystem", leaf)
+		}
+		child := make([]byte, e.sb.blockSize)
+		if _, err := e.disk.ReadAt(child, int64(leaf)*e.sb.blockSize); err != nil {
+			return err
+		}
+		if err := e.readExtentNode(child, depth-1, extents); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readBlockMap maps the blocks of an inode without extents, through its
+// 12 direct and single, double and triple indirect block pointers
+func (e *Ext4) readBlockMap(ino *inode) ([]extent, error) {
+	m := &blockMapper{e: e, blocks: uint64((ino.size + e.sb.blockSize - 1) / e.sb.blockSize)}
+	perBlock := uint64(e.sb.blockSize / 4)
+
+	var logical uint64
+	for i := 0; i < 15 && logical < m.blocks; i++ {
+		ptr := binary.LittleEndian.Uint32(ino.block[i*4:])
+		if i < 12 {
+			m.add(logical, ptr)
+			logical++
+			continue
+		}
+
+		level := i - 11
+		span := uint64(1)
+		for l := 0; l < level; l++ {
+			span *= perBlock
+		}
+		if ptr != 0 {
+			if err := m.walk(ptr, level, logical, perBlock); err != nil {
+				return nil, err
+			}
+		}
+		logical += span
+	}
+	return m.extents, nil
+}
+
+type blockMapper struct {
+	e       *Ext4
+	blocks  uint64
+	extents []extent
+}
+
+func (m *blockMapper) add(logical uint64, physical uint32) {
+	if physical == 0 || logical >= m.blocks {
+		return
+	}
+	if n := len(m.extents); n > 0 {
+		last := &m.extents[n-1]
+		if last.logical+last.length == logical && last.physical+last.length == uint64(physical) {
+			last.length++
+			return
+		}
+	}
+	m.extents = append(m.extents, extent{logical: logical, length: 1, physical: uint64(physical)})
+}
+
+func (m *blockMapper) walk(block uint32, level int, logical, perBlock uint64) error {
+	if uint64(block) >= m.e.sb.blocksCount {
+		return fmt.Errorf("indirect block %d beyond the filesystem", block)
+	}
+	b := make([]byte, m.e.sb.blockSize)
+	if _, err := m.e.disk.ReadAt(b, int64(block)*m.e.sb.blockSize); err != nil {
+		return err
+	}
+
+	span := uint64(1)
+	for l := 1; l < level; l++ {
+		span *= perBlock
+	}
+	for i := uint64(0); i < perBlock && logical+i*span < m.blocks; i++ {
+		ptr := binary.LittleEndian.Uint32(b[i*4:])
+		if level == 1 {
+			m.add(logical+i, ptr)
+		} else if ptr != 0 {
+			if err := m.walk(ptr, level-1, logical+i*span, perBlock); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// blockReader reads the data of an inode through its extents. Blocks not
+// covered by an extent are holes and read as zeros.
+type blockReader struct {
+	e       *Ext4
+	size    int64
+	extents []extent
+}
+
+func (r *blockReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	blockSize := r.e.sb.blockSize
+	n := 0
+	for n < len(p) && off < r.size {
+		want := min(int64(len(p)-n), r.size-off)
+		block := uint64(off / blockSize)
+		i := sort.Search(len(r.extents), func(i int) bool {
+			return r.extents[i].logical+r.extents[i].length > block
+		})
+
+		if i < len(r.extents) && r.extents[i].logical <= block {
+			ext := r.extents[i]
+			want = min(want, int64(ext.logical+ext.length)*blockSize-off)
+			pos := int64(ext.physical+block-ext.logical)*blockSize + off%blockSize
+			if m, err := r.e.disk.ReadAt(p[n:n+int(want)], pos); int64(m) < want {
+				return n + m, fmt.Errorf("failed to read block %d: %w", ext.physical+block-ext.logical, err)
+			}
+		} else {
+			if i < len(r.extents) {
+				want = min(want, int64(r.extents[i].logical)*blockSize-off)
+			}
+			clear(p[n : n+int(want)])
+		}
+		n += int(want)
+		off += want
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readlink returns the target of a symlink inode. Targets shorter than 60
+// bytes are usually stored in the inode itself.
+func (e *Ext4) readlink(ino *inode) (string, error) {
+	if ino.size > maxSymlinkLength {
+		return "", fmt.Errorf("symlink of %d bytes is too long", ino.size)
+	}
+	if ino.size < inodeBlockBytes && ino.flags&(inodeExtents|inodeInlineData|inodeEncrypted) == 0 {
+		return string(ino.block[:ino.size]), nil
+	}
+
+	r, err := e.fileReader(ino)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, ino.size)
+	if _, err := r.ReadAt(b, 0); err != nil && err != io.EOF {
+		return "", err
+	}
+	return string(b), nil
+}
+
+type dirent struct {
+	inode uint32
+	name  string
+}
+
+// dirents returns the entries of a directory other than . and .. in
+// on-disk order. Hashed-tree directories are read linearly too: their
+// index blocks look like a single unused entry. Names containing / or NUL
+// cannot be created by Linux and are skipped, so a crafted image cannot
+// name a path outside the directory.
+func (e *Ext4) dirents(dir *inode) ([]dirent, error) {
+	r, err := e.fileReader(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	le := binary.LittleEndian
+	blockSize := e.sb.blockSize
+	b := make([]byte, blockSize)
+	var entries []dirent
+	for off := int64(0); off < dir.size; off += blockSize {
+		if _, err := r.ReadAt(b, off); err != nil {
+			return nil, fmt.Errorf("failed to read directory inode %d: %w", dir.num, err)
+		}
+
+		for pos := int64(0); pos+8 <= blockSize; {
+			num := le.Uint32(b[pos:])
+			recLen := int64(le.Uint16(b[pos+4:]))
+			if blockSize == 65536 && (recLen == 0 || recLen == 65535) {
+				recLen = 65536
+			}
+			nameLen := int64(b[pos+6])
+			if e.sb.incompat&incompatFiletype == 0 {
+				nameLen = int64(le.Uint16(b[pos+6:]))
+			}
+			if recLen < 8 || pos+recLen > blockSize || 8+nameLen > recLen {
+				return nil, fmt.Errorf("corrupt entry in directory inode %d at offset %d", dir.num, off+pos)
+			}
+
+			name := string(b[pos+8 : pos+8+nameLen])
+			if num != 0 && nameLen > 0 && name != "." && name != ".." && !strings.ContainsAny(name, "/\x00") {
+				entries = append(entries, dirent{inode: num, name: name})
+			}
+			pos += recLen
+		}
+	}
+	return entries, nil
+}
+
+func (e *Ext4) findEntry(dir *inode, name string) (uint32, error) {
+	entries, err := e.dirents(dir)
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range entries {
+		if entry.name == name {
+			return entry.inode, nil
+		}
+	}
+	return 0, fs.ErrNotExist
+}
+
+func (e *Ext4) readDir(dir *inode) ([]fs.DirEntry, error) {
+	raw, err := e.dirents(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]fs.DirEntry, 0, len(raw))
+	for _, entry := range raw {
+		ino, err := e.readInode(entry.inode)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, fs.FileInfoToDirEntry(&fileInfo{name: entry.name, ino: ino}))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+type fileInfo struct {
+	name string
+	ino  *inode
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.ino.size }
+func (fi *fileInfo) ModTime() time.Time { return fi.ino.mtime }
+func (fi *fileInfo) IsDir() bool        { return fi.ino.isDir() }
+
+func (fi *fileInfo) Mode() fs.FileMode {
+	mode := fs.FileMode(fi.ino.mode & 0o777)
+	if fi.ino.mode&0o4000 != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if fi.ino.mode&0o2000 != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if fi.ino.mode&0o1000 != 0 {
+		mode |= fs.ModeSticky
+	}
+
+	switch fi.ino.mode & 0xf000 {
+	case 0x4000:
+		mode |= fs.ModeDir
+	case 0xa000:
+		mode |= fs.ModeSymlink
+	case 0x2000:
+		mode |= fs.ModeDevice | fs.ModeCharDevice
+	case 0x6000:
+		mode |= fs.ModeDevice
+	case 0x1000:
+		mode |= fs.ModeNamedPipe
+	case 0xc000:
+		mode |= fs.ModeSocket
+	}
+	return mode
+}
+
+func (fi *fileInfo) Sys() any {
+	return &InodeStat{Inode: fi.ino.num, UID: fi.ino.uid, GID: fi.ino.gid, Links: fi.ino.links}
+}
+
+type regularFile struct {
+	info *fileInfo
+	*io.SectionReader
+}
+
+func (f *regularFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *regularFile) Close() error               { return nil }
+
+type dirFile struct {
+	info    *fileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *dirFile) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *dirFile) Close() error               { return nil }
+
+func (d *dirFile) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: errors.New("is a directory")}
+}
+
+func (d *dirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(rest))
+	d.offset += n
+	return rest[:n], nil
+}
@@ -0,0 +1,176 @@
+package diskfs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// loadImage returns a filesystem image from testdata, which
+// testdata/mkfixtures.sh generates
+func loadImage(t *testing.T, name string) []byte {
+	t.Helper()
+
+	f, err := os.Open(filepath.Join("testdata", name+".gz"))
+	require.NoError(t, err)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	image, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	return image
+}
+
+// lines matches the output of seq -f "line %06g" from to
+func lines(from, to int) []byte {
+	var b bytes.Buffer
+	for i := from; i <= to; i++ {
+		fmt.Fprintf(&b, "line %06d\n", i)
+	}
+	return b.Bytes()
+}
+
+func TestExt4(t *testing.T) {
+	fsys, err := OpenExt4(bytes.NewReader(loadImage(t, "ext4.img")))
+	require.NoError(t, err)
+	assert.Equal(t, "ext4", fsys.Kind())
+	assert.Equal(t, "cloudimg-rootfs", fsys.Label())
+	assert.Equal(t, int64(16<<20), fsys.Size())
+
+	data, err := fs.ReadFile(fsys, "etc/hostname")
+	require.NoError(t, err)
+	assert.Equal(t, "ubuntu-template\n", string(data))
+
+	info, err := fsys.Stat("home/ubuntu/.bashrc")
+	require.NoError(t, err)
+	assert.Equal(t, fs.FileMode(0o600), info.Mode())
+	assert.Equal(t, uint32(0), info.Sys().(*InodeStat).UID)
+	data, err = fs.ReadFile(fsys, "home/ubuntu/.bashrc")
+	require.NoError(t, err)
+	assert.Equal(t, lines(1, 2000), data)
+
+	// Three extents with holes between them read back as written
+	want := make([]byte, 5<<20)
+	copy(want, lines(1, 6000))
+	copy(want[1<<20:], lines(6001, 12000))
+	want = append(want, lines(12001, 18000)...)
+	data, err = fs.ReadFile(fsys, "var/log/app/sparse.log")
+	require.NoError(t, err)
+	assert.Equal(t, want, data)
+
+	// A hashed-tree directory lists every entry in order
+	entries, err := fsys.ReadDir("many")
+	require.NoError(t, err)
+	require.Len(t, entries, 300)
+	assert.Equal(t, "file-1", entries[0].Name())
+	assert.Equal(t, "file-10", entries[1].Name())
+	data, err = fs.ReadFile(fsys, "many/file-299")
+	require.NoError(t, err)
+	assert.Equal(t, "299\n", string(data))
+
+	require.NoError(t, fstest.TestFS(fsys, "etc/hostname", "home/ubuntu/.bashrc", "many/file-300", "var/log/app/sparse.log"))
+}
+
+func TestExt4Symlinks(t *testing.T) {
+	fsys, err := OpenExt4(bytes.NewReader(loadImage(t, "ext4.img")))
+	require.NoError(t, err)
+
+	target, err := fsys.ReadLink("etc/localtime")
+	require.NoError(t, err)
+	assert.Equal(t, "/usr/share/zoneinfo/UTC", target)
+
+	info, err := fsys.Lstat("etc/localtime")
+	require.NoError(t, err)
+	assert.Equal(t, fs.ModeSymlink, info.Mode().Type())
+
+	// Absolute targets resolve from the root of the filesystem
+	data, err := fs.ReadFile(fsys, "etc/localtime")
+	require.NoError(t, err)
+	assert.Equal(t, "TZif2 UTC\n", string(data))
+
+	// Targets too long for the inode are stored in a block
+	target, err = fsys.ReadLink("home/ubuntu/long-link")
+	require.NoError(t, err)
+	assert.Greater(t, len(target), 60)
+	data, err = fs.ReadFile(fsys, "home/ubuntu/long-link")
+	require.NoError(t, err)
+	assert.Equal(t, "TZif2 UTC\n", string(data))
+
+	// Relative symlinks to directories are followed inside paths
+	info, err = fsys.Stat("home/ubuntu/logs")
+	require.NoError(t, err)
+	assert.True(t, info.IsDir())
+	info, err = fsys.Stat("home/ubuntu/logs/sparse.log")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5<<20+6000*12), info.Size())
+
+	_, err = fsys.ReadLink("etc/hostname")
+	assert.ErrorContains(t, err, "not a symlink")
+}
+
+func TestExt4Errors(t *testing.T) {
+	fsys, err := OpenExt4(bytes.NewReader(loadImage(t, "ext4.img")))
+	require.NoError(t, err)
+
+	_, err = fsys.Open("etc/missing")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	_, err = fsys.Open("etc/hostname/child")
+	assert.ErrorContains(t, err, "not a directory")
+
+	_, err = fsys.Open("/etc/hostname")
+	assert.ErrorIs(t, err, fs.ErrInvalid)
+
+	_, err = fsys.ReadDir("etc/hostname")
+	assert.ErrorContains(t, err, "not a directory")
+
+	_, err = OpenExt4(bytes.NewReader(make([]byte, 1<<20)))
+	assert.ErrorContains(t, err, "not an ext2/3/4 filesystem")
+}
+
+func TestExt4SkipsUnsafeNames(t *testing.T) {
+	// Rename /etc/hostname and /etc/localtime in place to names Linux
+	// cannot create, as a crafted image could
+	image := loadImage(t, "ext4.img")
+	for old, crafted := range map[string]string{"\x08\x01hostname": "\x08\x01../../hn", "\x09\x07localtime": "\x09\x07local\x00ime"} {
+		require.Equal(t, 1, bytes.Count(image, []byte(old)))
+		image = bytes.Replace(image, []byte(old), []byte(crafted), 1)
+	}
+
+	fsys, err := OpenExt4(bytes.NewReader(image))
+	require.NoError(t, err)
+
+	entries, err := fsys.ReadDir("etc")
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	_, err = fsys.Open("etc/hostname")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestExt2BlockMaps(t *testing.T) {
+	fsys, err := OpenExt4(bytes.NewReader(loadImage(t, "ext2.img")))
+	require.NoError(t, err)
+	assert.Equal(t, "ext2", fsys.Kind())
+	assert.Equal(t, "boot", fsys.Label())
+
+	// Large enough on 1K blocks to need double indirect blocks
+	data, err := fs.ReadFile(fsys, "home/ubuntu/.bashrc")
+	require.NoError(t, err)
+	assert.Equal(t, lines(1, 25000), data)
+
+	data, err = fs.ReadFile(fsys, "home/ubuntu/logs/sparse.log")
+	require.NoError(t, err)
+	assert.Len(t, data, 5<<20+6000*12)
+
+	require.NoError(t, fstest.TestFS(fsys, "etc/hostname", "many/file-1"))
+}
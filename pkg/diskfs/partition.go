@@ -0,0 +1,282 @@
+// Package diskfs reads partition tables and ext2/3/4 filesystems from raw
+// disk images, read-only, so files can be recovered from a backup without
+// restoring the VM
+package diskfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+const sectorSize = 512
+
+// Partition is a partition of a disk image. A disk without a partition
+// table is reported as a single partition numbered 0 covering the disk.
+type Partition struct {
+	Number int    `json:"number"`
+	Start  int64  `json:"start"` // Byte offset on the disk
+	Size   int64  `json:"size"`
+	Type   string `json:"type"`           // MBR type in hex, e.g. "83", or GPT type GUID
+	Name   string `json:"name,omitempty"` // GPT partition name
+}
+
+// Section returns a reader for the contents of the partition
+func (p Partition) Section(disk io.ReaderAt) *io.SectionReader {
+	return io.NewSectionReader(disk, p.Start, p.Size)
+}
+
+// mbrEntry is a partition entry in an MBR or EBR sector
+type mbrEntry struct {
+	Status   uint8
+	FirstCHS [3]byte
+	Type     uint8
+	LastCHS  [3]byte
+	FirstLBA uint32
+	Sectors  uint32
+}
+
+// gptHeader is the start of a GPT header
+type gptHeader struct {
+	Signature      [8]byte
+	Revision       uint32
+	HeaderSize     uint32
+	HeaderCRC      uint32
+	Reserved       uint32
+	CurrentLBA     uint64
+	BackupLBA      uint64
+	FirstUsableLBA uint64
+	LastUsableLBA  uint64
+	DiskGUID       [16]byte
+	EntriesLBA     uint64
+	NumEntries     uint32
+	EntrySize      uint32
+}
+
+// gptEntry is the fixed part of a GPT partition entry
+type gptEntry struct {
+	TypeGUID   [16]byte
+	UniqueGUID [16]byte
+	FirstLBA   uint64
+	LastLBA    uint64
+	Attributes uint64
+	Name       [36]uint16
+}
+
+// Well-known GPT partition type GUIDs
+const (
+	gptLinuxFilesystem = "0FC63DAF-8483-4772-8E79-3D69D8477DE4"
+	gptEFISystem       = "C12A7328-F81F-11D2-BA4B-00A0C93EC93B"
+	gptBIOSBoot        = "21686148-6449-6E6F-744E-656564454649"
+	gptLinuxSwap       = "0657FD6D-A4AB-43C4-84E5-0933C84B4F4F"
+	gptLinuxLVM        = "E6D6D379-F507-44C2-A23C-238F2A3DF928"
+)
+
+// ReadPartitions returns the partitions of a disk image from its GPT or
+// MBR partition table, including logical partitions of an extended MBR
+// partition
+func ReadPartitions(disk io.ReaderAt, size int64) ([]Partition, error) {
+	mbr := make([]byte, sectorSize)
+	if _, err := disk.ReadAt(mbr, 0); err != nil {
+		return nil, fmt.Errorf("failed to read partition table: %w", err)
+	}
+
+	if mbr[510] != 0x55 || mbr[511] != 0xaa {
+		return []Partition{{Number: 0, Start: 0, Size: size}}, nil
+	}
+
+	entries, err := mbrEntries(mbr)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.Type == 0xee {
+			return readGPT(disk, size)
+		}
+	}
+
+	var partitions []Partition
+	for i, e := range entries {
+		if e.Type == 0 || e.Sectors == 0 {
+			continue
+		}
+		if isExtended(e.Type) {
+			logical, err := readEBRChain(disk, int64(e.FirstLBA))
+			if err != nil {
+				return nil, err
+			}
+			partitions = append(partitions, logical...)
+			continue
+		}
+		partitions = append(partitions, Partition{
+			Number: i + 1,
+			Start:  int64(e.FirstLBA) * sectorSize,
+			Size:   int64(e.Sectors) * sectorSize,
+			Type:   fmt.Sprintf("%02x", e.Type),
+		})
+	}
+
+	// A boot sector signature without partitions is a filesystem on the
+	// whole disk, e.g. FAT
+	if len(partitions) == 0 {
+		return []Partition{{Number: 0, Start: 0, Size: size}}, nil
+	}
+	return partitions, nil
+}
+
+func mbrEntries(sector []byte) ([4]mbrEntry, error) {
+	var entries [4]mbrEntry
+	err := binary.Read(bytes.NewReader(sector[446:510]), binary.LittleEndian, &entries)
+	return entries, err
+}
+
+func isExtended(partitionType uint8) bool {
+	return partitionType == 0x05 || partitionType == 0x0f || partitionType == 0x85
+}
+
+// readEBRChain follows the extended boot records of an extended partition
+// starting at sector base. Logical partitions are numbered from 5.
+func readEBRChain(disk io.ReaderAt, base int64) ([]Partition, error) {
+	var partitions []Partition
+	sector := make([]byte, sectorSize)
+	next := int64(0)
+
+	for number := 5; number < 5+128; number++ {
+		if _, err := disk.ReadAt(sector, (base+next)*sectorSize); err != nil {
+			return nil, fmt.Errorf("failed to read extended boot record: %w", err)
+		}
+		if sector[510] != 0x55 || sector[511] != 0xaa {
+			return nil, fmt.Errorf("invalid extended boot record at sector %d", base+next)
+		}
+
+		entries, err := mbrEntries(sector)
+		if err != nil {
+			return nil, err
+		}
+		if entries[0].Type != 0 && entries[0].Sectors != 0 {
+			partitions = append(partitions, Partition{
+				Number: number,
+				Start:  (base + next + int64(entries[0].FirstLBA)) * sectorSize,
+				Size:   int64(entries[0].Sectors) * sectorSize,
+				Type:   fmt.Sprintf("%02x", entries[0].Type),
+			})
+		}
+
+		// The second entry links to the next EBR, relative to the start
+		// of the extended partition
+		if !isExtended(entries[1].Type) || entries[1].FirstLBA == 0 {
+			return partitions, nil
+		}
+		next = int64(entries[1].FirstLBA)
+	}
+	return nil, fmt.Errorf("extended partition has too many logical partitions")
+}
+
+// readGPT reads the partitions of a GPT disk from its primary header
+func readGPT(disk io.ReaderAt, size int64) ([]Partition, error) {
+	buf := make([]byte, sectorSize)
+	if _, err := disk.ReadAt(buf, sectorSize); err != nil {
+		return nil, fmt.Errorf("failed to read GPT header: %w", err)
+	}
+
+	var header gptHeader
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &header); err != nil {
+		return nil, err
+	}
+	if string(header.Signature[:]) != "EFI PART" {
+		return nil, fmt.Errorf("invalid GPT header signature")
+	}
+	if header.EntrySize < 128 || header.NumEntries > 1024 {
+		return nil, fmt.Errorf("invalid GPT header: %d entries of %d bytes", header.NumEntries, header.EntrySize)
+	}
+
+	table := make([]byte, int64(header.NumEntries)*int64(header.EntrySize))
+	if _, err := disk.ReadAt(table, int64(header.EntriesLBA)*sectorSize); err != nil {
+		return nil, fmt.Errorf("failed to read GPT partition entries: %w", err)
+	}
+
+	var partitions []Partition
+	for i := 0; i < int(header.NumEntries); i++ {
+		var entry gptEntry
+		raw := table[i*int(header.EntrySize):]
+		if err := binary.Read(bytes.NewReader(raw[:128]), binary.LittleEndian, &entry); err != nil {
+			return nil, err
+		}
+		if entry.TypeGUID == [16]byte{} {
+			continue
+		}
+		if entry.LastLBA < entry.FirstLBA || int64(entry.LastLBA+1)*sectorSize > size {
+			return nil, fmt.Errorf("GPT partition %d lies outside the disk", i+1)
+		}
+
+		partitions = append(partitions, Partition{
+			Number: i + 1,
+			Start:  int64(entry.FirstLBA) * sectorSize,
+			Size:   int64(entry.LastLBA-entry.FirstLBA+1) * sectorSize,
+			Type:   formatGUID(entry.TypeGUID),
+			Name:   strings.TrimRight(string(utf16.Decode(entry.Name[:])), "\x00"),
+		})
+	}
+	return partitions, nil
+}
+
+// formatGUID formats a GUID stored in the mixed-endian GPT layout
+func formatGUID(b [16]byte) string {
+	return fmt.Sprintf("%08X-%04X-%04X-%X-%X",
+		binary.LittleEndian.Uint32(b[0:4]),
+		binary.LittleEndian.Uint16(b[4:6]),
+		binary.LittleEndian.Uint16(b[6:8]),
+		b[8:10], b[10:16])
+}
+
+// TypeName describes the partition type, or returns the type itself if it
+// is not a well-known one
+func (p Partition) TypeName() string {
+	switch p.Type {
+	case "83", gptLinuxFilesystem:
+		return "Linux filesystem"
+	case "ef", gptEFISystem:
+		return "EFI System"
+	case gptBIOSBoot:
+		return "BIOS boot"
+	case "82", gptLinuxSwap:
+		return "Linux swap"
+	case "8e", gptLinuxLVM:
+		return "Linux LVM"
+	case "07":
+		return "NTFS/exFAT"
+	case "0b", "0c":
+		return "FAT32"
+	case "":
+		return "whole disk"
+	}
+	return p.Type
+}
+
+// Detect names the filesystem on a partition: ext2, ext3, ext4, vfat,
+// xfs, swap or LVM2_member, or an empty string if it is not recognised
+func Detect(r io.ReaderAt) string {
+	buf := make([]byte, 4096)
+	n, _ := r.ReadAt(buf, 0)
+	buf = buf[:n]
+
+	if len(buf) >= superblockOffset+superblockSize {
+		if sb, err := parseSuperblock(buf[superblockOffset : superblockOffset+superblockSize]); err == nil {
+			return sb.kind()
+		}
+	}
+	switch {
+	case len(buf) >= 4 && string(buf[0:4]) == "XFSB":
+		return "xfs"
+	case len(buf) >= 4096 && string(buf[4086:4096]) == "SWAPSPACE2":
+		return "swap"
+	case len(buf) >= 520 && string(buf[512:520]) == "LABELONE":
+		return "LVM2_member"
+	case len(buf) >= 90 && (string(buf[82:87]) == "FAT32" || string(buf[54:59]) == "FAT12" || string(buf[54:59]) == "FAT16"):
+		return "vfat"
+	}
+	return ""
+}
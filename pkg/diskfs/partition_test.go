@@ -0,0 +1,111 @@
+package diskfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// linuxFilesystemGUID is gptLinuxFilesystem in its on-disk byte order
+var linuxFilesystemGUID = []byte{
+	0xaf, 0x3d, 0xc6, 0x0f, 0x83, 0x84, 0x72, 0x47,
+	0x8e, 0x79, 0x3d, 0x69, 0xd8, 0x47, 0x7d, 0xe4,
+}
+
+// gptDisk returns a disk with a GPT partition named root holding image
+// at 1MiB
+func gptDisk(image []byte) []byte {
+	disk := make([]byte, 1<<20+len(image)+1<<20)
+	le := binary.LittleEndian
+
+	// Protective MBR
+	disk[446+4] = 0xee
+	le.PutUint32(disk[446+8:], 1)
+	le.PutUint32(disk[446+12:], uint32(len(disk)/sectorSize-1))
+	disk[510], disk[511] = 0x55, 0xaa
+
+	header := disk[sectorSize:]
+	copy(header, "EFI PART")
+	le.PutUint64(header[0x48:], 2)
+	le.PutUint32(header[0x50:], 128)
+	le.PutUint32(header[0x54:], 128)
+
+	entry := disk[2*sectorSize:]
+	copy(entry, linuxFilesystemGUID)
+	entry[16] = 1
+	le.PutUint64(entry[32:], 2048)
+	le.PutUint64(entry[40:], uint64(2048+len(image)/sectorSize-1))
+	for i, c := range utf16.Encode([]rune("root")) {
+		le.PutUint16(entry[56+i*2:], c)
+	}
+
+	copy(disk[1<<20:], image)
+	return disk
+}
+
+// putMBREntry writes a partition entry into an MBR or EBR sector
+func putMBREntry(sector []byte, index int, partitionType byte, first, sectors uint32) {
+	entry := sector[446+index*16:]
+	entry[4] = partitionType
+	binary.LittleEndian.PutUint32(entry[8:], first)
+	binary.LittleEndian.PutUint32(entry[12:], sectors)
+	sector[510], sector[511] = 0x55, 0xaa
+}
+
+func TestReadPartitionsGPT(t *testing.T) {
+	image := loadImage(t, "ext4.img")
+	disk := gptDisk(image)
+
+	partitions, err := ReadPartitions(bytes.NewReader(disk), int64(len(disk)))
+	require.NoError(t, err)
+	require.Len(t, partitions, 1)
+
+	p := partitions[0]
+	assert.Equal(t, 1, p.Number)
+	assert.Equal(t, int64(1<<20), p.Start)
+	assert.Equal(t, int64(len(image)), p.Size)
+	assert.Equal(t, "0FC63DAF-8483-4772-8E79-3D69D8477DE4", p.Type)
+	assert.Equal(t, "Linux filesystem", p.TypeName())
+	assert.Equal(t, "root", p.Name)
+
+	assert.Equal(t, "ext4", Detect(p.Section(bytes.NewReader(disk))))
+	fsys, err := OpenExt4(p.Section(bytes.NewReader(disk)))
+	require.NoError(t, err)
+	assert.Equal(t, "cloudimg-rootfs", fsys.Label())
+}
+
+func TestReadPartitionsMBR(t *testing.T) {
+	disk := make([]byte, 64<<20)
+	putMBREntry(disk, 0, 0x83, 2048, 8192)
+	putMBREntry(disk, 1, 0x05, 20480, 40960)
+
+	// Two logical partitions in the extended partition, linked by EBRs
+	ebr := disk[20480*sectorSize:]
+	putMBREntry(ebr, 0, 0x82, 2048, 4096)
+	putMBREntry(ebr, 1, 0x05, 10240, 20480)
+	putMBREntry(disk[(20480+10240)*sectorSize:], 0, 0x83, 2048, 8192)
+
+	partitions, err := ReadPartitions(bytes.NewReader(disk), int64(len(disk)))
+	require.NoError(t, err)
+	require.Len(t, partitions, 3)
+
+	assert.Equal(t, Partition{Number: 1, Start: 2048 * sectorSize, Size: 8192 * sectorSize, Type: "83"}, partitions[0])
+	assert.Equal(t, Partition{Number: 5, Start: (20480 + 2048) * sectorSize, Size: 4096 * sectorSize, Type: "82"}, partitions[1])
+	assert.Equal(t, Partition{Number: 6, Start: (20480 + 10240 + 2048) * sectorSize, Size: 8192 * sectorSize, Type: "83"}, partitions[2])
+	assert.Equal(t, "Linux swap", partitions[1].TypeName())
+}
+
+func TestReadPartitionsWholeDisk(t *testing.T) {
+	image := loadImage(t, "ext2.img")
+
+	partitions, err := ReadPartitions(bytes.NewReader(image), int64(len(image)))
+	require.NoError(t, err)
+	assert.Equal(t, []Partition{{Number: 0, Start: 0, Size: int64(len(image))}}, partitions)
+	assert.Equal(t, "ext2", Detect(bytes.NewReader(image)))
+
+	assert.Equal(t, "", Detect(bytes.NewReader(make([]byte, 8192))))
+}
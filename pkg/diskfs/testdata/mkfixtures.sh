@@ -0,0 +1,40 @@
+#!/bin/sh
+# Regenerates the filesystem images used by the diskfs tests. Needs
+# e2fsprogs 1.43 or later for mke2fs -d.
+set -eu
+
+cd "$(dirname "$0")"
+root=$(mktemp -d)
+trap 'rm -rf "$root"' EXIT
+
+lines() {
+	seq -f "line %06g" "$1" "$2"
+}
+
+mkdir -p "$root/etc" "$root/home/ubuntu" "$root/var/log/app" "$root/usr/share/zoneinfo" "$root/many"
+printf 'ubuntu-template\n' > "$root/etc/hostname"
+printf 'TZif2 UTC\n' > "$root/usr/share/zoneinfo/UTC"
+ln -s /usr/share/zoneinfo/UTC "$root/etc/localtime"
+ln -s ../../var/log/app "$root/home/ubuntu/logs"
+ln -s ../../usr/share/zoneinfo/././././././././././././././././././././UTC "$root/home/ubuntu/long-link"
+lines 1 2000 > "$root/home/ubuntu/.bashrc"
+chmod 600 "$root/home/ubuntu/.bashrc"
+for i in $(seq 1 300); do
+	printf '%s\n' "$i" > "$root/many/file-$i"
+done
+
+# Data at 0, 1MiB and 5MiB with holes between
+app="$root/var/log/app/sparse.log"
+lines 1 6000 | dd of="$app" conv=notrunc status=none
+lines 6001 12000 | dd of="$app" bs=1M seek=1 conv=notrunc status=none
+lines 12001 18000 | dd of="$app" bs=1M seek=5 conv=notrunc status=none
+
+rm -f ext4.img ext2.img
+mke2fs -q -t ext4 -b 4096 -L cloudimg-rootfs -E root_owner=0:0 -d "$root" ext4.img 16M
+e2fsck -fyD ext4.img > /dev/null || [ $? -le 1 ]
+
+# Block-mapped files with double indirect blocks on 1K blocks
+lines 1 25000 > "$root/home/ubuntu/.bashrc"
+mke2fs -q -t ext2 -b 1024 -N 512 -L boot -E root_owner=0:0 -d "$root" ext2.img 2M
+
+gzip -9nf ext4.img ext2.img
@@ -91,6 +91,11 @@ func (c *ESXiClient) Finder() *find.Finder {
 	return c.finder
 }
 
+// Datacenter returns the datacenter the client is scoped to
+func (c *ESXiClient) Datacenter() *object.Datacenter {
+	return c.datacenter
+}
+
 func (c *ESXiClient) FindVM(ctx context.Context, name string) (*object.VirtualMachine, error) {
 	vm, err := c.finder.VirtualMachine(ctx, name)
 	if err != nil {
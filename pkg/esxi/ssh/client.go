@@ -2,11 +2,13 @@ package ssh
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"strings"
 	"time"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 type SSHClient struct {
@@ -16,37 +18,72 @@ type SSHClient struct {
 }
 
 func NewSSHClient(host, user, keyPath string) (*SSHClient, error) {
-	key, err := os.ReadFile(keyPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read SSH key: %w", err)
-	}
-
-	signer, err := ssh.ParsePrivateKey(key)
+	auth, err := PublicKeyAuth(keyPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse SSH key: %w", err)
+		return nil, err
 	}
 
 	config := &ssh.ClientConfig{
 		User: user,
 		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(signer),
+			auth,
 		},
 		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
 		Timeout:         10 * time.Second,
 	}
 
-	client, err := ssh.Dial("tcp", fmt.Sprintf("%s:22", host), config)
+	return Dial(host, config)
+}
+
+// Dial connects to addr ("host" or "host:port", default port 22) with an
+// explicit client configuration
+func Dial(addr string, config *ssh.ClientConfig) (*SSHClient, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, "22"
+	}
+
+	client, err := ssh.Dial("tcp", net.JoinHostPort(host, port), config)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect: %w", err)
 	}
 
 	return &SSHClient{
 		host:   host,
-		user:   user,
+		user:   config.User,
 		client: client,
 	}, nil
 }
 
+// PublicKeyAuth loads the private key at keyPath as an SSH auth method
+func PublicKeyAuth(keyPath string) (ssh.AuthMethod, error) {
+	key, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SSH key: %w", err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SSH key: %w", err)
+	}
+
+	return ssh.PublicKeys(signer), nil
+}
+
+// HostKeyCallback verifies host keys against a known_hosts file, or accepts
+// any host key when knownHostsPath is empty
+func HostKeyCallback(knownHostsPath string) (ssh.HostKeyCallback, error) {
+	if knownHostsPath == "" {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	callback, err := knownhosts.New(knownHostsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load known hosts: %w", err)
+	}
+	return callback, nil
+}
+
 func NewSSHClientWithPassword(host, user, password string) (*SSHClient, error) {
 	config := &ssh.ClientConfig{
 		User: user,
@@ -57,16 +94,7 @@ func NewSSHClientWithPassword(host, user, password string) (*SSHClient, error) {
 		Timeout:         10 * time.Second,
 	}
 
-	client, err := ssh.Dial("tcp", fmt.Sprintf("%s:22", host), config)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect: %w", err)
-	}
-
-	return &SSHClient{
-		host:   host,
-		user:   user,
-		client: client,
-	}, nil
+	return Dial(host, config)
 }
 
 func (c *SSHClient) RunCommand(cmd string) (string, error) {
@@ -181,6 +209,12 @@ func (c *SSHClient) ListVMs() ([]map[string]string, error) {
 	return vms, nil
 }
 
+// Client returns the underlying SSH connection, for protocols such as SFTP
+// that run over it
+func (c *SSHClient) Client() *ssh.Client {
+	return c.client
+}
+
 func (c *SSHClient) Close() error {
 	if c.client != nil {
 		return c.client.Close()
@@ -11,6 +11,7 @@ import (
 	"github.com/r11/esxi-commander/pkg/audit"
 	"github.com/r11/esxi-commander/pkg/esxi/client"
 	"github.com/r11/esxi-commander/pkg/metrics"
+	"github.com/r11/esxi-commander/pkg/tasks"
 )
 
 type Operations struct {
@@ -93,12 +94,16 @@ func (o *Operations) CreateFromTemplate(ctx context.Context, opts *CreateOptions
 		return nil, fmt.Errorf("failed to get folder: %w", err)
 	}
 
-	task, err := template.Clone(ctx, folder, opts.Name, cloneSpec)
-	if err != nil {
-		return nil, fmt.Errorf("failed to start clone: %w", err)
+	// A re-run after a crash waits for the clone that is already underway
+	task := tasks.FromContext(ctx).Reattach(ctx, template.Common, "clone")
+	if task == nil {
+		task, err = template.Clone(ctx, folder, opts.Name, cloneSpec)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start clone: %w", err)
+		}
 	}
 
-	info, err := task.WaitForResult(ctx, nil)
+	info, err := tasks.WaitForResult(ctx, task)
 	if err != nil {
 		return nil, fmt.Errorf("clone failed: %w", err)
 	}
@@ -163,13 +168,16 @@ func (o *Operations) CloneVM(ctx context.Context, sourceName, destName string, g
 		return nil, fmt.Errorf("failed to get folder: %w", err)
 	}
 
-	task, err := source.Clone(ctx, folder, destName, cloneSpec)
-	if err != nil {
-		metrics.RecordVMOperation("clone", "failure", time.Since(start).Seconds())
-		return nil, fmt.Errorf("failed to start clone: %w", err)
+	task := tasks.FromContext(ctx).Reattach(ctx, source.Common, "clone")
+	if task == nil {
+		task, err = source.Clone(ctx, folder, destName, cloneSpec)
+		if err != nil {
+			metrics.RecordVMOperation("clone", "failure", time.Since(start).Seconds())
+			return nil, fmt.Errorf("failed to start clone: %w", err)
+		}
 	}
 
-	info, err := task.WaitForResult(ctx, nil)
+	info, err := tasks.WaitForResult(ctx, task)
 	if err != nil {
 		metrics.RecordVMOperation("clone", "failure", time.Since(start).Seconds())
 		return nil, fmt.Errorf("clone failed: %w", err)
@@ -185,7 +193,7 @@ func (o *Operations) PowerOn(ctx context.Context, vm *object.VirtualMachine) err
 		return fmt.Errorf("failed to start power on: %w", err)
 	}
 
-	_, err = task.WaitForResult(ctx, nil)
+	_, err = tasks.WaitForResult(ctx, task)
 	if err != nil {
 		return fmt.Errorf("power on failed: %w", err)
 	}
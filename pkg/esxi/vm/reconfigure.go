@@ -0,0 +1,463 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/r11/esxi-commander/pkg/audit"
+	"github.com/r11/esxi-commander/pkg/metrics"
+	"github.com/r11/esxi-commander/pkg/tasks"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// ReconfigureOptions lists the changes to make to a VM. Nil fields are
+// left as they are
+type ReconfigureOptions struct {
+	CPU            *int32
+	CoresPerSocket *int32
+	MemoryMB       *int64
+	CPUHotAdd      *bool
+	MemoryHotAdd   *bool
+
+	// DiskGB grows the disk labelled Disk, or the first disk when Disk is empty
+	Disk   string
+	DiskGB *int64
+
+	CPUAllocation    AllocationChange // MHz
+	MemoryAllocation AllocationChange // MB
+}
+
+// AllocationChange changes a CPU or memory resource allocation. Nil and
+// empty fields are left as they are
+type AllocationChange struct {
+	Reservation *int64
+	Limit       *int64 // -1 for unlimited
+	Shares      string // low, normal, high or a number of shares
+}
+
+// ConfigChange is one setting changed by a reconfigure
+type ConfigChange struct {
+	Setting string `json:"setting"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+}
+
+// ReconfigurePlan is a validated reconfiguration of a VM
+type ReconfigurePlan struct {
+	VM         string                         `json:"vm"`
+	PowerState types.VirtualMachinePowerState `json:"power_state"`
+	Changes    []ConfigChange                 `json:"changes"`
+	Spec       types.VirtualMachineConfigSpec `json:"-"`
+}
+
+// PlanReconfigure validates opts against the named VM's current
+// configuration and power state and returns the spec that applies them
+func (o *Operations) PlanReconfigure(ctx context.Context, name string, opts ReconfigureOptions) (*ReconfigurePlan, error) {
+	_, plan, err := o.planReconfigure(ctx, name, opts)
+	return plan, err
+}
+
+// Reconfigure changes the named VM's CPU, memory, disk, hot-add and
+// resource allocation settings. Settings that already match are skipped
+// and a plan with no changes does not touch the VM
+func (o *Operations) Reconfigure(ctx context.Context, name string, opts ReconfigureOptions) (*ReconfigurePlan, error) {
+	start := time.Now()
+
+	auditCtx := audit.GetLogger().LogOperation(ctx, "vm.reconfigure", map[string]interface{}{
+		"vm": name,
+	})
+
+	vmObj, plan, err := o.planReconfigure(ctx, name, opts)
+	if err != nil {
+		metrics.RecordVMOperation("reconfigure", "failure", time.Since(start).Seconds())
+		auditCtx.Failure(err)
+		return nil, err
+	}
+
+	changes := make([]string, 0, len(plan.Changes))
+	for _, change := range plan.Changes {
+		changes = append(changes, fmt.Sprintf("%s: %s -> %s", change.Setting, change.From, change.To))
+	}
+	auditCtx.SetParameter("changes", changes)
+
+	if len(plan.Changes) == 0 {
+		metrics.RecordVMOperation("reconfigure", "success", time.Since(start).Seconds())
+		auditCtx.Success()
+		return plan, nil
+	}
+
+	task, err := vmObj.Reconfigure(ctx, plan.Spec)
+	if err != nil {
+		metrics.RecordVMOperation("reconfigure", "failure", time.Since(start).Seconds())
+		auditCtx.Failure(err)
+		return nil, fmt.Errorf("failed to start reconfigure: %w", err)
+	}
+
+	if _, err := tasks.WaitForResult(ctx, task); err != nil {
+		metrics.RecordVMOperation("reconfigure", "failure", time.Since(start).Seconds())
+		auditCtx.Failure(err)
+		return nil, fmt.Errorf("reconfigure failed: %w", err)
+	}
+
+	metrics.RecordVMOperation("reconfigure", "success", time.Since(start).Seconds())
+	auditCtx.Success()
+	return plan, nil
+}
+
+func (o *Operations) planReconfigure(ctx context.Context, name string, opts ReconfigureOptions) (*object.VirtualMachine, *ReconfigurePlan, error) {
+	vmObj, err := o.client.FindVM(ctx, name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("VM not found: %w", err)
+	}
+
+	var mvm mo.VirtualMachine
+	if err := vmObj.Properties(ctx, vmObj.Reference(), []string{"config", "runtime.powerState", "snapshot"}, &mvm); err != nil {
+		return nil, nil, fmt.Errorf("failed to get VM configuration: %w", err)
+	}
+	if mvm.Config == nil {
+		return nil, nil, fmt.Errorf("VM '%s' has no configuration", name)
+	}
+
+	plan, err := newReconfigurePlan(name, &mvm, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return vmObj, plan, nil
+}
+
+// newReconfigurePlan builds the config spec for opts, collecting every
+// setting that cannot be changed in the VM's current state
+func newReconfigurePlan(name string, mvm *mo.VirtualMachine, opts ReconfigureOptions) (*ReconfigurePlan, error) {
+	config := mvm.Config
+	hardware := config.Hardware
+	poweredOff := mvm.Runtime.PowerState == types.VirtualMachinePowerStatePoweredOff
+
+	plan := &ReconfigurePlan{VM: name, PowerState: mvm.Runtime.PowerState, Changes: []ConfigChange{}}
+	var errs []error
+	change := func(setting, from, to string) {
+		plan.Changes = append(plan.Changes, ConfigChange{Setting: setting, From: from, To: to})
+	}
+
+	// CPU
+	cpus, cores := hardware.NumCPU, hardware.NumCoresPerSocket
+	if cores == 0 {
+		cores = 1
+	}
+	newCPUs, newCores := cpus, cores
+	if opts.CPU != nil {
+		newCPUs = *opts.CPU
+	}
+	if opts.CoresPerSocket != nil {
+		newCores = *opts.CoresPerSocket
+	}
+	switch {
+	case newCPUs < 1:
+		errs = append(errs, fmt.Errorf("CPU count must be at least 1"))
+	case newCores < 1:
+		errs = append(errs, fmt.Errorf("cores per socket must be at least 1"))
+	case newCPUs%newCores != 0:
+		errs = append(errs, fmt.Errorf("%d CPUs cannot be split into sockets of %d cores", newCPUs, newCores))
+	}
+	if newCPUs != cpus {
+		switch {
+		case poweredOff:
+		case newCPUs > cpus && !boolValue(config.CpuHotAddEnabled):
+			errs = append(errs, fmt.Errorf("adding CPUs to a running VM needs CPU hot add; power the VM off first"))
+		case newCPUs < cpus && !boolValue(config.CpuHotRemoveEnabled):
+			errs = append(errs, fmt.Errorf("removing CPUs needs the VM powered off"))
+		}
+		plan.Spec.NumCPUs = newCPUs
+		change("CPUs", strconv.Itoa(int(cpus)), strconv.Itoa(int(newCPUs)))
+	}
+	if newCores != cores {
+		if !poweredOff {
+			errs = append(errs, fmt.Errorf("changing cores per socket needs the VM powered off"))
+		}
+		plan.Spec.NumCoresPerSocket = newCores
+		change("Cores per socket", strconv.Itoa(int(cores)), strconv.Itoa(int(newCores)))
+	}
+
+	// Memory
+	memoryMB := int64(hardware.MemoryMB)
+	newMemoryMB := memoryMB
+	if opts.MemoryMB != nil && *opts.MemoryMB != memoryMB {
+		newMemoryMB = *opts.MemoryMB
+		switch {
+		case newMemoryMB < 4 || newMemoryMB%4 != 0:
+			errs = append(errs, fmt.Errorf("memory must be a positive multiple of 4 MB, got %d MB", newMemoryMB))
+		case poweredOff:
+		case newMemoryMB < memoryMB:
+			errs = append(errs, fmt.Errorf("removing memory needs the VM powered off"))
+		case !boolValue(config.MemoryHotAddEnabled):
+			errs = append(errs, fmt.Errorf("adding memory to a running VM needs memory hot add; power the VM off first"))
+		case config.HotPlugMemoryLimit > 0 && newMemoryMB > config.HotPlugMemoryLimit:
+			errs = append(errs, fmt.Errorf("memory can only be hot added up to %s on this VM", formatMB(config.HotPlugMemoryLimit)))
+		case config.HotPlugMemoryIncrementSize > 0 && (newMemoryMB-memoryMB)%config.HotPlugMemoryIncrementSize != 0:
+			errs = append(errs, fmt.Errorf("memory must be hot added in steps of %d MB", config.HotPlugMemoryIncrementSize))
+		}
+		plan.Spec.MemoryMB = newMemoryMB
+		change("Memory", formatMB(memoryMB), formatMB(newMemoryMB))
+	}
+
+	// Hot add
+	for _, toggle := range []struct {
+		setting string
+		current *bool
+		want    *bool
+		spec    **bool
+	}{
+		{"CPU hot add", config.CpuHotAddEnabled, opts.CPUHotAdd, &plan.Spec.CpuHotAddEnabled},
+		{"Memory hot add", config.MemoryHotAddEnabled, opts.MemoryHotAdd, &plan.Spec.MemoryHotAddEnabled},
+	} {
+		if toggle.want == nil || boolValue(toggle.current) == *toggle.want {
+			continue
+		}
+		if !poweredOff {
+			errs = append(errs, fmt.Errorf("changing %s needs the VM powered off", strings.ToLower(toggle.setting)))
+		}
+		*toggle.spec = types.NewBool(*toggle.want)
+		change(toggle.setting, onOff(boolValue(toggle.current)), onOff(*toggle.want))
+	}
+
+	// Resource allocation
+	cpuAllocation, err := allocationSpec("CPU", "MHz", config.CpuAllocation, opts.CPUAllocation, change)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	plan.Spec.CpuAllocation = cpuAllocation
+
+	memoryAllocation, err := allocationSpec("Memory", "MB", config.MemoryAllocation, opts.MemoryAllocation, change)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	plan.Spec.MemoryAllocation = memoryAllocation
+	if reservation := reservationOf(config.MemoryAllocation, opts.MemoryAllocation); reservation > newMemoryMB {
+		errs = append(errs, fmt.Errorf("memory reservation of %s is more than the VM's %s of memory", formatMB(reservation), formatMB(newMemoryMB)))
+	}
+
+	// Disk
+	if opts.DiskGB != nil {
+		deviceChange, setting, from, to, err := diskGrowSpec(mvm, opts.Disk, *opts.DiskGB)
+		if err != nil {
+			errs = append(errs, err)
+		} else if deviceChange != nil {
+			plan.Spec.DeviceChange = append(plan.Spec.DeviceChange, deviceChange)
+			change(setting, from, to)
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, fmt.Errorf("cannot reconfigure VM '%s' (%s): %w", name, mvm.Runtime.PowerState, err)
+	}
+	return plan, nil
+}
+
+// allocationSpec returns the resource allocation spec that applies want,
+// or nil when nothing changes
+func allocationSpec(resource, unit string, current *types.ResourceAllocationInfo, want AllocationChange, change func(setting, from, to string)) (*types.ResourceAllocationInfo, error) {
+	if current == nil {
+		current = &types.ResourceAllocationInfo{}
+	}
+
+	var spec types.ResourceAllocationInfo
+	changed := false
+	if want.Reservation != nil && *want.Reservation != int64Value(current.Reservation, 0) {
+		if *want.Reservation < 0 {
+			return nil, fmt.Errorf("%s reservation cannot be negative", strings.ToLower(resource))
+		}
+		spec.Reservation = types.NewInt64(*want.Reservation)
+		change(resource+" reservation", formatAmount(int64Value(current.Reservation, 0), unit), formatAmount(*want.Reservation, unit))
+		changed = true
+	}
+
+	if want.Limit != nil && *want.Limit != int64Value(current.Limit, -1) {
+		if *want.Limit < -1 {
+			return nil, fmt.Errorf("%s limit cannot be negative", strings.ToLower(resource))
+		}
+		spec.Limit = types.NewInt64(*want.Limit)
+		change(resource+" limit", formatLimit(int64Value(current.Limit, -1), unit), formatLimit(*want.Limit, unit))
+		changed = true
+	}
+
+	reservation, limit := reservationOf(current, want), int64Value(current.Limit, -1)
+	if want.Limit != nil {
+		limit = *want.Limit
+	}
+	if limit != -1 && limit < reservation {
+		return nil, fmt.Errorf("%s limit of %s is below the reservation of %s",
+			strings.ToLower(resource), formatAmount(limit, unit), formatAmount(reservation, unit))
+	}
+
+	if want.Shares != "" {
+		shares, err := parseShares(want.Shares)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s shares: %w", strings.ToLower(resource), err)
+		}
+		if !sameShares(current.Shares, shares) {
+			spec.Shares = shares
+			change(resource+" shares", formatShares(current.Shares), formatShares(shares))
+			changed = true
+		}
+	}
+
+	if !changed {
+		return nil, nil
+	}
+	return &spec, nil
+}
+
+// diskGrowSpec returns the device change that grows the disk labelled
+// label, or the first disk, to sizeGB, or nil when it is already that size
+func diskGrowSpec(mvm *mo.VirtualMachine, label string, sizeGB int64) (*types.VirtualDeviceConfigSpec, string, string, string, error) {
+	devices := object.VirtualDeviceList(mvm.Config.Hardware.Device)
+	disks := devices.SelectByType((*types.VirtualDisk)(nil))
+
+	var disk *types.VirtualDisk
+	for _, device := range disks {
+		if label == "" || devices.Name(device) == label || deviceLabel(device) == label {
+			disk = device.(*types.VirtualDisk)
+			break
+		}
+	}
+	if disk == nil {
+		if label == "" {
+			return nil, "", "", "", fmt.Errorf("VM has no disks")
+		}
+		return nil, "", "", "", fmt.Errorf("VM has no disk '%s'", label)
+	}
+
+	name := deviceLabel(disk)
+	if name == "" {
+		name = devices.Name(disk)
+	}
+	current := disk.CapacityInBytes
+	if current == 0 {
+		current = disk.CapacityInKB * 1024
+	}
+	want := sizeGB << 30
+
+	switch {
+	case want == current:
+		return nil, "", "", "", nil
+	case want < current:
+		return nil, "", "", "", fmt.Errorf("disks cannot shrink: %s is %s", name, formatBytes(current))
+	case mvm.Snapshot != nil:
+		return nil, "", "", "", fmt.Errorf("cannot grow %s while the VM has snapshots", name)
+	}
+
+	grown := *disk
+	grown.CapacityInBytes = want
+	grown.CapacityInKB = want / 1024
+	return &types.VirtualDeviceConfigSpec{
+		Operation: types.VirtualDeviceConfigSpecOperationEdit,
+		Device:    &grown,
+	}, name, formatBytes(current), formatBytes(want), nil
+}
+
+func deviceLabel(device types.BaseVirtualDevice) string {
+	if info := device.GetVirtualDevice().DeviceInfo; info != nil {
+		return info.GetDescription().Label
+	}
+	return ""
+}
+
+// reservationOf returns the reservation an allocation will have once want
+// is applied
+func reservationOf(current *types.ResourceAllocationInfo, want AllocationChange) int64 {
+	if want.Reservation != nil {
+		return *want.Reservation
+	}
+	if current == nil {
+		return 0
+	}
+	return int64Value(current.Reservation, 0)
+}
+
+func parseShares(s string) (*types.SharesInfo, error) {
+	switch level := types.SharesLevel(strings.ToLower(s)); level {
+	case types.SharesLevelLow, types.SharesLevelNormal, types.SharesLevelHigh:
+		return &types.SharesInfo{Level: level}, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 32)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("%q is not low, normal, high or a positive number", s)
+	}
+	return &types.SharesInfo{Level: types.SharesLevelCustom, Shares: int32(n)}, nil
+}
+
+func sameShares(current, want *types.SharesInfo) bool {
+	if current == nil {
+		return false
+	}
+	if want.Level == types.SharesLevelCustom {
+		return current.Level == types.SharesLevelCustom && current.Shares == want.Shares
+	}
+	return current.Level == want.Level
+}
+
+func formatShares(shares *types.SharesInfo) string {
+	switch {
+	case shares == nil:
+		return "-"
+	case shares.Level == types.SharesLevelCustom:
+		return strconv.Itoa(int(shares.Shares))
+	case shares.Shares > 0:
+		return fmt.Sprintf("%s (%d)", shares.Level, shares.Shares)
+	}
+	return string(shares.Level)
+}
+
+func formatLimit(limit int64, unit string) string {
+	if limit == -1 {
+		return "unlimited"
+	}
+	return formatAmount(limit, unit)
+}
+
+func formatAmount(n int64, unit string) string {
+	if unit == "MB" {
+		return formatMB(n)
+	}
+	return fmt.Sprintf("%d %s", n, unit)
+}
+
+func formatMB(mb int64) string {
+	if mb >= 1024 && mb%1024 == 0 {
+		return fmt.Sprintf("%d GB", mb/1024)
+	}
+	return fmt.Sprintf("%d MB", mb)
+}
+
+func formatBytes(b int64) string {
+	switch {
+	case b%(1<<30) == 0:
+		return fmt.Sprintf("%d GB", b>>30)
+	case b < 1<<30 && b%(1<<20) == 0:
+		return fmt.Sprintf("%d MB", b>>20)
+	}
+	return fmt.Sprintf("%.1f GB", float64(b)/(1<<30))
+}
+
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+func boolValue(b *bool) bool {
+	return b != nil && *b
+}
+
+func int64Value(n *int64, unset int64) int64 {
+	if n == nil {
+		return unset
+	}
+	return *n
+}
@@ -0,0 +1,199 @@
+package vm
+
+import (
+	"context"
+	"crypto/tls"
+	"testing"
+
+	"github.com/r11/esxi-commander/pkg/esxi/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// testVM returns a VM with 2 CPUs, 4 GB of memory and a 10 GB disk
+func testVM(state types.VirtualMachinePowerState) *mo.VirtualMachine {
+	return &mo.VirtualMachine{
+		Runtime: types.VirtualMachineRuntimeInfo{PowerState: state},
+		Config: &types.VirtualMachineConfigInfo{
+			Hardware: types.VirtualHardware{
+				NumCPU:            2,
+				NumCoresPerSocket: 1,
+				MemoryMB:          4096,
+				Device: []types.BaseVirtualDevice{
+					&types.VirtualDisk{
+						VirtualDevice: types.VirtualDevice{
+							Key:        2000,
+							DeviceInfo: &types.Description{Label: "Hard disk 1"},
+						},
+						CapacityInBytes: 10 << 30,
+					},
+				},
+			},
+			CpuAllocation:    &types.ResourceAllocationInfo{Reservation: types.NewInt64(0), Limit: types.NewInt64(-1), Shares: &types.SharesInfo{Level: types.SharesLevelNormal, Shares: 2000}},
+			MemoryAllocation: &types.ResourceAllocationInfo{Reservation: types.NewInt64(0), Limit: types.NewInt64(-1), Shares: &types.SharesInfo{Level: types.SharesLevelNormal, Shares: 40960}},
+		},
+	}
+}
+
+func int32p(n int32) *int32 { return &n }
+func int64p(n int64) *int64 { return &n }
+
+func TestReconfigurePlanPoweredOff(t *testing.T) {
+	plan, err := newReconfigurePlan("web", testVM(types.VirtualMachinePowerStatePoweredOff), ReconfigureOptions{
+		CPU:            int32p(4),
+		CoresPerSocket: int32p(2),
+		MemoryMB:       int64p(8192),
+		CPUHotAdd:      types.NewBool(true),
+		DiskGB:         int64p(20),
+		MemoryAllocation: AllocationChange{
+			Reservation: int64p(2048),
+			Shares:      "high",
+		},
+		CPUAllocation: AllocationChange{Limit: int64p(-1)},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, []ConfigChange{
+		{Setting: "CPUs", From: "2", To: "4"},
+		{Setting: "Cores per socket", From: "1", To: "2"},
+		{Setting: "Memory", From: "4 GB", To: "8 GB"},
+		{Setting: "CPU hot add", From: "off", To: "on"},
+		{Setting: "Memory reservation", From: "0 MB", To: "2 GB"},
+		{Setting: "Memory shares", From: "normal (40960)", To: "high"},
+		{Setting: "Hard disk 1", From: "10 GB", To: "20 GB"},
+	}, plan.Changes)
+
+	assert.Equal(t, int32(4), plan.Spec.NumCPUs)
+	assert.Equal(t, int32(2), plan.Spec.NumCoresPerSocket)
+	assert.Equal(t, int64(8192), plan.Spec.MemoryMB)
+	assert.True(t, *plan.Spec.CpuHotAddEnabled)
+	assert.Nil(t, plan.Spec.MemoryHotAddEnabled)
+	assert.Nil(t, plan.Spec.CpuAllocation, "an unchanged limit is left out")
+	require.NotNil(t, plan.Spec.MemoryAllocation)
+	assert.Equal(t, int64(2048), *plan.Spec.MemoryAllocation.Reservation)
+	assert.Nil(t, plan.Spec.MemoryAllocation.Limit)
+	assert.Equal(t, types.SharesLevelHigh, plan.Spec.MemoryAllocation.Shares.Level)
+
+	require.Len(t, plan.Spec.DeviceChange, 1)
+	edit := plan.Spec.DeviceChange[0].GetVirtualDeviceConfigSpec()
+	assert.Equal(t, types.VirtualDeviceConfigSpecOperationEdit, edit.Operation)
+	assert.Equal(t, int64(20<<30), edit.Device.(*types.VirtualDisk).CapacityInBytes)
+}
+
+func TestReconfigurePlanPoweredOn(t *testing.T) {
+	on := types.VirtualMachinePowerStatePoweredOn
+
+	_, err := newReconfigurePlan("web", testVM(on), ReconfigureOptions{CPU: int32p(4), MemoryMB: int64p(8192)})
+	assert.ErrorContains(t, err, "adding CPUs to a running VM needs CPU hot add")
+	assert.ErrorContains(t, err, "adding memory to a running VM needs memory hot add")
+
+	_, err = newReconfigurePlan("web", testVM(on), ReconfigureOptions{CPU: int32p(1), MemoryMB: int64p(2048)})
+	assert.ErrorContains(t, err, "removing CPUs needs the VM powered off")
+	assert.ErrorContains(t, err, "removing memory needs the VM powered off")
+
+	_, err = newReconfigurePlan("web", testVM(on), ReconfigureOptions{CoresPerSocket: int32p(2), MemoryHotAdd: types.NewBool(true)})
+	assert.ErrorContains(t, err, "changing cores per socket needs the VM powered off")
+	assert.ErrorContains(t, err, "changing memory hot add needs the VM powered off")
+
+	vm := testVM(on)
+	vm.Config.CpuHotAddEnabled = types.NewBool(true)
+	vm.Config.MemoryHotAddEnabled = types.NewBool(true)
+	vm.Config.HotPlugMemoryLimit = 16384
+	plan, err := newReconfigurePlan("web", vm, ReconfigureOptions{CPU: int32p(4), MemoryMB: int64p(8192)})
+	require.NoError(t, err)
+	assert.Len(t, plan.Changes, 2)
+
+	_, err = newReconfigurePlan("web", vm, ReconfigureOptions{MemoryMB: int64p(32768)})
+	assert.ErrorContains(t, err, "memory can only be hot added up to 16 GB")
+}
+
+func TestReconfigurePlanValidation(t *testing.T) {
+	off := types.VirtualMachinePowerStatePoweredOff
+
+	tests := []struct {
+		name string
+		opts ReconfigureOptions
+		want string
+	}{
+		{"uneven sockets", ReconfigureOptions{CPU: int32p(3), CoresPerSocket: int32p(2)}, "3 CPUs cannot be split into sockets of 2 cores"},
+		{"zero CPUs", ReconfigureOptions{CPU: int32p(0)}, "CPU count must be at least 1"},
+		{"odd memory", ReconfigureOptions{MemoryMB: int64p(1001)}, "multiple of 4 MB"},
+		{"shrink disk", ReconfigureOptions{DiskGB: int64p(5)}, "disks cannot shrink: Hard disk 1 is 10 GB"},
+		{"unknown disk", ReconfigureOptions{Disk: "Hard disk 9", DiskGB: int64p(20)}, "VM has no disk 'Hard disk 9'"},
+		{"reservation over memory", ReconfigureOptions{MemoryAllocation: AllocationChange{Reservation: int64p(8192)}}, "memory reservation of 8 GB is more than the VM's 4 GB of memory"},
+		{"limit under reservation", ReconfigureOptions{CPUAllocation: AllocationChange{Reservation: int64p(2000), Limit: int64p(1000)}}, "cpu limit of 1000 MHz is below the reservation of 2000 MHz"},
+		{"bad shares", ReconfigureOptions{CPUAllocation: AllocationChange{Shares: "lots"}}, "invalid cpu shares"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newReconfigurePlan("web", testVM(off), tt.opts)
+			assert.ErrorContains(t, err, tt.want)
+		})
+	}
+
+	vm := testVM(off)
+	vm.Snapshot = &types.VirtualMachineSnapshotInfo{}
+	_, err := newReconfigurePlan("web", vm, ReconfigureOptions{DiskGB: int64p(20)})
+	assert.ErrorContains(t, err, "cannot grow Hard disk 1 while the VM has snapshots")
+
+	// Settings that already match are not changes
+	plan, err := newReconfigurePlan("web", testVM(off), ReconfigureOptions{
+		CPU:           int32p(2),
+		MemoryMB:      int64p(4096),
+		DiskGB:        int64p(10),
+		CPUHotAdd:     types.NewBool(false),
+		CPUAllocation: AllocationChange{Shares: "normal"},
+	})
+	require.NoError(t, err)
+	assert.Empty(t, plan.Changes)
+}
+
+func TestReconfigure(t *testing.T) {
+	model := simulator.ESX()
+	require.NoError(t, model.Create())
+	model.Service.TLS = new(tls.Config)
+	t.Cleanup(model.Remove)
+	server := model.Service.NewServer()
+	t.Cleanup(server.Close)
+
+	password, _ := server.URL.User.Password()
+	c, err := client.NewClient(&client.Config{
+		Host:     server.URL.Host,
+		User:     server.URL.User.Username(),
+		Password: password,
+		Insecure: true,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+
+	ctx := context.Background()
+	vms, err := c.ListVMs(ctx)
+	require.NoError(t, err)
+	require.NotEmpty(t, vms)
+	name := vms[0].Name
+
+	ops := NewOperations(c)
+	vmObj, err := c.FindVM(ctx, name)
+	require.NoError(t, err)
+	require.NoError(t, ops.PowerOff(ctx, vmObj))
+
+	plan, err := ops.Reconfigure(ctx, name, ReconfigureOptions{CPU: int32p(4), MemoryMB: int64p(2048)})
+	require.NoError(t, err)
+	assert.Len(t, plan.Changes, 2)
+
+	var mvm mo.VirtualMachine
+	require.NoError(t, vmObj.Properties(ctx, vmObj.Reference(), []string{"config.hardware"}, &mvm))
+	assert.Equal(t, int32(4), mvm.Config.Hardware.NumCPU)
+	assert.Equal(t, int32(2048), mvm.Config.Hardware.MemoryMB)
+
+	// Running again changes nothing
+	plan, err = ops.Reconfigure(ctx, name, ReconfigureOptions{CPU: int32p(4), MemoryMB: int64p(2048)})
+	require.NoError(t, err)
+	assert.Empty(t, plan.Changes)
+
+	_, err = ops.Reconfigure(ctx, "no-such-vm", ReconfigureOptions{CPU: int32p(4)})
+	assert.Error(t, err)
+}
@@ -1,6 +1,8 @@
 package metrics
 
 import (
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
@@ -48,6 +50,46 @@ var (
 		[]string{"operation", "status"},
 	)
 
+	ScheduledRunsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ceso_scheduled_runs_total",
+			Help: "Total scheduled backup job runs by outcome (completed, failed, skipped)",
+		},
+		[]string{"job", "status"},
+	)
+
+	BackupDrillPassed = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ceso_backup_drill_passed",
+			Help: "Whether the most recent restore drill of a VM's backup passed (1) or failed (0)",
+		},
+		[]string{"vm_name"},
+	)
+
+	BackupDrillTimestamp = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ceso_backup_drill_timestamp_seconds",
+			Help: "Unix time the most recent restore drill of a VM's backup started",
+		},
+		[]string{"vm_name"},
+	)
+
+	BackupDrillStepSeconds = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ceso_backup_drill_step_seconds",
+			Help: "Time taken by each step of the most recent restore drill of a VM's backup (restore, heartbeat, probe, total)",
+		},
+		[]string{"vm_name", "step"},
+	)
+
+	APIRequestsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ceso_api_requests_total",
+			Help: "Total cesod REST API requests by JSON-RPC method and HTTP status",
+		},
+		[]string{"method", "status"},
+	)
+
 	AIAgentOperationsTotal = promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "ceso_ai_agent_operations_total",
@@ -95,6 +137,28 @@ func RecordBackupSize(vmName string, sizeBytes float64) {
 	BackupSizeBytes.WithLabelValues(vmName).Set(sizeBytes)
 }
 
+func RecordScheduledRun(job string, status string) {
+	ScheduledRunsTotal.WithLabelValues(job, status).Inc()
+}
+
+// RecordBackupDrill publishes the outcome of a VM's most recent restore
+// drill; steps maps step names to seconds
+func RecordBackupDrill(vmName string, passed bool, started time.Time, steps map[string]float64) {
+	value := 0.0
+	if passed {
+		value = 1
+	}
+	BackupDrillPassed.WithLabelValues(vmName).Set(value)
+	BackupDrillTimestamp.WithLabelValues(vmName).Set(float64(started.Unix()))
+	for step, seconds := range steps {
+		BackupDrillStepSeconds.WithLabelValues(vmName, step).Set(seconds)
+	}
+}
+
+func RecordAPIRequest(method string, status string) {
+	APIRequestsTotal.WithLabelValues(method, status).Inc()
+}
+
 func RecordAIOperation(mode string, operation string) {
 	AIAgentOperationsTotal.WithLabelValues(mode, operation).Inc()
 }
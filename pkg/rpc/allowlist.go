@@ -0,0 +1,77 @@
+package rpc
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Allowlist admits clients by IP address, as configured in
+// security.ip_allowlist
+type Allowlist struct {
+	nets []*net.IPNet
+}
+
+// ParseAllowlist parses IP addresses and CIDR ranges. An empty list admits
+// every client.
+func ParseAllowlist(entries []string) (*Allowlist, error) {
+	a := &Allowlist{}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip_allowlist entry %q", entry)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			entry = fmt.Sprintf("%s/%d", entry, bits)
+		}
+
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ip_allowlist entry %q: %w", entry, err)
+		}
+		a.nets = append(a.nets, ipNet)
+	}
+	return a, nil
+}
+
+// AllowsAddr reports whether a client at addr may connect. Clients on the
+// Unix socket are admitted by its file permissions instead.
+func (a *Allowlist) AllowsAddr(addr net.Addr) bool {
+	if a == nil || len(a.nets) == 0 {
+		return true
+	}
+
+	switch addr := addr.(type) {
+	case nil, *net.UnixAddr:
+		return true
+	case *net.TCPAddr:
+		return a.Allows(addr.IP)
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return false
+		}
+		return a.Allows(net.ParseIP(host))
+	}
+}
+
+// Allows reports whether ip is in the allowlist
+func (a *Allowlist) Allows(ip net.IP) bool {
+	if a == nil || len(a.nets) == 0 {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range a.nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
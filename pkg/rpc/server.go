@@ -0,0 +1,369 @@
+// Package rpc implements the JSON-RPC 2.0 server cesod exposes over a Unix
+// socket and TLS
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/r11/esxi-commander/pkg/audit"
+	"github.com/r11/esxi-commander/pkg/security"
+	"github.com/rs/zerolog/log"
+)
+
+// JSON-RPC 2.0 error codes, and the server-defined ones cesod adds
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+	CodeNotAllowed     = -32001 // The sandbox denied the operation
+)
+
+// ProgressMethod is the notification sent while a call runs
+const ProgressMethod = "progress"
+
+// Error is a JSON-RPC error object. Handlers return one to choose the code;
+// any other error is reported as an internal error.
+type Error struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// InvalidParams returns an invalid params error for err
+func InvalidParams(err error) *Error {
+	return &Error{Code: CodeInvalidParams, Message: fmt.Sprintf("invalid params: %v", err)}
+}
+
+// Handler runs a method call and returns its result
+type Handler func(ctx context.Context, call *Call) (interface{}, error)
+
+// Method is a registered method
+type Method struct {
+	Name      string
+	Operation string // Sandbox operation checked before every call
+	Handler   Handler
+}
+
+// Call is one method call on a connection
+type Call struct {
+	Method string
+	Params json.RawMessage
+
+	id     json.RawMessage // nil for notifications
+	notify func(method string, params interface{})
+}
+
+// Bind decodes the call's params object into v, rejecting unknown fields
+func (c *Call) Bind(v interface{}) error {
+	if len(c.Params) == 0 || bytes.Equal(c.Params, []byte("null")) {
+		return nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(c.Params))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return InvalidParams(err)
+	}
+	return nil
+}
+
+// ProgressParams are the params of a progress notification. ID is the id
+// of the request the progress belongs to.
+type ProgressParams struct {
+	ID      json.RawMessage `json:"id"`
+	Stage   string          `json:"stage"`
+	Percent float32         `json:"percent"` // -1 when unknown
+}
+
+// Progress sends a progress notification for the call to the client.
+// Calls sent as notifications have no id to report progress against, so
+// nothing is sent for them.
+func (c *Call) Progress(stage string, percent float32) {
+	if c.id == nil || c.notify == nil {
+		return
+	}
+	c.notify(ProgressMethod, ProgressParams{ID: c.id, Stage: stage, Percent: percent})
+}
+
+type request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+}
+
+type response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type notification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+// Server dispatches JSON-RPC calls to registered methods. Every call is
+// checked against the sandbox, and TCP clients against the IP allowlist.
+type Server struct {
+	methods   map[string]Method
+	sandbox   *security.Sandbox
+	allowlist *Allowlist
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+// NewServer creates a server enforcing sandbox and allowlist; a nil
+// allowlist admits every client
+func NewServer(sandbox *security.Sandbox, allowlist *Allowlist) *Server {
+	return &Server{
+		methods:   make(map[string]Method),
+		sandbox:   sandbox,
+		allowlist: allowlist,
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+// Register adds a method; operation is the sandbox operation it performs
+func (s *Server) Register(name, operation string, handler Handler) {
+	s.methods[name] = Method{Name: name, Operation: operation, Handler: handler}
+}
+
+// Methods returns the registered methods sorted by name
+func (s *Server) Methods() []Method {
+	methods := make([]Method, 0, len(s.methods))
+	for _, method := range s.methods {
+		methods = append(methods, method)
+	}
+	sort.Slice(methods, func(i, j int) bool {
+		return methods[i].Name < methods[j].Name
+	})
+	return methods
+}
+
+// Serve accepts connections on l until ctx is cancelled, then closes the
+// open connections and waits for their calls to return
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+	}()
+	defer s.wg.Wait()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return fmt.Errorf("failed to accept connection: %w", err)
+		}
+
+		if !s.allowlist.AllowsAddr(conn.RemoteAddr()) {
+			log.Warn().Str("remote", addrString(conn.RemoteAddr())).Msg("rejected RPC client not in security.ip_allowlist")
+			conn.Close()
+			continue
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serveConn(ctx, conn)
+
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// serveConn reads requests from conn until it closes. Calls run
+// concurrently and are cancelled when the connection goes away.
+func (s *Server) serveConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	c := &connWriter{encoder: json.NewEncoder(conn)}
+	var calls sync.WaitGroup
+	defer calls.Wait()
+
+	decoder := json.NewDecoder(conn)
+	for {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			if err != io.EOF && ctx.Err() == nil && !errors.Is(err, net.ErrClosed) {
+				// The stream cannot be resynchronised after malformed JSON
+				c.write(response{JSONRPC: "2.0", Error: &Error{Code: CodeParseError, Message: "parse error"}, ID: json.RawMessage("null")})
+			}
+			cancel()
+			return
+		}
+
+		calls.Add(1)
+		go func() {
+			defer calls.Done()
+			if reply := s.handleMessage(ctx, conn, c, raw); reply != nil {
+				c.write(reply)
+			}
+		}()
+	}
+}
+
+// handleMessage handles a request or batch and returns the reply, or nil
+// if nothing is to be sent back
+func (s *Server) handleMessage(ctx context.Context, conn net.Conn, c *connWriter, raw json.RawMessage) interface{} {
+	trimmed := bytes.TrimLeft(raw, " \t\r\n")
+	if len(trimmed) == 0 || trimmed[0] != '[' {
+		if resp := s.handleRequest(ctx, conn, c, raw); resp != nil {
+			return resp
+		}
+		return nil
+	}
+
+	var batch []json.RawMessage
+	if err := json.Unmarshal(raw, &batch); err != nil || len(batch) == 0 {
+		return response{JSONRPC: "2.0", Error: &Error{Code: CodeInvalidRequest, Message: "invalid request"}, ID: json.RawMessage("null")}
+	}
+
+	responses := make([]*response, len(batch))
+	var wg sync.WaitGroup
+	for i, item := range batch {
+		wg.Add(1)
+		go func(i int, item json.RawMessage) {
+			defer wg.Done()
+			responses[i] = s.handleRequest(ctx, conn, c, item)
+		}(i, item)
+	}
+	wg.Wait()
+
+	var replies []*response
+	for _, resp := range responses {
+		if resp != nil {
+			replies = append(replies, resp)
+		}
+	}
+	if len(replies) == 0 {
+		return nil
+	}
+	return replies
+}
+
+// handleRequest runs a single request and returns its response, or nil for
+// a notification
+func (s *Server) handleRequest(ctx context.Context, conn net.Conn, c *connWriter, raw json.RawMessage) *response {
+	var req request
+	if err := json.Unmarshal(raw, &req); err != nil || req.JSONRPC != "2.0" || req.Method == "" {
+		return &response{JSONRPC: "2.0", Error: &Error{Code: CodeInvalidRequest, Message: "invalid request"}, ID: json.RawMessage("null")}
+	}
+
+	result, err := s.Call(ctx, conn.RemoteAddr(), &Call{
+		Method: req.Method,
+		Params: req.Params,
+		id:     req.ID,
+		notify: func(method string, params interface{}) {
+			c.write(notification{JSONRPC: "2.0", Method: method, Params: params})
+		},
+	})
+
+	if req.ID == nil {
+		return nil
+	}
+
+	resp := &response{JSONRPC: "2.0", ID: req.ID}
+	if err != nil {
+		var rpcErr *Error
+		if !errors.As(err, &rpcErr) {
+			rpcErr = &Error{Code: CodeInternalError, Message: err.Error()}
+		}
+		resp.Error = rpcErr
+	} else {
+		if result == nil {
+			result = struct{}{}
+		}
+		resp.Result = result
+	}
+	return resp
+}
+
+// Call checks call against the sandbox, runs it and records it in the
+// audit log. remote is the client's address.
+func (s *Server) Call(ctx context.Context, remote net.Addr, call *Call) (interface{}, error) {
+	method, ok := s.methods[call.Method]
+	if !ok {
+		return nil, &Error{Code: CodeMethodNotFound, Message: fmt.Sprintf("method not found: %s", call.Method)}
+	}
+
+	auditCtx := audit.GetLogger().LogOperation(ctx, "rpc."+call.Method, map[string]interface{}{
+		"remote":    addrString(remote),
+		"operation": method.Operation,
+	})
+
+	if err := s.sandbox.CheckOperation(method.Operation); err != nil {
+		auditCtx.Failure(err)
+		return nil, &Error{Code: CodeNotAllowed, Message: err.Error()}
+	}
+
+	result, err := method.Handler(ctx, call)
+	if err != nil {
+		auditCtx.Failure(err)
+		return nil, err
+	}
+	auditCtx.Success()
+	return result, nil
+}
+
+// addrString returns addr as a string; Unix socket peers have no address
+func addrString(addr net.Addr) string {
+	if addr == nil || addr.String() == "" {
+		return "unix"
+	}
+	return addr.String()
+}
+
+// connWriter serialises the responses and notifications written to a
+// connection by concurrent calls
+type connWriter struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+func (c *connWriter) write(v interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.encoder.Encode(v); err != nil {
+		log.Debug().Err(err).Msg("failed to write RPC message")
+	}
+}
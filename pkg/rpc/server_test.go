@@ -0,0 +1,264 @@
+package rpc
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/r11/esxi-commander/pkg/audit"
+	"github.com/r11/esxi-commander/pkg/security"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "rpc-audit")
+	if err != nil {
+		panic(err)
+	}
+	if err := audit.Initialize(filepath.Join(dir, "audit.json")); err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+type echoParams struct {
+	Text string `json:"text"`
+}
+
+// startServer serves a test server on a Unix socket and returns a client
+// connection to it
+func startServer(t *testing.T, mode security.OperationMode) (net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	sandbox := &security.Sandbox{Mode: mode, AllowedOps: map[string]bool{"test.read": true}}
+	s := NewServer(sandbox, nil)
+	s.Register("echo", "test.read", func(ctx context.Context, call *Call) (interface{}, error) {
+		var params echoParams
+		if err := call.Bind(&params); err != nil {
+			return nil, err
+		}
+		return params, nil
+	})
+	s.Register("write", "test.write", func(ctx context.Context, call *Call) (interface{}, error) {
+		return nil, nil
+	})
+	s.Register("fail", "test.read", func(ctx context.Context, call *Call) (interface{}, error) {
+		return nil, fmt.Errorf("it broke")
+	})
+	s.Register("task", "test.read", func(ctx context.Context, call *Call) (interface{}, error) {
+		call.Progress("copy", 50)
+		call.Progress("copy", 100)
+		return "done", nil
+	})
+
+	socket := filepath.Join(t.TempDir(), "rpc.sock")
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.NoError(t, s.Serve(ctx, l))
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	conn, err := net.Dial("unix", socket)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return conn, bufio.NewReader(conn)
+}
+
+// roundTrip sends req and decodes the next message into v
+func roundTrip(t *testing.T, conn net.Conn, r *bufio.Reader, req string, v interface{}) {
+	t.Helper()
+	_, err := conn.Write([]byte(req + "\n"))
+	require.NoError(t, err)
+	line, err := r.ReadBytes('\n')
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(line, v))
+}
+
+type testResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result"`
+	Error   *Error          `json:"error"`
+	ID      json.RawMessage `json:"id"`
+}
+
+func TestServerCall(t *testing.T) {
+	conn, r := startServer(t, security.ModeStandard)
+
+	var resp testResponse
+	roundTrip(t, conn, r, `{"jsonrpc":"2.0","method":"echo","params":{"text":"hi"},"id":1}`, &resp)
+	assert.Equal(t, "2.0", resp.JSONRPC)
+	assert.Nil(t, resp.Error)
+	assert.JSONEq(t, `{"text":"hi"}`, string(resp.Result))
+	assert.Equal(t, "1", string(resp.ID))
+}
+
+func TestServerErrors(t *testing.T) {
+	conn, r := startServer(t, security.ModeStandard)
+
+	tests := []struct {
+		name string
+		req  string
+		code int
+	}{
+		{"method not found", `{"jsonrpc":"2.0","method":"missing","id":1}`, CodeMethodNotFound},
+		{"sandbox denial", `{"jsonrpc":"2.0","method":"write","id":2}`, CodeNotAllowed},
+		{"unknown param", `{"jsonrpc":"2.0","method":"echo","params":{"txt":"hi"},"id":3}`, CodeInvalidParams},
+		{"handler error", `{"jsonrpc":"2.0","method":"fail","id":4}`, CodeInternalError},
+		{"missing version", `{"method":"echo","id":5}`, CodeInvalidRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp testResponse
+			roundTrip(t, conn, r, tt.req, &resp)
+			require.NotNil(t, resp.Error)
+			assert.Equal(t, tt.code, resp.Error.Code)
+		})
+	}
+}
+
+func TestServerUnrestrictedMode(t *testing.T) {
+	conn, r := startServer(t, security.ModeUnrestricted)
+
+	var resp testResponse
+	roundTrip(t, conn, r, `{"jsonrpc":"2.0","method":"write","id":1}`, &resp)
+	assert.Nil(t, resp.Error)
+	assert.JSONEq(t, `{}`, string(resp.Result))
+}
+
+func TestServerBatch(t *testing.T) {
+	conn, r := startServer(t, security.ModeStandard)
+
+	// The notification gets no response
+	var resps []testResponse
+	roundTrip(t, conn, r, `[
+		{"jsonrpc":"2.0","method":"echo","params":{"text":"a"},"id":1},
+		{"jsonrpc":"2.0","method":"echo","params":{"text":"b"}},
+		{"jsonrpc":"2.0","method":"missing","id":2}
+	]`, &resps)
+	require.Len(t, resps, 2)
+	assert.JSONEq(t, `{"text":"a"}`, string(resps[0].Result))
+	assert.Equal(t, CodeMethodNotFound, resps[1].Error.Code)
+}
+
+func TestServerNotification(t *testing.T) {
+	conn, r := startServer(t, security.ModeStandard)
+
+	// The next message must be the response to the second request
+	_, err := conn.Write([]byte(`{"jsonrpc":"2.0","method":"task"}` + "\n"))
+	require.NoError(t, err)
+
+	var resp testResponse
+	roundTrip(t, conn, r, `{"jsonrpc":"2.0","method":"echo","params":{"text":"x"},"id":"b"}`, &resp)
+	assert.Equal(t, `"b"`, string(resp.ID))
+}
+
+func TestServerProgress(t *testing.T) {
+	conn, r := startServer(t, security.ModeStandard)
+
+	_, err := conn.Write([]byte(`{"jsonrpc":"2.0","method":"task","id":7}` + "\n"))
+	require.NoError(t, err)
+
+	var percents []float32
+	for {
+		line, err := r.ReadBytes('\n')
+		require.NoError(t, err)
+
+		var msg struct {
+			Method string          `json:"method"`
+			Params ProgressParams  `json:"params"`
+			Result json.RawMessage `json:"result"`
+		}
+		require.NoError(t, json.Unmarshal(line, &msg))
+		if msg.Method == "" {
+			assert.JSONEq(t, `"done"`, string(msg.Result))
+			break
+		}
+
+		assert.Equal(t, ProgressMethod, msg.Method)
+		assert.Equal(t, "7", string(msg.Params.ID))
+		assert.Equal(t, "copy", msg.Params.Stage)
+		percents = append(percents, msg.Params.Percent)
+	}
+	assert.Equal(t, []float32{50, 100}, percents)
+}
+
+func TestServerParseError(t *testing.T) {
+	conn, r := startServer(t, security.ModeStandard)
+
+	var resp testResponse
+	roundTrip(t, conn, r, `{"jsonrpc":`+"}", &resp)
+	require.NotNil(t, resp.Error)
+	assert.Equal(t, CodeParseError, resp.Error.Code)
+}
+
+func TestServerAllowlist(t *testing.T) {
+	allowlist, err := ParseAllowlist([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+
+	s := NewServer(&security.Sandbox{Mode: security.ModeUnrestricted}, allowlist)
+	s.Register("echo", "test.read", func(ctx context.Context, call *Call) (interface{}, error) {
+		return "hi", nil
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Serve(ctx, l)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	// The server closes the connection without answering
+	conn.Write([]byte(`{"jsonrpc":"2.0","method":"echo","id":1}` + "\n"))
+	_, err = bufio.NewReader(conn).ReadBytes('\n')
+	assert.Error(t, err)
+}
+
+func TestParseAllowlist(t *testing.T) {
+	allowlist, err := ParseAllowlist([]string{"192.168.1.0/24", "10.1.2.3", "fd00::/8"})
+	require.NoError(t, err)
+
+	assert.True(t, allowlist.Allows(net.ParseIP("192.168.1.20")))
+	assert.True(t, allowlist.Allows(net.ParseIP("10.1.2.3")))
+	assert.True(t, allowlist.Allows(net.ParseIP("fd00::1")))
+	assert.False(t, allowlist.Allows(net.ParseIP("10.1.2.4")))
+	assert.False(t, allowlist.Allows(nil))
+	assert.True(t, allowlist.AllowsAddr(&net.UnixAddr{Name: "@", Net: "unix"}))
+	assert.False(t, allowlist.AllowsAddr(&net.TCPAddr{IP: net.ParseIP("172.16.0.1")}))
+
+	empty, err := ParseAllowlist(nil)
+	require.NoError(t, err)
+	assert.True(t, empty.Allows(net.ParseIP("172.16.0.1")))
+
+	_, err = ParseAllowlist([]string{"not-an-ip"})
+	assert.Error(t, err)
+}
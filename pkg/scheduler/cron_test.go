@@ -0,0 +1,82 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScheduleNext(t *testing.T) {
+	// A Wednesday
+	from := time.Date(2025, 1, 15, 10, 30, 20, 0, time.UTC)
+
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2025, 1, 15, 10, 31, 0, 0, time.UTC)},
+		{"0 2 * * *", time.Date(2025, 1, 16, 2, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2025, 1, 16, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2025, 1, 15, 11, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2025, 1, 15, 10, 45, 0, 0, time.UTC)},
+		{"45 10-12/2 * * *", time.Date(2025, 1, 15, 10, 45, 0, 0, time.UTC)},
+		{"0 3 * * sun", time.Date(2025, 1, 19, 3, 0, 0, 0, time.UTC)},
+		{"0 3 * * 7", time.Date(2025, 1, 19, 3, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 feb *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 6 1,20 jan-mar *", time.Date(2025, 1, 20, 6, 0, 0, 0, time.UTC)},
+		// Both day fields restricted: either matches
+		{"0 0 1 * fri", time.Date(2025, 1, 17, 0, 0, 0, 0, time.UTC)},
+		// A stepped day of week is restricted, so day of month is ignored
+		{"0 0 * * */3", time.Date(2025, 1, 18, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			schedule, err := ParseSchedule(tt.spec)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, schedule.Next(from))
+		})
+	}
+}
+
+func TestScheduleNextInLocation(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.NoError(t, err)
+
+	schedule, err := ParseSchedule("30 2 * * *")
+	require.NoError(t, err)
+
+	// 02:30 does not exist on the day clocks go forward
+	next := schedule.Next(time.Date(2025, 3, 30, 0, 0, 0, 0, berlin))
+	assert.Equal(t, time.Date(2025, 3, 31, 2, 30, 0, 0, berlin), next)
+
+	next = schedule.Next(time.Date(2025, 6, 1, 12, 0, 0, 0, berlin))
+	assert.Equal(t, time.Date(2025, 6, 2, 0, 30, 0, 0, time.UTC), next.UTC())
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"@reboot",
+	} {
+		_, err := ParseSchedule(spec)
+		assert.Error(t, err, spec)
+	}
+
+	// Never matches
+	schedule, err := ParseSchedule("0 0 30 feb *")
+	require.NoError(t, err)
+	assert.True(t, schedule.Next(time.Now()).IsZero())
+}
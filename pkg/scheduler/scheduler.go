@@ -0,0 +1,349 @@
+// Package scheduler runs backup jobs on cron schedules inside cesod
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/r11/esxi-commander/internal/storage"
+	"github.com/r11/esxi-commander/pkg/audit"
+	"github.com/r11/esxi-commander/pkg/backup"
+	"github.com/r11/esxi-commander/pkg/metrics"
+	"github.com/rs/zerolog/log"
+)
+
+// Job is a scheduled backup job
+type Job struct {
+	Name        string
+	Schedule    *Schedule
+	Location    *time.Location // Time zone the schedule is evaluated in; nil means local time
+	VMs         []string       // VMs selected by name
+	Tags        []string       // VMs carrying any of these tags are selected as well
+	Hot         bool           // Snapshot running VMs; otherwise they are powered off for the backup
+	Incremental bool
+	Target      string   // Backup target name; empty selects backup.default_target
+	CopyTo      []string // Target names each new backup is replicated to
+	Description string
+
+	// Retention applied to each backed up VM after a run; nil keeps everything
+	Retention *backup.PruneOptions
+
+	// Makes this a drill job, which restore-tests the newest backup of each
+	// selected VM instead of backing it up; BackupID and VMName are unset
+	Drill *backup.DrillOptions
+}
+
+// VM is a VM a job can select
+type VM struct {
+	Name string
+	Tags []string
+}
+
+// Backend does the work of job runs against ESXi and the backup catalog
+type Backend interface {
+	ListVMs(ctx context.Context) ([]VM, error)
+	Backup(ctx context.Context, job *Job, vmName string) (*backup.BackupInfo, error)
+	Replicate(ctx context.Context, backupID, target string) (*storage.Replica, error)
+	Prune(ctx context.Context, job *Job, vmName string) (*backup.PruneResult, error)
+	Drill(ctx context.Context, job *Job, vmName string) (*backup.DrillResult, error)
+	RecordRun(run *storage.JobRun) error
+}
+
+// Scheduler fires jobs on their schedules. A job never runs twice at once:
+// a run that comes due while the previous one is still going is skipped,
+// recorded as skipped and logged as a warning.
+type Scheduler struct {
+	backend Backend
+	jobs    []*Job
+
+	mu      sync.Mutex
+	running map[string]string // Job name to the ID of its running run
+	wg      sync.WaitGroup
+}
+
+// New creates a scheduler for jobs
+func New(backend Backend, jobs []*Job) *Scheduler {
+	return &Scheduler{
+		backend: backend,
+		jobs:    jobs,
+		running: make(map[string]string),
+	}
+}
+
+// Run fires jobs on schedule until ctx is cancelled, then waits for the
+// runs in progress to finish. Runs missed while the host was suspended are
+// made up once, not once per missed slot.
+func (s *Scheduler) Run(ctx context.Context) {
+	defer s.wg.Wait()
+
+	next := make(map[*Job]time.Time)
+	for _, job := range s.jobs {
+		next[job] = job.next(time.Now())
+		log.Info().Str("job", job.Name).Str("schedule", job.Schedule.String()).Time("next", next[job]).Msg("scheduled backup job")
+	}
+
+	for {
+		var due time.Time
+		for _, at := range next {
+			if !at.IsZero() && (due.IsZero() || at.Before(due)) {
+				due = at
+			}
+		}
+		if due.IsZero() {
+			<-ctx.Done()
+			return
+		}
+
+		timer := time.NewTimer(time.Until(due))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		now := time.Now()
+		for _, job := range s.jobs {
+			if at := next[job]; !at.IsZero() && !at.After(now) {
+				s.Trigger(ctx, job, at)
+				next[job] = job.next(now)
+			}
+		}
+	}
+}
+
+// next returns the first time after t the job is due
+func (j *Job) next(t time.Time) time.Time {
+	if j.Location != nil {
+		t = t.In(j.Location)
+	}
+	return j.Schedule.Next(t)
+}
+
+// Trigger starts a run of job in the background, unless the job is still
+// running, in which case the run is recorded as skipped and an error
+// returned. scheduled is the time the run was due.
+func (s *Scheduler) Trigger(ctx context.Context, job *Job, scheduled time.Time) (*storage.JobRun, error) {
+	run := &storage.JobRun{
+		ID:        fmt.Sprintf("run-%s-%s", job.Name, uuid.New().String()[:8]),
+		Job:       job.Name,
+		Scheduled: scheduled,
+		Started:   time.Now(),
+	}
+
+	s.mu.Lock()
+	previous, busy := s.running[job.Name]
+	if !busy {
+		s.running[job.Name] = run.ID
+		s.wg.Add(1)
+	}
+	s.mu.Unlock()
+
+	if busy {
+		err := fmt.Errorf("job %s is still running (run %s); skipped run due at %s",
+			job.Name, previous, scheduled.Format(time.RFC3339))
+		run.Finished = run.Started
+		run.Status = "skipped"
+		run.Error = err.Error()
+		s.record(run)
+
+		audit.GetLogger().LogOperation(ctx, "schedule.run", map[string]interface{}{
+			"job":    job.Name,
+			"run_id": run.ID,
+		}).Failure(err)
+		metrics.RecordScheduledRun(job.Name, run.Status)
+		log.Warn().Str("job", job.Name).Str("running", previous).Msg("skipped overlapping backup job run")
+		return run, err
+	}
+
+	go func() {
+		defer s.wg.Done()
+		defer func() {
+			s.mu.Lock()
+			delete(s.running, job.Name)
+			s.mu.Unlock()
+		}()
+		s.execute(ctx, job, run)
+	}()
+	return run, nil
+}
+
+// execute backs up or drills every VM the job selects, applies the job's
+// retention and records the run
+func (s *Scheduler) execute(ctx context.Context, job *Job, run *storage.JobRun) {
+	auditCtx := audit.GetLogger().LogOperation(ctx, "schedule.run", map[string]interface{}{
+		"job":    job.Name,
+		"run_id": run.ID,
+	})
+	log.Info().Str("job", job.Name).Str("run", run.ID).Msg("starting backup job")
+
+	vmNames, err := s.selectVMs(ctx, job)
+	if err == nil && len(vmNames) == 0 {
+		err = fmt.Errorf("no VMs match the job's selection")
+	}
+
+	if err == nil {
+		run.VMs = make([]storage.JobVMResult, len(vmNames))
+		if job.Drill != nil {
+			// Each drill restores and boots a VM, so they run one at a time
+			for i, vmName := range vmNames {
+				run.VMs[i] = s.drillVM(ctx, job, vmName)
+			}
+		} else {
+			// The backup manager holds runs beyond backup.max_concurrent
+			// until a slot frees up, so every VM can be started at once
+			var wg sync.WaitGroup
+			for i, vmName := range vmNames {
+				wg.Add(1)
+				go func(result *storage.JobVMResult, vmName string) {
+					defer wg.Done()
+					*result = s.backupVM(ctx, job, vmName)
+				}(&run.VMs[i], vmName)
+			}
+			wg.Wait()
+		}
+
+		var failed []string
+		for _, result := range run.VMs {
+			if result.Error != "" {
+				failed = append(failed, result.VMName)
+			}
+		}
+		if len(failed) > 0 {
+			err = fmt.Errorf("%d of %d VMs failed: %s", len(failed), len(run.VMs), strings.Join(failed, ", "))
+		}
+	}
+
+	run.Finished = time.Now()
+	run.Status = "completed"
+	if err != nil {
+		run.Status = "failed"
+		run.Error = err.Error()
+	}
+	s.record(run)
+	metrics.RecordScheduledRun(job.Name, run.Status)
+
+	if err != nil {
+		auditCtx.Failure(err)
+		log.Error().Str("job", job.Name).Str("run", run.ID).Err(err).Msg("backup job failed")
+		return
+	}
+	auditCtx.Success()
+	log.Info().Str("job", job.Name).Str("run", run.ID).Int("vms", len(run.VMs)).Msg("backup job completed")
+}
+
+// backupVM backs up one VM, copies the backup to the job's replica
+// targets and, if all that succeeded, applies the job's retention to its
+// backups. Older backups are kept while the new one lacks a replica.
+func (s *Scheduler) backupVM(ctx context.Context, job *Job, vmName string) storage.JobVMResult {
+	result := storage.JobVMResult{VMName: vmName, Status: "failed"}
+
+	info, err := s.backend.Backup(ctx, job, vmName)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.BackupID = info.ID
+	result.Status = "completed"
+
+	for _, target := range job.CopyTo {
+		replica, err := s.backend.Replicate(ctx, info.ID, target)
+		if err != nil {
+			result.Error = fmt.Sprintf("copy to %s failed: %v", target, err)
+			return result
+		}
+		result.Replicas = append(result.Replicas, replica.Location)
+	}
+
+	if job.Retention != nil {
+		pruned, err := s.backend.Prune(ctx, job, vmName)
+		if err != nil {
+			result.Error = fmt.Sprintf("retention failed: %v", err)
+			return result
+		}
+		result.Pruned = pruned.Deleted
+	}
+	return result
+}
+
+// drillVM restore-tests the newest backup of one VM
+func (s *Scheduler) drillVM(ctx context.Context, job *Job, vmName string) storage.JobVMResult {
+	result := storage.JobVMResult{VMName: vmName, Status: "failed"}
+
+	drill, err := s.backend.Drill(ctx, job, vmName)
+	if drill != nil {
+		result.BackupID = drill.BackupID
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Status = "completed"
+	return result
+}
+
+// selectVMs returns the VMs named by the job and those carrying one of its
+// tags, sorted and without duplicates
+func (s *Scheduler) selectVMs(ctx context.Context, job *Job) ([]string, error) {
+	selected := make(map[string]bool)
+	for _, name := range job.VMs {
+		selected[name] = true
+	}
+
+	if len(job.Tags) > 0 {
+		vms, err := s.backend.ListVMs(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list VMs: %w", err)
+		}
+		for _, vm := range vms {
+			if hasAnyTag(vm.Tags, job.Tags) {
+				selected[vm.Name] = true
+			}
+		}
+	}
+
+	names := make([]string, 0, len(selected))
+	for name := range selected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func hasAnyTag(tags, wanted []string) bool {
+	for _, tag := range tags {
+		for _, want := range wanted {
+			if strings.EqualFold(tag, want) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *Scheduler) record(run *storage.JobRun) {
+	if err := s.backend.RecordRun(run); err != nil {
+		log.Error().Str("job", run.Job).Str("run", run.ID).Err(err).Msg("failed to record backup job run")
+	}
+}
+
+// ParseTags returns the tags in a VM annotation: the comma or space
+// separated words of each line starting with "tags:", e.g. "tags: prod, db"
+func ParseTags(annotation string) []string {
+	var tags []string
+	for _, line := range strings.Split(annotation, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) < 5 || !strings.EqualFold(line[:5], "tags:") {
+			continue
+		}
+		tags = append(tags, strings.FieldsFunc(line[5:], func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})...)
+	}
+	return tags
+}
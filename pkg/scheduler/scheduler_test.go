@@ -0,0 +1,239 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/r11/esxi-commander/internal/storage"
+	"github.com/r11/esxi-commander/pkg/backup"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeBackend records what the scheduler asks of it. Backups of VMs and
+// copies to targets in fail return an error; backups block while gate is
+// non-nil and open. Drills of VMs in fail fail as well.
+type fakeBackend struct {
+	mu         sync.Mutex
+	vms        []VM
+	fail       map[string]bool
+	gate       chan struct{}
+	backups    []string
+	replicated []string
+	pruned     []string
+	drilled    []string
+	runs       []*storage.JobRun
+}
+
+func (b *fakeBackend) ListVMs(ctx context.Context) ([]VM, error) {
+	return b.vms, nil
+}
+
+func (b *fakeBackend) Backup(ctx context.Context, job *Job, vmName string) (*backup.BackupInfo, error) {
+	if b.gate != nil {
+		<-b.gate
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.backups = append(b.backups, vmName)
+	if b.fail[vmName] {
+		return nil, fmt.Errorf("failed to export VM")
+	}
+	return &backup.BackupInfo{ID: "backup-" + vmName, VMName: vmName}, nil
+}
+
+func (b *fakeBackend) Replicate(ctx context.Context, backupID, target string) (*storage.Replica, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.replicated = append(b.replicated, backupID+"@"+target)
+	if b.fail[target] {
+		return nil, fmt.Errorf("connection refused")
+	}
+	return &storage.Replica{Location: target + "://" + backupID}, nil
+}
+
+func (b *fakeBackend) Prune(ctx context.Context, job *Job, vmName string) (*backup.PruneResult, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pruned = append(b.pruned, vmName)
+	return &backup.PruneResult{Deleted: 2}, nil
+}
+
+func (b *fakeBackend) Drill(ctx context.Context, job *Job, vmName string) (*backup.DrillResult, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.drilled = append(b.drilled, vmName)
+	result := &backup.DrillResult{BackupID: "backup-" + vmName, VMName: vmName}
+	if b.fail[vmName] {
+		return result, fmt.Errorf("no VMware Tools heartbeat within 10m0s")
+	}
+	return result, nil
+}
+
+func (b *fakeBackend) RecordRun(run *storage.JobRun) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	copied := *run
+	b.runs = append(b.runs, &copied)
+	return nil
+}
+
+func testJob(t *testing.T, name string) *Job {
+	t.Helper()
+	schedule, err := ParseSchedule("@daily")
+	require.NoError(t, err)
+	return &Job{Name: name, Schedule: schedule, Hot: true}
+}
+
+func TestTriggerBacksUpSelectedVMs(t *testing.T) {
+	backend := &fakeBackend{
+		vms: []VM{
+			{Name: "web01", Tags: []string{"prod", "web"}},
+			{Name: "web02", Tags: []string{"Prod"}},
+			{Name: "dev01", Tags: []string{"dev"}},
+			{Name: "db01"},
+		},
+		fail: map[string]bool{"web02": true},
+	}
+	s := New(backend, nil)
+
+	job := testJob(t, "nightly")
+	job.VMs = []string{"db01", "web01"}
+	job.Tags = []string{"prod"}
+	job.Retention = &backup.PruneOptions{KeepLast: 3}
+
+	scheduled := time.Date(2025, 1, 15, 2, 0, 0, 0, time.UTC)
+	_, err := s.Trigger(context.Background(), job, scheduled)
+	require.NoError(t, err)
+	s.wg.Wait()
+
+	assert.ElementsMatch(t, []string{"db01", "web01", "web02"}, backend.backups)
+	assert.ElementsMatch(t, []string{"db01", "web01"}, backend.pruned, "retention only follows successful backups")
+
+	require.Len(t, backend.runs, 1)
+	run := backend.runs[0]
+	assert.Equal(t, "nightly", run.Job)
+	assert.Equal(t, scheduled, run.Scheduled)
+	assert.Equal(t, "failed", run.Status)
+	assert.Contains(t, run.Error, "1 of 3 VMs failed: web02")
+	assert.Equal(t, []storage.JobVMResult{
+		{VMName: "db01", BackupID: "backup-db01", Status: "completed", Pruned: 2},
+		{VMName: "web01", BackupID: "backup-web01", Status: "completed", Pruned: 2},
+		{VMName: "web02", Status: "failed", Error: "failed to export VM"},
+	}, run.VMs)
+}
+
+func TestTriggerReplicatesBeforeRetention(t *testing.T) {
+	backend := &fakeBackend{fail: map[string]bool{"tape": true}}
+	s := New(backend, nil)
+
+	job := testJob(t, "offsite")
+	job.VMs = []string{"db01"}
+	job.CopyTo = []string{"sftp", "tape"}
+	job.Retention = &backup.PruneOptions{KeepLast: 3}
+
+	_, err := s.Trigger(context.Background(), job, time.Now())
+	require.NoError(t, err)
+	s.wg.Wait()
+
+	assert.Equal(t, []string{"backup-db01@sftp", "backup-db01@tape"}, backend.replicated)
+	assert.Empty(t, backend.pruned, "older backups are kept while a copy is missing")
+
+	require.Len(t, backend.runs, 1)
+	assert.Equal(t, []storage.JobVMResult{{
+		VMName:   "db01",
+		BackupID: "backup-db01",
+		Status:   "completed",
+		Error:    "copy to tape failed: connection refused",
+		Replicas: []string{"sftp://backup-db01"},
+	}}, backend.runs[0].VMs)
+}
+
+func TestTriggerDrillsInsteadOfBackingUp(t *testing.T) {
+	backend := &fakeBackend{fail: map[string]bool{"web01": true}}
+	s := New(backend, nil)
+
+	job := testJob(t, "weekly-drill")
+	job.VMs = []string{"web01", "db01"}
+	job.Retention = &backup.PruneOptions{KeepLast: 3}
+	job.Drill = &backup.DrillOptions{Network: "isolated"}
+
+	_, err := s.Trigger(context.Background(), job, time.Now())
+	require.NoError(t, err)
+	s.wg.Wait()
+
+	assert.Equal(t, []string{"db01", "web01"}, backend.drilled)
+	assert.Empty(t, backend.backups)
+	assert.Empty(t, backend.pruned)
+
+	require.Len(t, backend.runs, 1)
+	assert.Equal(t, "failed", backend.runs[0].Status)
+	assert.Equal(t, []storage.JobVMResult{
+		{VMName: "db01", BackupID: "backup-db01", Status: "completed"},
+		{VMName: "web01", BackupID: "backup-web01", Status: "failed", Error: "no VMware Tools heartbeat within 10m0s"},
+	}, backend.runs[0].VMs)
+}
+
+func TestTriggerSkipsOverlappingRun(t *testing.T) {
+	backend := &fakeBackend{gate: make(chan struct{})}
+	s := New(backend, nil)
+
+	job := testJob(t, "hourly")
+	job.VMs = []string{"web01"}
+	other := testJob(t, "other")
+	other.VMs = []string{"db01"}
+
+	first, err := s.Trigger(context.Background(), job, time.Now())
+	require.NoError(t, err)
+
+	skipped, err := s.Trigger(context.Background(), job, time.Now())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "job hourly is still running (run "+first.ID+")")
+	assert.Equal(t, "skipped", skipped.Status)
+
+	// Other jobs are not held up
+	_, err = s.Trigger(context.Background(), other, time.Now())
+	require.NoError(t, err)
+
+	close(backend.gate)
+	s.wg.Wait()
+
+	statuses := make(map[string]string)
+	for _, run := range backend.runs {
+		statuses[run.ID] = run.Status
+	}
+	assert.Len(t, statuses, 3)
+	assert.Equal(t, "completed", statuses[first.ID])
+	assert.Equal(t, "skipped", statuses[skipped.ID])
+
+	// Once the run is over the job can run again
+	_, err = s.Trigger(context.Background(), job, time.Now())
+	require.NoError(t, err)
+	s.wg.Wait()
+}
+
+func TestTriggerFailsWithoutVMs(t *testing.T) {
+	backend := &fakeBackend{vms: []VM{{Name: "dev01", Tags: []string{"dev"}}}}
+	s := New(backend, nil)
+
+	job := testJob(t, "prod")
+	job.Tags = []string{"prod"}
+	_, err := s.Trigger(context.Background(), job, time.Now())
+	require.NoError(t, err)
+	s.wg.Wait()
+
+	require.Len(t, backend.runs, 1)
+	assert.Equal(t, "failed", backend.runs[0].Status)
+	assert.Contains(t, backend.runs[0].Error, "no VMs match")
+	assert.Empty(t, backend.backups)
+}
+
+func TestParseTags(t *testing.T) {
+	annotation := "Database server\nTags: prod, db  eu-west\nowner: ops\ntags:backup"
+	assert.Equal(t, []string{"prod", "db", "eu-west", "backup"}, ParseTags(annotation))
+	assert.Empty(t, ParseTags("no tags here"))
+}
@@ -44,9 +44,12 @@ var restrictedOps = map[string]bool{
 	"vm.list":     true,
 	"vm.info":     true,
 	"backup.list": true,
+	"backup.verify": true,
 	"template.list": true,
 	"datastore.list": true,
 	"network.list": true,
+	"host.info":   true,
+	"pci.list":    true,
 }
 
 // Standard mode operations (exclude destructive bulk operations)
@@ -57,13 +60,20 @@ var standardOps = map[string]bool{
 	"vm.clone":    true,
 	"vm.delete":   true,
 	"vm.power":    true,
+	"vm.snapshot": true,
 	"backup.create": true,
 	"backup.restore": true,
 	"backup.list": true,
 	"backup.delete": true,
+	"backup.verify": true,
+	"backup.replicate": true,
+	"backup.hold": true,
+	"backup.drill": true,
 	"template.list": true,
 	"datastore.list": true,
 	"network.list": true,
+	"host.info":   true,
+	"pci.list":    true,
 }
 
 // Initialize sets up the default sandbox
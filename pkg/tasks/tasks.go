@@ -0,0 +1,442 @@
+// Package tasks gives long-running operations durable IDs. Each task is
+// persisted with its state transitions, the ESXi task it is waiting on and
+// the process running it, so that other processes can follow or cancel it
+// and a re-run after a crash can pick it up again.
+package tasks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/r11/esxi-commander/internal/storage"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/progress"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// DefaultDBPath is used when tasks.db_path is not configured
+const DefaultDBPath = "/var/lib/ceso/tasks.db"
+
+var (
+	// pollInterval is how often cancellation requests and waited-on tasks
+	// are checked
+	pollInterval = 2 * time.Second
+
+	// progressInterval limits how often progress within a stage is written
+	progressInterval = time.Second
+
+	// retention is how long finished tasks are kept
+	retention = 30 * 24 * time.Hour
+)
+
+// errResumed aborts adopting a task another process resumed first
+var errResumed = errors.New("task resumed by another process")
+
+// Manager starts tracked tasks and inspects or cancels the tasks of every
+// process sharing its database
+type Manager struct {
+	store *storage.TaskStore
+}
+
+// NewManager returns a manager for the task database at path
+func NewManager(path string) *Manager {
+	if path == "" {
+		path = DefaultDBPath
+	}
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, strings.TrimPrefix(path, "~"))
+		}
+	}
+	return &Manager{store: storage.NewTaskStore(path)}
+}
+
+// Start begins tracking an operation of kind on target. If an earlier run of
+// the same operation was interrupted, its task is resumed under the same ID.
+// The returned context carries the task and is cancelled when the task is.
+func (m *Manager) Start(ctx context.Context, kind, target string) (context.Context, *Task, error) {
+	if _, err := m.store.PruneTasks(time.Now().Add(-retention)); err != nil {
+		return ctx, nil, err
+	}
+
+	entry, err := m.adopt(kind, target)
+	if err != nil {
+		return ctx, nil, err
+	}
+	if entry == nil {
+		host, _ := os.Hostname()
+		entry = &storage.TaskEntry{
+			ID:      fmt.Sprintf("task-%s", uuid.New().String()[:8]),
+			Kind:    kind,
+			Target:  target,
+			Percent: -1,
+			Host:    host,
+			PID:     os.Getpid(),
+			Created: time.Now(),
+		}
+		entry.Transition(storage.TaskRunning, "", "started")
+		if err := m.store.AddTask(entry); err != nil {
+			return ctx, nil, err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	t := &Task{
+		store:    m.store,
+		id:       entry.ID,
+		esxiTask: entry.ESXiTask,
+		stage:    entry.Stage,
+		cancel:   cancel,
+		stop:     make(chan struct{}),
+	}
+	go t.watch(ctx)
+
+	return context.WithValue(ctx, taskKey{}, t), t, nil
+}
+
+// adopt takes over the newest orphaned task of kind on target, if any
+func (m *Manager) adopt(kind, target string) (*storage.TaskEntry, error) {
+	entries, err := m.store.ListTasks()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		if e.Kind != kind || e.Target != target || !orphaned(e) {
+			continue
+		}
+
+		host, _ := os.Hostname()
+		entry, err := m.store.UpdateTask(e.ID, func(task *storage.TaskEntry) error {
+			if !orphaned(task) {
+				return errResumed
+			}
+			note := fmt.Sprintf("resumed by process %d on %s", os.Getpid(), host)
+			task.Host = host
+			task.PID = os.Getpid()
+			task.Error = ""
+			task.Transition(storage.TaskRunning, task.Stage, note)
+			return nil
+		})
+		if errors.Is(err, errResumed) {
+			return nil, nil
+		}
+		return entry, err
+	}
+	return nil, nil
+}
+
+// List returns all tasks, newest first
+func (m *Manager) List() ([]*storage.TaskEntry, error) {
+	entries, err := m.store.ListTasks()
+	if err != nil {
+		return nil, err
+	}
+	for i, e := range entries {
+		entries[i] = m.refresh(e)
+	}
+	return entries, nil
+}
+
+// Get returns a task by ID
+func (m *Manager) Get(id string) (*storage.TaskEntry, error) {
+	e, err := m.store.GetTask(id)
+	if err != nil {
+		return nil, err
+	}
+	return m.refresh(e), nil
+}
+
+// refresh marks a running task whose process is gone as interrupted
+func (m *Manager) refresh(e *storage.TaskEntry) *storage.TaskEntry {
+	if e.State != storage.TaskRunning || ownerAlive(e) {
+		return e
+	}
+
+	updated, err := m.store.UpdateTask(e.ID, func(task *storage.TaskEntry) error {
+		if task.State == storage.TaskRunning && !ownerAlive(task) {
+			task.Transition(storage.TaskInterrupted, task.Stage, fmt.Sprintf("process %d on %s exited", task.PID, task.Host))
+		}
+		return nil
+	})
+	if err != nil {
+		return e
+	}
+	return updated
+}
+
+// Wait blocks until the task finishes or is interrupted
+func (m *Manager) Wait(ctx context.Context, id string) (*storage.TaskEntry, error) {
+	for {
+		e, err := m.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		if e.Done() || e.State == storage.TaskInterrupted {
+			return e, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return e, ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// Cancel asks the process running the task to stop and, if c is not nil,
+// cancels the ESXi task it is waiting on. A task whose process is gone is
+// cancelled right away so that it is not resumed.
+func (m *Manager) Cancel(ctx context.Context, c *vim25.Client, id string) (*storage.TaskEntry, error) {
+	e, err := m.store.UpdateTask(id, func(task *storage.TaskEntry) error {
+		if task.Done() {
+			return fmt.Errorf("task %s already %s", task.ID, task.State)
+		}
+		task.CancelRequested = true
+		if task.State == storage.TaskInterrupted || !ownerAlive(task) {
+			task.Transition(storage.TaskCancelled, task.Stage, "cancelled after its process exited")
+		} else {
+			task.Updated = time.Now()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if c == nil || e.ESXiTask == "" {
+		return e, nil
+	}
+
+	esxiTask := object.NewTask(c, types.ManagedObjectReference{Type: "Task", Value: e.ESXiTask})
+	var mt mo.Task
+	if err := esxiTask.Properties(ctx, esxiTask.Reference(), []string{"info"}, &mt); err != nil {
+		// ESXi forgets finished tasks after a while
+		return e, nil
+	}
+	switch mt.Info.State {
+	case types.TaskInfoStateQueued, types.TaskInfoStateRunning:
+		if err := esxiTask.Cancel(ctx); err != nil {
+			return e, fmt.Errorf("failed to cancel ESXi task %s: %w", e.ESXiTask, err)
+		}
+	}
+	return e, nil
+}
+
+// orphaned reports whether a task was left unfinished by its process
+func orphaned(e *storage.TaskEntry) bool {
+	switch e.State {
+	case storage.TaskInterrupted:
+		return true
+	case storage.TaskRunning:
+		return !ownerAlive(e)
+	}
+	return false
+}
+
+// ownerAlive reports whether the process running a task still exists.
+// Processes on other hosts are assumed to be alive.
+func ownerAlive(e *storage.TaskEntry) bool {
+	host, err := os.Hostname()
+	if err != nil || e.Host != host || e.PID == os.Getpid() {
+		return true
+	}
+	err = syscall.Kill(e.PID, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// Task is an operation tracked by this process. All methods are safe to
+// call on a nil *Task, so untracked operations need no special casing.
+type Task struct {
+	store    *storage.TaskStore
+	id       string
+	esxiTask string // Recorded by an interrupted run, for Reattach
+
+	cancel context.CancelFunc
+	stop   chan struct{}
+	once   sync.Once
+
+	mu    sync.Mutex
+	stage string
+	saved time.Time
+}
+
+type taskKey struct{}
+
+// FromContext returns the task started with ctx, or nil
+func FromContext(ctx context.Context) *Task {
+	t, _ := ctx.Value(taskKey{}).(*Task)
+	return t
+}
+
+// ID returns the task's ID
+func (t *Task) ID() string {
+	if t == nil {
+		return ""
+	}
+	return t.id
+}
+
+// Progress records the current stage and its percentage. It has the
+// signature of backup.ProgressFunc.
+func (t *Task) Progress(stage string, percent float32) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	changed := stage != t.stage
+	if !changed && percent < 100 && time.Since(t.saved) < progressInterval {
+		return
+	}
+	t.stage = stage
+	t.saved = time.Now()
+
+	t.update(func(e *storage.TaskEntry) {
+		if changed {
+			e.Transition(e.State, stage, "")
+		}
+		e.Percent = percent
+		e.Updated = time.Now()
+	})
+}
+
+// Finish records the outcome of the task and releases its context
+func (t *Task) Finish(result string, err error) {
+	if t == nil {
+		return
+	}
+	t.once.Do(func() { close(t.stop) })
+	defer t.cancel()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.update(func(e *storage.TaskEntry) {
+		switch {
+		case err == nil:
+			e.Result = result
+			e.Transition(storage.TaskSucceeded, e.Stage, "")
+		case e.CancelRequested:
+			e.Error = err.Error()
+			e.Transition(storage.TaskCancelled, e.Stage, "cancelled on request")
+		default:
+			e.Error = err.Error()
+			e.Transition(storage.TaskFailed, e.Stage, "")
+		}
+	})
+}
+
+// Reattach returns the ESXi task an interrupted run was waiting on if it
+// runs method on entity and has not failed, so that the operation can wait
+// for it instead of starting over. It returns nil otherwise.
+func (t *Task) Reattach(ctx context.Context, entity object.Common, method string) *object.Task {
+	if t == nil || t.esxiTask == "" {
+		return nil
+	}
+	task := object.NewTask(entity.Client(), types.ManagedObjectReference{Type: "Task", Value: t.esxiTask})
+	var mt mo.Task
+	if err := task.Properties(ctx, task.Reference(), []string{"info"}, &mt); err != nil {
+		return nil
+	}
+
+	info := mt.Info
+	if info.Entity == nil || *info.Entity != entity.Reference() ||
+		!strings.HasPrefix(info.DescriptionId, entity.Reference().Type+"."+method) ||
+		info.State == types.TaskInfoStateError {
+		return nil
+	}
+	return task
+}
+
+// watch cancels the task's context when cancellation is requested
+func (t *Task) watch(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if e, err := t.store.GetTask(t.id); err == nil && e.CancelRequested {
+				t.cancel()
+				return
+			}
+		}
+	}
+}
+
+// update applies fn to the stored task. Tracking is best effort: an
+// operation is not failed because its task could not be written.
+func (t *Task) update(fn func(e *storage.TaskEntry)) {
+	t.store.UpdateTask(t.id, func(e *storage.TaskEntry) error {
+		fn(e)
+		return nil
+	})
+}
+
+// setESXiTask records the ESXi task the operation is waiting on
+func (t *Task) setESXiTask(ref types.ManagedObjectReference) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.update(func(e *storage.TaskEntry) {
+		e.ESXiTask = ref.Value
+		e.Updated = time.Now()
+	})
+}
+
+// WaitForResult waits for an ESXi task like object.Task.WaitForResult. If
+// ctx carries a task, the ESXi task and its progress are recorded in it.
+func WaitForResult(ctx context.Context, task *object.Task) (*types.TaskInfo, error) {
+	t := FromContext(ctx)
+	if t == nil {
+		return task.WaitForResult(ctx)
+	}
+	t.setESXiTask(task.Reference())
+	s := &sinker{t: t}
+	info, err := task.WaitForResult(ctx, s)
+	s.wg.Wait()
+	return info, err
+}
+
+// Wait waits for an ESXi task like object.Task.Wait, recording it like
+// WaitForResult
+func Wait(ctx context.Context, task *object.Task) error {
+	_, err := WaitForResult(ctx, task)
+	return err
+}
+
+// sinker feeds ESXi task progress into the current stage of a task. wg
+// lets the last report be written before the wait returns.
+type sinker struct {
+	t  *Task
+	wg sync.WaitGroup
+}
+
+func (s *sinker) Sink() chan<- progress.Report {
+	ch := make(chan progress.Report)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for r := range ch {
+			s.t.mu.Lock()
+			stage := s.t.stage
+			s.t.mu.Unlock()
+			s.t.Progress(stage, r.Percentage())
+		}
+	}()
+	return ch
+}
@@ -0,0 +1,196 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/r11/esxi-commander/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func init() {
+	pollInterval = 10 * time.Millisecond
+}
+
+func newTestManager(t *testing.T) *Manager {
+	return NewManager(filepath.Join(t.TempDir(), "tasks.db"))
+}
+
+// deadPID returns the PID of a process that has exited
+func deadPID(t *testing.T) int {
+	cmd := exec.Command("true")
+	require.NoError(t, cmd.Run())
+	return cmd.Process.Pid
+}
+
+// orphan stores a running task whose process has exited
+func orphan(t *testing.T, m *Manager, kind, target, esxiTask string) *storage.TaskEntry {
+	host, _ := os.Hostname()
+	entry := &storage.TaskEntry{
+		ID:       "task-orphan",
+		Kind:     kind,
+		Target:   target,
+		Percent:  -1,
+		ESXiTask: esxiTask,
+		Host:     host,
+		PID:      deadPID(t),
+		Created:  time.Now(),
+	}
+	entry.Transition(storage.TaskRunning, "clone", "started")
+	require.NoError(t, m.store.AddTask(entry))
+	return entry
+}
+
+func TestTaskLifecycle(t *testing.T) {
+	m := newTestManager(t)
+
+	_, task, err := m.Start(context.Background(), "backup.create", "web01")
+	require.NoError(t, err)
+	assert.Regexp(t, `^task-[0-9a-f]{8}$`, task.ID())
+
+	task.Progress("export", 0)
+	task.Progress("export", 40) // Throttled
+	task.Progress("upload", 100)
+	task.Finish("backup-web01-1234abcd", nil)
+
+	entry, err := m.Get(task.ID())
+	require.NoError(t, err)
+	assert.Equal(t, storage.TaskSucceeded, entry.State)
+	assert.Equal(t, "backup-web01-1234abcd", entry.Result)
+	assert.Equal(t, "upload", entry.Stage)
+	assert.Equal(t, float32(100), entry.Percent)
+	require.NotNil(t, entry.Finished)
+	assert.Equal(t, os.Getpid(), entry.PID)
+
+	var stages []string
+	for _, h := range entry.History {
+		stages = append(stages, h.State+"/"+h.Stage)
+	}
+	assert.Equal(t, []string{"running/", "running/export", "running/upload", "succeeded/upload"}, stages)
+
+	_, failed, err := m.Start(context.Background(), "backup.create", "web02")
+	require.NoError(t, err)
+	failed.Finish("", errors.New("export failed"))
+
+	entries, err := m.List()
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, failed.ID(), entries[0].ID) // Newest first
+	assert.Equal(t, storage.TaskFailed, entries[0].State)
+	assert.Equal(t, "export failed", entries[0].Error)
+}
+
+func TestNilTask(t *testing.T) {
+	var task *Task
+	assert.Empty(t, task.ID())
+	task.Progress("export", 10)
+	task.Finish("", nil)
+	assert.Nil(t, task.Reattach(context.Background(), object.Common{}, "clone"))
+	assert.Nil(t, FromContext(context.Background()))
+}
+
+func TestInterruptedTaskIsResumed(t *testing.T) {
+	m := newTestManager(t)
+	orphan(t, m, "vm.clone", "web01", "")
+
+	entry, err := m.Get("task-orphan")
+	require.NoError(t, err)
+	assert.Equal(t, storage.TaskInterrupted, entry.State)
+
+	// Another target does not resume it
+	_, other, err := m.Start(context.Background(), "vm.clone", "web02")
+	require.NoError(t, err)
+	assert.NotEqual(t, "task-orphan", other.ID())
+
+	_, task, err := m.Start(context.Background(), "vm.clone", "web01")
+	require.NoError(t, err)
+	assert.Equal(t, "task-orphan", task.ID())
+
+	entry, err = m.Get(task.ID())
+	require.NoError(t, err)
+	assert.Equal(t, storage.TaskRunning, entry.State)
+	assert.Equal(t, os.Getpid(), entry.PID)
+	assert.Contains(t, entry.History[len(entry.History)-1].Note, "resumed")
+}
+
+func TestCancel(t *testing.T) {
+	m := newTestManager(t)
+
+	ctx, task, err := m.Start(context.Background(), "backup.restore", "backup-web01-1234abcd")
+	require.NoError(t, err)
+	assert.Same(t, task, FromContext(ctx))
+
+	entry, err := m.Cancel(context.Background(), nil, task.ID())
+	require.NoError(t, err)
+	assert.True(t, entry.CancelRequested)
+	assert.Equal(t, storage.TaskRunning, entry.State)
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("context not cancelled")
+	}
+	task.Finish("", ctx.Err())
+
+	entry, err = m.Wait(context.Background(), task.ID())
+	require.NoError(t, err)
+	assert.Equal(t, storage.TaskCancelled, entry.State)
+
+	_, err = m.Cancel(context.Background(), nil, task.ID())
+	assert.Error(t, err)
+
+	// A task without a process is cancelled right away
+	orphan(t, m, "vm.create", "web01", "")
+	entry, err = m.Cancel(context.Background(), nil, "task-orphan")
+	require.NoError(t, err)
+	assert.Equal(t, storage.TaskCancelled, entry.State)
+}
+
+func TestReattach(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		finder := find.NewFinder(c)
+		dc, err := finder.DefaultDatacenter(ctx)
+		require.NoError(t, err)
+		finder.SetDatacenter(dc)
+		folders, err := dc.Folders(ctx)
+		require.NoError(t, err)
+		vms, err := finder.VirtualMachineList(ctx, "*")
+		require.NoError(t, err)
+		source := vms[0]
+
+		m := newTestManager(t)
+		taskCtx, tracked, err := m.Start(ctx, "vm.clone", "web01")
+		require.NoError(t, err)
+
+		clone, err := source.Clone(ctx, folders.VmFolder, "web01", types.VirtualMachineCloneSpec{})
+		require.NoError(t, err)
+		_, err = WaitForResult(taskCtx, clone)
+		require.NoError(t, err)
+
+		entry, err := m.Get(tracked.ID())
+		require.NoError(t, err)
+		assert.Equal(t, clone.Reference().Value, entry.ESXiTask)
+
+		// A re-run after a crash picks up the recorded clone
+		orphan(t, m, "vm.clone", "web02", entry.ESXiTask)
+		_, resumed, err := m.Start(ctx, "vm.clone", "web02")
+		require.NoError(t, err)
+		require.Equal(t, "task-orphan", resumed.ID())
+		assert.Nil(t, resumed.Reattach(ctx, source.Common, "powerOn"))
+
+		reattached := resumed.Reattach(ctx, source.Common, "clone")
+		require.NotNil(t, reattached)
+		assert.Equal(t, clone.Reference(), reattached.Reference())
+	})
+}